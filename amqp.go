@@ -13,52 +13,69 @@ import (
  * AMQP bookkeeping
  */
 
-func NewConsumer(amqpURI, queueName string, autoDelete bool, ctag string, bindToRawExchange bool,
-	routingKeys []string) (*Consumer, <-chan amqp.Delivery, error) {
-	c := &Consumer{
-		conn:    nil,
-		channel: nil,
-		tag:     ctag,
+// amqpTLSConfig loads the client certificate and CA configured for the AMQP connection.
+func amqpTLSConfig() (*tls.Config, error) {
+	cfg := new(tls.Config)
+
+	// Check if we have client SSL config to use and load it
+	if config.AMQPTLSCACert != "" && config.AMQPTLSClientCert != "" && config.AMQPTLSClientKey != "" {
+		caCert, err := ioutil.ReadFile(config.AMQPTLSCACert)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		cfg.RootCAs = caCertPool
+
+		cert, err := tls.LoadX509KeyPair(config.AMQPTLSClientCert, config.AMQPTLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
 	}
 
-	var err error
+	cfg.InsecureSkipVerify = true
+
+	return cfg, nil
+}
 
+func dialAMQP(amqpURI string) (*amqp.Connection, error) {
 	if config.AMQPTLSEnabled == true {
 		log.Info("Connecting to message bus via TLS...")
 
-		cfg := new(tls.Config)
-
-		// Check if we have client SSL config to use and load it
-		if config.AMQPTLSCACert != "" && config.AMQPTLSClientCert != "" && config.AMQPTLSClientKey != "" {
-			caCert, err := ioutil.ReadFile(config.AMQPTLSCACert)
-			if err != nil {
-				log.Fatal(err)
-			}
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM(caCert)
-			cfg.RootCAs = caCertPool
-	
-			cert, err := tls.LoadX509KeyPair(config.AMQPTLSClientCert, config.AMQPTLSClientKey)
-			if err != nil {
-				log.Fatal(err)
-			}
-			cfg.Certificates = []tls.Certificate{cert}
-		}
-		
-		cfg.InsecureSkipVerify = true
-
-		c.conn, err = amqp.DialTLS(amqpURI, cfg)
-
+		cfg, err := amqpTLSConfig()
 		if err != nil {
-			return nil, nil, fmt.Errorf("Dial: %s", err)
+			log.Fatal(err)
 		}
-	} else {
-		log.Info("Connecting to message bus...")
-		c.conn, err = amqp.Dial(amqpURI)
 
+		conn, err := amqp.DialTLS(amqpURI, cfg)
 		if err != nil {
-			return nil, nil, fmt.Errorf("Dial: %s", err)
+			return nil, fmt.Errorf("Dial: %s", err)
 		}
+		return conn, nil
+	}
+
+	log.Info("Connecting to message bus...")
+	conn, err := amqp.Dial(amqpURI)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %s", err)
+	}
+	return conn, nil
+}
+
+func NewConsumer(amqpURI, queueName string, autoDelete bool, ctag string, bindToRawExchange bool,
+	routingKeys []string) (*Consumer, <-chan amqp.Delivery, error) {
+	c := &Consumer{
+		conn:    nil,
+		channel: nil,
+		tag:     ctag,
+	}
+
+	var err error
+
+	c.conn, err = dialAMQP(amqpURI)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	c.channel, err = c.conn.Channel()
@@ -68,7 +85,7 @@ func NewConsumer(amqpURI, queueName string, autoDelete bool, ctag string, bindTo
 
 	queue, err := c.channel.QueueDeclare(
 		queueName,
-		false, // durable,
+		config.AtLeastOnceDelivery, // durable,
 		autoDelete,  // delete when unused
 		false, // exclusive
 		false, // nowait
@@ -77,6 +94,7 @@ func NewConsumer(amqpURI, queueName string, autoDelete bool, ctag string, bindTo
 	if err != nil {
 		return nil, nil, fmt.Errorf("Queue declare: %s", err)
 	}
+	c.queue = queue.Name
 
 	if bindToRawExchange {
 		err = c.channel.QueueBind(queueName, "", "api.rawsensordata", false, nil)
@@ -94,10 +112,19 @@ func NewConsumer(amqpURI, queueName string, autoDelete bool, ctag string, bindTo
 		log.Infof("Subscribed to %s", key)
 	}
 
+	if config.AtLeastOnceDelivery && config.AMQPPrefetchCount > 0 {
+		// limit the number of unacknowledged deliveries the broker will push to us
+		err = c.channel.Qos(config.AMQPPrefetchCount, 0, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Channel Qos: %s", err)
+		}
+		log.Infof("Prefetching at most %d unacknowledged deliveries", config.AMQPPrefetchCount)
+	}
+
 	deliveries, err := c.channel.Consume(
 		queue.Name,
 		c.tag,
-		true,  // automatic ack
+		!config.AtLeastOnceDelivery, // automatic ack
 		false, // exclusive
 		false, // noLocal
 		false, // noWait
@@ -112,10 +139,81 @@ func NewConsumer(amqpURI, queueName string, autoDelete bool, ctag string, bindTo
 }
 
 func (c *Consumer) Shutdown() error {
+	if err := c.Cancel(); err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// Cancel stops new deliveries to the consumer. The deliveries channel is closed once those already received have
+// been read, and the connection stays open so that they can still be acknowledged.
+func (c *Consumer) Cancel() error {
 	if err := c.channel.Cancel(c.tag, true); err != nil {
 		return fmt.Errorf("Consumer cancel failed: %s", err)
 	}
 
+	return nil
+}
+
+// Bind binds the consumer's queue to more routing keys, and to the raw sensor exchange if bindToRawExchange is
+// set. The bindings are made on a channel of their own, so that an error does not close the channel the
+// deliveries arrive on.
+func (c *Consumer) Bind(routingKeys []string, bindToRawExchange bool) error {
+	channel, err := c.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Channel: %s", err)
+	}
+	defer channel.Close()
+
+	if bindToRawExchange {
+		if err := channel.QueueBind(c.queue, "", "api.rawsensordata", false, nil); err != nil {
+			return fmt.Errorf("QueueBind: %s", err)
+		}
+		log.Info("Subscribed to bulk raw sensor event exchange")
+	}
+
+	for _, key := range routingKeys {
+		if err := channel.QueueBind(c.queue, key, "api.events", false, nil); err != nil {
+			return fmt.Errorf("QueueBind: %s", err)
+		}
+		log.Infof("Subscribed to %s", key)
+	}
+
+	return nil
+}
+
+// Unbind removes bindings made by NewConsumer or Bind. All of the bindings are attempted; the first error
+// is returned.
+func (c *Consumer) Unbind(routingKeys []string, unbindRawExchange bool) error {
+	var firstErr error
+	unbind := func(key, exchange string) bool {
+		channel, err := c.conn.Channel()
+		if err == nil {
+			// a failed unbind closes the channel, so each gets its own
+			err = channel.QueueUnbind(c.queue, key, exchange, nil)
+			channel.Close()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("QueueUnbind: %s", err)
+		}
+		return err == nil
+	}
+
+	if unbindRawExchange && unbind("", "api.rawsensordata") {
+		log.Info("Unsubscribed from bulk raw sensor event exchange")
+	}
+
+	for _, key := range routingKeys {
+		if unbind(key, "api.events") {
+			log.Infof("Unsubscribed from %s", key)
+		}
+	}
+
+	return firstErr
+}
+
+func (c *Consumer) Close() error {
 	if err := c.conn.Close(); err != nil {
 		return fmt.Errorf("AMQP connection close error: %s", err)
 	}
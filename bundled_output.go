@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,7 +20,8 @@ type UploadStatus struct {
 }
 
 type BundledOutput struct {
-	behavior BundleBehavior
+	behavior     BundleBehavior
+	outputConfig *OutputConfiguration
 
 	tempFileDirectory string
 	tempFileOutput    *FileOutput
@@ -37,10 +39,25 @@ type BundledOutput struct {
 
 	filesToUpload []string
 
+	// uploads in progress
+	uploading int32
+
+	// bundles waiting to be uploaded, in the order they were rolled over, so that deliveries are only
+	// acknowledged once every bundle holding their events has been uploaded
+	received       int64
+	pendingBundles []pendingBundle
+	acknowledge    DeliveryAcknowledger
+
 	// TODO: make this thread-safe from the status page
 	sync.RWMutex
 }
 
+type pendingBundle struct {
+	fileName string
+	through  int64
+	uploaded bool
+}
+
 type BundleStatistics struct {
 	FilesUploaded        int64       `json:"files_uploaded"`
 	UploadErrors         int64       `json:"upload_errors"`
@@ -64,6 +81,42 @@ type BundleBehavior interface {
 	String() string
 }
 
+func (o *BundledOutput) SetAcknowledger(ack DeliveryAcknowledger) {
+	o.acknowledge = ack
+}
+
+// bundleUploaded marks a bundle as done and acknowledges the messages in every bundle up to the first one
+// that is still waiting to be uploaded.
+func (o *BundledOutput) bundleUploaded(fileName string) {
+	if o.acknowledge == nil {
+		return
+	}
+
+	for i := range o.pendingBundles {
+		if o.pendingBundles[i].fileName == fileName {
+			o.pendingBundles[i].uploaded = true
+			break
+		}
+	}
+
+	n := 0
+	for n < len(o.pendingBundles) && o.pendingBundles[n].uploaded {
+		n++
+	}
+	if n > 0 {
+		o.acknowledge(o.pendingBundles[n-1].through, nil)
+		o.pendingBundles = o.pendingBundles[n:]
+	}
+}
+
+func (o *BundledOutput) startUpload(fileName string) {
+	atomic.AddInt32(&o.uploading, 1)
+	go func() {
+		defer atomic.AddInt32(&o.uploading, -1)
+		o.uploadOne(fileName)
+	}()
+}
+
 func (o *BundledOutput) uploadOne(fileName string) {
 	fp, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
@@ -77,10 +130,16 @@ func (o *BundledOutput) uploadOne(fileName string) {
 		fp.Close()
 		return
 	} else {
-		if fileInfo.Size() > 0 || config.UploadEmptyFiles {
+		if fileInfo.Size() > 0 || o.outputConfig.UploadEmptyFiles {
 			// only upload if the file size is greater than zero
+			start := time.Now()
 			uploadStatus := o.behavior.Upload(fileName, fp)
 			err = uploadStatus.result
+			if err == nil {
+				metricUploadDuration.ObserveSince(start, o.outputConfig.Name, "success")
+			} else {
+				metricUploadDuration.ObserveSince(start, o.outputConfig.Name, "error")
+			}
 			o.fileResultChan <- uploadStatus
 		}
 	}
@@ -123,24 +182,48 @@ func (o *BundledOutput) queueStragglers() {
 	}
 }
 
+// splitBundleParameters separates the directory bundles are kept in from the parameters of the behavior.
+func splitBundleParameters(connString string) (tempFileDirectory, behaviorParameters string) {
+	parts := strings.SplitN(connString, ":", 2)
+	if len(parts) > 1 && parts[0] != "http" && parts[0] != "https" {
+		return parts[0], parts[1]
+	}
+
+	// temporary file location
+	return "/var/cb/data/event-forwarder", connString
+}
+
+// Probe checks that bundles can be written and, if the behavior supports it, that its destination can be reached.
+func (o *BundledOutput) Probe(connString string) error {
+	tempFileDirectory, connString := splitBundleParameters(connString)
+	if err := checkWritableDirectory(tempFileDirectory); err != nil {
+		return err
+	}
+
+	if o.behavior == nil {
+		return errors.New("BundledOutput Probe called without a behavior")
+	}
+	if err := o.behavior.Initialize(connString); err != nil {
+		return err
+	}
+
+	if prober, ok := o.behavior.(ProbingBundleBehavior); ok {
+		return prober.Probe()
+	}
+	return nil
+}
+
 func (o *BundledOutput) Initialize(connString string) error {
 	o.fileResultChan = make(chan UploadStatus)
 	o.filesToUpload = make([]string, 0)
 
 	// maximum file size before we trigger an upload is ~10MB.
-	o.maxFileSize = config.BundleSizeMax
+	o.maxFileSize = o.outputConfig.BundleSizeMax
 
 	// roll over duration defaults to five minutes
-	o.rollOverDuration = config.BundleSendTimeout
+	o.rollOverDuration = o.outputConfig.BundleSendTimeout
 
-	parts := strings.SplitN(connString, ":", 2)
-	if len(parts) > 1 && parts[0] != "http" && parts[0] != "https" {
-		o.tempFileDirectory = parts[0]
-		connString = parts[1]
-	} else {
-		// temporary file location
-		o.tempFileDirectory = "/var/cb/data/event-forwarder"
-	}
+	o.tempFileDirectory, connString = splitBundleParameters(connString)
 
 	if o.behavior == nil {
 		return errors.New("BundledOutput Initialize called without a behavior")
@@ -176,11 +259,12 @@ func (o *BundledOutput) output(message string) error {
 
 	// first try to write the message to our output file
 	o.currentFileSize += int64(len(message))
+	o.received++
 	return o.tempFileOutput.output(message)
 }
 
 func (o *BundledOutput) rollOver() error {
-	if o.currentFileSize == 0 && !config.UploadEmptyFiles {
+	if o.currentFileSize == 0 && !o.outputConfig.UploadEmptyFiles {
 		// don't upload zero length files if UploadEmptyFiles is false
 		return nil
 	}
@@ -191,7 +275,11 @@ func (o *BundledOutput) rollOver() error {
 		return err
 	}
 
-	go o.uploadOne(fn)
+	if o.acknowledge != nil {
+		o.pendingBundles = append(o.pendingBundles, pendingBundle{fileName: fn, through: o.received})
+	}
+
+	o.startUpload(fn)
 	o.currentFileSize = 0
 
 	return nil
@@ -214,39 +302,61 @@ func (o *BundledOutput) Statistics() interface{} {
 		UploadErrors:         o.uploadErrors,
 		HoldingArea:          o.tempFileOutput.Statistics(),
 		StorageStatistics:    o.behavior.Statistics(),
-		BundleSendTimeout:    int64(config.BundleSendTimeout / time.Second),
-		BundleSizeMax:        config.BundleSizeMax,
-		UploadEmptyFiles:     config.UploadEmptyFiles,
+		BundleSendTimeout:    int64(o.outputConfig.BundleSendTimeout / time.Second),
+		BundleSizeMax:        o.outputConfig.BundleSizeMax,
+		UploadEmptyFiles:     o.outputConfig.UploadEmptyFiles,
 	}
 }
 
 func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	go func() {
+		// closing errorChan tells the dispatcher that this output has stopped
+		defer close(errorChan)
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
-		term := make(chan os.Signal, 1)
-		signal.Notify(term, syscall.SIGTERM)
-		signal.Notify(term, syscall.SIGINT)
-
 		defer refreshTicker.Stop()
 		defer o.tempFileOutput.closeFile()
 		defer o.tempFileOutput.flushOutput(true)
 		defer signal.Stop(hup)
-		defer signal.Stop(term)
+
+		// once messages is closed, the last bundle is rolled over and the output keeps uploading until every
+		// bundle has been sent; shutdown_timeout bounds how long the forwarder waits for that
+		draining := false
 
 		for {
+			if draining && len(o.filesToUpload) == 0 && atomic.LoadInt32(&o.uploading) == 0 {
+				log.Infof("All bundles have been sent to %s", o.behavior.String())
+				return
+			}
+
+			input := messages
+			if draining {
+				input = nil
+			}
+
 			select {
-			case message := <-messages:
+			case message, ok := <-input:
+				if !ok {
+					log.Infof("Sending the remaining bundles to %s", o.behavior.String())
+					draining = true
+					if err := o.rollOver(); err != nil {
+						errorChan <- err
+						return
+					}
+					continue
+				}
+
 				if err := o.output(message); err != nil {
 					errorChan <- err
 					return
 				}
 
 			case <-refreshTicker.C:
-				if time.Now().Sub(o.tempFileOutput.lastRolledOver) > o.rollOverDuration {
+				if !draining && time.Now().Sub(o.tempFileOutput.lastRolledOver) > o.rollOverDuration {
 					if err := o.rollOver(); err != nil {
 						errorChan <- err
 						return
@@ -256,7 +366,7 @@ func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error
 				if len(o.filesToUpload) > 0 {
 					var fn string
 					fn, o.filesToUpload = o.filesToUpload[0], o.filesToUpload[1:]
-					go o.uploadOne(fn)
+					o.startUpload(fn)
 				}
 
 			case fileResult := <-o.fileResultChan:
@@ -274,6 +384,10 @@ func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error
 						//  and instead an issue with the data we've sent. So move the file to the debug area and
 						//  don't try to upload it again.
 						MoveFileToDebug(fileResult.fileName)
+
+						// retrying would fail the same way, so acknowledge these events; they are kept in the
+						// debug area instead
+						o.bundleUploaded(fileResult.fileName)
 					}
 
 					log.Infof("Error uploading file %s: %s", fileResult.fileName, fileResult.result)
@@ -281,6 +395,7 @@ func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error
 					o.successfulUploads += 1
 					o.lastSuccessfulUpload = time.Now()
 					log.Infof("Successfully uploaded file %s to %s.", fileResult.fileName, o.behavior.String())
+					o.bundleUploaded(fileResult.fileName)
 				}
 
 			case <-hup:
@@ -290,14 +405,6 @@ func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error
 					errorChan <- err
 					return
 				}
-			case <-term:
-				// handle exit gracefully
-				errorChan <- errors.New("SIGTERM received")
-				o.tempFileOutput.flushOutput(true)
-				o.tempFileOutput.closeFile()
-				refreshTicker.Stop()
-				log.Info("Received SIGTERM. Exiting")
-				return
 			}
 		}
 	}()
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+/*
+ * Delivery capture writes raw AMQP deliveries to disk before they are processed, in the format read by the
+ * directory replay input. Each run writes to its own subdirectory, rolled over at max_directory_size, and only
+ * the newest max_directories are kept.
+ */
+
+var (
+	capturedDeliveries = expvar.NewInt("captured_deliveries")
+	captureErrors      = expvar.NewInt("capture_errors")
+)
+
+var deliveryCapture *DeliveryCapture
+
+type DeliveryCapture struct {
+	sync.Mutex
+
+	directory        string
+	sampleRate       int
+	routingKeys      []string
+	maxDirectorySize int64
+	maxDirectories   int
+
+	// deliveries seen, used for sampling, and deliveries written, used to name the files
+	seen     int64
+	sequence int64
+
+	rotations        int
+	currentDirectory string
+	currentSize      int64
+}
+
+func NewDeliveryCapture(c Configuration) (*DeliveryCapture, error) {
+	capture := &DeliveryCapture{
+		directory:        c.CaptureDirectory,
+		sampleRate:       c.CaptureSampleRate,
+		routingKeys:      c.CaptureRoutingKeys,
+		maxDirectorySize: c.CaptureMaxDirectorySize,
+		maxDirectories:   c.CaptureMaxDirectories,
+	}
+
+	if err := os.MkdirAll(capture.directory, 0700); err != nil {
+		return nil, err
+	}
+	if err := capture.rotate(); err != nil {
+		return nil, err
+	}
+
+	return capture, nil
+}
+
+// Record writes the delivery to the capture directory if it is selected by the sample rate or the routing keys.
+// Errors are logged, since a failed capture should never stop a delivery from being processed.
+func (c *DeliveryCapture) Record(delivery amqp.Delivery) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.seen++
+	if !c.selects(delivery.RoutingKey) {
+		return
+	}
+
+	if err := c.write(delivery); err != nil {
+		captureErrors.Add(1)
+		log.Errorf("Could not capture delivery with routing key %s: %s", delivery.RoutingKey, err)
+		return
+	}
+	capturedDeliveries.Add(1)
+}
+
+func (c *DeliveryCapture) selects(routingKey string) bool {
+	if c.sampleRate > 0 && c.seen%int64(c.sampleRate) == 0 {
+		return true
+	}
+	for _, pattern := range c.routingKeys {
+		if routingKeyMatches(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DeliveryCapture) write(delivery amqp.Delivery) error {
+	captured := CapturedDelivery{
+		RoutingKey:  delivery.RoutingKey,
+		ContentType: delivery.ContentType,
+		Exchange:    delivery.Exchange,
+		Headers:     delivery.Headers,
+		Timestamp:   delivery.Timestamp,
+	}
+	if captured.Timestamp.IsZero() {
+		captured.Timestamp = time.Now().UTC()
+	}
+
+	metadata, err := json.Marshal(captured)
+	if err != nil {
+		return err
+	}
+
+	if c.currentSize > 0 && c.currentSize+int64(len(delivery.Body)+len(metadata)) > c.maxDirectorySize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+
+	c.sequence++
+	bodyFile := filepath.Join(c.currentDirectory, fmt.Sprintf("%010d-%s", c.sequence, delivery.RoutingKey))
+
+	// the sidecar is written last, and renamed into place, so that the replay input skips partial captures
+	if err := ioutil.WriteFile(bodyFile, delivery.Body, 0600); err != nil {
+		return err
+	}
+	tempFile := bodyFile + captureMetadataSuffix + ".tmp"
+	if err := ioutil.WriteFile(tempFile, metadata, 0600); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if err := os.Rename(tempFile, bodyFile+captureMetadataSuffix); err != nil {
+		return err
+	}
+
+	c.currentSize += int64(len(delivery.Body) + len(metadata))
+	return nil
+}
+
+// rotate starts a new capture subdirectory and removes the oldest ones beyond max_directories.
+func (c *DeliveryCapture) rotate() error {
+	// the rotation count keeps names unique, and in order, when rotating more than once in the same instant
+	c.rotations++
+	name := fmt.Sprintf("%s-%04d", time.Now().UTC().Format("20060102T150405.000000"), c.rotations)
+
+	currentDirectory := filepath.Join(c.directory, name)
+	if err := os.MkdirAll(currentDirectory, 0700); err != nil {
+		return err
+	}
+	c.currentDirectory = currentDirectory
+	c.currentSize = 0
+	c.sequence = 0
+
+	log.Infof("Capturing deliveries to %s", c.currentDirectory)
+
+	entries, err := ioutil.ReadDir(c.directory)
+	if err != nil {
+		return err
+	}
+
+	directories := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			directories = append(directories, entry.Name())
+		}
+	}
+	sort.Strings(directories)
+
+	for len(directories) > c.maxDirectories {
+		oldest := filepath.Join(c.directory, directories[0])
+		log.Infof("Removing capture directory %s", oldest)
+		if err := os.RemoveAll(oldest); err != nil {
+			return err
+		}
+		directories = directories[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestDeliveryCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input, err := ini.Load(strings.NewReader(`
+[capture]
+directory=` + dir + `
+sample_rate=3
+routing_keys=watchlist.#
+max_directory_size=120
+max_directories=2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseCapture(input, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	capture, err := NewDeliveryCapture(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routingKeys := []string{
+		"ingress.event.procstart",
+		"watchlist.hit.process",
+		"ingress.event.netconn",
+		"ingress.event.filemod",
+		"ingress.event.regmod",
+		"ingress.event.childproc",
+	}
+	for _, routingKey := range routingKeys {
+		capture.Record(amqp.Delivery{
+			RoutingKey:  routingKey,
+			ContentType: "application/protobuf",
+			Exchange:    "api.events",
+			Headers:     amqp.Table{"sensorId": int64(12)},
+			Body:        []byte(routingKey),
+		})
+	}
+
+	// watchlist.hit.process matches the routing keys, the 3rd and 6th deliveries are sampled, and each capture
+	// is large enough to start a new directory; only the last two directories are kept
+	directories, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(directories) != 2 {
+		t.Fatalf("Expected 2 capture directories, got %d", len(directories))
+	}
+
+	files, err := captureFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := make([]string, 0)
+	for _, file := range files {
+		delivery, ok, err := readCapturedDelivery(file)
+		if err != nil {
+			t.Fatalf("Could not read capture %s: %s", file, err)
+		}
+		if !ok {
+			continue
+		}
+
+		if delivery.ContentType != "application/protobuf" || delivery.Exchange != "api.events" ||
+			string(delivery.Body) != delivery.RoutingKey || delivery.Timestamp.IsZero() {
+			t.Errorf("Unexpected delivery %+v", delivery)
+		}
+		if sensorId, err := parseIntFromHeader(delivery.Headers["sensorId"]); err != nil || sensorId != 12 {
+			t.Errorf("Could not read sensorId header back from %s: %v", filepath.Base(file), err)
+		}
+		replayed = append(replayed, delivery.RoutingKey)
+	}
+
+	expected := "ingress.event.netconn,ingress.event.childproc"
+	if strings.Join(replayed, ",") != expected {
+		t.Errorf("Expected captures %s, got %v", expected, replayed)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"zvelo.io/ttlru"
@@ -49,11 +50,58 @@ type ApiInfo struct {
 
 /*
  * This is the Cache for the report title within post processing
- * Mapping: "<feed_id>|<report_id>" -> report_title
+ * Mapping: "<feed_id>|<report_id>" -> *ThreatReport
  */
 var FeedCache = ttlru.New(128, ttlru.WithTTL(5*time.Minute))
 
-func GetCb(route string) ([]byte, error) {
+/*
+ * Reports that the server does not have are remembered for a short while, so that a storm of hits on a report the
+ * server cannot return does not query the server for every hit. Timeouts and server errors are not remembered, so
+ * the next hit retries them.
+ * Mapping: "<feed_id>|<report_id>" -> error
+ */
+var FeedNegativeCache = ttlru.New(128, ttlru.WithTTL(30*time.Second))
+
+// concurrent lookups of the same report share a single request
+var reportLookups flightGroup
+
+// the Cb API settings (cb_server_url and the api_* options) are restart-only, and a reload reports changes to them
+// through restartOnlyChanges, so a single client and its pool of keep-alive connections is shared by every request
+var (
+	cbAPIClient     *http.Client
+	cbAPIClientLock sync.Mutex
+)
+
+const cbAPITimeout = 30 * time.Second
+
+// cbAPIStatusError is returned by GetCb when the server answers with a status other than 200.
+type cbAPIStatusError struct {
+	StatusCode int
+}
+
+func (e *cbAPIStatusError) Error() string {
+	return fmt.Sprintf("Cb Response Server returned a %d status code.\n", e.StatusCode)
+}
+
+// permanentLookupError returns true if retrying the lookup that failed with err would fail the same way: the
+// server does not have what was asked for, or what it returned cannot be decoded.
+func permanentLookupError(err error) bool {
+	switch err := err.(type) {
+	case *cbAPIStatusError:
+		return err.StatusCode == http.StatusNotFound || err.StatusCode == http.StatusGone
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return false
+}
+
+func getCbAPIClient() (*http.Client, error) {
+	cbAPIClientLock.Lock()
+	defer cbAPIClientLock.Unlock()
+
+	if cbAPIClient != nil {
+		return cbAPIClient, nil
+	}
 
 	var proxyRequest func(*http.Request) (*url.URL, error)
 
@@ -71,11 +119,21 @@ func GetCb(route string) ([]byte, error) {
 	}
 
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: !config.CbAPIVerifySSL, MinVersion: tls.VersionTLS12},
-		Proxy:           proxyRequest,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: !config.CbAPIVerifySSL, MinVersion: tls.VersionTLS12},
+		Proxy:               proxyRequest,
+		MaxIdleConnsPerHost: config.PostprocessWorkers + config.EnrichmentMaxConcurrent,
+	}
+
+	cbAPIClient = &http.Client{Transport: tr, Timeout: cbAPITimeout}
+	return cbAPIClient, nil
+}
+
+func GetCb(route string) ([]byte, error) {
+	httpClient, err := getCbAPIClient()
+	if err != nil {
+		return nil, err
 	}
 
-	httpClient := &http.Client{Transport: tr}
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", config.CbServerURL, route), nil)
 	if err != nil {
 		return nil, err
@@ -88,11 +146,10 @@ func GetCb(route string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
+	body, err := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Cb Response Server returned a %d status code.\n", resp.StatusCode)
+		return nil, &cbAPIStatusError{StatusCode: resp.StatusCode}
 	}
-
-	body, err := ioutil.ReadAll(resp.Body)
 	return body, err
 }
 
@@ -114,65 +171,78 @@ func GetCbVersion() (version string, err error) {
 }
 
 func GetReportTitle(FeedId int, ReportId string) (string, error) {
-	threatReport := ThreatReport{}
+	reportTitle, _, err := GetReport(FeedId, ReportId)
+	return reportTitle, err
+}
 
+func GetReport(FeedId int, ReportId string) (string, int, error) {
 	key := strconv.Itoa(FeedId) + "|" + ReportId
 
-	reportTitle, cachePresent := FeedCache.Get(key)
+	if cached, ok := FeedCache.Get(key); ok && cached != nil {
+		threatReport := cached.(*ThreatReport)
+		return threatReport.Title, threatReport.Score, nil
+	}
+	if cached, ok := FeedNegativeCache.Get(key); ok && cached != nil {
+		return "", 0, cached.(error)
+	}
 
-	if cachePresent && reportTitle != nil {
-		return reportTitle.(string), nil
-	} else {
+	report, err := reportLookups.Do(key, func() (interface{}, error) {
 		body, err := GetCb(fmt.Sprintf("api/v1/feed/%d/report/%s", FeedId, ReportId))
-		if err != nil {
-			return "", err
+		if err == nil {
+			threatReport := &ThreatReport{}
+			err = json.Unmarshal(body, threatReport)
+			if err == nil {
+				FeedCache.Set(key, threatReport)
+				return threatReport, nil
+			}
 		}
 
-		err = json.Unmarshal(body, &threatReport)
-
-		if err != nil {
-			return "", err
+		if permanentLookupError(err) {
+			FeedNegativeCache.Set(key, err)
 		}
-
-		FeedCache.Set(key, threatReport.Title)
-
-		return threatReport.Title, nil
+		return nil, err
+	})
+	if err != nil {
+		return "", 0, err
 	}
-}
-
-func GetReport(FeedId int, ReportId string) (string, int, error) {
-
-	threatReport := ThreatReport{}
 
-	key := strconv.Itoa(FeedId) + "|" + ReportId
+	threatReport := report.(*ThreatReport)
+	return threatReport.Title, threatReport.Score, nil
+}
 
-	raw_threat_report_p, cachePresent := FeedCache.Get(key)
+// flightGroup coalesces concurrent calls with the same key into a single call, whose result they all share.
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
 
-	if cachePresent {
-		if raw_threat_report_p != nil {
-			threat_report_p := (raw_threat_report_p).(*ThreatReport)
-			threat_report := *threat_report_p
-			reportTitle := threat_report.Title
-			reportScore := threat_report.Score
-			return reportTitle, reportScore, nil
-		}
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
 
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
 	}
-	//implicit ELSE
-	body, err := GetCb(fmt.Sprintf("api/v1/feed/%d/report/%s", FeedId, ReportId))
-
-	if err != nil {
-		return "", 0, err
+	if call, ok := g.calls[key]; ok {
+		g.Unlock()
+		<-call.done
+		return call.value, call.err
 	}
 
-	err = json.Unmarshal(body, &threatReport)
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.Unlock()
 
-	if err != nil {
-		return "", 0, err
-	}
-
-	FeedCache.Set(key, &threatReport)
+	call.value, call.err = fn()
+	close(call.done)
 
-	return threatReport.Title, threatReport.Score, nil
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
 
+	return call.value, call.err
 }
@@ -0,0 +1,279 @@
+package cef
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	productVendorName string
+	productName       string
+	productVersion    string
+	cefVersion        string
+	defaultSeverity   string
+	headerFormatter   *strings.Replacer
+	formatter         *strings.Replacer
+)
+
+func init() {
+	productVendorName = "CB"
+	productName = "CB"
+	productVersion = "5.1"
+	cefVersion = "0"
+	defaultSeverity = "1"
+
+	// pipes and backslashes must be escaped in the header fields
+	headerFormatter = strings.NewReplacer(
+		"\\", "\\\\",
+		"|", "\\|",
+		"\n", " ",
+		"\r", " ",
+	)
+
+	// equal signs and backslashes must be escaped in extension values, newlines are encoded
+	formatter = strings.NewReplacer(
+		"\\", "\\\\",
+		"=", "\\=",
+		"\n", "\\n",
+		"\r", "\\r",
+	)
+}
+
+func generateHeader(cbVersion, eventType, severity string) string {
+	return fmt.Sprintf("CEF:%s|%s|%s|%s|%s|%s|%s|", cefVersion, headerFormatter.Replace(productVendorName),
+		headerFormatter.Replace(productName), headerFormatter.Replace(cbVersion), headerFormatter.Replace(eventType),
+		headerFormatter.Replace(eventType), severity)
+}
+
+func normalizeAddToMap(msg map[string]interface{}, temp map[string]interface{}) {
+	outboundConnections := map[string]string{
+		"local_ip":    "src",
+		"remote_ip":   "dst",
+		"protocol":    "proto",
+		"local_port":  "spt",
+		"remote_port": "dpt",
+	}
+	inboundConnections := map[string]string{
+		"local_ip":    "dst",
+		"remote_ip":   "src",
+		"protocol":    "proto",
+		"local_port":  "dpt",
+		"remote_port": "spt",
+	}
+
+	cefMap := outboundConnections
+	if directionality, ok := temp["direction"]; ok {
+		if directionality == "inbound" {
+			cefMap = inboundConnections
+		}
+	}
+
+	for key, value := range temp {
+		if newKey, ok := cefMap[key]; ok {
+			msg[newKey] = value
+		}
+	}
+}
+
+// addStandardKeys maps Cb field names onto the CEF dictionary keys for files, users and hosts.
+func addStandardKeys(msg map[string]interface{}) {
+	if path, ok := msg["path"].(string); ok && len(path) > 0 {
+		msg["filePath"] = path
+		msg["fname"] = path[strings.LastIndexAny(path, "/\\")+1:]
+	}
+
+	if username, ok := msg["username"]; ok {
+		msg["suser"] = username
+	}
+
+	if hostname, ok := msg["computer_name"]; ok {
+		msg["shost"] = hostname
+	} else if hostname, ok := msg["hostname"]; ok {
+		msg["shost"] = hostname
+	}
+}
+
+// severity maps a 0-100 report_score onto the 0-10 CEF severity scale.
+func severity(msg map[string]interface{}) string {
+	var score int64
+	switch value := msg["report_score"].(type) {
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return defaultSeverity
+		}
+		score = int64(f)
+	case int:
+		score = int64(value)
+	case int64:
+		score = value
+	case float64:
+		score = int64(value)
+	default:
+		return defaultSeverity
+	}
+
+	if score < 0 {
+		score = 0
+	} else if score > 100 {
+		score = 100
+	}
+	return strconv.FormatInt(score/10, 10)
+}
+
+func Encode(msg map[string]interface{}) (string, error) {
+	keyNames := make([]string, 0)
+	kvPairs := make([]string, 0)
+
+	// promote "docs" up to the root
+	if val, ok := msg["docs"]; ok {
+		if subdocs, ok := val.([]interface{}); ok {
+			if len(subdocs) != 1 {
+				return "", errors.New("More than one entry in docs[]")
+			}
+			if kv, ok := subdocs[0].(map[string]interface{}); ok {
+				for key, value := range kv {
+					msg[key] = value
+				}
+				delete(msg, "docs")
+			} else {
+				return "", errors.New("could not map docs[0] to map[string]interface{}")
+			}
+		} else if subdocs, ok := val.([]map[string]interface{}); ok {
+			if len(subdocs) != 1 {
+				return "", errors.New("More than one entry in docs[]")
+			}
+			for key, value := range subdocs[0] {
+				msg[key] = value
+			}
+			delete(msg, "docs")
+		} else {
+			return "", errors.New("could not map docs to []interface{}")
+		}
+	}
+
+	//
+	// Add the CEF network keys (src, dst, spt, dpt, proto) for the connection described by ioc_attr
+	//
+	if ioc_attr, ok := msg["ioc_attr"]; ok {
+		val := reflect.ValueOf(ioc_attr)
+
+		if val.Kind() == reflect.String {
+			var temp map[string]interface{}
+			decoder := json.NewDecoder(strings.NewReader(ioc_attr.(string)))
+
+			// Ensure that we decode numbers in the JSON as integers and *not* float64s
+			decoder.UseNumber()
+
+			if err := decoder.Decode(&temp); err != nil {
+				return "", errors.New("Received error when unmarshaling JSON ioc_attr")
+			}
+			normalizeAddToMap(msg, temp)
+
+		} else if val.Kind() == reflect.Map {
+			if kv, ok := ioc_attr.(map[string]interface{}); ok {
+				normalizeAddToMap(msg, kv)
+			}
+		}
+	}
+
+	//
+	// For netconns we want to map remote and local ports to the CEF network keys
+	//
+	if msg["type"] == "ingress.event.netconn" {
+		normalizeAddToMap(msg, msg)
+	}
+
+	addStandardKeys(msg)
+
+	for key, _ := range msg {
+		keyNames = append(keyNames, key)
+	}
+
+	// message type applied to messages without an explicit message type.
+	// the code below will promote the "type" to the signature ID and name in the CEF header.
+	messageType := "unknown.event.type"
+	cbVersion := productVersion
+
+	sort.Strings(keyNames)
+	for _, key := range keyNames {
+		if !reflect.ValueOf(msg[key]).IsValid() {
+			continue
+		}
+
+		var val string
+
+		switch typed_msg_val := msg[key].(type) {
+		case map[string]interface{}:
+			if len(typed_msg_val) == 0 {
+				val = ""
+			} else {
+				t, err := json.Marshal(typed_msg_val)
+				if err != nil {
+					log.Infof("Could not marshal key %s with value %v into JSON: %s, skipping", key, msg[key], err.Error())
+					continue
+				}
+				val = formatter.Replace(string(t))
+			}
+
+		case []string:
+			// single entry arrays are flattened; longer ones are formatted as JSON
+			length_of_array := len(typed_msg_val)
+			if length_of_array == 0 {
+				val = ""
+			} else if length_of_array == 1 {
+				if key == "type" {
+					messageType = typed_msg_val[0]
+				} else if key == "cb_version" {
+					cbVersion = typed_msg_val[0]
+				}
+				val = formatter.Replace(typed_msg_val[0])
+			} else {
+				t, err := json.Marshal(typed_msg_val)
+				if err != nil {
+					log.Infof("Could not marshal key %s with value %v into JSON: %s, skipping", key, msg[key], err.Error())
+					continue
+				}
+				val = formatter.Replace(string(t))
+			}
+
+		case json.Number:
+			val_str := typed_msg_val.String()
+			if key == "type" {
+				messageType = val_str
+			} else if key == "cb_version" {
+				cbVersion = val_str
+			}
+			val = formatter.Replace(val_str)
+
+		case string:
+			// make sure to format strings with the appropriate character escaping
+			// also make sure we reflect the "type" and "cb_version" on to the message header, if present
+			if key == "type" {
+				messageType = typed_msg_val
+			} else if key == "cb_version" {
+				cbVersion = typed_msg_val
+			}
+			val = formatter.Replace(typed_msg_val)
+		case int, int32, int64, uint32, uint64, uint:
+			val = fmt.Sprintf("%d", typed_msg_val)
+		case bool:
+			val = fmt.Sprintf("%t", typed_msg_val)
+		default:
+			// simplify and use fmt.Sprintf to format the output
+			val = formatter.Replace(fmt.Sprintf("%v", typed_msg_val))
+		}
+
+		kvPairs = append(kvPairs, fmt.Sprintf("%s=%s", key, val))
+	}
+
+	ret := fmt.Sprintf("%s%s", generateHeader(cbVersion, messageType, severity(msg)), strings.Join(kvPairs, " "))
+
+	return ret, nil
+}
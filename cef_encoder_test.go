@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	cef "github.com/carbonblack/cb-event-forwarder/cef"
+	"strings"
+	"testing"
+)
+
+func TestCefEncoder(t *testing.T) {
+	msg := map[string]interface{}{
+		"type":       "feed.storage.hit.process",
+		"cb_version": "5.1.0|150625",
+		"docs": []interface{}{map[string]interface{}{
+			"path":     `c:\windows\system32\cmd.exe`,
+			"username": "SYSTEM",
+			"hostname": "WIN-IA9NQ1GN8OI",
+			"cmdline":  "cmd.exe /c set A=B\r\nexit",
+		}},
+		"ioc_attr":     `{"direction": "inbound", "local_ip": "10.0.0.5", "remote_ip": "8.8.8.8", "local_port": 445, "remote_port": 51000, "protocol": 6}`,
+		"report_score": json.Number("75"),
+	}
+
+	out, err := cef.Encode(msg)
+	if err != nil {
+		t.Fatalf("Error generating CEF output: %s", err.Error())
+	}
+
+	header := `CEF:0|CB|CB|5.1.0\|150625|feed.storage.hit.process|feed.storage.hit.process|7|`
+	if !strings.HasPrefix(out, header) {
+		t.Errorf("Expected CEF header %s, got %s", header, out)
+	}
+
+	for _, expected := range []string{
+		`cmdline=cmd.exe /c set A\=B\r\nexit `,
+		`dpt=445 `,
+		`dst=10.0.0.5 `,
+		`filePath=c:\\windows\\system32\\cmd.exe `,
+		`fname=cmd.exe `,
+		`proto=6 `,
+		`shost=WIN-IA9NQ1GN8OI`,
+		`spt=51000 `,
+		`src=8.8.8.8 `,
+		`suser=SYSTEM `,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s in CEF output %s", expected, out)
+		}
+	}
+}
+
+func TestCefEncoderDocs(t *testing.T) {
+	msg := map[string]interface{}{
+		"type": "watchlist.hit.binary",
+		"docs": []interface{}{map[string]interface{}{"md5": "A"}, map[string]interface{}{"md5": "B"}},
+	}
+	if _, err := cef.Encode(msg); err == nil {
+		t.Errorf("Expected an error encoding an event with more than one entry in docs[]")
+	}
+
+	msg = map[string]interface{}{"md5": "A"}
+	out, err := cef.Encode(msg)
+	if err != nil {
+		t.Fatalf("Error generating CEF output: %s", err.Error())
+	}
+	if out != "CEF:0|CB|CB|5.1|unknown.event.type|unknown.event.type|1|md5=A" {
+		t.Errorf("Unexpected CEF output %s", out)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+/*
+ * -check tests every dependency named in the configuration without forwarding any events, and prints a report.
+ */
+
+// probeTimeout bounds each connection attempt made by -check.
+const probeTimeout = 10 * time.Second
+
+// ProbingOutputHandler is implemented by outputs that can check that the destination in their parameters can be
+// reached, without initializing the output or sending it any events.
+type ProbingOutputHandler interface {
+	Probe(parameters string) error
+}
+
+// ProbingBundleBehavior is implemented by bundle behaviors that can check their destination once initialized.
+type ProbingBundleBehavior interface {
+	Probe() error
+}
+
+const (
+	checkPassed = iota
+	checkWarning
+	checkFailed
+	checkSkipped
+)
+
+type checkResult struct {
+	status  int
+	subject string
+	message string
+}
+
+type checkReport struct {
+	results []checkResult
+}
+
+func (r *checkReport) add(status int, subject, format string, args ...interface{}) {
+	r.results = append(r.results, checkResult{status: status, subject: subject, message: fmt.Sprintf(format, args...)})
+}
+
+// check records a pass with the given message if err is nil, and a failure with the error otherwise.
+func (r *checkReport) check(subject string, err error, format string, args ...interface{}) {
+	if err != nil {
+		r.add(checkFailed, subject, "%s", err)
+	} else {
+		r.add(checkPassed, subject, format, args...)
+	}
+}
+
+func (r *checkReport) count(status int) int {
+	n := 0
+	for _, result := range r.results {
+		if result.status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *checkReport) write(w io.Writer) {
+	labels := map[int]string{checkPassed: "PASS", checkWarning: "WARN", checkFailed: "FAIL", checkSkipped: "SKIP"}
+	for _, result := range r.results {
+		fmt.Fprintf(w, "[%s] %s: %s\n", labels[result.status], result.subject, result.message)
+	}
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed, %d skipped\n", r.count(checkPassed), r.count(checkWarning),
+		r.count(checkFailed), r.count(checkSkipped))
+}
+
+// runConfigurationCheck checks the configuration file and everything it refers to, prints a report and returns
+// the status the forwarder should exit with.
+func runConfigurationCheck(fn string, w io.Writer) int {
+	report := &checkReport{}
+	checkConfigurationFile(report, fn)
+
+	fmt.Fprintf(w, "cb-event-forwarder %s configuration check of %s\n\n", version, fn)
+	report.write(w)
+
+	if report.count(checkFailed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func checkConfigurationFile(report *checkReport, fn string) {
+	c, err := ParseConfig(fn)
+	if configErrs, ok := err.(ConfigurationError); ok {
+		for _, message := range configErrs.Errors {
+			report.add(checkFailed, "configuration", "%s", message)
+		}
+	} else if err != nil {
+		report.add(checkFailed, "configuration", "Could not read %s: %s", fn, err)
+		return
+	}
+
+	if input, err := loadConfigFile(fn); err == nil {
+		for _, warning := range unknownOptions(input) {
+			report.add(checkWarning, "configuration", "%s", warning)
+		}
+	}
+
+	if err != nil {
+		report.add(checkSkipped, "connectivity", "the configuration has errors; fix them first")
+		return
+	}
+	report.add(checkPassed, "configuration", "%s is valid", fn)
+
+	applyCommandLineOptions(&c)
+	config = c
+
+	checkDirectories(report, c)
+
+	if c.AMQPDisabled {
+		report.add(checkSkipped, "RabbitMQ", "AMQP input is disabled")
+	} else {
+		checkAMQP(report, c)
+	}
+
+	if c.PerformFeedPostprocessing {
+		apiVersion, err := GetCbVersion()
+		report.check("Cb API", err, "%s is running version %s", c.CbServerURL, apiVersion)
+	} else {
+		report.add(checkSkipped, "Cb API", "api_token is not set, so feed post-processing is disabled")
+	}
+
+	for _, output := range c.Outputs {
+		checkOutput(report, output)
+	}
+}
+
+// knownOptions lists the options read from each kind of section. Outputs configured in [bridge] read their
+// options from a section named after their type, such as [s3]. TestKnownOptions fails when the parser in
+// config.go reads an option that is missing here.
+var knownOptions = map[string][]string{
+	"bridge": {
+		"server_name", "debug", "debug_store", "http_server_port", "cb_server_hostname", "cb_server_url",
+		"rabbit_mq_username", "rabbit_mq_password", "rabbit_mq_port", "rabbit_mq_auto_delete_queue",
+		"rabbit_mq_queue_name", "rabbit_mq_use_tls", "rabbit_mq_ca_cert", "rabbit_mq_cert", "rabbit_mq_key",
+		"rabbit_mq_prefetch_count", "rabbit_mq_disabled", "rabbit_mq_consumer_count", "delivery_mode",
+		"shutdown_timeout", "input_type", "input_directory", "use_raw_sensor_exchange", "monitored_logs",
+		"compress_data", "audit_log", "message_processor_count", "output_queue_size", "event_ordering",
+		"api_token", "api_verify_ssl", "api_proxy_url", "postprocess_workers", "postprocess_queue_size",
+		"output_type", "output_format",
+		"events_watchlist", "events_feed", "events_alert", "events_raw_sensor", "events_binary_observed",
+		"events_binary_upload", "events_storage_partition",
+		"outfile", "tcpout", "udpout", "s3out", "httpout", "syslogout", "splunkout", "elasticsearchout",
+	},
+	"output": {
+		"output_type", "output_format", "event_types",
+		"outfile", "tcpout", "udpout", "s3out", "httpout", "syslogout", "splunkout", "elasticsearchout",
+		"tls_verify", "insecure_tls", "server_cname", "ca_cert", "client_key", "client_cert",
+		"spool_directory", "spool_segment_size", "spool_max_size",
+		"upload_empty_files", "bundle_size_max", "bundle_send_timeout", "compress_data",
+		"credential_profile", "acl_policy", "storage_class", "server_side_encryption", "object_prefix",
+		"verbose_key", "authorization_token", "http_post_template", "content_type", "hec_token",
+		"brokers", "topic_suffix", "topic_template", "partition_key", "use_tls", "sasl_mechanism",
+		"sasl_username", "sasl_password", "required_acks", "idempotent", "compression", "version",
+		"retry_max", "retry_backoff", "resend_max",
+		"index", "username", "password", "api_key", "bulk_max_events",
+	},
+	"filter": {
+		"action", "field", "event_types", "ignore_case", "glob", "values", "cidr", "regex",
+	},
+	"transform": {
+		"operation", "field", "event_types", "to", "value",
+	},
+	"capture": {
+		"directory", "sample_rate", "routing_keys", "max_directory_size", "max_directories",
+	},
+	"rate_limit": {
+		"events_per_second", "burst", "per_event_type", "event_types", "summary_interval",
+	},
+	"dedup": {
+		"window", "action", "max_entries", "event_types", "fields",
+	},
+	"process_table": {
+		"enabled", "max_processes", "ttl",
+	},
+	"enrichment": {
+		"enabled", "event_types", "cache_ttl", "cache_size", "max_concurrent", "timeout_ms",
+	},
+}
+
+// legacyOutputSections are the sections read by outputs configured in [bridge].
+var legacyOutputSections = []string{"s3", "http", "splunk", "syslog", "kafka", "elasticsearch", "tcp", "udp", "file"}
+
+// unknownOptions returns a warning for each section and option that the forwarder does not read.
+func unknownOptions(input ini.File) []string {
+	warnings := make([]string, 0)
+
+	sections := make([]string, 0, len(input))
+	for section := range input {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		kind := section
+		if i := strings.Index(section, ":"); i >= 0 {
+			kind = section[:i]
+		}
+		for _, legacy := range legacyOutputSections {
+			if section == legacy {
+				kind = "output"
+			}
+		}
+
+		known, ok := knownOptions[kind]
+		if !ok {
+			if section != "" || len(input[section]) > 0 {
+				warnings = append(warnings, fmt.Sprintf("Unknown section [%s]", section))
+			}
+			continue
+		}
+
+		options := make([]string, 0, len(input[section]))
+		for option := range input[section] {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+
+		for _, option := range options {
+			found := false
+			for _, k := range known {
+				if option == k {
+					found = true
+					break
+				}
+			}
+			if !found {
+				warnings = append(warnings, fmt.Sprintf("Unknown option %s in [%s]", option, section))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// checkWritableDirectory makes sure that files can be created in the directory, or that it can be created if it
+// does not exist yet.
+func checkWritableDirectory(dir string) error {
+	existing := dir
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return errors.New(fmt.Sprintf("%s is not a directory", existing))
+			}
+			break
+		}
+		if !os.IsNotExist(err) || filepath.Dir(existing) == existing {
+			return err
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	fp, err := ioutil.TempFile(existing, ".cb-event-forwarder-check")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot write to %s: %s", existing, err))
+	}
+	fp.Close()
+	os.Remove(fp.Name())
+
+	return nil
+}
+
+func checkDirectories(report *checkReport, c Configuration) {
+	if c.DebugFlag {
+		report.check("debug store", checkWritableDirectory(c.DebugStore), "%s is writable", c.DebugStore)
+	}
+
+	if len(c.CaptureDirectory) > 0 {
+		report.check("capture", checkWritableDirectory(c.CaptureDirectory), "%s is writable", c.CaptureDirectory)
+	}
+
+	if c.InputType == DirectoryInputType {
+		_, err := ioutil.ReadDir(c.InputDirectory)
+		report.check("replay", err, "%s is readable", c.InputDirectory)
+	}
+}
+
+// checkAMQP logs in to RabbitMQ and binds the configured routing keys to a temporary queue, which the broker
+// deletes when the connection is closed.
+func checkAMQP(report *checkReport, c Configuration) {
+	subject := fmt.Sprintf("RabbitMQ %s@%s:%d", c.AMQPUsername, c.AMQPHostname, c.AMQPPort)
+
+	if c.AMQPTLSEnabled {
+		_, err := amqpTLSConfig()
+		report.check(subject, err, "loaded TLS certificates")
+		if err != nil {
+			return
+		}
+	}
+
+	conn, err := dialAMQP(c.AMQPURL())
+	if err != nil {
+		report.add(checkFailed, subject, "%s", err)
+		return
+	}
+	defer conn.Close()
+	report.add(checkPassed, subject, "logged in")
+
+	channel, err := conn.Channel()
+	if err != nil {
+		report.add(checkFailed, subject, "Channel: %s", err)
+		return
+	}
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		report.add(checkFailed, subject, "Queue declare: %s", err)
+		return
+	}
+
+	if c.UseRawSensorExchange {
+		err = channel.QueueBind(queue.Name, "", "api.rawsensordata", false, nil)
+		report.check(subject, err, "bound to the raw sensor event exchange")
+		if err != nil {
+			return
+		}
+	}
+
+	for _, key := range c.EventTypes {
+		if err := channel.QueueBind(queue.Name, key, "api.events", false, nil); err != nil {
+			report.add(checkFailed, subject, "Could not bind %s: %s", key, err)
+			return
+		}
+	}
+	report.add(checkPassed, subject, "bound %d routing keys", len(c.EventTypes))
+}
+
+func checkOutput(report *checkReport, output *OutputConfiguration) {
+	subject := fmt.Sprintf("output %s (%s)", output.Name, output.OutputTypeName)
+
+	handler, parameters, err := newOutputHandler(output)
+	if err != nil {
+		report.add(checkFailed, subject, "%s", err)
+		return
+	}
+
+	prober, ok := handler.(ProbingOutputHandler)
+	if !ok {
+		report.add(checkSkipped, subject, "this output cannot be checked without starting it")
+		return
+	}
+
+	report.check(subject, prober.Probe(parameters), "%s is reachable", output.OutputParameters)
+}
+
+// probeTCP connects to the address and disconnects again.
+func probeTCP(network, address string) error {
+	conn, err := net.DialTimeout(network, address, probeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP sends a request that does not carry any events and returns the response status.
+func probeHTTP(client *http.Client, method, url string, headers map[string]string) (int, error) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	for key, value := range headers {
+		if key != "Content-Type" {
+			request.Header.Set(key, value)
+		}
+	}
+
+	probeClient := &http.Client{Transport: client.Transport, Timeout: probeTimeout}
+	response, err := probeClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	return response.StatusCode, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestUnknownOptions(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[bridge]
+output_type=s3
+rabbit_mq_pasword=secret
+
+[s3]
+acl_policy=bucket-owner-full-control
+storage_clas=STANDARD
+
+[output:alerts]
+output_type=tcp
+tcpout=siem.example.com:514
+
+[filters:noise]
+action=exclude
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Unknown option rabbit_mq_pasword in [bridge]",
+		"Unknown section [filters:noise]",
+		"Unknown option storage_clas in [s3]",
+	}
+	if warnings := unknownOptions(input); !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("Wrong warnings: %q", warnings)
+	}
+}
+
+// configSectionKinds names the kind of section read by the parse functions that take the section name from a
+// variable.
+var configSectionKinds = map[string]string{
+	"ParseConfig":              "output",
+	"parseOutputConfiguration": "output",
+	"parseKafkaConfiguration":  "output",
+	"parseFilterRules":         "filter",
+	"parseTransforms":          "transform",
+	"parseDedup":               "dedup",
+}
+
+// TestKnownOptions makes sure that every option read by the configuration parser is listed in knownOptions, so
+// that check does not warn about it.
+func TestKnownOptions(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "config.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stringValue := func(expr ast.Expr) (string, bool) {
+		if lit, ok := expr.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			value, err := strconv.Unquote(lit.Value)
+			return value, err == nil
+		}
+		return "", false
+	}
+
+	read := 0
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+
+		// options named by a variable take the values assigned to it in the function, or the first field of
+		// the table it is ranged over
+		assigned := make(map[string][]string)
+		var table []string
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.AssignStmt:
+				if ident, ok := node.Lhs[0].(*ast.Ident); ok && len(node.Rhs) == 1 {
+					if value, ok := stringValue(node.Rhs[0]); ok {
+						assigned[ident.Name] = append(assigned[ident.Name], value)
+					}
+				}
+			case *ast.CompositeLit:
+				if node.Type == nil && len(node.Elts) > 0 {
+					if value, ok := stringValue(node.Elts[0]); ok {
+						table = append(table, value)
+					}
+				}
+			}
+			return true
+		})
+
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok || len(call.Args) != 2 {
+				return true
+			}
+			selector, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || selector.Sel.Name != "Get" {
+				return true
+			}
+			if receiver, ok := selector.X.(*ast.Ident); !ok || receiver.Name != "input" {
+				return true
+			}
+			position := fset.Position(call.Pos())
+
+			kind, ok := stringValue(call.Args[0])
+			if ok && kind == "" {
+				// /etc/cb/cb.conf
+				return true
+			}
+			if !ok {
+				if kind, ok = configSectionKinds[fn.Name.Name]; !ok {
+					t.Errorf("%s: add the kind of section read by %s to configSectionKinds", position, fn.Name.Name)
+					return true
+				}
+			}
+
+			var options []string
+			switch key := call.Args[1].(type) {
+			case *ast.BasicLit:
+				option, _ := stringValue(key)
+				options = []string{option}
+			case *ast.Ident:
+				options = assigned[key.Name]
+			case *ast.SelectorExpr:
+				options = table
+			}
+			if len(options) == 0 {
+				t.Errorf("%s: could not tell which option is read", position)
+			}
+
+			for _, option := range options {
+				read++
+				found := false
+				for _, known := range knownOptions[kind] {
+					found = found || known == option
+				}
+				if !found {
+					t.Errorf("%s: option %s read from [%s] sections is missing from knownOptions", position, option,
+						kind)
+				}
+			}
+			return true
+		})
+	}
+
+	if read < 100 {
+		t.Errorf("Expected to find the options read by the parser, only found %d", read)
+	}
+}
+
+func TestConfigurationCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reachable := listener.Addr().String()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	savedConfig := config
+	defer func() { config = savedConfig }()
+
+	tests := []struct {
+		address  string
+		exitCode int
+		result   string
+	}{
+		{reachable, 0, "[PASS] output siem (tcp): " + reachable + " is reachable"},
+		{unreachable, 1, "[FAIL] output siem (tcp): "},
+	}
+
+	for _, test := range tests {
+		fn := filepath.Join(dir, "cb-event-forwarder.conf")
+		err := ioutil.WriteFile(fn, []byte(fmt.Sprintf(`
+[bridge]
+rabbit_mq_disabled=true
+output_type=file
+outfile=%s
+
+[output:siem]
+output_type=tcp
+tcpout=%s
+`, filepath.Join(dir, "events", "event_bridge_output.json"), test.address)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var report bytes.Buffer
+		if exitCode := runConfigurationCheck(fn, &report); exitCode != test.exitCode {
+			t.Errorf("Expected exit code %d, got %d:\n%s", test.exitCode, exitCode, report.String())
+		}
+		for _, line := range []string{
+			"[PASS] configuration: " + fn + " is valid",
+			"[SKIP] RabbitMQ: AMQP input is disabled",
+			"[PASS] output default (file): ",
+			test.result,
+		} {
+			if !strings.Contains(report.String(), line) {
+				t.Errorf("Expected %q in the report:\n%s", line, report.String())
+			}
+		}
+	}
+
+	listener.Close()
+}
@@ -6,8 +6,11 @@ import (
 	"errors"
 	_ "expvar"
 	"fmt"
+	"github.com/Shopify/sarama"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -25,11 +28,18 @@ const (
 	HttpOutputType
 	SplunkOutputType
 	KafkaOutputType
+	ElasticsearchOutputType
+)
+
+const (
+	AMQPInputType = iota
+	DirectoryInputType
 )
 
 const (
 	LEEFOutputFormat = iota
 	JSONOutputFormat
+	CEFOutputFormat
 )
 
 type Configuration struct {
@@ -37,9 +47,9 @@ type Configuration struct {
 	AMQPHostname         string
 	DebugFlag            bool
 	DebugStore           string
-	OutputType           int
-	OutputFormat         int
 	AMQPDisabled         bool
+	InputType            int
+	InputDirectory       string
 	AMQPUsername         string
 	AMQPPassword         string
 	AMQPPort             int
@@ -49,7 +59,21 @@ type Configuration struct {
 	AMQPTLSCACert        string
 	AMQPQueueName        string
 	AMQPAutoDeleteQueue  bool
-	OutputParameters     string
+	AMQPPrefetchCount    int
+
+	// each AMQP consumer has its own connection and channel, and MessageProcessorCount message processors
+	AMQPConsumerCount     int
+	MessageProcessorCount int
+
+	// with SensorOrderedEvents the events of each sensor are sent in the order in which they were received
+	EventOrdering int
+
+	// the number of encoded events each output buffers before the message processors wait on it
+	OutputQueueSize int
+
+	// With at-least-once delivery the queue is declared durable and each AMQP delivery is only acknowledged
+	// once every event it produced has been flushed, written or uploaded by the outputs.
+	AtLeastOnceDelivery bool
 	EventTypes           []string
 	EventMap             map[string]bool
 	HTTPServerPort       int
@@ -57,6 +81,88 @@ type Configuration struct {
 	UseRawSensorExchange bool
 	MonitoredLogs        []string
 
+	// Outputs holds one entry per configured output. The legacy output_type in [bridge] is parsed into an
+	// output named "default"; each [output:<name>] section adds another.
+	Outputs []*OutputConfiguration
+
+	// Compress data on S3 or file output types
+	FileHandlerCompressData bool
+
+	// include/exclude rules applied to events before they are sent to the outputs
+	FilterRules []*FilterRule
+
+	// field rewrites applied to every event, in order, before it is encoded
+	Transforms []*Transform
+
+	// capture of raw deliveries for later replay; disabled unless CaptureDirectory is set
+	CaptureDirectory        string
+	CaptureSampleRate       int
+	CaptureRoutingKeys      []string
+	CaptureMaxDirectorySize int64
+	CaptureMaxDirectories   int
+
+	// token-bucket rate limits applied per sensor, and optionally per event type, after filtering; disabled
+	// unless RateLimit is set
+	RateLimit                float64
+	RateLimitBurst           int
+	RateLimitByEventType     bool
+	RateLimitEventTypes      []string
+	RateLimitSummaryInterval time.Duration
+
+	// suppression of repeated events within a window, keyed by the fields named in each rule; disabled unless
+	// DedupWindow is set
+	DedupWindow     time.Duration
+	DedupAction     int
+	DedupMaxEntries int
+	DedupRules      []*DedupRule
+
+	// table of running processes, built from procstart and childproc events, used to add the command line and
+	// parent to other raw events; disabled unless ProcessTableEnabled is set
+	ProcessTableEnabled bool
+	ProcessTableSize    int
+	ProcessTableTTL     time.Duration
+
+	// enrichment of watchlist hits, feed hits and alerts with process and sensor details from the Cb API, as part
+	// of post processing
+	EnrichmentEnabled       bool
+	EnrichmentEventTypes    []string
+	EnrichmentCacheTTL      time.Duration
+	EnrichmentCacheSize     int
+	EnrichmentMaxConcurrent int
+	EnrichmentTimeout       time.Duration
+
+	// optional post processing of feed hits to retrieve titles
+	PerformFeedPostprocessing bool
+	CbAPIToken                string
+	CbAPIVerifySSL            bool
+	CbAPIProxyUrl             string
+
+	// post processing is done by a fixed pool of workers reading from a bounded queue
+	PostprocessWorkers   int
+	PostprocessQueueSize int
+
+	AuditLog bool
+
+	// how long to wait for events in flight to be sent when shutting down
+	ShutdownTimeout time.Duration
+}
+
+// OutputConfiguration holds everything needed to start a single OutputHandler.
+type OutputConfiguration struct {
+	Name             string
+	OutputType       int
+	OutputTypeName   string
+	OutputFormat     int
+	OutputParameters string
+
+	// Signature identifies the options the output was configured from, apart from event_types, so that a
+	// configuration reload only restarts outputs whose configuration changed
+	Signature string
+
+	// routing keys (AMQP topic syntax, e.g. "watchlist.#") that are sent to this output.
+	// An empty list sends every event.
+	EventTypes []string
+
 	// this is a hack for S3 specific configuration
 	S3ServerSideEncryption  *string
 	S3CredentialProfileName *string
@@ -84,24 +190,39 @@ type Configuration struct {
 	BundleSendTimeout   time.Duration
 	BundleSizeMax       int64
 
-	// Compress data on S3 or file output types
-	FileHandlerCompressData bool
-
 	TLSConfig *tls.Config
 
-	// optional post processing of feed hits to retrieve titles
-	PerformFeedPostprocessing bool
-	CbAPIToken                string
-	CbAPIVerifySSL            bool
-	CbAPIProxyUrl             string
-
 	// Kafka-specific configuration
-	KafkaBrokers     *string
-	KafkaTopicSuffix *string
+	KafkaBrokers       *string
+	KafkaTopicSuffix   *string
+	KafkaTopicTemplate *template.Template
+	KafkaPartitionKey  string
+	KafkaUseTLS        bool
+	KafkaSASLMechanism string
+	KafkaSASLUsername  string
+	KafkaSASLPassword  string
+	KafkaRequiredAcks  sarama.RequiredAcks
+	KafkaIdempotent    bool
+	KafkaCompression   sarama.CompressionCodec
+	KafkaVersion       sarama.KafkaVersion
+	KafkaRetryMax      int
+	KafkaRetryBackoff  time.Duration
+	KafkaResendMax     int
 
 	//Splunkd
 	SplunkToken *string
-	AuditLog    bool
+
+	// Elasticsearch-specific configuration
+	ElasticsearchIndexTemplate *template.Template
+	ElasticsearchUsername      string
+	ElasticsearchPassword      string
+	ElasticsearchAPIKey        string
+	ElasticsearchBulkMaxEvents int
+
+	// on-disk spool for network outputs (tcp, udp, syslog) while the destination is unreachable
+	SpoolDirectory   string
+	SpoolSegmentSize int64
+	SpoolMaxSize     int64
 }
 
 type ConfigurationError struct {
@@ -117,6 +238,16 @@ func (c *Configuration) AMQPURL() string {
 	}
 }
 
+// HasOutputType returns true if any of the configured outputs is of the given type.
+func (c *Configuration) HasOutputType(outputType int) bool {
+	for _, output := range c.Outputs {
+		if output.OutputType == outputType {
+			return true
+		}
+	}
+	return false
+}
+
 func (e ConfigurationError) Error() string {
 	return fmt.Sprintf("Configuration errors:\n %s", strings.Join(e.Errors, "\n "))
 }
@@ -174,6 +305,9 @@ func (c *Configuration) parseEventTypes(input ini.File) {
 			"ingress.event.remotethread",
 			"ingress.event.processblock",
 			"ingress.event.emetmitigation",
+			"ingress.event.processmeta",
+			"ingress.event.stats",
+			"ingress.event.vtwrite",
 		}},
 		{"events_binary_observed", []string{
 			"binaryinfo.#",
@@ -224,31 +358,454 @@ func (c *Configuration) parseMonitoredLogs(input ini.File) {
 	}
 }
 
+// parseFilterRules reads the [filter:<name>] sections. Each rule names a field and exactly one way to match it:
+// glob, values (a list), cidr or regex.
+func (c *Configuration) parseFilterRules(input ini.File, errs *ConfigurationError) {
+	filterSections := make([]string, 0)
+	for section := range input {
+		if strings.HasPrefix(section, "filter:") {
+			filterSections = append(filterSections, section)
+		}
+	}
+	sort.Strings(filterSections)
+
+	for _, section := range filterSections {
+		rule := &FilterRule{Name: strings.TrimSpace(strings.TrimPrefix(section, "filter:"))}
+
+		action, _ := input.Get(section, "action")
+		switch strings.ToLower(strings.TrimSpace(action)) {
+		case "include":
+			rule.Action = FilterInclude
+		case "exclude":
+			rule.Action = FilterExclude
+		default:
+			errs.addErrorString(fmt.Sprintf("[%s] Unknown value for 'action': valid values are include, exclude", section))
+			continue
+		}
+
+		field, ok := input.Get(section, "field")
+		if !ok || len(strings.TrimSpace(field)) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] Missing value for key field", section))
+			continue
+		}
+		rule.Field = strings.TrimSpace(field)
+
+		val, ok := input.Get(section, "event_types")
+		if ok {
+			rule.EventTypes = splitFilterValues(val)
+		}
+
+		ignoreCase := false
+		val, ok = input.Get(section, "ignore_case")
+		if ok {
+			b, err := strconv.ParseBool(val)
+			if err == nil {
+				ignoreCase = b
+			} else {
+				errs.addErrorString(fmt.Sprintf("[%s] Unknown value for 'ignore_case': valid values are true, false, 1, 0", section))
+			}
+		}
+
+		matchers := 0
+		var err error
+		if val, ok := input.Get(section, "glob"); ok {
+			matchers++
+			rule.matcher, err = newGlobMatcher(val, ignoreCase)
+		}
+		if val, ok := input.Get(section, "values"); ok {
+			matchers++
+			rule.matcher, err = newValuesMatcher(val, ignoreCase)
+		}
+		if val, ok := input.Get(section, "cidr"); ok {
+			matchers++
+			rule.matcher, err = newCIDRMatcher(val)
+		}
+		if val, ok := input.Get(section, "regex"); ok {
+			matchers++
+			rule.matcher, err = newRegexpMatcher(val, ignoreCase)
+		}
+
+		if matchers != 1 {
+			errs.addErrorString(fmt.Sprintf("[%s] Exactly one of glob, values, cidr or regex is required", section))
+			continue
+		}
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("[%s] Invalid filter: %s", section, err))
+			continue
+		}
+
+		c.FilterRules = append(c.FilterRules, rule)
+	}
+}
+
+// parseTransforms reads the [transform:<name>] sections, which are applied in the order of their names.
+func (c *Configuration) parseTransforms(input ini.File, errs *ConfigurationError) {
+	transformSections := make([]string, 0)
+	for section := range input {
+		if strings.HasPrefix(section, "transform:") {
+			transformSections = append(transformSections, section)
+		}
+	}
+	sort.Strings(transformSections)
+
+	for _, section := range transformSections {
+		transform := &Transform{Name: strings.TrimSpace(strings.TrimPrefix(section, "transform:"))}
+
+		operation, _ := input.Get(section, "operation")
+		operationType, ok := transformOperations[strings.ToLower(strings.TrimSpace(operation))]
+		if !ok {
+			errs.addErrorString(fmt.Sprintf("[%s] Unknown value for 'operation': valid values are rename, delete, add, "+
+				"copy, lowercase, uppercase, hash", section))
+			continue
+		}
+		transform.Operation = operationType
+
+		val, _ := input.Get(section, "field")
+		transform.Fields = splitFilterValues(val)
+		if len(transform.Fields) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] Missing value for key field", section))
+			continue
+		}
+
+		val, ok = input.Get(section, "event_types")
+		if ok {
+			transform.EventTypes = splitFilterValues(val)
+		}
+
+		switch transform.Operation {
+		case TransformRename, TransformCopy:
+			if len(transform.Fields) != 1 {
+				errs.addErrorString(fmt.Sprintf("[%s] %s takes a single field", section, operation))
+				continue
+			}
+			val, ok = input.Get(section, "to")
+			if !ok || len(strings.TrimSpace(val)) == 0 {
+				errs.addErrorString(fmt.Sprintf("[%s] Missing value for key to, required by %s", section, operation))
+				continue
+			}
+			transform.Target = strings.TrimSpace(val)
+		case TransformAdd:
+			val, ok = input.Get(section, "value")
+			if !ok {
+				errs.addErrorString(fmt.Sprintf("[%s] Missing value for key value, required by add", section))
+				continue
+			}
+			transform.Value = val
+		}
+
+		c.Transforms = append(c.Transforms, transform)
+	}
+}
+
+// parseCapture reads the optional [capture] section. Without routing_keys or sample_rate every delivery is
+// captured.
+func (c *Configuration) parseCapture(input ini.File, errs *ConfigurationError) {
+	val, ok := input.Get("capture", "directory")
+	if !ok || len(strings.TrimSpace(val)) == 0 {
+		return
+	}
+	c.CaptureDirectory = strings.TrimSpace(val)
+
+	c.CaptureSampleRate = 0
+	c.CaptureMaxDirectorySize = 100 * 1024 * 1024
+	c.CaptureMaxDirectories = 10
+
+	val, ok = input.Get("capture", "routing_keys")
+	if ok {
+		c.CaptureRoutingKeys = splitFilterValues(val)
+	}
+
+	val, ok = input.Get("capture", "sample_rate")
+	if ok {
+		rate, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || rate < 0 {
+			errs.addErrorString("[capture] Invalid value for 'sample_rate': must be 0 or a positive integer")
+		} else {
+			c.CaptureSampleRate = rate
+		}
+	} else if len(c.CaptureRoutingKeys) == 0 {
+		c.CaptureSampleRate = 1
+	}
+
+	val, ok = input.Get("capture", "max_directory_size")
+	if ok {
+		size, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		if err != nil || size <= 0 {
+			errs.addErrorString("[capture] Invalid value for 'max_directory_size': must be a positive number of bytes")
+		} else {
+			c.CaptureMaxDirectorySize = size
+		}
+	}
+
+	val, ok = input.Get("capture", "max_directories")
+	if ok {
+		count, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || count <= 0 {
+			errs.addErrorString("[capture] Invalid value for 'max_directories': must be a positive integer")
+		} else {
+			c.CaptureMaxDirectories = count
+		}
+	}
+}
+
+// parseRateLimit reads the [rate_limit] section.
+func (c *Configuration) parseRateLimit(input ini.File, errs *ConfigurationError) {
+	val, ok := input.Get("rate_limit", "events_per_second")
+	if !ok || len(strings.TrimSpace(val)) == 0 {
+		return
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil || rate <= 0 {
+		errs.addErrorString("[rate_limit] Invalid value for 'events_per_second': must be a positive number")
+		return
+	}
+	c.RateLimit = rate
+
+	// by default allow a minute's worth of events at once
+	c.RateLimitBurst = int(rate * 60)
+	c.RateLimitSummaryInterval = 60 * time.Second
+
+	val, ok = input.Get("rate_limit", "burst")
+	if ok {
+		burst, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || burst <= 0 {
+			errs.addErrorString("[rate_limit] Invalid value for 'burst': must be a positive integer")
+		} else {
+			c.RateLimitBurst = burst
+		}
+	}
+	if c.RateLimitBurst < 1 {
+		c.RateLimitBurst = 1
+	}
+
+	val, ok = input.Get("rate_limit", "per_event_type")
+	if ok {
+		b, err := strconv.ParseBool(strings.TrimSpace(val))
+		if err != nil {
+			errs.addErrorString("[rate_limit] Unknown value for 'per_event_type': valid values are true, false, 1, 0")
+		} else {
+			c.RateLimitByEventType = b
+		}
+	}
+
+	val, ok = input.Get("rate_limit", "event_types")
+	if ok {
+		c.RateLimitEventTypes = splitFilterValues(val)
+	}
+
+	val, ok = input.Get("rate_limit", "summary_interval")
+	if ok {
+		seconds, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || seconds <= 0 {
+			errs.addErrorString("[rate_limit] Invalid value for 'summary_interval': must be a positive number of seconds")
+		} else {
+			c.RateLimitSummaryInterval = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
+// parseDedup reads the [dedup] section and the [dedup:<name>] rules. Without any rules, repeated module loads and
+// network connections are deduplicated.
+func (c *Configuration) parseDedup(input ini.File, errs *ConfigurationError) {
+	val, ok := input.Get("dedup", "window")
+	if !ok || len(strings.TrimSpace(val)) == 0 {
+		return
+	}
+
+	seconds, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || seconds <= 0 {
+		errs.addErrorString("[dedup] Invalid value for 'window': must be a positive number of seconds")
+		return
+	}
+	c.DedupWindow = time.Duration(seconds) * time.Second
+	c.DedupAction = DedupDrop
+	c.DedupMaxEntries = 100000
+
+	val, ok = input.Get("dedup", "action")
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "drop":
+			c.DedupAction = DedupDrop
+		case "count":
+			c.DedupAction = DedupCount
+		default:
+			errs.addErrorString("[dedup] Unknown value for 'action': valid values are drop, count")
+		}
+	}
+
+	val, ok = input.Get("dedup", "max_entries")
+	if ok {
+		entries, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || entries <= 0 {
+			errs.addErrorString("[dedup] Invalid value for 'max_entries': must be a positive integer")
+		} else {
+			c.DedupMaxEntries = entries
+		}
+	}
+
+	ruleSections := make([]string, 0)
+	for section := range input {
+		if strings.HasPrefix(section, "dedup:") {
+			ruleSections = append(ruleSections, section)
+		}
+	}
+	sort.Strings(ruleSections)
+
+	for _, section := range ruleSections {
+		rule := &DedupRule{Name: strings.TrimSpace(strings.TrimPrefix(section, "dedup:"))}
+
+		val, _ := input.Get(section, "event_types")
+		rule.EventTypes = splitFilterValues(val)
+		if len(rule.EventTypes) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] Missing value for key event_types", section))
+			continue
+		}
+
+		val, _ = input.Get(section, "fields")
+		rule.Fields = splitFilterValues(val)
+		if len(rule.Fields) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] Missing value for key fields", section))
+			continue
+		}
+
+		c.DedupRules = append(c.DedupRules, rule)
+	}
+
+	if len(ruleSections) == 0 {
+		c.DedupRules = defaultDedupRules()
+	}
+}
+
+// parseEnrichment reads the [enrichment] section. Enrichment is part of post processing, so it needs api_token.
+func (c *Configuration) parseEnrichment(input ini.File, errs *ConfigurationError) {
+	val, ok := input.Get("enrichment", "enabled")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(val))
+	if err != nil {
+		errs.addErrorString("[enrichment] Unknown value for 'enabled': valid values are true, false, 1, 0")
+		return
+	}
+	if !enabled {
+		return
+	}
+	if !c.PerformFeedPostprocessing {
+		errs.addErrorString("[enrichment] Enrichment queries the Cb API; set api_token in [bridge]")
+		return
+	}
+
+	c.EnrichmentEnabled = true
+	c.EnrichmentEventTypes = []string{"watchlist.#", "feed.#", "alert.#"}
+	c.EnrichmentCacheTTL = 5 * time.Minute
+	c.EnrichmentCacheSize = 10000
+	c.EnrichmentMaxConcurrent = 8
+	c.EnrichmentTimeout = 5 * time.Second
+
+	val, ok = input.Get("enrichment", "event_types")
+	if ok {
+		c.EnrichmentEventTypes = splitFilterValues(val)
+	}
+
+	val, ok = input.Get("enrichment", "cache_ttl")
+	if ok {
+		seconds, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || seconds <= 0 {
+			errs.addErrorString("[enrichment] Invalid value for 'cache_ttl': must be a positive number of seconds")
+		} else {
+			c.EnrichmentCacheTTL = time.Duration(seconds) * time.Second
+		}
+	}
+
+	val, ok = input.Get("enrichment", "cache_size")
+	if ok {
+		size, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || size <= 0 {
+			errs.addErrorString("[enrichment] Invalid value for 'cache_size': must be a positive integer")
+		} else {
+			c.EnrichmentCacheSize = size
+		}
+	}
+
+	val, ok = input.Get("enrichment", "max_concurrent")
+	if ok {
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || n <= 0 {
+			errs.addErrorString("[enrichment] Invalid value for 'max_concurrent': must be a positive integer")
+		} else {
+			c.EnrichmentMaxConcurrent = n
+		}
+	}
+
+	val, ok = input.Get("enrichment", "timeout_ms")
+	if ok {
+		ms, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || ms <= 0 {
+			errs.addErrorString("[enrichment] Invalid value for 'timeout_ms': must be a positive number of milliseconds")
+		} else {
+			c.EnrichmentTimeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+// parseProcessTable reads the [process_table] section.
+func (c *Configuration) parseProcessTable(input ini.File, errs *ConfigurationError) {
+	val, ok := input.Get("process_table", "enabled")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(val))
+	if err != nil {
+		errs.addErrorString("[process_table] Unknown value for 'enabled': valid values are true, false, 1, 0")
+		return
+	}
+	if !enabled {
+		return
+	}
+	c.ProcessTableEnabled = true
+	c.ProcessTableSize = 100000
+
+	val, ok = input.Get("process_table", "max_processes")
+	if ok {
+		size, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || size <= 0 {
+			errs.addErrorString("[process_table] Invalid value for 'max_processes': must be a positive integer")
+		} else {
+			c.ProcessTableSize = size
+		}
+	}
+
+	val, ok = input.Get("process_table", "ttl")
+	if ok {
+		seconds, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || seconds < 0 {
+			errs.addErrorString("[process_table] Invalid value for 'ttl': must be a number of seconds")
+		} else {
+			c.ProcessTableTTL = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
 func ParseConfig(fn string) (Configuration, error) {
 	config := Configuration{}
 	errs := ConfigurationError{Empty: true}
 
-	input, err := ini.LoadFile(fn)
+	input, err := loadConfigFile(fn)
 	if err != nil {
 		return config, err
 	}
 
 	// defaults
 	config.DebugFlag = false
-	config.OutputFormat = JSONOutputFormat
-	config.OutputType = FileOutputType
 	config.AMQPDisabled = false
 	config.AMQPHostname = "localhost"
 	config.AMQPUsername = "cb"
 	config.HTTPServerPort = 33706
 	config.AMQPPort = 5004
 	config.DebugStore = "/tmp"
-
-	config.S3ACLPolicy = nil
-	config.S3ServerSideEncryption = nil
-	config.S3CredentialProfileName = nil
-	config.S3StorageClass = nil
 	config.AMQPAutoDeleteQueue = true
+	config.ShutdownTimeout = 30 * time.Second
 
 	// required values
 	val, ok := input.Get("bridge", "server_name")
@@ -290,6 +847,16 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
+	val, ok = input.Get("bridge", "shutdown_timeout")
+	if ok {
+		seconds, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || seconds < 0 {
+			errs.addErrorString("Invalid value for 'shutdown_timeout': must be a number of seconds")
+		} else {
+			config.ShutdownTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
 	val, ok = input.Get("bridge", "rabbit_mq_disabled")
 	if ok {
 	   b, err := strconv.ParseBool(val)
@@ -298,6 +865,30 @@ func ParseConfig(fn string) (Configuration, error) {
 	   }
 	}
 
+	val, ok = input.Get("bridge", "input_type")
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "amqp":
+			config.InputType = AMQPInputType
+		case "directory":
+			config.InputType = DirectoryInputType
+		default:
+			errs.addErrorString("Unknown value for 'input_type': valid values are amqp, directory")
+		}
+	}
+
+	if config.InputType == DirectoryInputType {
+		val, ok = input.Get("bridge", "input_directory")
+		if !ok {
+			errs.addErrorString("Missing value for key input_directory, required by input_type directory")
+		} else {
+			config.InputDirectory = val
+		}
+
+		// deliveries are read from disk, so there is no broker to connect to
+		config.AMQPDisabled = true
+	}
+
 	if !config.AMQPDisabled {
 	   val, ok = input.Get("bridge", "rabbit_mq_username")
 	   if ok {
@@ -368,6 +959,59 @@ func ParseConfig(fn string) (Configuration, error) {
 	   }
 	}
 
+	val, ok = input.Get("bridge", "delivery_mode")
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "at_least_once":
+			config.AtLeastOnceDelivery = true
+		case "at_most_once":
+			config.AtLeastOnceDelivery = false
+		default:
+			errs.addErrorString("Unknown value for 'delivery_mode': valid values are at_most_once, at_least_once")
+		}
+	}
+
+	// bound the number of unacknowledged deliveries held in memory when acknowledging manually
+	if config.AtLeastOnceDelivery {
+		config.AMQPPrefetchCount = 100
+	}
+	val, ok = input.Get("bridge", "rabbit_mq_prefetch_count")
+	if ok {
+		prefetch, err := strconv.Atoi(val)
+		if err == nil && prefetch >= 0 {
+			config.AMQPPrefetchCount = prefetch
+		} else {
+			errs.addErrorString("Unknown value for 'rabbit_mq_prefetch_count': must be a non-negative integer")
+		}
+	}
+
+	if config.AtLeastOnceDelivery && config.AMQPAutoDeleteQueue {
+		log.Warn("delivery_mode is at_least_once but rabbit_mq_auto_delete_queue is true; events queued while the")
+		log.Warn("forwarder is stopped will be lost when the queue is deleted.")
+	}
+
+	config.MessageProcessorCount = runtime.NumCPU() * 2
+	val, ok = input.Get("bridge", "message_processor_count")
+	if ok {
+		count, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || count <= 0 {
+			errs.addErrorString("Invalid value for 'message_processor_count': must be a positive integer")
+		} else {
+			config.MessageProcessorCount = count
+		}
+	}
+
+	config.OutputQueueSize = 100
+	val, ok = input.Get("bridge", "output_queue_size")
+	if ok {
+		size, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || size < 0 {
+			errs.addErrorString("Invalid value for 'output_queue_size': must be 0 or a positive integer")
+		} else {
+			config.OutputQueueSize = size
+		}
+	}
+
 	val, ok = input.Get("bridge", "cb_server_url")
 	if ok {
 		if !strings.HasSuffix(val, "/") {
@@ -376,13 +1020,11 @@ func ParseConfig(fn string) (Configuration, error) {
 		config.CbServerURL = val
 	}
 
+	// the output_format in [bridge] is the default for every output
+	defaultOutputFormat := JSONOutputFormat
 	val, ok = input.Get("bridge", "output_format")
 	if ok {
-		val = strings.TrimSpace(val)
-		val = strings.ToLower(val)
-		if val == "leef" {
-			config.OutputFormat = LEEFOutputFormat
-		}
+		defaultOutputFormat = parseOutputFormat(val)
 	}
 
 	config.FileHandlerCompressData = false
@@ -404,290 +1046,688 @@ func ParseConfig(fn string) (Configuration, error) {
 	}
 
 	outType, ok := input.Get("bridge", "output_type")
-	var parameterKey string
 	if ok {
-		outType = strings.TrimSpace(outType)
-		outType = strings.ToLower(outType)
-
-		switch outType {
-		case "file":
-			parameterKey = "outfile"
-			config.OutputType = FileOutputType
-		case "tcp":
-			parameterKey = "tcpout"
-			config.OutputType = TCPOutputType
-		case "udp":
-			parameterKey = "udpout"
-			config.OutputType = UDPOutputType
-		case "s3":
-			parameterKey = "s3out"
-			config.OutputType = S3OutputType
-
-			profileName, ok := input.Get("s3", "credential_profile")
-			if ok {
-				config.S3CredentialProfileName = &profileName
-			}
+		output := parseOutputConfiguration(input, "default", "bridge", outType, defaultOutputFormat, &errs)
+		config.Outputs = append(config.Outputs, output)
+	}
 
-			aclPolicy, ok := input.Get("s3", "acl_policy")
-			if ok {
-				config.S3ACLPolicy = &aclPolicy
-			}
+	// additional outputs are configured in their own [output:<name>] sections
+	outputSections := make([]string, 0)
+	for section := range input {
+		if strings.HasPrefix(section, "output:") {
+			outputSections = append(outputSections, section)
+		}
+	}
+	sort.Strings(outputSections)
 
-			storageClass, ok := input.Get("s3", "storage_class")
-			if ok {
-				config.S3StorageClass = &storageClass
-				log.Println("Set storage class: ", storageClass)
-			} else {
-				log.Println("Unable to set storage class: ", storageClass)
-			}
+	for _, section := range outputSections {
+		name := strings.TrimSpace(strings.TrimPrefix(section, "output:"))
+		outType, ok := input.Get(section, "output_type")
+		if !ok {
+			errs.addErrorString(fmt.Sprintf("Missing output_type in section [%s]", section))
+			continue
+		}
+		output := parseOutputConfiguration(input, name, section, outType, defaultOutputFormat, &errs)
+		config.Outputs = append(config.Outputs, output)
+	}
 
-			sseType, ok := input.Get("s3", "server_side_encryption")
-			if ok {
-				config.S3ServerSideEncryption = &sseType
-			}
+	if len(config.Outputs) == 0 {
+		errs.addErrorString("No output type specified")
+		return config, errs
+	}
 
-			objectPrefix, ok := input.Get("s3", "object_prefix")
-			if ok {
-				config.S3ObjectPrefix = &objectPrefix
-			}
+	config.EventOrdering = UnorderedEvents
+	val, ok = input.Get("bridge", "event_ordering")
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "none":
+			config.EventOrdering = UnorderedEvents
+		case "sensor":
+			config.EventOrdering = SensorOrderedEvents
+		default:
+			errs.addErrorString("Unknown value for 'event_ordering': valid values are none, sensor")
+		}
+	}
 
-			val, ok = input.Get("s3", "verbose_key")
-			if ok {
-				b, err := strconv.ParseBool(val)
-				if err == nil {
-					config.S3VerboseKey = b
-				}
-			}
+	// the Kafka output can take more than a single consumer delivers, so it gets one per two cores by default;
+	// consumers share the queue between them, so events are only kept in order with a single consumer
+	config.AMQPConsumerCount = 1
+	if runtime.NumCPU() > 1 && config.HasOutputType(KafkaOutputType) && config.EventOrdering == UnorderedEvents {
+		config.AMQPConsumerCount = runtime.NumCPU() / 2
+	}
+	val, ok = input.Get("bridge", "rabbit_mq_consumer_count")
+	if ok {
+		count, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || count <= 0 {
+			errs.addErrorString("Invalid value for 'rabbit_mq_consumer_count': must be a positive integer")
+		} else {
+			config.AMQPConsumerCount = count
+		}
+	}
+	if config.EventOrdering == SensorOrderedEvents && config.AMQPConsumerCount > 1 {
+		log.Warn("event_ordering is sensor but rabbit_mq_consumer_count is more than 1; events from a sensor may")
+		log.Warn("still be sent out of order when its deliveries are taken by different consumers.")
+	}
 
-			val, ok = input.Get("s3", "compress_data")
-			if ok {
-				b, err := strconv.ParseBool(val)
-				if err == nil {
-					config.S3CompressData = b
-				}
-			} else {
-				config.S3CompressData = true
+	val, ok = input.Get("bridge", "use_raw_sensor_exchange")
+	if ok {
+		boolval, err := strconv.ParseBool(val)
+		if err == nil {
+			config.UseRawSensorExchange = boolval
+			if boolval {
+				log.Warn("Configured to listen on the Carbon Black Enterprise Response raw sensor event feed.")
+				log.Warn("- This will result in a *large* number of messages output via the event forwarder!")
+				log.Warn("- Ensure that raw sensor events are enabled in your Cb server (master & minion) via")
+				log.Warn("  the 'EnableRawSensorDataBroadcast' variable in /etc/cb/cb.conf")
 			}
-		case "http":
-			parameterKey = "httpout"
-			config.OutputType = HttpOutputType
+		} else {
+			errs.addErrorString("Unknown value for 'use_raw_sensor_exchange': valid values are true, false, 1, 0")
+		}
+	}
 
-			token, ok := input.Get("http", "authorization_token")
-			if ok {
-				config.HttpAuthorizationToken = &token
-			}
+	val, ok = input.Get("bridge", "api_verify_ssl")
+	if ok {
+		config.CbAPIVerifySSL, err = strconv.ParseBool(val)
+		if err != nil {
+			errs.addErrorString("Unknown value for 'api_verify_ssl': valid values are true, false, 1, 0. Default is 'false'")
+		}
+	}
+	val, ok = input.Get("bridge", "api_token")
+	if ok {
+		config.CbAPIToken = val
+		config.PerformFeedPostprocessing = true
+	}
 
-			postTemplate, ok := input.Get("http", "http_post_template")
-			config.HttpPostTemplate = template.New("http_post_output")
-			if ok {
-				config.HttpPostTemplate = template.Must(config.HttpPostTemplate.Parse(postTemplate))
-			} else {
-				if config.OutputFormat == JSONOutputFormat {
-					config.HttpPostTemplate = template.Must(config.HttpPostTemplate.Parse(
-						`{"filename": "{{.FileName}}", "service": "carbonblack", "alerts":[{{range .Events}}{{.EventText}}{{end}}]}`))
-				} else {
-					config.HttpPostTemplate = template.Must(config.HttpPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
+	config.CbAPIProxyUrl = ""
+	val, ok = input.Get("bridge", "api_proxy_url")
+	if ok {
+		config.CbAPIProxyUrl = val
+	}
+
+	config.PostprocessWorkers = 8
+	val, ok = input.Get("bridge", "postprocess_workers")
+	if ok {
+		workers, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || workers <= 0 {
+			errs.addErrorString("Invalid value for 'postprocess_workers': must be a positive integer")
+		} else {
+			config.PostprocessWorkers = workers
+		}
+	}
+
+	config.PostprocessQueueSize = 1000
+	val, ok = input.Get("bridge", "postprocess_queue_size")
+	if ok {
+		size, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || size < 0 {
+			errs.addErrorString("Invalid value for 'postprocess_queue_size': must be 0 or a positive integer")
+		} else {
+			config.PostprocessQueueSize = size
+		}
+	}
+
+	config.parseEventTypes(input)
+
+	config.parseMonitoredLogs(input)
+
+	config.parseFilterRules(input, &errs)
+
+	config.parseTransforms(input, &errs)
+
+	config.parseCapture(input, &errs)
+
+	config.parseRateLimit(input, &errs)
+
+	config.parseDedup(input, &errs)
+
+	config.parseEnrichment(input, &errs)
+
+	config.parseProcessTable(input, &errs)
+
+	if !errs.Empty {
+		return config, errs
+	} else {
+		return config, nil
+	}
+}
+
+func parseOutputFormat(val string) int {
+	val = strings.TrimSpace(val)
+	val = strings.ToLower(val)
+	switch val {
+	case "leef":
+		return LEEFOutputFormat
+	case "cef":
+		return CEFOutputFormat
+	}
+	return JSONOutputFormat
+}
+
+// parseOutputConfiguration reads the settings for a single output. For the legacy output configured in [bridge],
+// the type-specific options are read from the section named after the output type ([s3], [http], ...); named
+// outputs keep all of their options in their own [output:<name>] section.
+func parseOutputConfiguration(input ini.File, name, section, outType string, defaultFormat int,
+	errs *ConfigurationError) *OutputConfiguration {
+	output := &OutputConfiguration{Name: name, OutputFormat: defaultFormat}
+	signatureSections := []string{section}
+
+	outType = strings.TrimSpace(outType)
+	outType = strings.ToLower(outType)
+	output.OutputTypeName = outType
+
+	legacy := section == "bridge"
+	optionSection := section
+	errorPrefix := fmt.Sprintf("[%s] ", section)
+	if legacy {
+		optionSection = outType
+		errorPrefix = ""
+	} else {
+		val, ok := input.Get(section, "output_format")
+		if ok {
+			output.OutputFormat = parseOutputFormat(val)
+		}
+
+		val, ok = input.Get(section, "event_types")
+		if ok {
+			for _, routingKey := range strings.Split(val, ",") {
+				routingKey = strings.TrimSpace(routingKey)
+				if len(routingKey) > 0 {
+					output.EventTypes = append(output.EventTypes, routingKey)
 				}
 			}
+		}
+	}
 
-			contentType, ok := input.Get("http", "content_type")
-			if ok {
-				config.HttpContentType = &contentType
-			} else {
-				jsonString := "application/json"
-				config.HttpContentType = &jsonString
-			}
-		case "syslog":
-			parameterKey = "syslogout"
-			config.OutputType = SyslogOutputType
-		case "kafka":
-			config.OutputType = KafkaOutputType
-
-			kafkaBrokers, ok := input.Get("kafka", "brokers")
-			if ok {
-				config.KafkaBrokers = &kafkaBrokers
-			}
+	var parameterKey string
+
+	switch outType {
+	case "file":
+		parameterKey = "outfile"
+		output.OutputType = FileOutputType
+	case "tcp":
+		parameterKey = "tcpout"
+		output.OutputType = TCPOutputType
+	case "udp":
+		parameterKey = "udpout"
+		output.OutputType = UDPOutputType
+	case "s3":
+		parameterKey = "s3out"
+		output.OutputType = S3OutputType
+
+		profileName, ok := input.Get(optionSection, "credential_profile")
+		if ok {
+			output.S3CredentialProfileName = &profileName
+		}
+
+		aclPolicy, ok := input.Get(optionSection, "acl_policy")
+		if ok {
+			output.S3ACLPolicy = &aclPolicy
+		}
+
+		storageClass, ok := input.Get(optionSection, "storage_class")
+		if ok {
+			output.S3StorageClass = &storageClass
+			log.Println("Set storage class: ", storageClass)
+		} else {
+			log.Println("Unable to set storage class: ", storageClass)
+		}
+
+		sseType, ok := input.Get(optionSection, "server_side_encryption")
+		if ok {
+			output.S3ServerSideEncryption = &sseType
+		}
+
+		objectPrefix, ok := input.Get(optionSection, "object_prefix")
+		if ok {
+			output.S3ObjectPrefix = &objectPrefix
+		}
 
-			kafkaTopicSuffix, ok := input.Get("kafka", "topic_suffix")
-			if ok {
-				config.KafkaTopicSuffix = &kafkaTopicSuffix
+		val, ok := input.Get(optionSection, "verbose_key")
+		if ok {
+			b, err := strconv.ParseBool(val)
+			if err == nil {
+				output.S3VerboseKey = b
 			}
-		case "splunk":
-			parameterKey = "splunkout"
-			config.OutputType = SplunkOutputType
+		}
 
-			token, ok := input.Get("splunk", "hec_token")
-			if ok {
-				config.SplunkToken = &token
+		val, ok = input.Get(optionSection, "compress_data")
+		if ok {
+			b, err := strconv.ParseBool(val)
+			if err == nil {
+				output.S3CompressData = b
 			}
+		} else {
+			output.S3CompressData = true
+		}
+	case "http":
+		parameterKey = "httpout"
+		output.OutputType = HttpOutputType
 
-			postTemplate, ok := input.Get("splunk", "http_post_template")
-			config.HttpPostTemplate = template.New("http_post_output")
-			if ok {
-				config.HttpPostTemplate = template.Must(config.HttpPostTemplate.Parse(postTemplate))
+		token, ok := input.Get(optionSection, "authorization_token")
+		if ok {
+			output.HttpAuthorizationToken = &token
+		}
+
+		postTemplate, ok := input.Get(optionSection, "http_post_template")
+		output.HttpPostTemplate = template.New("http_post_output")
+		if ok {
+			output.HttpPostTemplate = template.Must(output.HttpPostTemplate.Parse(postTemplate))
+		} else {
+			if output.OutputFormat == JSONOutputFormat {
+				output.HttpPostTemplate = template.Must(output.HttpPostTemplate.Parse(
+					`{"filename": "{{.FileName}}", "service": "carbonblack", "alerts":[{{range .Events}}{{.EventText}}{{end}}]}`))
 			} else {
-				if config.OutputFormat == JSONOutputFormat {
-					config.HttpPostTemplate = template.Must(config.HttpPostTemplate.Parse(
-						`{{range .Events}}{"sourcetype":"bit9:carbonblack:json","event":{{.EventText}}}{{end}}`))
-				} else {
-					config.HttpPostTemplate = template.Must(config.HttpPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
-				}
+				output.HttpPostTemplate = template.Must(output.HttpPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
 			}
+		}
+
+		contentType, ok := input.Get(optionSection, "content_type")
+		if ok {
+			output.HttpContentType = &contentType
+		} else {
+			jsonString := "application/json"
+			output.HttpContentType = &jsonString
+		}
+	case "syslog":
+		parameterKey = "syslogout"
+		output.OutputType = SyslogOutputType
+	case "kafka":
+		output.OutputType = KafkaOutputType
+
+		kafkaBrokers, ok := input.Get(optionSection, "brokers")
+		if ok {
+			output.KafkaBrokers = &kafkaBrokers
+		} else {
+			errs.addErrorString(errorPrefix + "Missing value for key brokers, required by output type kafka")
+		}
+
+		kafkaTopicSuffix, _ := input.Get(optionSection, "topic_suffix")
+		output.KafkaTopicSuffix = &kafkaTopicSuffix
 
-			contentType, ok := input.Get("http", "content_type")
-			if ok {
-				config.HttpContentType = &contentType
+		parseKafkaConfiguration(input, optionSection, errorPrefix, output, errs)
+	case "splunk":
+		parameterKey = "splunkout"
+		output.OutputType = SplunkOutputType
+
+		token, ok := input.Get(optionSection, "hec_token")
+		if ok {
+			output.SplunkToken = &token
+		}
+
+		postTemplate, ok := input.Get(optionSection, "http_post_template")
+		output.HttpPostTemplate = template.New("http_post_output")
+		if ok {
+			output.HttpPostTemplate = template.Must(output.HttpPostTemplate.Parse(postTemplate))
+		} else {
+			if output.OutputFormat == JSONOutputFormat {
+				output.HttpPostTemplate = template.Must(output.HttpPostTemplate.Parse(
+					`{{range .Events}}{"sourcetype":"bit9:carbonblack:json","event":{{.EventText}}}{{end}}`))
 			} else {
-				jsonString := "application/json"
-				config.HttpContentType = &jsonString
+				output.HttpPostTemplate = template.Must(output.HttpPostTemplate.Parse(`{{range .Events}}{{.EventText}}{{end}}`))
 			}
+		}
 
-		default:
-			errs.addErrorString(fmt.Sprintf("Unknown output type: %s", outType))
+		// the legacy splunk output has always read its content_type from the [http] section
+		contentTypeSection := optionSection
+		if legacy {
+			contentTypeSection = "http"
+			signatureSections = append(signatureSections, contentTypeSection)
+		}
+		contentType, ok := input.Get(contentTypeSection, "content_type")
+		if ok {
+			output.HttpContentType = &contentType
+		} else {
+			jsonString := "application/json"
+			output.HttpContentType = &jsonString
 		}
-	} else {
-		errs.addErrorString("No output type specified")
-		return config, errs
-	}
 
-	if len(parameterKey) > 0 {
-		val, ok = input.Get("bridge", parameterKey)
+	case "elasticsearch":
+		parameterKey = "elasticsearchout"
+		output.OutputType = ElasticsearchOutputType
+
+		if output.OutputFormat != JSONOutputFormat {
+			errs.addErrorString(errorPrefix + "The elasticsearch output requires output_format=json")
+		}
+
+		indexTemplate, ok := input.Get(optionSection, "index")
 		if !ok {
-			errs.addErrorString(fmt.Sprintf("Missing value for key %s, required by output type %s",
-				parameterKey, outType))
+			indexTemplate = `cb-event-forwarder-{{.Time.Format "2006.01.02"}}`
+		}
+		t, err := template.New("elasticsearch_index").Option("missingkey=error").Parse(indexTemplate)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("%sCould not parse 'index': %s", errorPrefix, err))
 		} else {
-			config.OutputParameters = val
+			output.ElasticsearchIndexTemplate = t
 		}
-	}
 
-	val, ok = input.Get("bridge", "use_raw_sensor_exchange")
-	if ok {
-		boolval, err := strconv.ParseBool(val)
-		if err == nil {
-			config.UseRawSensorExchange = boolval
-			if boolval {
-				log.Warn("Configured to listen on the Carbon Black Enterprise Response raw sensor event feed.")
-				log.Warn("- This will result in a *large* number of messages output via the event forwarder!")
-				log.Warn("- Ensure that raw sensor events are enabled in your Cb server (master & minion) via")
-				log.Warn("  the 'EnableRawSensorDataBroadcast' variable in /etc/cb/cb.conf")
+		output.ElasticsearchUsername, _ = input.Get(optionSection, "username")
+		output.ElasticsearchPassword, _ = input.Get(optionSection, "password")
+		output.ElasticsearchAPIKey, _ = input.Get(optionSection, "api_key")
+
+		output.ElasticsearchBulkMaxEvents = 1000
+		bulkMaxEvents, ok := input.Get(optionSection, "bulk_max_events")
+		if ok {
+			bulkMaxEvents, err := strconv.Atoi(bulkMaxEvents)
+			if err == nil && bulkMaxEvents > 0 {
+				output.ElasticsearchBulkMaxEvents = bulkMaxEvents
+			} else {
+				errs.addErrorString(errorPrefix + "Unknown value for 'bulk_max_events': must be a positive integer")
 			}
+		}
+
+	default:
+		errs.addErrorString(fmt.Sprintf("%sUnknown output type: %s", errorPrefix, outType))
+	}
+
+	if len(parameterKey) > 0 {
+		val, ok := input.Get(section, parameterKey)
+		if !ok {
+			errs.addErrorString(fmt.Sprintf("%sMissing value for key %s, required by output type %s",
+				errorPrefix, parameterKey, outType))
 		} else {
-			errs.addErrorString("Unknown value for 'use_raw_sensor_exchange': valid values are true, false, 1, 0")
+			output.OutputParameters = val
 		}
 	}
 
 	// TLS configuration
-	config.TLSVerify = true
-	tlsVerify, ok := input.Get(outType, "tls_verify")
+	output.TLSVerify = true
+	tlsVerify, ok := input.Get(optionSection, "tls_verify")
 	if ok {
 		boolval, err := strconv.ParseBool(tlsVerify)
 		if err == nil {
 			if boolval == false {
-				config.TLSVerify = false
+				output.TLSVerify = false
 			}
 		} else {
-			errs.addErrorString("Unknown value for 'tls_verify': valid values are true, false, 1, 0. Default is 'true'")
+			errs.addErrorString(errorPrefix + "Unknown value for 'tls_verify': valid values are true, false, 1, 0. Default is 'true'")
 		}
 	}
 
-	config.TLS12Only = true
-	tlsInsecure, ok := input.Get(outType, "insecure_tls")
+	output.TLS12Only = true
+	tlsInsecure, ok := input.Get(optionSection, "insecure_tls")
 	if ok {
 		boolval, err := strconv.ParseBool(tlsInsecure)
 		if err == nil {
 			if boolval == true {
-				config.TLS12Only = false
+				output.TLS12Only = false
 			}
 		} else {
-			errs.addErrorString("Unknown value for 'insecure_tls': ")
+			errs.addErrorString(errorPrefix + "Unknown value for 'insecure_tls': ")
 		}
 	}
 
-	serverCName, ok := input.Get(outType, "server_cname")
+	serverCName, ok := input.Get(optionSection, "server_cname")
+	if ok {
+		output.TLSCName = &serverCName
+	}
+
+	caCert, ok := input.Get(optionSection, "ca_cert")
 	if ok {
-		config.TLSCName = &serverCName
+		output.TLSCACert = &caCert
 	}
 
-	config.TLSConfig = configureTLS(config)
+	clientKey, ok := input.Get(optionSection, "client_key")
+	if ok {
+		output.TLSClientKey = &clientKey
+	}
+
+	clientCert, ok := input.Get(optionSection, "client_cert")
+	if ok {
+		output.TLSClientCert = &clientCert
+	}
+
+	tlsConfig, err := configureTLS(output)
+	if err != nil {
+		errs.addErrorString(fmt.Sprintf("%sCould not load TLS certificates: %s", errorPrefix, err))
+	}
+	output.TLSConfig = tlsConfig
+
+	// Spool configuration
+	if output.OutputType == TCPOutputType || output.OutputType == UDPOutputType || output.OutputType == SyslogOutputType {
+		spoolDirectory, ok := input.Get(optionSection, "spool_directory")
+		if ok {
+			output.SpoolDirectory = spoolDirectory
+		}
+
+		// default to 10MB segments and a 1GB spool
+		output.SpoolSegmentSize = 10 * 1024 * 1024
+		spoolSegmentSize, ok := input.Get(optionSection, "spool_segment_size")
+		if ok {
+			spoolSegmentSize, err := strconv.ParseInt(spoolSegmentSize, 10, 64)
+			if err == nil && spoolSegmentSize > 0 {
+				output.SpoolSegmentSize = spoolSegmentSize
+			} else {
+				errs.addErrorString(errorPrefix + "Unknown value for 'spool_segment_size': must be a positive integer")
+			}
+		}
+
+		output.SpoolMaxSize = 1024 * 1024 * 1024
+		spoolMaxSize, ok := input.Get(optionSection, "spool_max_size")
+		if ok {
+			spoolMaxSize, err := strconv.ParseInt(spoolMaxSize, 10, 64)
+			if err == nil && spoolMaxSize > 0 {
+				output.SpoolMaxSize = spoolMaxSize
+			} else {
+				errs.addErrorString(errorPrefix + "Unknown value for 'spool_max_size': must be a positive integer")
+			}
+		}
+	}
 
 	// Bundle configuration
 
 	// default to sending empty files to S3/HTTP POST endpoint
 	if outType == "splunk" {
-		config.UploadEmptyFiles = false
+		output.UploadEmptyFiles = false
 		log.Info("Splunk HEC does not accept empty files as input, ignoring upload_empty_files=true for 'splunkout'")
 	} else {
-		config.UploadEmptyFiles = true
+		output.UploadEmptyFiles = true
 	}
-	sendEmptyFiles, ok := input.Get(outType, "upload_empty_files")
+	sendEmptyFiles, ok := input.Get(optionSection, "upload_empty_files")
 	if ok {
 		boolval, err := strconv.ParseBool(sendEmptyFiles)
 		if err == nil {
 			if boolval == false {
-				config.UploadEmptyFiles = false
+				output.UploadEmptyFiles = false
 			}
 		} else {
-			errs.addErrorString("Unknown value for 'upload_empty_files': valid values are true, false, 1, 0. Default is 'true'")
+			errs.addErrorString(errorPrefix + "Unknown value for 'upload_empty_files': valid values are true, false, 1, 0. Default is 'true'")
 		}
 	}
 
-	if config.OutputFormat == JSONOutputFormat {
-		config.CommaSeparateEvents = true
+	if output.OutputFormat == JSONOutputFormat {
+		output.CommaSeparateEvents = true
 	} else {
-		config.CommaSeparateEvents = false
+		output.CommaSeparateEvents = false
 	}
 
 	// default 10MB bundle size max before forcing a send
-	config.BundleSizeMax = 10 * 1024 * 1024
-	bundleSizeMax, ok := input.Get(outType, "bundle_size_max")
+	output.BundleSizeMax = 10 * 1024 * 1024
+	bundleSizeMax, ok := input.Get(optionSection, "bundle_size_max")
 	if ok {
 		bundleSizeMax, err := strconv.ParseInt(bundleSizeMax, 10, 64)
 		if err == nil {
-			config.BundleSizeMax = bundleSizeMax
+			output.BundleSizeMax = bundleSizeMax
 		}
 	}
 
 	// default 5 minute send interval
-	config.BundleSendTimeout = 5 * time.Minute
-	bundleSendTimeout, ok := input.Get(outType, "bundle_send_timeout")
+	output.BundleSendTimeout = 5 * time.Minute
+	bundleSendTimeout, ok := input.Get(optionSection, "bundle_send_timeout")
 	if ok {
 		bundleSendTimeout, err := strconv.ParseInt(bundleSendTimeout, 10, 64)
 		if err == nil {
-			config.BundleSendTimeout = time.Duration(bundleSendTimeout) * time.Second
+			output.BundleSendTimeout = time.Duration(bundleSendTimeout) * time.Second
 		}
 	}
 
-	val, ok = input.Get("bridge", "api_verify_ssl")
+	if legacy {
+		// the legacy output only uses a few of the options in [bridge]; the rest can change without restarting it
+		signatureSections[0] = optionSection
+	}
+	output.Signature = fmt.Sprintf("%s|%d|%s|%s", outType, output.OutputFormat, output.OutputParameters,
+		sectionSignature(input, signatureSections))
+
+	return output
+}
+
+// sectionSignature returns the options in the given sections, other than event_types, in a canonical form.
+func sectionSignature(input ini.File, sections []string) string {
+	options := make([]string, 0)
+	for _, section := range sections {
+		for key, value := range input[section] {
+			if key != "event_types" {
+				options = append(options, fmt.Sprintf("[%s]%s=%s", section, key, value))
+			}
+		}
+	}
+	sort.Strings(options)
+	return strings.Join(options, "\n")
+}
+
+// parseKafkaConfiguration reads the producer options for a kafka output: TLS and SASL authentication, message
+// keys and topics, and the delivery guarantees requested from the brokers.
+func parseKafkaConfiguration(input ini.File, optionSection, errorPrefix string, output *OutputConfiguration,
+	errs *ConfigurationError) {
+
+	topicTemplate, ok := input.Get(optionSection, "topic_template")
 	if ok {
-		config.CbAPIVerifySSL, err = strconv.ParseBool(val)
+		t, err := parseKafkaTopicTemplate(topicTemplate)
 		if err != nil {
-			errs.addErrorString("Unknown value for 'api_verify_ssl': valid values are true, false, 1, 0. Default is 'false'")
+			errs.addErrorString(fmt.Sprintf("%sCould not parse 'topic_template': %s", errorPrefix, err))
+		} else {
+			output.KafkaTopicTemplate = t
 		}
 	}
-	val, ok = input.Get("bridge", "api_token")
+
+	partitionKey, ok := input.Get(optionSection, "partition_key")
 	if ok {
-		config.CbAPIToken = val
-		config.PerformFeedPostprocessing = true
+		output.KafkaPartitionKey = strings.TrimSpace(partitionKey)
 	}
 
-	config.CbAPIProxyUrl = ""
-	val, ok = input.Get("bridge", "api_proxy_url")
+	useTLS, ok := input.Get(optionSection, "use_tls")
 	if ok {
-		config.CbAPIProxyUrl = val
+		boolval, err := strconv.ParseBool(useTLS)
+		if err == nil {
+			output.KafkaUseTLS = boolval
+		} else {
+			errs.addErrorString(errorPrefix + "Unknown value for 'use_tls': valid values are true, false, 1, 0. Default is 'false'")
+		}
 	}
 
-	config.parseEventTypes(input)
+	mechanism, ok := input.Get(optionSection, "sasl_mechanism")
+	if ok {
+		mechanism = strings.ToUpper(strings.TrimSpace(mechanism))
+		switch mechanism {
+		case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+			output.KafkaSASLMechanism = mechanism
+		default:
+			errs.addErrorString(errorPrefix + "Unknown value for 'sasl_mechanism': valid values are PLAIN, SCRAM-SHA-256, SCRAM-SHA-512")
+		}
 
-	config.parseMonitoredLogs(input)
+		output.KafkaSASLUsername, _ = input.Get(optionSection, "sasl_username")
+		output.KafkaSASLPassword, _ = input.Get(optionSection, "sasl_password")
+		if len(output.KafkaSASLUsername) == 0 {
+			errs.addErrorString(errorPrefix + "Missing value for key sasl_username, required by sasl_mechanism")
+		}
+	}
 
-	if !errs.Empty {
-		return config, errs
-	} else {
-		return config, nil
+	output.KafkaRequiredAcks = sarama.WaitForLocal
+	requiredAcks, ok := input.Get(optionSection, "required_acks")
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(requiredAcks)) {
+		case "none", "0":
+			output.KafkaRequiredAcks = sarama.NoResponse
+		case "local", "1":
+			output.KafkaRequiredAcks = sarama.WaitForLocal
+		case "all", "-1":
+			output.KafkaRequiredAcks = sarama.WaitForAll
+		default:
+			errs.addErrorString(errorPrefix + "Unknown value for 'required_acks': valid values are none, local, all")
+		}
+	}
+
+	idempotent, ok := input.Get(optionSection, "idempotent")
+	if ok {
+		boolval, err := strconv.ParseBool(idempotent)
+		if err == nil {
+			output.KafkaIdempotent = boolval
+		} else {
+			errs.addErrorString(errorPrefix + "Unknown value for 'idempotent': valid values are true, false, 1, 0. Default is 'false'")
+		}
+	}
+	if output.KafkaIdempotent && output.KafkaRequiredAcks != sarama.WaitForAll {
+		errs.addErrorString(errorPrefix + "idempotent=true requires required_acks=all")
+	}
+
+	output.KafkaCompression = sarama.CompressionNone
+	compression, ok := input.Get(optionSection, "compression")
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(compression)) {
+		case "none":
+			output.KafkaCompression = sarama.CompressionNone
+		case "gzip":
+			output.KafkaCompression = sarama.CompressionGZIP
+		case "snappy":
+			output.KafkaCompression = sarama.CompressionSnappy
+		case "lz4":
+			output.KafkaCompression = sarama.CompressionLZ4
+		case "zstd":
+			output.KafkaCompression = sarama.CompressionZSTD
+		default:
+			errs.addErrorString(errorPrefix + "Unknown value for 'compression': valid values are none, gzip, snappy, lz4, zstd")
+		}
+	}
+
+	// idempotent producers need at least Kafka 0.11 and zstd needs 2.1
+	output.KafkaVersion = sarama.V1_0_0_0
+	if output.KafkaCompression == sarama.CompressionZSTD {
+		output.KafkaVersion = sarama.V2_1_0_0
+	}
+	version, ok := input.Get(optionSection, "version")
+	if ok {
+		kafkaVersion, err := sarama.ParseKafkaVersion(strings.TrimSpace(version))
+		if err == nil {
+			output.KafkaVersion = kafkaVersion
+		} else {
+			errs.addErrorString(fmt.Sprintf("%sUnknown value for 'version': %s", errorPrefix, err))
+		}
+	}
+
+	output.KafkaRetryMax = 3
+	retryMax, ok := input.Get(optionSection, "retry_max")
+	if ok {
+		retryMax, err := strconv.Atoi(retryMax)
+		if err == nil && retryMax >= 0 {
+			output.KafkaRetryMax = retryMax
+		} else {
+			errs.addErrorString(errorPrefix + "Unknown value for 'retry_max': must be a non-negative integer")
+		}
+	}
+
+	output.KafkaRetryBackoff = 100 * time.Millisecond
+	retryBackoff, ok := input.Get(optionSection, "retry_backoff")
+	if ok {
+		retryBackoff, err := strconv.ParseInt(retryBackoff, 10, 64)
+		if err == nil && retryBackoff >= 0 {
+			output.KafkaRetryBackoff = time.Duration(retryBackoff) * time.Millisecond
+		} else {
+			errs.addErrorString(errorPrefix + "Unknown value for 'retry_backoff': must be a non-negative number of milliseconds")
+		}
+	}
+
+	output.KafkaResendMax = 5
+	resendMax, ok := input.Get(optionSection, "resend_max")
+	if ok {
+		resendMax, err := strconv.Atoi(resendMax)
+		if err == nil && resendMax >= 0 {
+			output.KafkaResendMax = resendMax
+		} else {
+			errs.addErrorString(errorPrefix + "Unknown value for 'resend_max': must be a non-negative integer")
+		}
 	}
 }
 
-func configureTLS(config Configuration) *tls.Config {
+func configureTLS(config *OutputConfiguration) (*tls.Config, error) {
 	tlsConfig := &tls.Config{}
 
 	if config.TLSVerify == false {
@@ -700,7 +1740,7 @@ func configureTLS(config Configuration) *tls.Config {
 		log.Infof("Loading client cert/key from %s & %s", *config.TLSClientCert, *config.TLSClientKey)
 		cert, err := tls.LoadX509KeyPair(*config.TLSClientCert, *config.TLSClientKey)
 		if err != nil {
-			log.Fatal(err)
+			return tlsConfig, err
 		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
@@ -710,10 +1750,12 @@ func configureTLS(config Configuration) *tls.Config {
 		log.Infof("Loading valid CAs from file %s", *config.TLSCACert)
 		caCert, err := ioutil.ReadFile(*config.TLSCACert)
 		if err != nil {
-			log.Fatal(err)
+			return tlsConfig, err
 		}
 		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return tlsConfig, errors.New(fmt.Sprintf("No certificates found in %s", *config.TLSCACert))
+		}
 		tlsConfig.RootCAs = caCertPool
 	}
 
@@ -730,5 +1772,5 @@ func configureTLS(config Configuration) *tls.Config {
 		tlsConfig.MinVersion = tls.VersionTLS10
 	}
 
-	return tlsConfig
+	return tlsConfig, nil
 }
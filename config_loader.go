@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vaughan0/go-ini"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Configuration sources: INI or YAML files, overrides from CB_EF_* environment variables, and ${file:<path>}
+ * references to secrets mounted as files.
+ */
+
+const environmentPrefix = "CB_EF_"
+
+// yamlSectionGroups maps the YAML keys that hold named sections to the prefix of those sections.
+var yamlSectionGroups = map[string]string{
+	"outputs":    "output",
+	"filters":    "filter",
+	"transforms": "transform",
+}
+
+var secretReference = regexp.MustCompile(`\$\{file:([^}]+)\}`)
+
+// loadConfigFile reads the configuration file and applies the environment overrides and secret references.
+func loadConfigFile(fn string) (ini.File, error) {
+	var input ini.File
+	var err error
+
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml":
+		var fp *os.File
+		fp, err = os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		input, err = loadYAML(fp)
+		fp.Close()
+	default:
+		input, err = ini.LoadFile(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	applyEnvironmentOverrides(input, os.Environ())
+
+	if err := resolveSecrets(input); err != nil {
+		return nil, err
+	}
+
+	return input, nil
+}
+
+// loadYAML reads a YAML configuration into INI sections.
+func loadYAML(r io.Reader) (ini.File, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse YAML configuration: %s", err))
+	}
+
+	input := make(ini.File)
+	for key, value := range document {
+		prefix, grouped := yamlSectionGroups[key]
+		if !grouped {
+			if err := addYAMLSection(input, key, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		sections, ok := value.(map[interface{}]interface{})
+		if !ok && value != nil {
+			return nil, errors.New(fmt.Sprintf("%s must map names to %s sections", key, prefix))
+		}
+		for name, options := range sections {
+			if err := addYAMLSection(input, fmt.Sprintf("%s:%v", prefix, name), options); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return input, nil
+}
+
+func addYAMLSection(input ini.File, section string, value interface{}) error {
+	options, ok := value.(map[interface{}]interface{})
+	if !ok && value != nil {
+		return errors.New(fmt.Sprintf("%s must be a section of options", section))
+	}
+
+	input[section] = make(ini.Section)
+	for key, option := range options {
+		val, err := yamlOptionValue(option)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s.%v: %s", section, key, err))
+		}
+		input[section][fmt.Sprint(key)] = val
+	}
+
+	return nil
+}
+
+func yamlOptionValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			if _, ok := element.([]interface{}); ok {
+				return "", errors.New("lists cannot be nested")
+			}
+			val, err := yamlOptionValue(element)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, val)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return "", errors.New("expected a value or a list of values")
+	}
+}
+
+// environmentSectionName returns the name a section has in CB_EF_* environment variables.
+func environmentSectionName(section string) string {
+	return strings.ToUpper(strings.Replace(section, ":", "_", -1))
+}
+
+// applyEnvironmentOverrides sets the options named by CB_EF_* variables in the environment, which is given in
+// the form returned by os.Environ.
+func applyEnvironmentOverrides(input ini.File, environment []string) {
+	// apply them in a fixed order, so that the result does not depend on the order of the environment
+	sort.Strings(environment)
+
+	for _, variable := range environment {
+		if !strings.HasPrefix(variable, environmentPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(variable, environmentPrefix), "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			continue
+		}
+		name, value := parts[0], parts[1]
+
+		section, key := "bridge", name
+		if i := strings.Index(name, "__"); i >= 0 {
+			section, key = environmentSection(input, name[:i]), name[i+2:]
+		}
+		key = strings.ToLower(key)
+
+		if _, ok := input[section]; !ok {
+			input[section] = make(ini.Section)
+		}
+		input[section][key] = value
+
+		log.Infof("Configuration option %s in [%s] set from the environment", key, section)
+	}
+}
+
+// environmentSection finds the section an environment variable refers to. Sections that are not in the
+// configuration file are created; the first '_' after output, filter or transform is taken to be the ':'.
+func environmentSection(input ini.File, name string) string {
+	for section := range input {
+		if environmentSectionName(section) == name {
+			return section
+		}
+	}
+
+	section := strings.ToLower(name)
+	for _, prefix := range yamlSectionGroups {
+		if strings.HasPrefix(section, prefix+"_") {
+			return prefix + ":" + strings.TrimPrefix(section, prefix+"_")
+		}
+	}
+	return section
+}
+
+// resolveSecrets replaces each ${file:<path>} in the option values with the contents of the file.
+func resolveSecrets(input ini.File) error {
+	for sectionName, section := range input {
+		for key, value := range section {
+			var readErr error
+			resolved := secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+				path := secretReference.FindStringSubmatch(reference)[1]
+				contents, err := ioutil.ReadFile(path)
+				if err != nil {
+					if readErr == nil {
+						readErr = errors.New(fmt.Sprintf("Could not read %s in [%s] from %s: %s", key, sectionName,
+							path, err))
+					}
+					return reference
+				}
+				return strings.TrimRight(string(contents), "\r\n")
+			})
+			if readErr != nil {
+				return readErr
+			}
+			section[key] = resolved
+		}
+	}
+
+	return nil
+}
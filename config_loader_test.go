@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "hec_token")
+	if err := ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(dir, "cb-event-forwarder.yaml")
+	err = ioutil.WriteFile(fn, []byte(`
+bridge:
+  server_name: cbserver
+  cb_server_hostname: cb.example.com
+  rabbit_mq_username: cb
+  rabbit_mq_password: from-file
+  rabbit_mq_port: 5004
+  events_watchlist: [watchlist.hit.process, watchlist.storage.hit.process]
+  events_alert: ALL
+outputs:
+  alerts:
+    output_type: splunk
+    output_format: json
+    splunkout: https://splunk.example.com:8088/services/collector
+    hec_token: ${file:`+secret+`}
+    event_types:
+      - alert.#
+      - watchlist.#
+    bundle_send_timeout: 30
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CB_EF_RABBIT_MQ_PASSWORD", "from-environment")
+	os.Setenv("CB_EF_OUTPUT_ALERTS__BUNDLE_SEND_TIMEOUT", "60")
+	defer os.Unsetenv("CB_EF_RABBIT_MQ_PASSWORD")
+	defer os.Unsetenv("CB_EF_OUTPUT_ALERTS__BUNDLE_SEND_TIMEOUT")
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ServerName != "cbserver" || c.AMQPPort != 5004 {
+		t.Errorf("Wrong [bridge] options: server name %s, port %d", c.ServerName, c.AMQPPort)
+	}
+	if c.AMQPPassword != "from-environment" {
+		t.Errorf("rabbit_mq_password was not overridden from the environment: %s", c.AMQPPassword)
+	}
+	expectedEventTypes := []string{"watchlist.hit.process", "watchlist.storage.hit.process", "alert.#"}
+	if !reflect.DeepEqual(c.EventTypes, expectedEventTypes) {
+		t.Errorf("Wrong event types: %v", c.EventTypes)
+	}
+
+	if len(c.Outputs) != 1 || c.Outputs[0].Name != "alerts" {
+		t.Fatalf("Expected the alerts output, got %v", c.Outputs)
+	}
+	output := c.Outputs[0]
+	if output.SplunkToken == nil || *output.SplunkToken != "s3cret" {
+		t.Error("hec_token was not read from the secret file")
+	}
+	if !reflect.DeepEqual(output.EventTypes, []string{"alert.#", "watchlist.#"}) {
+		t.Errorf("Wrong output event types: %v", output.EventTypes)
+	}
+	if output.BundleSendTimeout.Seconds() != 60 {
+		t.Errorf("bundle_send_timeout was not overridden from the environment: %s", output.BundleSendTimeout)
+	}
+}
+
+func TestConfigurationSecretErrors(t *testing.T) {
+	input, err := loadYAML(strings.NewReader(`
+bridge:
+  rabbit_mq_password: ${file:/nonexistent/rabbit_mq_password}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveSecrets(input); err == nil {
+		t.Error("Expected an error for a secret file that does not exist")
+	}
+
+	if _, err := loadYAML(strings.NewReader("bridge: [output_type, file]")); err == nil {
+		t.Error("Expected an error for a section that is not a map of options")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"expvar"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"zvelo.io/ttlru"
+)
+
+/*
+ * Deduplication of repeated raw events. The first event with a given set of key fields is sent straight away and
+ * opens a window; repeats within it are dropped, or counted and reported in a separate forwarder.dedup event with
+ * a repeat_count once the window closes. The first event is never held back, so deduplication does not delay
+ * acknowledgements or change the order in which events are sent.
+ */
+
+const (
+	DedupDrop = iota
+	DedupCount
+)
+
+const dedupEventType = "forwarder.dedup"
+
+var deduplicatedEventCount = expvar.NewInt("deduplicated_event_count")
+
+var eventDeduplicator *Deduplicator
+
+type DedupRule struct {
+	Name       string
+	EventTypes []string
+	Fields     []string
+}
+
+// defaultDedupRules are used when [dedup] is enabled without any rules.
+func defaultDedupRules() []*DedupRule {
+	return []*DedupRule{
+		{
+			Name:       "moduleload",
+			EventTypes: []string{"ingress.event.moduleload"},
+			Fields:     []string{"process_guid", "md5", "path"},
+		},
+		{
+			Name:       "netconn",
+			EventTypes: []string{"ingress.event.netconn"},
+			Fields:     []string{"process_guid", "direction", "protocol", "remote_ip", "remote_port", "domain"},
+		},
+	}
+}
+
+type Deduplicator struct {
+	sync.Mutex
+
+	window     time.Duration
+	action     int
+	maxEntries int
+	rules      []*DedupRule
+
+	windows ttlru.Cache
+
+	// with the count action, the open windows in the order in which they close
+	pending []*dedupWindow
+
+	// set once the repeat counts have been flushed for shutdown; later windows are no longer counted
+	closed bool
+
+	now func() time.Time
+}
+
+type dedupWindow struct {
+	expires time.Time
+	repeats int64
+	closed  bool
+
+	// with the count action, the forwarder.dedup event that reports the repeats
+	summary map[string]interface{}
+}
+
+type DedupStatus struct {
+	Window          string `json:"window"`
+	Action          string `json:"action"`
+	MaxEntries      int    `json:"max_entries"`
+	TrackedWindows  int    `json:"tracked_windows"`
+	PendingCounts   int    `json:"pending_counts"`
+	SuppressedTotal int64  `json:"suppressed_total"`
+}
+
+func NewDeduplicator(c Configuration) *Deduplicator {
+	return &Deduplicator{
+		window:     c.DedupWindow,
+		action:     c.DedupAction,
+		maxEntries: c.DedupMaxEntries,
+		rules:      c.DedupRules,
+		windows:    ttlru.New(c.DedupMaxEntries, ttlru.WithTTL(c.DedupWindow)),
+		now:        time.Now,
+	}
+}
+
+// key returns the hash of the event's type and the values of the fields named by the first rule that applies
+// to it, along with the rule. It returns false if no rule applies, or if the event has none of the rule's fields.
+func (d *Deduplicator) key(event *Event, eventType string) (uint64, *DedupRule, bool) {
+	for _, rule := range d.rules {
+		if !eventTypesMatch(rule.EventTypes, eventType) {
+			continue
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(eventType))
+
+		found := false
+		for _, field := range rule.Fields {
+			value, ok := event.Lookup(field)
+			found = found || ok
+			h.Write([]byte{0})
+			h.Write([]byte(value))
+		}
+		return h.Sum64(), rule, found
+	}
+	return 0, nil, false
+}
+
+// Check returns true if the event should be sent to the outputs. Repeats of an event within its window are
+// suppressed; with the count action they are reported by Expired once the window closes.
+func (d *Deduplicator) Check(event *Event) bool {
+	eventType := event.Type()
+	key, rule, ok := d.key(event, eventType)
+	if !ok {
+		return true
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	if value, ok := d.windows.Get(key); ok {
+		window := value.(*dedupWindow)
+		if !window.closed && now.Before(window.expires) {
+			window.repeats++
+			deduplicatedEventCount.Add(1)
+			metricDeduplicatedEvents.Add(1, eventType)
+			return false
+		}
+	}
+
+	window := &dedupWindow{expires: now.Add(d.window)}
+	d.windows.Set(key, window)
+
+	if d.action == DedupCount && !d.closed {
+		window.summary = dedupSummary(event, eventType, rule, now)
+		d.pending = append(d.pending, window)
+	}
+	return true
+}
+
+// dedupSummary returns the forwarder.dedup event for a window opened by event: the event type, the values of
+// the rule's fields, and the sensor the event came from. repeat_count and timestamp are set when it closes.
+func dedupSummary(event *Event, eventType string, rule *DedupRule, start time.Time) map[string]interface{} {
+	fields := make(map[string]interface{}, len(rule.Fields))
+	for _, field := range rule.Fields {
+		if value, ok := event.Lookup(field); ok {
+			fields[field] = value
+		}
+	}
+
+	summary := map[string]interface{}{
+		"type":         dedupEventType,
+		"dedup_type":   eventType,
+		"dedup_fields": fields,
+		"window_start": start.Unix(),
+	}
+	for _, field := range []string{"sensor_id", "computer_name"} {
+		if value, ok := event.Get(field); ok {
+			summary[field] = value
+		}
+	}
+	return summary
+}
+
+// Expired returns a forwarder.dedup event for each window that has closed with repeats, with the number of
+// repeats suppressed in its repeat_count field. Windows are closed early if more than max_entries are pending.
+func (d *Deduplicator) Expired() []map[string]interface{} {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	n := 0
+	for n < len(d.pending) && (!now.Before(d.pending[n].expires) || len(d.pending)-n > d.maxEntries) {
+		n++
+	}
+	return d.closePending(n, now)
+}
+
+// closePending closes the first n pending windows and returns the summaries of those with repeats. It must be
+// called with the lock held.
+func (d *Deduplicator) closePending(n int, now time.Time) []map[string]interface{} {
+	summaries := make([]map[string]interface{}, 0)
+	for _, window := range d.pending[:n] {
+		window.closed = true
+		if window.repeats == 0 {
+			continue
+		}
+
+		window.summary["repeat_count"] = window.repeats
+		window.summary["timestamp"] = now.Unix()
+		summaries = append(summaries, window.summary)
+	}
+	d.pending = d.pending[n:]
+	return summaries
+}
+
+// flushAll sends the repeat counts of every pending window, whether or not it has closed. Windows opened
+// afterwards are no longer counted; shutdown calls this once the workers have finished.
+func (d *Deduplicator) flushAll() {
+	d.Lock()
+	d.closed = true
+	summaries := d.closePending(len(d.pending), d.now())
+	d.Unlock()
+
+	d.send(summaries)
+}
+
+func (d *Deduplicator) send(summaries []map[string]interface{}) {
+	for _, summary := range summaries {
+		if err := outputMessage(newEvent(summary), nil); err != nil {
+			log.Errorf("Could not send deduplication summary: %s", err)
+		}
+	}
+}
+
+// sendExpired sends the repeat counts as windows close, until shutdown.
+func (d *Deduplicator) sendExpired() {
+	interval := time.Second
+	if d.window < interval {
+		interval = d.window
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.send(d.Expired())
+		case <-shutdownRequested:
+			return
+		}
+	}
+}
+
+func (d *Deduplicator) Status() DedupStatus {
+	d.Lock()
+	defer d.Unlock()
+
+	action := "drop"
+	if d.action == DedupCount {
+		action = "count"
+	}
+
+	return DedupStatus{
+		Window:          d.window.String(),
+		Action:          action,
+		MaxEntries:      d.maxEntries,
+		TrackedWindows:  d.windows.Len(),
+		PendingCounts:   len(d.pending),
+		SuppressedTotal: deduplicatedEventCount.Value(),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestDeduplicator(t *testing.T) {
+	modload := func(guid, path string) *Event {
+		return newEvent(map[string]interface{}{"type": "ingress.event.moduleload", "process_guid": guid,
+			"md5": "ABCD", "path": path})
+	}
+
+	for _, action := range []string{"drop", "count"} {
+		input, err := ini.Load(strings.NewReader(`
+[dedup]
+window=10
+action=` + action + `
+
+[dedup:modload]
+event_types=ingress.event.moduleload
+fields=process_guid,md5,path
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := ConfigurationError{Empty: true}
+		var c Configuration
+		c.parseDedup(input, &errs)
+		if !errs.Empty {
+			t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+		}
+
+		now := time.Unix(1500000000, 0)
+		dedup := NewDeduplicator(c)
+		dedup.now = func() time.Time { return now }
+
+		if !dedup.Check(modload("guid-1", "c:\\windows\\system32\\ntdll.dll")) {
+			t.Errorf("%s: the first event should be sent", action)
+		}
+		for i := 0; i < 5; i++ {
+			if dedup.Check(modload("guid-1", "c:\\windows\\system32\\ntdll.dll")) {
+				t.Errorf("%s: repeats within the window should be suppressed", action)
+			}
+		}
+
+		if !dedup.Check(modload("guid-1", "c:\\windows\\system32\\kernel32.dll")) {
+			t.Errorf("%s: events with other field values should not be suppressed", action)
+		}
+		if !dedup.Check(newEvent(map[string]interface{}{"type": "ingress.event.regmod", "process_guid": "guid-1"})) {
+			t.Errorf("%s: event types without a rule should not be deduplicated", action)
+		}
+
+		if expired := dedup.Expired(); len(expired) != 0 {
+			t.Errorf("%s: no window should have closed yet, got %d", action, len(expired))
+		}
+
+		now = now.Add(10 * time.Second)
+		expired := dedup.Expired()
+		if action == "drop" {
+			if len(expired) != 0 {
+				t.Errorf("drop: no repeats should be counted, got %d", len(expired))
+			}
+		} else {
+			// only the window with repeats is reported
+			expected := map[string]interface{}{
+				"type":       dedupEventType,
+				"dedup_type": "ingress.event.moduleload",
+				"dedup_fields": map[string]interface{}{"process_guid": "guid-1", "md5": "ABCD",
+					"path": "c:\\windows\\system32\\ntdll.dll"},
+				"repeat_count": int64(5),
+				"window_start": int64(1500000000),
+				"timestamp":    int64(1500000010),
+			}
+			if len(expired) != 1 || !reflect.DeepEqual(expired[0], expected) {
+				t.Errorf("count: wrong repeat counts: %v", expired)
+			}
+		}
+
+		if !dedup.Check(modload("guid-1", "c:\\windows\\system32\\ntdll.dll")) {
+			t.Errorf("%s: a new window should open once the last one has closed", action)
+		}
+	}
+}
+
+func TestDeduplicatorMaxEntries(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	dedup := NewDeduplicator(Configuration{
+		DedupWindow:     time.Minute,
+		DedupAction:     DedupCount,
+		DedupMaxEntries: 2,
+		DedupRules:      defaultDedupRules(),
+	})
+	dedup.now = func() time.Time { return now }
+
+	for _, guid := range []string{"guid-1", "guid-2", "guid-3"} {
+		for i := 0; i < 2; i++ {
+			dedup.Check(newEvent(map[string]interface{}{"type": "ingress.event.netconn", "process_guid": guid,
+				"remote_ip": "10.0.0.1", "remote_port": 443, "sensor_id": 7}))
+		}
+	}
+
+	expired := dedup.Expired()
+	if len(expired) != 1 || expired[0]["sensor_id"] != 7 || expired[0]["repeat_count"] != int64(1) {
+		t.Errorf("Expected the oldest window to be closed early, got %v", expired)
+	}
+	if fields, _ := expired[0]["dedup_fields"].(map[string]interface{}); fields["process_guid"] != "guid-1" {
+		t.Errorf("Expected the oldest window to be closed early, got %v", expired)
+	}
+	if status := dedup.Status(); status.PendingCounts != 2 {
+		t.Errorf("Expected 2 pending windows, got %d", status.PendingCounts)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+/*
+ * At-least-once delivery bookkeeping
+ *
+ * Every AMQP delivery is wrapped in a pendingDelivery that counts the events still owed to the outputs. The
+ * count starts at one for the worker processing the delivery and is incremented for each event queued on an
+ * output. Outputs report back through their outputRoute once events are flushed, written or uploaded; when the
+ * count drops to zero the delivery is acknowledged, or requeued if any of its events could not be delivered.
+ */
+
+var (
+	acknowledgedDeliveries = expvar.NewInt("acknowledged_deliveries")
+	requeuedDeliveries     = expvar.NewInt("requeued_deliveries")
+	unacknowledgedEvents   = expvar.NewInt("unacknowledged_events")
+)
+
+// DeliveryAcknowledger is called by an output to report that every message it has read from its channel, up
+// to and including the through'th (counting from 1), has been handled. A non-nil err means that those messages
+// could not be delivered and should be redelivered by the message bus.
+type DeliveryAcknowledger func(through int64, err error)
+
+// Outputs that can tell when their messages have been delivered implement AcknowledgingOutputHandler. Messages
+// sent to other outputs are acknowledged as soon as they are queued.
+type AcknowledgingOutputHandler interface {
+	SetAcknowledger(ack DeliveryAcknowledger)
+}
+
+type pendingDelivery struct {
+	delivery    amqp.Delivery
+	outstanding int64
+	failed      int32
+}
+
+func newPendingDelivery(delivery amqp.Delivery) *pendingDelivery {
+	return &pendingDelivery{delivery: delivery, outstanding: 1}
+}
+
+// all methods accept a nil receiver so that callers don't need to check whether acknowledgements are enabled
+
+func (p *pendingDelivery) add() {
+	if p != nil {
+		atomic.AddInt64(&p.outstanding, 1)
+	}
+}
+
+func (p *pendingDelivery) fail() {
+	if p != nil {
+		atomic.StoreInt32(&p.failed, 1)
+	}
+}
+
+func (p *pendingDelivery) done() {
+	if p == nil || atomic.AddInt64(&p.outstanding, -1) != 0 {
+		return
+	}
+
+	var err error
+	if atomic.LoadInt32(&p.failed) != 0 {
+		requeuedDeliveries.Add(1)
+		err = p.delivery.Nack(false, true)
+	} else {
+		acknowledgedDeliveries.Add(1)
+		err = p.delivery.Ack(false)
+	}
+
+	if err != nil {
+		// the channel has most likely been closed; the broker will redeliver the message after we reconnect
+		log.Debugf("Could not acknowledge delivery %d: %s", p.delivery.DeliveryTag, err)
+	}
+}
+
+type routedDelivery struct {
+	sequence int64
+	delivery *pendingDelivery
+}
+
+// deliveryQueue tracks the deliveries behind the messages queued on a single output, in the order in which the
+// output will read them.
+type deliveryQueue struct {
+	sent    int64
+	pending []routedDelivery
+
+	sync.Mutex
+}
+
+// push records that the next message sent to the output belongs to the given delivery, returning its sequence.
+func (q *deliveryQueue) push(delivery *pendingDelivery) int64 {
+	q.Lock()
+	defer q.Unlock()
+
+	q.sent++
+	if delivery != nil {
+		delivery.add()
+		unacknowledgedEvents.Add(1)
+		q.pending = append(q.pending, routedDelivery{sequence: q.sent, delivery: delivery})
+	}
+	return q.sent
+}
+
+func (q *deliveryQueue) acknowledge(through int64, err error) {
+	q.Lock()
+	n := 0
+	for n < len(q.pending) && q.pending[n].sequence <= through {
+		n++
+	}
+	acknowledged := q.pending[:n]
+	q.pending = q.pending[n:]
+	q.Unlock()
+
+	for _, routed := range acknowledged {
+		if err != nil {
+			routed.delivery.fail()
+		}
+		unacknowledgedEvents.Add(-1)
+		routed.delivery.done()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type testAcknowledger struct {
+	acked    []uint64
+	requeued []uint64
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.requeued = append(a.requeued, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestDeliveryQueueAcknowledgement(t *testing.T) {
+	acknowledger := &testAcknowledger{}
+	first := newPendingDelivery(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1})
+	second := newPendingDelivery(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 2})
+
+	var s3, splunk deliveryQueue
+
+	// the first delivery produced two events sent to both outputs, the second one event sent to S3 only
+	s3.push(first)
+	splunk.push(first)
+	s3.push(nil)
+	s3.push(first)
+	splunk.push(first)
+	s3.push(second)
+
+	first.done()
+	second.done()
+
+	s3.acknowledge(3, nil)
+	if len(acknowledger.acked) != 0 {
+		t.Fatalf("Acknowledged before every output delivered its events: %v", acknowledger.acked)
+	}
+
+	splunk.acknowledge(2, nil)
+	if len(acknowledger.acked) != 1 || acknowledger.acked[0] != 1 {
+		t.Fatalf("First delivery should have been acknowledged: %v", acknowledger.acked)
+	}
+
+	s3.acknowledge(4, errors.New("upload failed"))
+	if len(acknowledger.requeued) != 1 || acknowledger.requeued[0] != 2 {
+		t.Fatalf("Second delivery should have been requeued: %v", acknowledger.requeued)
+	}
+}
+
+func TestDeliveryWithoutEvents(t *testing.T) {
+	acknowledger := &testAcknowledger{}
+	delivery := newPendingDelivery(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 7})
+	delivery.done()
+
+	if len(acknowledger.acked) != 1 || acknowledger.acked[0] != 7 {
+		t.Errorf("Delivery without events should be acknowledged once processed: %v", acknowledger.acked)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* This is the Elasticsearch _bulk API implementation of the BundleBehavior interface defined in bundled_output.go */
+type ElasticsearchBehavior struct {
+	dest         string
+	headers      map[string]string
+	outputConfig *OutputConfiguration
+
+	client *http.Client
+
+	indexedEvents  int64
+	retriedEvents  int64
+	rejectedEvents int64
+}
+
+type ElasticsearchStatistics struct {
+	Destination    string `json:"destination"`
+	IndexedEvents  int64  `json:"indexed_events"`
+	RetriedEvents  int64  `json:"retried_events"`
+	RejectedEvents int64  `json:"rejected_events"`
+}
+
+// ElasticsearchIndexData is passed to the index name template for each event. Time is the time of the event,
+// or of the upload for events without a timestamp, in UTC.
+type ElasticsearchIndexData struct {
+	Time  time.Time
+	Type  string
+	Event map[string]interface{}
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool                                     `json:"errors"`
+	Items  []map[string]elasticsearchBulkItemResult `json:"items"`
+}
+
+type elasticsearchBulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+/* Construct the ElasticsearchBehavior object */
+func (this *ElasticsearchBehavior) Initialize(dest string) error {
+	this.headers = make(map[string]string)
+
+	this.dest = strings.TrimRight(dest, "/") + "/_bulk"
+
+	/* add credentials, if applicable */
+	if len(this.outputConfig.ElasticsearchAPIKey) > 0 {
+		this.headers["Authorization"] = "ApiKey " + this.outputConfig.ElasticsearchAPIKey
+	} else if len(this.outputConfig.ElasticsearchUsername) > 0 {
+		credentials := this.outputConfig.ElasticsearchUsername + ":" + this.outputConfig.ElasticsearchPassword
+		this.headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	this.headers["Content-Type"] = "application/x-ndjson"
+
+	transport := &http.Transport{
+		TLSClientConfig: this.outputConfig.TLSConfig,
+	}
+	this.client = &http.Client{Transport: transport}
+
+	return nil
+}
+
+// Probe requests the cluster information, which checks the credentials without indexing anything.
+func (this *ElasticsearchBehavior) Probe() error {
+	status, err := probeHTTP(this.client, "GET", strings.TrimSuffix(this.dest, "/_bulk")+"/", this.headers)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New(fmt.Sprintf("Elasticsearch returned HTTP %d", status))
+	}
+	return nil
+}
+
+func (this *ElasticsearchBehavior) String() string {
+	return "Elasticsearch " + this.Key()
+}
+
+func (this *ElasticsearchBehavior) Statistics() interface{} {
+	return ElasticsearchStatistics{
+		Destination:    this.dest,
+		IndexedEvents:  atomic.LoadInt64(&this.indexedEvents),
+		RetriedEvents:  atomic.LoadInt64(&this.retriedEvents),
+		RejectedEvents: atomic.LoadInt64(&this.rejectedEvents),
+	}
+}
+
+func (this *ElasticsearchBehavior) Key() string {
+	return this.dest
+}
+
+// Upload sends the events in the given file to the _bulk API, bulk_max_events at a time. Events that
+// Elasticsearch rejects with a transient error are written back to the file, which the bundled output then
+// retries; events rejected because of their content are dropped (and kept in the debug store, if enabled).
+func (this *ElasticsearchBehavior) Upload(fileName string, fp *os.File) UploadStatus {
+	events, err := readBundleEvents(fp)
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err, status: 0}
+	}
+
+	retry := make([]string, 0)
+	rejected := make([]string, 0)
+	var uploadErr error
+	uploadStatus := 200
+	uploadTime := time.Now().UTC()
+
+	for start := 0; start < len(events); start += this.outputConfig.ElasticsearchBulkMaxEvents {
+		end := start + this.outputConfig.ElasticsearchBulkMaxEvents
+		if end > len(events) {
+			end = len(events)
+		}
+
+		statuses, status, err := this.bulk(events[start:end], uploadTime)
+		if err != nil {
+			// the request failed as a whole; keep this and the remaining events for the next attempt
+			retry = append(retry, events[start:]...)
+			uploadErr = err
+			uploadStatus = status
+			break
+		}
+
+		for i, itemStatus := range statuses {
+			switch {
+			case itemStatus >= 200 && itemStatus < 300:
+				atomic.AddInt64(&this.indexedEvents, 1)
+			case itemStatus == 429 || itemStatus >= 500:
+				retry = append(retry, events[start+i])
+			default:
+				rejected = append(rejected, events[start+i])
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		atomic.AddInt64(&this.rejectedEvents, int64(len(rejected)))
+		log.Infof("Elasticsearch rejected %d events from %s", len(rejected), fileName)
+		saveRejectedEvents(fileName, rejected)
+	}
+
+	if len(retry) == 0 {
+		return UploadStatus{fileName: fileName, result: nil, status: 200}
+	}
+
+	atomic.AddInt64(&this.retriedEvents, int64(len(retry)))
+	if len(retry) < len(events) {
+		if err := rewriteBundle(fileName, retry); err != nil {
+			log.Infof("Could not rewrite %s with the events to retry, the whole file will be retried: %s",
+				fileName, err)
+		}
+	}
+
+	if uploadErr == nil {
+		uploadErr = fmt.Errorf("%d of %d events were not accepted by Elasticsearch and will be retried",
+			len(retry), len(events))
+		uploadStatus = 429
+	}
+	return UploadStatus{fileName: fileName, result: uploadErr, status: uploadStatus}
+}
+
+// bulk sends one _bulk request and returns the status of each event, in order. Events that are not valid JSON
+// are never sent and get a 400 status.
+func (this *ElasticsearchBehavior) bulk(events []string, uploadTime time.Time) ([]int, int, error) {
+	statuses := make([]int, len(events))
+	sent := make([]int, 0, len(events))
+
+	var body bytes.Buffer
+	for i, eventText := range events {
+		action, err := this.bulkAction(eventText, uploadTime)
+		if err != nil {
+			log.Debugf("Not sending event to Elasticsearch: %s", err)
+			statuses[i] = 400
+			continue
+		}
+
+		body.Write(action)
+		body.WriteString("\n")
+		body.WriteString(eventText)
+		body.WriteString("\n")
+		sent = append(sent, i)
+	}
+
+	if len(sent) == 0 {
+		return statuses, 200, nil
+	}
+
+	request, err := http.NewRequest("POST", this.dest, &body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	/* Set the header values of the post */
+	for key, value := range this.headers {
+		request.Header.Set(key, value)
+	}
+
+	/* Execute the POST */
+	resp, err := this.client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	/* Some sort of issue with the POST */
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		errorData := resp.Status + "\n" + string(body)
+
+		return nil, resp.StatusCode, fmt.Errorf("Elasticsearch bulk request failed: Error code %s", errorData)
+	}
+
+	var bulkResponse elasticsearchBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bulkResponse); err != nil {
+		return nil, 0, fmt.Errorf("Could not parse Elasticsearch bulk response: %s", err)
+	}
+
+	if len(bulkResponse.Items) != len(sent) {
+		return nil, 0, fmt.Errorf("Elasticsearch bulk response has %d items for %d events",
+			len(bulkResponse.Items), len(sent))
+	}
+
+	for i, item := range bulkResponse.Items {
+		for _, result := range item {
+			statuses[sent[i]] = result.Status
+			if len(result.Error) > 0 {
+				log.Debugf("Elasticsearch could not index event: %s", string(result.Error))
+			}
+		}
+	}
+
+	return statuses, 200, nil
+}
+
+// bulkAction returns the action line for an event: the index named by the index template and, if the event
+// has an event_guid, a document ID so that events which are retried are not indexed twice.
+func (this *ElasticsearchBehavior) bulkAction(eventText string, uploadTime time.Time) ([]byte, error) {
+	var event map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(eventText))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return nil, err
+	}
+
+	data := ElasticsearchIndexData{Time: eventTime(event, uploadTime), Event: event}
+	data.Type, _ = event["type"].(string)
+
+	var index bytes.Buffer
+	if err := this.outputConfig.ElasticsearchIndexTemplate.Execute(&index, data); err != nil {
+		return nil, err
+	}
+
+	action := map[string]interface{}{"_index": index.String()}
+	if guid, ok := event["event_guid"].(string); ok && len(guid) > 0 {
+		action["_id"] = guid
+	}
+
+	return json.Marshal(map[string]interface{}{"index": action})
+}
+
+// eventTime returns the time of an event from its timestamp field, which holds either seconds since the epoch
+// or an RFC 3339 time.
+func eventTime(event map[string]interface{}, defaultTime time.Time) time.Time {
+	for _, field := range []string{"timestamp", "event_timestamp"} {
+		switch value := event[field].(type) {
+		case json.Number:
+			if seconds, err := value.Float64(); err == nil {
+				return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+			}
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return defaultTime
+}
+
+// readBundleEvents returns the non-empty lines of a bundle file, which may be gzip compressed.
+func readBundleEvents(fp *os.File) ([]string, error) {
+	var fileReader io.Reader = fp
+
+	if IsGzip(fp) {
+		gzipReader, err := gzip.NewReader(fp)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		fileReader = gzipReader
+	}
+
+	events := make([]string, 0)
+	scanner := bufio.NewScanner(fileReader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if eventText := scanner.Text(); len(eventText) > 0 {
+			events = append(events, eventText)
+		}
+	}
+
+	return events, scanner.Err()
+}
+
+// rewriteBundle atomically replaces the contents of a bundle file with the given events.
+func rewriteBundle(fileName string, events []string) error {
+	tempName := filepath.Join(filepath.Dir(fileName), ".retry-"+filepath.Base(fileName))
+
+	if err := ioutil.WriteFile(tempName, []byte(strings.Join(events, "\n")+"\n"), 0644); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return os.Rename(tempName, fileName)
+}
+
+// saveRejectedEvents keeps events that could not be indexed in the debug store, if debugging is enabled.
+func saveRejectedEvents(fileName string, events []string) {
+	if !config.DebugFlag {
+		return
+	}
+
+	dest := filepath.Join(config.DebugStore, filepath.Base(fileName)+".rejected")
+	err := ioutil.WriteFile(dest, []byte(strings.Join(events, "\n")+"\n"), 0644)
+	if err != nil {
+		log.Debugf("Could not save rejected events to %s: %v", dest, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestElasticsearchBulkUpload(t *testing.T) {
+	// the server accepts event 1, asks for event 2 to be retried and rejects event 3
+	actions := make([]map[string]map[string]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("Unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		items := make([]string, 0)
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				t.Fatalf("Could not parse bulk action %s: %s", scanner.Text(), err)
+			}
+			actions = append(actions, action)
+
+			scanner.Scan()
+			var event map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &event)
+
+			status := 201
+			switch event["seq"] {
+			case 2.0:
+				status = 429
+			case 3.0:
+				status = 400
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		}
+
+		fmt.Fprintf(w, `{"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	input, err := ini.Load(strings.NewReader(`
+[output:es]
+output_type=elasticsearch
+elasticsearchout=` + server.URL + `
+index=cb-{{.Type}}-{{.Time.Format "2006.01.02"}}
+bulk_max_events=2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	output := parseOutputConfiguration(input, "es", "output:es", "elasticsearch", JSONOutputFormat, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	behavior := &ElasticsearchBehavior{outputConfig: output}
+	if err := behavior.Initialize(output.OutputParameters); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "elasticsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := []string{
+		`{"seq": 1, "type": "ingress.event.procstart", "timestamp": 1441439437.029, "event_guid": "guid-1"}`,
+		`{"seq": 2, "type": "ingress.event.netconn", "timestamp": 1441439437.029}`,
+		`not json`,
+		`{"seq": 3, "type": "ingress.event.netconn", "timestamp": "2016-08-11T01:01:01Z"}`,
+	}
+	fileName := filepath.Join(dir, "event-forwarder.2016-08-11T01:01:01.000")
+	if err := ioutil.WriteFile(fileName, []byte(strings.Join(events, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadStatus := behavior.Upload(fileName, fp)
+	fp.Close()
+
+	if uploadStatus.result == nil || uploadStatus.status != 429 {
+		t.Errorf("Expected a retryable upload error, got %d: %v", uploadStatus.status, uploadStatus.result)
+	}
+
+	expectedActions := []map[string]string{
+		{"_index": "cb-ingress.event.procstart-2015.09.05", "_id": "guid-1"},
+		{"_index": "cb-ingress.event.netconn-2015.09.05"},
+		{"_index": "cb-ingress.event.netconn-2016.08.11"},
+	}
+	if len(actions) != len(expectedActions) {
+		t.Fatalf("Expected %d bulk actions, got %v", len(expectedActions), actions)
+	}
+	for i, expected := range expectedActions {
+		if fmt.Sprint(actions[i]["index"]) != fmt.Sprint(expected) {
+			t.Errorf("Action %d: expected %v, got %v", i, expected, actions[i]["index"])
+		}
+	}
+
+	// only the event the server asked to retry is left in the bundle
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != events[1]+"\n" {
+		t.Errorf("Unexpected bundle contents after upload: %s", contents)
+	}
+
+	statistics := behavior.Statistics().(ElasticsearchStatistics)
+	if statistics.IndexedEvents != 1 || statistics.RetriedEvents != 1 || statistics.RejectedEvents != 2 {
+		t.Errorf("Unexpected statistics %+v", statistics)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"zvelo.io/ttlru"
+)
+
+/*
+ * Enrichment adds process and sensor details from the Cb API to watchlist hits, feed hits and alerts. Fields
+ * already present in an event are never overwritten.
+ */
+
+var enrichmentResults = expvar.NewMap("enrichment_results")
+
+var eventEnricher *Enricher
+
+type Enricher struct {
+	eventTypes []string
+	timeout    time.Duration
+
+	// enrichmentKey -> map[string]interface{} of the fields to add
+	cache ttlru.Cache
+
+	// a slot is taken for the duration of each event's lookups
+	slots chan struct{}
+
+	// fetches a route from the Cb API
+	get func(route string) ([]byte, error)
+}
+
+// enrichmentKey identifies a process (with its segment) or a sensor (without one).
+type enrichmentKey struct {
+	processGUID string
+	segment     string
+	sensorID    string
+}
+
+// processSummary holds the parts of /api/v1/process/<guid>/<segment> that are added to events.
+type processSummary struct {
+	Process struct {
+		Cmdline    string `json:"cmdline"`
+		Username   string `json:"username"`
+		ParentName string `json:"parent_name"`
+	} `json:"process"`
+	Parent struct {
+		Path    string `json:"path"`
+		Cmdline string `json:"cmdline"`
+	} `json:"parent"`
+}
+
+// sensorInfo holds the parts of /api/v1/sensor/<id> that are added to events.
+type sensorInfo struct {
+	ComputerDNSName string `json:"computer_dns_name"`
+	OSEnvironment   string `json:"os_environment_display_string"`
+}
+
+func NewEnricher(c Configuration) *Enricher {
+	return &Enricher{
+		eventTypes: c.EnrichmentEventTypes,
+		timeout:    c.EnrichmentTimeout,
+		cache:      ttlru.New(c.EnrichmentCacheSize, ttlru.WithTTL(c.EnrichmentCacheTTL)),
+		slots:      make(chan struct{}, c.EnrichmentMaxConcurrent),
+		get:        GetCb,
+	}
+}
+
+// enrichmentKeys returns the keys of the process and sensor an event is about. Watchlist hits on processes carry
+// them in the document that was hit rather than at the top level.
+func enrichmentKeys(msg map[string]interface{}) []enrichmentKey {
+	sources := []map[string]interface{}{msg}
+	if docs, ok := msg["docs"].([]map[string]interface{}); ok && len(docs) > 0 {
+		sources = append(sources, docs[0])
+	}
+
+	var process, sensor enrichmentKey
+	for _, source := range sources {
+		if process.processGUID == "" {
+			process.processGUID, _ = lookupField(source, "process_guid")
+			process.segment, _ = lookupField(source, "segment_id")
+		}
+		if sensor.sensorID == "" {
+			sensor.sensorID, _ = lookupField(source, "sensor_id")
+		}
+	}
+
+	keys := make([]enrichmentKey, 0, 2)
+	if process.processGUID != "" {
+		if process.segment == "" {
+			process.segment = "1"
+		}
+		keys = append(keys, process)
+	}
+	if sensor.sensorID != "" {
+		keys = append(keys, sensor)
+	}
+	return keys
+}
+
+// Enrich adds the details of the event's process and sensor to the event, if it is of one of the configured types.
+func (e *Enricher) Enrich(event *Event) {
+	eventType := event.Type()
+	if !eventTypesMatch(e.eventTypes, eventType) {
+		return
+	}
+
+	msg := event.Map()
+	keys := enrichmentKeys(msg)
+	if len(keys) == 0 {
+		return
+	}
+
+	fields, missing := e.cached(keys)
+	if len(missing) == 0 {
+		e.finish(msg, fields, "cached")
+		return
+	}
+
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+
+	select {
+	case e.slots <- struct{}{}:
+	case <-timer.C:
+		e.finish(msg, fields, "timeout")
+		return
+	}
+
+	type lookupResult struct {
+		fields map[string]interface{}
+		err    error
+	}
+	// buffered so that a lookup that outlives the timeout can still finish and fill the cache
+	results := make(chan lookupResult, 1)
+	go func() {
+		defer func() { <-e.slots }()
+
+		looked, err := e.lookup(missing)
+		results <- lookupResult{looked, err}
+	}()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			log.Debugf("Could not enrich %s event: %s", eventType, result.err)
+			e.finish(msg, fields, "error")
+			return
+		}
+		for k, v := range result.fields {
+			fields[k] = v
+		}
+		e.finish(msg, fields, "enriched")
+	case <-timer.C:
+		e.finish(msg, fields, "timeout")
+	}
+}
+
+// finish adds the fields that the event does not have yet and counts the result.
+func (e *Enricher) finish(msg map[string]interface{}, fields map[string]interface{}, result string) {
+	for k, v := range fields {
+		if _, ok := msg[k]; !ok {
+			msg[k] = v
+		}
+	}
+	enrichmentResults.Add(result, 1)
+	metricEnrichments.Add(1, result)
+}
+
+// cached returns the cached fields for the keys, and the keys that are not cached.
+func (e *Enricher) cached(keys []enrichmentKey) (map[string]interface{}, []enrichmentKey) {
+	fields := make(map[string]interface{})
+	missing := make([]enrichmentKey, 0, len(keys))
+
+	for _, key := range keys {
+		value, ok := e.cache.Get(key)
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		for k, v := range value.(map[string]interface{}) {
+			fields[k] = v
+		}
+	}
+	return fields, missing
+}
+
+// lookup queries the Cb API for each key and caches the results.
+func (e *Enricher) lookup(keys []enrichmentKey) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+
+	for _, key := range keys {
+		var looked map[string]interface{}
+		var err error
+		if key.processGUID != "" {
+			looked, err = e.lookupProcess(key.processGUID, key.segment)
+		} else {
+			looked, err = e.lookupSensor(key.sensorID)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e.cache.Set(key, looked)
+		for k, v := range looked {
+			fields[k] = v
+		}
+	}
+	return fields, nil
+}
+
+func (e *Enricher) lookupProcess(processGUID, segment string) (map[string]interface{}, error) {
+	body, err := e.get(fmt.Sprintf("api/v1/process/%s/%s", processGUID, segment))
+	if err != nil {
+		return nil, err
+	}
+
+	summary := processSummary{}
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{})
+	addNonEmpty(fields, "cmdline", summary.Process.Cmdline)
+	addNonEmpty(fields, "username", summary.Process.Username)
+	addNonEmpty(fields, "parent_name", summary.Process.ParentName)
+	addNonEmpty(fields, "parent_path", summary.Parent.Path)
+	addNonEmpty(fields, "parent_cmdline", summary.Parent.Cmdline)
+	return fields, nil
+}
+
+func (e *Enricher) lookupSensor(sensorID string) (map[string]interface{}, error) {
+	body, err := e.get(fmt.Sprintf("api/v1/sensor/%s", sensorID))
+	if err != nil {
+		return nil, err
+	}
+
+	info := sensorInfo{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{})
+	addNonEmpty(fields, "host_os", info.OSEnvironment)
+	addNonEmpty(fields, "host_dns_name", info.ComputerDNSName)
+	return fields, nil
+}
+
+func addNonEmpty(fields map[string]interface{}, key, value string) {
+	if value != "" {
+		fields[key] = value
+	}
+}
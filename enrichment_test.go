@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestEnrichment(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[enrichment]
+enabled=true
+timeout_ms=100
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.PerformFeedPostprocessing = true
+	c.parseEnrichment(input, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	slow := make(chan struct{})
+	defer close(slow)
+
+	enricher := NewEnricher(c)
+	enricher.get = func(route string) ([]byte, error) {
+		lock.Lock()
+		requests[route]++
+		lock.Unlock()
+
+		switch route {
+		case "api/v1/process/00000001-0000-0b1c-01d2-4f8e2c8f7c3e/2":
+			return []byte(`{"process": {"cmdline": "powershell.exe -enc ZQBj", "username": "CORP\\alice",
+				"parent_name": "winword.exe"}, "parent": {"path": "c:\\program files\\office\\winword.exe"}}`), nil
+		case "api/v1/sensor/1":
+			return []byte(`{"os_environment_display_string": "Windows 10 Enterprise", "computer_dns_name": "ws1"}`),
+				nil
+		case "api/v1/process/00000001-0000-0b1c-01d2-4f8e2c8f7c3f/1":
+			<-slow
+			return []byte(`{}`), nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	alert := func(processGUID string) map[string]interface{} {
+		return map[string]interface{}{"type": "alert.watchlist.hit.query.process", "process_guid": processGUID,
+			"segment_id": "2", "sensor_id": json.Number("1"), "username": "from-the-alert"}
+	}
+
+	enrich := func(msg map[string]interface{}) map[string]interface{} {
+		event := newEvent(msg)
+		enricher.Enrich(event)
+		return event.Map()
+	}
+
+	msg := enrich(alert("00000001-0000-0b1c-01d2-4f8e2c8f7c3e"))
+	expected := map[string]interface{}{
+		"cmdline":     "powershell.exe -enc ZQBj",
+		"username":    "from-the-alert",
+		"parent_name": "winword.exe",
+		"parent_path": "c:\\program files\\office\\winword.exe",
+		"host_os":     "Windows 10 Enterprise",
+	}
+	for k, v := range expected {
+		if msg[k] != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, msg[k])
+		}
+	}
+
+	// a second hit on the same process is served from the cache
+	msg = enrich(alert("00000001-0000-0b1c-01d2-4f8e2c8f7c3e"))
+	if msg["cmdline"] != "powershell.exe -enc ZQBj" {
+		t.Errorf("Cached lookup was not applied: %v", msg)
+	}
+	lock.Lock()
+	if requests["api/v1/process/00000001-0000-0b1c-01d2-4f8e2c8f7c3e/2"] != 1 || requests["api/v1/sensor/1"] != 1 {
+		t.Errorf("Expected each lookup to be made once, got %v", requests)
+	}
+	lock.Unlock()
+
+	// watchlist hits carry the process in their docs
+	start := time.Now()
+	msg = enrich(map[string]interface{}{"type": "watchlist.hit.process", "docs": []map[string]interface{}{
+		{"process_guid": "00000001-0000-0b1c-01d2-4f8e2c8f7c3f", "segment_id": "1", "sensor_id": json.Number("1")},
+	}})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("A slow lookup should have timed out after 100ms, took %s", elapsed)
+	}
+	if msg["host_os"] != "Windows 10 Enterprise" || msg["cmdline"] != nil {
+		t.Errorf("Expected only the cached sensor details after a timeout, got %v", msg)
+	}
+
+	msg = enrich(map[string]interface{}{"type": "ingress.event.procstart",
+		"process_guid": "00000001-0000-0b1c-01d2-4f8e2c8f7c3e"})
+	if len(msg) != 2 {
+		t.Errorf("Event types that are not configured should not be enriched: %v", msg)
+	}
+
+	c = Configuration{}
+	errs = ConfigurationError{Empty: true}
+	c.parseEnrichment(input, &errs)
+	if errs.Empty {
+		t.Error("Expected an error when enrichment is enabled without api_token")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+ * JSON encoding of events without reflection, byte for byte the same as json.Marshal.
+ */
+
+// jsonEscapes holds the escaped form of each ASCII byte that encoding/json escapes, and nil for the others.
+var jsonEscapes [utf8.RuneSelf][]byte
+
+// how encoding/json writes each byte of invalid UTF-8, and the line and paragraph separators U+2028 and U+2029
+var jsonInvalidUTF8, jsonLineSeparator, jsonParagraphSeparator []byte
+
+func init() {
+	for b := 0; b < utf8.RuneSelf; b++ {
+		if escaped := jsonStringContent(string(rune(b))); len(escaped) != 1 {
+			jsonEscapes[b] = escaped
+		}
+	}
+
+	jsonInvalidUTF8 = jsonStringContent("\xff")
+	jsonLineSeparator = jsonStringContent("\u2028")
+	jsonParagraphSeparator = jsonStringContent("\u2029")
+}
+
+// jsonStringContent returns the encoding of s by encoding/json, without its quotes.
+func jsonStringContent(s string) []byte {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return encoded[1 : len(encoded)-1]
+}
+
+var eventJSONBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 0, 1024)
+	return &buf
+}}
+
+// encodeEventJSON returns the JSON encoding of an event, as json.Marshal would.
+func encodeEventJSON(msg map[string]interface{}) (string, error) {
+	bufp := eventJSONBuffers.Get().(*[]byte)
+	defer eventJSONBuffers.Put(bufp)
+
+	buf, err := appendJSONObject((*bufp)[:0], msg)
+	*bufp = buf
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// encodeTypedEventJSON returns the JSON encoding of a typed event, which is the same as that of its map.
+func encodeTypedEventJSON(event typedEvent) (string, error) {
+	bufp := eventJSONBuffers.Get().(*[]byte)
+	defer eventJSONBuffers.Put(bufp)
+
+	w := jsonFieldWriter{buf: append((*bufp)[:0], '{'), extra: newSortedFields(event.extraFields())}
+	event.writeFields(&w)
+	w.extra.writeRest(&w)
+	*bufp = w.buf
+	if w.err != nil {
+		return "", w.err
+	}
+	return string(append(w.buf, '}')), nil
+}
+
+// jsonFieldWriter appends the fields of a typed event to buf, merging in its extra fields.
+type jsonFieldWriter struct {
+	buf    []byte
+	extra  sortedFields
+	fields int
+	err    error
+}
+
+// field writes the key of a typed field and returns true, unless an extra field took its place.
+func (w *jsonFieldWriter) field(key string) bool {
+	if w.extra.writeThrough(key, w) {
+		return false
+	}
+	w.key(key)
+	return true
+}
+
+func (w *jsonFieldWriter) key(key string) {
+	if w.fields > 0 {
+		w.buf = append(w.buf, ',')
+	}
+	w.fields++
+	w.buf = appendJSONString(w.buf, key)
+	w.buf = append(w.buf, ':')
+}
+
+func (w *jsonFieldWriter) writeExtra(key string, value interface{}) {
+	w.key(key)
+	w.value(value)
+}
+
+func (w *jsonFieldWriter) value(value interface{}) {
+	var err error
+	w.buf, err = appendJSONValue(w.buf, value)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *jsonFieldWriter) String(key, value string) {
+	if w.field(key) {
+		w.buf = appendJSONString(w.buf, value)
+	}
+}
+
+func (w *jsonFieldWriter) Number(key string, value json.Number) {
+	if w.field(key) {
+		w.value(value)
+	}
+}
+
+func (w *jsonFieldWriter) Int(key string, value int64) {
+	if w.field(key) {
+		w.buf = strconv.AppendInt(w.buf, value, 10)
+	}
+}
+
+func (w *jsonFieldWriter) Uint(key string, value uint64) {
+	if w.field(key) {
+		w.buf = strconv.AppendUint(w.buf, value, 10)
+	}
+}
+
+func (w *jsonFieldWriter) Float(key string, value float64) {
+	if w.field(key) {
+		w.value(value)
+	}
+}
+
+func (w *jsonFieldWriter) Bool(key string, value bool) {
+	if w.field(key) {
+		w.buf = strconv.AppendBool(w.buf, value)
+	}
+}
+
+func (w *jsonFieldWriter) Value(key string, value interface{}) {
+	if w.field(key) {
+		w.value(value)
+	}
+}
+
+func (w *jsonFieldWriter) Docs(doc map[string]interface{}) {
+	if w.field("docs") {
+		w.buf = append(w.buf, '[')
+		w.value(doc)
+		w.buf = append(w.buf, ']')
+	}
+}
+
+func appendJSONObject(buf []byte, msg map[string]interface{}) ([]byte, error) {
+	if msg == nil {
+		return append(buf, "null"...), nil
+	}
+
+	keys := make([]string, 0, len(msg))
+	for key := range msg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var err error
+	buf = append(buf, '{')
+	for i, key := range keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, key)
+		buf = append(buf, ':')
+		buf, err = appendJSONValue(buf, msg[key])
+		if err != nil {
+			return buf, err
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+func appendJSONValue(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case string:
+		return appendJSONString(buf, v), nil
+	case bool:
+		return strconv.AppendBool(buf, v), nil
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10), nil
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(buf, v, 10), nil
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10), nil
+	case uint64:
+		return strconv.AppendUint(buf, v, 10), nil
+	case float64:
+		if !math.IsInf(v, 0) && !math.IsNaN(v) {
+			return appendJSONFloat(buf, v), nil
+		}
+	case json.Number:
+		if v == "" {
+			return append(buf, '0'), nil
+		}
+		if isJSONNumber(string(v)) {
+			return append(buf, v...), nil
+		}
+	case map[string]interface{}:
+		return appendJSONObject(buf, v)
+	case []interface{}:
+		if v == nil {
+			return append(buf, "null"...), nil
+		}
+		var err error
+		buf = append(buf, '[')
+		for i, element := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf, err = appendJSONValue(buf, element)
+			if err != nil {
+				return buf, err
+			}
+		}
+		return append(buf, ']'), nil
+	case []string:
+		if v == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '[')
+		for i, element := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, element)
+		}
+		return append(buf, ']'), nil
+	}
+
+	// everything else, including the values json.Marshal rejects, is left to encoding/json
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return buf, err
+	}
+	return append(buf, encoded...), nil
+}
+
+// appendJSONFloat formats a float as encoding/json does: like ES6, with exponents only for very large and very
+// small numbers.
+func appendJSONFloat(buf []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(buf)
+		if n >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+			buf[n-2] = buf[n-1]
+			buf = buf[:n-1]
+		}
+	}
+	return buf
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if escaped := jsonEscapes[b]; escaped != nil {
+				buf = append(buf, s[start:i]...)
+				buf = append(buf, escaped...)
+				start = i + 1
+			}
+			i++
+			continue
+		}
+
+		var replacement []byte
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			replacement = jsonInvalidUTF8
+		case r == '\u2028':
+			replacement = jsonLineSeparator
+		case r == '\u2029':
+			replacement = jsonParagraphSeparator
+		}
+		if replacement != nil {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, replacement...)
+			start = i + size
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+// isJSONNumber returns true if s is a valid JSON number, which json.Marshal requires of a json.Number.
+func isJSONNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	// optional minus
+	if s[0] == '-' {
+		s = s[1:]
+		if s == "" {
+			return false
+		}
+	}
+
+	// digits
+	switch {
+	case s[0] == '0':
+		s = s[1:]
+	case '1' <= s[0] && s[0] <= '9':
+		s = s[1:]
+		for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+			s = s[1:]
+		}
+	default:
+		return false
+	}
+
+	// . followed by 1 or more digits
+	if len(s) >= 2 && s[0] == '.' && '0' <= s[1] && s[1] <= '9' {
+		s = s[2:]
+		for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+			s = s[1:]
+		}
+	}
+
+	// e or E followed by an optional - or + and 1 or more digits
+	if len(s) >= 2 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s[0] == '+' || s[0] == '-' {
+			s = s[1:]
+			if s == "" {
+				return false
+			}
+		}
+		for len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+			s = s[1:]
+		}
+	}
+
+	return s == ""
+}
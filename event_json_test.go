@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path"
+	"testing"
+)
+
+// rawTestEvents returns the events decoded from every file under tests/raw_data.
+func rawTestEvents(t testing.TB) []map[string]interface{} {
+	formats := [...]struct {
+		formatType string
+		process    func(string, []byte) ([]map[string]interface{}, error)
+	}{{"json", processJson}, {"protobuf", processProtobuf}}
+
+	config.CbServerURL = "https://cbtests/"
+	config.EventMap = make(map[string]bool)
+	publishLiveConfiguration(&config)
+
+	events := make([]map[string]interface{}, 0)
+	for _, format := range formats {
+		pathname := path.Join("./tests/raw_data", format.formatType)
+		routingKeys, err := ioutil.ReadDir(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, routingKey := range routingKeys {
+			config.EventMap[routingKey.Name()] = true
+
+			routingDir := path.Join(pathname, routingKey.Name())
+			files, err := ioutil.ReadDir(routingDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, file := range files {
+				b, err := ioutil.ReadFile(path.Join(routingDir, file.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				msgs, err := format.process(routingKey.Name(), b)
+				if err != nil {
+					continue
+				}
+				for _, msg := range msgs {
+					if msg != nil {
+						msg["cb_server"] = "cbserver"
+						events = append(events, msg)
+					}
+				}
+			}
+		}
+	}
+	return events
+}
+
+func TestEventJSONMatchesMarshal(t *testing.T) {
+	events := rawTestEvents(t)
+	if len(events) == 0 {
+		t.Fatal("No test events")
+	}
+
+	events = append(events, map[string]interface{}{
+		"html":         "<script>alert(\"x&y\")</script>",
+		"control":      "tab\there\nnew line\x00\x1f\b\f\\",
+		"separators":   "line\u2028paragraph\u2029",
+		"invalid_utf8": "bad\xffbyte\xc3",
+		"unicode":      "c:\\users\\j\u00f6rg\\\u6587\u6863.txt",
+		"floats":       []interface{}{0.0, math.Copysign(0, -1), 1e21, 1e20, 1e-6, 1e-7, 123456789.125, -2.5e-10},
+		"numbers":      []interface{}{json.Number("42"), json.Number("-0.5e+10"), json.Number(""), int32(-7), uint64(1 << 63)},
+		"nested":       map[string]interface{}{"b": []string{"x", "y"}, "a": nil, "c": []string(nil)},
+		"other":        map[string]string{"k": "v"},
+		"":             true,
+	})
+
+	for _, msg := range events {
+		expected, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := encodeEventJSON(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded != string(expected) {
+			t.Errorf("Encoded event differs from json.Marshal:\n%s\n%s", encoded, expected)
+		}
+	}
+}
+
+func TestEventJSONErrors(t *testing.T) {
+	for _, value := range []interface{}{math.NaN(), math.Inf(1), json.Number("0x10"), make(chan int)} {
+		msg := map[string]interface{}{"value": value}
+		if _, err := json.Marshal(msg); err == nil {
+			t.Fatalf("json.Marshal accepted %v", value)
+		}
+		if _, err := encodeEventJSON(msg); err == nil {
+			t.Errorf("Expected an error encoding %v", value)
+		}
+	}
+}
+
+func BenchmarkEventJSONMarshal(b *testing.B) {
+	events := rawTestEvents(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		json.Marshal(events[i%len(events)])
+	}
+}
+
+func BenchmarkEventJSONEncode(b *testing.B) {
+	events := rawTestEvents(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		encodeEventJSON(events[i%len(events)])
+	}
+}
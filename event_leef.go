@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/carbonblack/cb-event-forwarder/leef"
+)
+
+// encodeTypedEventLEEF returns the LEEF encoding of a typed event, which is the same as leef.Encode returns for
+// its map.
+func encodeTypedEventLEEF(event typedEvent) (string, error) {
+	fields, err := event.leefFields()
+	if err != nil {
+		return "", err
+	}
+
+	extra := event.extraFields()
+	if len(fields) > 0 {
+		merged := make(map[string]interface{}, len(extra)+len(fields))
+		for key, value := range extra {
+			merged[key] = value
+		}
+		for key, value := range fields {
+			merged[key] = value
+		}
+		extra = merged
+	}
+
+	w := leefFieldWriter{leef: leef.NewWriter(), extra: newSortedFields(extra)}
+	event.writeFields(&w)
+	w.extra.writeRest(&w)
+	return w.leef.Encoded(), nil
+}
+
+// leefFieldWriter adds the fields of a typed event to a LEEF message, merging in its extra fields and the fields
+// LEEF adds to the event.
+type leefFieldWriter struct {
+	leef  *leef.Writer
+	extra sortedFields
+}
+
+// field returns true if the typed field is to be written, unless an extra field took its place.
+func (w *leefFieldWriter) field(key string) bool {
+	return !w.extra.writeThrough(key, w)
+}
+
+func (w *leefFieldWriter) writeExtra(key string, value interface{}) {
+	w.leef.Add(key, value)
+}
+
+func (w *leefFieldWriter) String(key, value string) {
+	if w.field(key) {
+		w.leef.AddString(key, value)
+	}
+}
+
+func (w *leefFieldWriter) Number(key string, value json.Number) {
+	if w.field(key) {
+		w.leef.AddNumber(key, value)
+	}
+}
+
+func (w *leefFieldWriter) Int(key string, value int64) {
+	if w.field(key) {
+		w.leef.AddInt(key, value)
+	}
+}
+
+func (w *leefFieldWriter) Uint(key string, value uint64) {
+	if w.field(key) {
+		w.leef.AddUint(key, value)
+	}
+}
+
+func (w *leefFieldWriter) Float(key string, value float64) {
+	if w.field(key) {
+		w.leef.AddFloat(key, value)
+	}
+}
+
+func (w *leefFieldWriter) Bool(key string, value bool) {
+	if w.field(key) {
+		w.leef.AddBool(key, value)
+	}
+}
+
+func (w *leefFieldWriter) Value(key string, value interface{}) {
+	if w.field(key) {
+		w.leef.Add(key, value)
+	}
+}
+
+// Docs does nothing, since the fields of the document are promoted to the top level.
+func (w *leefFieldWriter) Docs(doc map[string]interface{}) {}
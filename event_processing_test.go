@@ -1,7 +1,9 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"github.com/streadway/amqp"
 	"io/ioutil"
@@ -22,14 +24,23 @@ func processJson(routingKey string, indata []byte) ([]map[string]interface{}, er
 		return nil, err
 	}
 
-	msgs, err := ProcessJSONMessage(msg, routingKey)
+	events, err := ProcessJSONMessage(msg, routingKey)
 	if err != nil {
 		return nil, err
 	} else {
-		return msgs, nil
+		return eventMaps(events), nil
 	}
 }
 
+// eventMaps converts events to maps for the tests that compare the output of the map encoders.
+func eventMaps(events []*Event) []map[string]interface{} {
+	msgs := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		msgs = append(msgs, event.Map())
+	}
+	return msgs
+}
+
 func marshalJson(msgs []map[string]interface{}) (string, error) {
 	var ret string
 
@@ -48,13 +59,13 @@ func marshalJson(msgs []map[string]interface{}) (string, error) {
 func processProtobuf(routingKey string, indata []byte) ([]map[string]interface{}, error) {
 	emptyHeaders := new(amqp.Table)
 
-	msg, err := ProcessProtobufMessage(routingKey, indata, *emptyHeaders)
+	event, err := ProcessProtobufMessage(routingKey, indata, *emptyHeaders)
 	if err != nil {
 		return nil, err
+	} else if event == nil {
+		return nil, nil
 	} else {
-		msgs := make([]map[string]interface{}, 0, 1)
-		msgs = append(msgs, msg)
-		return msgs, nil
+		return eventMaps([]*Event{event}), nil
 	}
 }
 
@@ -90,6 +101,192 @@ func BenchmarkZipBundleProcessing(b *testing.B) {
 	}
 }
 
+func BenchmarkZipBundleStreaming(b *testing.B) {
+	fn := path.Join("./tests/stress_rabbit/zipbundles/1")
+	fp, _ := os.Open(fn)
+	d, _ := ioutil.ReadAll(fp)
+
+	fakeHeaders := amqp.Table{}
+
+	for i := 0; i < b.N; i++ {
+		ProcessRawZipBundleFunc("", d, fakeHeaders, func(event *Event) {})
+	}
+}
+
+// makeProtobufBundle returns the raw events of a routing key as a single bundle of length prefixed messages.
+func makeProtobufBundle(routingKey string) ([]byte, int, error) {
+	dir := path.Join("./tests/raw_data/protobuf", routingKey)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var bundle bytes.Buffer
+	for _, file := range files {
+		d, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, 0, err
+		}
+		binary.Write(&bundle, binary.LittleEndian, uint32(len(d)))
+		bundle.Write(d)
+	}
+	return bundle.Bytes(), len(files), nil
+}
+
+func BenchmarkProtobufBundleProcessing(b *testing.B) {
+	d, _, err := makeProtobufBundle("ingress.event.remotethread")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	fakeHeaders := amqp.Table{"sensorId": int32(1)}
+
+	for i := 0; i < b.N; i++ {
+		ProcessProtobufBundle("ingress.event.remotethread", d, fakeHeaders)
+	}
+}
+
+func BenchmarkProtobufBundleStreaming(b *testing.B) {
+	d, _, err := makeProtobufBundle("ingress.event.remotethread")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	fakeHeaders := amqp.Table{"sensorId": int32(1)}
+
+	for i := 0; i < b.N; i++ {
+		ProcessProtobufBundleFunc("ingress.event.remotethread", d, fakeHeaders, func(event *Event) {})
+	}
+}
+
+func TestProtobufBundleStreaming(t *testing.T) {
+	config.EventMap = map[string]bool{"ingress.event.remotethread": true}
+	publishLiveConfiguration(&config)
+
+	d, n, err := makeProtobufBundle("ingress.event.remotethread")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := 0
+	err = ProcessProtobufBundleFunc("ingress.event.remotethread", d, amqp.Table{}, func(event *Event) {
+		decoded++
+	})
+	if err != nil || decoded != n {
+		t.Errorf("Expected %d events, got %d (%v)", n, decoded, err)
+	}
+
+	// the events before a truncated message are still passed on
+	decoded = 0
+	err = ProcessProtobufBundleFunc("ingress.event.remotethread", d[:len(d)-1], amqp.Table{},
+		func(event *Event) {
+			decoded++
+		})
+	if err == nil || decoded != n-1 {
+		t.Errorf("Expected an error after %d events, got %d (%v)", n-1, decoded, err)
+	}
+
+	// the same bundle in a zip file
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	f, err := w.Create("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(d)
+	w.Close()
+
+	msgs, err := ProcessRawZipBundle("ingress.event.remotethread", archive.Bytes(), amqp.Table{})
+	if err != nil || len(msgs) != n {
+		t.Errorf("Expected %d events from the zip bundle, got %d (%v)", n, len(msgs), err)
+	}
+}
+
+// TestPartialBundles checks which events of a truncated or malformed bundle are forwarded: those decoded before
+// the error, and none after it.
+func TestPartialBundles(t *testing.T) {
+	const routingKey = "ingress.event.remotethread"
+	config.EventMap = map[string]bool{routingKey: true}
+	publishLiveConfiguration(&config)
+
+	d, n, err := makeProtobufBundle(routingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ProcessProtobufBundle(routingKey, d, amqp.Table{})
+	if err != nil || len(all) != n {
+		t.Fatalf("Expected %d events from the whole bundle, got %d (%v)", n, len(all), err)
+	}
+	encode := func(event *Event) string {
+		event.Set("ingest_ts", "2017-01-01T00:00:00.000Z")
+		return encodeGoldenEvent(t, event, JSONOutputFormat)
+	}
+
+	// the offset of each message's length
+	offsets := make([]int, 0, n)
+	for offset := 0; offset < len(d); offset += 4 + int(binary.LittleEndian.Uint32(d[offset:])) {
+		offsets = append(offsets, offset)
+	}
+
+	malformed := append([]byte{}, d...)
+	binary.LittleEndian.PutUint32(malformed[offsets[2]:], uint32(len(d)))
+
+	for _, test := range []struct {
+		name   string
+		body   []byte
+		events int
+	}{
+		{"truncated in the last message", d[:len(d)-1], n - 1},
+		{"truncated in a length", d[:offsets[3]+2], 3},
+		{"malformed length", malformed, 2},
+	} {
+		events, err := ProcessProtobufBundle(routingKey, test.body, amqp.Table{})
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if len(events) != test.events {
+			t.Errorf("%s: expected the first %d events, got %d", test.name, test.events, len(events))
+			continue
+		}
+		for i, event := range events {
+			if encode(event) != encode(all[i]) {
+				t.Errorf("%s: event %d is not event %d of the bundle", test.name, i, i)
+			}
+		}
+	}
+
+	// processing the delivery forwards the same events, and counts the bundle
+	route := &outputRoute{output: &OutputConfiguration{Name: "partial", OutputFormat: JSONOutputFormat},
+		messages: make(chan string, n), stopped: make(chan struct{})}
+	savedRoutes := outputRoutes
+	outputRoutes = []*outputRoute{route}
+	defer func() { outputRoutes = savedRoutes }()
+
+	partialBundles := func() float64 {
+		metricPartialBundles.Lock()
+		defer metricPartialBundles.Unlock()
+		return metricPartialBundles.values[metricPartialBundles.labels.key([]string{routingKey})]
+	}
+	before := partialBundles()
+
+	processMessage(malformed, routingKey, "application/protobuf", amqp.Table{}, "api.rawsensordata", nil)
+	if len(route.messages) != 2 {
+		t.Errorf("Expected the 2 events before the malformed length to be forwarded, got %d", len(route.messages))
+	}
+	for i := 0; len(route.messages) > 0; i++ {
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(<-route.messages), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if guid, _ := all[i].GetString("target_process_guid"); msg["target_process_guid"] != guid {
+			t.Errorf("Forwarded event %d targets process %v, expected %s", i, msg["target_process_guid"], guid)
+		}
+	}
+	if partialBundles() != before+1 {
+		t.Error("Expected the malformed bundle to be counted")
+	}
+}
+
 type outputMessageFunc func([]map[string]interface{}) (string, error)
 
 func TestEventProcessing(t *testing.T) {
@@ -105,6 +302,7 @@ func processTestEvents(t *testing.T, outputDir string, outputFunc outputMessageF
 
 	config.CbServerURL = "https://cbtests/"
 	config.EventMap = make(map[string]bool)
+	publishLiveConfiguration(&config)
 
 	for _, format := range formats {
 		pathname := path.Join("./tests/raw_data", format.formatType)
@@ -0,0 +1,2123 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/carbonblack/cb-event-forwarder/leef"
+	"github.com/carbonblack/cb-event-forwarder/sensor_events"
+)
+
+/*
+ * Typed events. The most common families of events are held in structs with a typed field for each of their known
+ * fields, which the JSON and LEEF encoders write without going through a map. The protobuf and JSON processors
+ * emit events of these families as typed events and all others as maps; the stages that work on maps, such as
+ * transforms and enrichment, convert a typed event with Event.Map when they apply to it. Fields a family does not
+ * know, or whose values are not of the expected type, are kept as they are and encoded like any map value, so
+ * typed events are encoded byte for byte as their maps would be.
+ */
+
+// Event is an event on its way through the forwarder: a typed event, or a map for the events that are not of one
+// of the typed families or that a stage has needed as a map.
+type Event struct {
+	typed typedEvent
+	msg   map[string]interface{}
+}
+
+// newEvent returns an event for msg, which is typed if it is of one of the typed families.
+func newEvent(msg map[string]interface{}) *Event {
+	if typed := newTypedEvent(msg); typed != nil {
+		return &Event{typed: typed}
+	}
+	return &Event{msg: msg}
+}
+
+// Type returns the type of the event.
+func (e *Event) Type() string {
+	eventType, _ := e.GetString("type")
+	return eventType
+}
+
+// Get returns the value of a field of the event.
+func (e *Event) Get(key string) (interface{}, bool) {
+	if e.typed == nil {
+		value, ok := e.msg[key]
+		return value, ok
+	}
+	if value, ok := e.typed.extraFields()[key]; ok {
+		return value, true
+	}
+	if value, ok := e.typed.field(key); ok {
+		return value, true
+	}
+	return nil, false
+}
+
+// GetString returns the value of a field of the event if it is a string.
+func (e *Event) GetString(key string) (string, bool) {
+	value, _ := e.Get(key)
+	s, ok := value.(string)
+	return s, ok
+}
+
+// Set sets a field of the event.
+func (e *Event) Set(key string, value interface{}) {
+	if e.typed == nil {
+		e.msg[key] = value
+		return
+	}
+	if _, ok := e.typed.extraFields()[key]; !ok && e.typed.setField(key, value) {
+		return
+	}
+	if _, ok := e.typed.field(key); ok {
+		// the typed field cannot hold the new value
+		e.Map()[key] = value
+		return
+	}
+	e.typed.addExtra(key, value)
+}
+
+// Lookup returns the string form of a field of the event, like lookupField.
+func (e *Event) Lookup(field string) (string, bool) {
+	if e.typed == nil {
+		return lookupField(e.msg, field)
+	}
+
+	key, rest := field, ""
+	if i := strings.IndexByte(field, '.'); i >= 0 {
+		key, rest = field[:i], field[i+1:]
+	}
+	value, ok := e.Get(key)
+	if !ok {
+		return "", false
+	}
+	if rest == "" {
+		return fieldString(value)
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	return lookupField(nested, rest)
+}
+
+// Map returns the event as a map, converting a typed event. The map is the event from then on, so changes made to
+// it are forwarded.
+func (e *Event) Map() map[string]interface{} {
+	if e.typed != nil {
+		e.msg = e.copyMap()
+		e.typed = nil
+	}
+	return e.msg
+}
+
+// copyMap returns a copy of the top level of the event as a map, for the encoders that rewrite their map.
+func (e *Event) copyMap() map[string]interface{} {
+	if e.typed == nil {
+		msgCopy := make(map[string]interface{}, len(e.msg))
+		for key, value := range e.msg {
+			msgCopy[key] = value
+		}
+		return msgCopy
+	}
+
+	msg := make(map[string]interface{}, 32)
+	e.typed.fields(msg)
+	for key, value := range e.typed.extraFields() {
+		msg[key] = value
+	}
+	return msg
+}
+
+// typedEvent is an event of one of the families below.
+type typedEvent interface {
+	// setField sets the typed field for key, returning false if the family has no such field or value is not of
+	// its type
+	setField(key string, value interface{}) bool
+	addExtra(key string, value interface{})
+	extraFields() map[string]interface{}
+
+	// field returns the value of the typed field for key, and whether the event has it
+	field(key string) (interface{}, bool)
+
+	// fields adds each of the typed fields the event has to m
+	fields(m map[string]interface{})
+
+	// writeFields passes each of the typed fields the event has to w, in key order
+	writeFields(w eventFieldWriter)
+
+	// leefFields returns the fields that LEEF messages add to the event, or replace
+	leefFields() (map[string]interface{}, error)
+}
+
+// eventFieldWriter receives the typed fields of an event.
+type eventFieldWriter interface {
+	String(key, value string)
+	Number(key string, value json.Number)
+	Int(key string, value int64)
+	Uint(key string, value uint64)
+	Float(key string, value float64)
+	Bool(key string, value bool)
+	Value(key string, value interface{})
+
+	// Docs receives the single document of a feed hit
+	Docs(doc map[string]interface{})
+}
+
+// newTypedEvent returns msg as a typed event, or nil if it is not of one of the typed families.
+func newTypedEvent(msg map[string]interface{}) typedEvent {
+	eventType, _ := msg["type"].(string)
+
+	var event typedEvent
+	switch eventType {
+	case "ingress.event.procstart", "ingress.event.procend", "ingress.event.process":
+		event = new(ProcessEvent)
+	case "ingress.event.moduleload":
+		event = new(ModloadEvent)
+	case "ingress.event.filemod":
+		event = new(FilemodEvent)
+	case "ingress.event.netconn":
+		event = new(NetconnEvent)
+	case "ingress.event.regmod":
+		event = new(RegmodEvent)
+	case "ingress.event.childproc":
+		event = new(ChildprocEvent)
+	case "ingress.event.crossprocopen", "ingress.event.remotethread":
+		event = new(CrossprocEvent)
+	default:
+		switch {
+		case strings.HasPrefix(eventType, "alert."):
+			event = new(AlertEvent)
+		case strings.HasPrefix(eventType, "feed.") && strings.Contains(eventType, ".hit."):
+			event = new(FeedHitEvent)
+		default:
+			return nil
+		}
+	}
+
+	for key, value := range msg {
+		if !event.setField(key, value) {
+			event.addExtra(key, value)
+		}
+	}
+
+	// LEEF messages promote a single document to the top level; leave any other docs to the map encoders
+	if _, ok := event.extraFields()["docs"]; ok {
+		return nil
+	}
+	return event
+}
+
+type eventBase struct {
+	// a bit for each typed field the event has
+	set uint64
+
+	// the fields that are not held in typed fields
+	extra map[string]interface{}
+}
+
+func (b *eventBase) has(field uint64) bool {
+	return b.set&field != 0
+}
+
+// mark records that the event has the typed fields, which the protobuf processor assigns directly.
+func (b *eventBase) mark(fields uint64) {
+	b.set |= fields
+}
+
+func (b *eventBase) addExtra(key string, value interface{}) {
+	if b.extra == nil {
+		b.extra = make(map[string]interface{})
+	}
+	b.extra[key] = value
+}
+
+func (b *eventBase) extraFields() map[string]interface{} {
+	return b.extra
+}
+
+func (b *eventBase) leefFields() (map[string]interface{}, error) {
+	if iocAttr, ok := b.extra["ioc_attr"]; ok {
+		return leef.IOCFields(iocAttr)
+	}
+	return nil, nil
+}
+
+func (b *eventBase) setString(field uint64, dst *string, value interface{}) bool {
+	v, ok := value.(string)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setNumber(field uint64, dst *json.Number, value interface{}) bool {
+	v, ok := value.(json.Number)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setInt32(field uint64, dst *int32, value interface{}) bool {
+	v, ok := value.(int32)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setUint16(field uint64, dst *uint16, value interface{}) bool {
+	v, ok := value.(uint16)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setUint32(field uint64, dst *uint32, value interface{}) bool {
+	v, ok := value.(uint32)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setUint64(field uint64, dst *uint64, value interface{}) bool {
+	v, ok := value.(uint64)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setFloat(field uint64, dst *float64, value interface{}) bool {
+	v, ok := value.(float64)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) setBool(field uint64, dst *bool, value interface{}) bool {
+	v, ok := value.(bool)
+	if ok {
+		*dst = v
+		b.set |= field
+	}
+	return ok
+}
+
+func (b *eventBase) writeString(w eventFieldWriter, field uint64, key, value string) {
+	if b.set&field != 0 {
+		w.String(key, value)
+	}
+}
+
+func (b *eventBase) writeNumber(w eventFieldWriter, field uint64, key string, value json.Number) {
+	if b.set&field != 0 {
+		w.Number(key, value)
+	}
+}
+
+func (b *eventBase) writeInt(w eventFieldWriter, field uint64, key string, value int64) {
+	if b.set&field != 0 {
+		w.Int(key, value)
+	}
+}
+
+func (b *eventBase) writeUint(w eventFieldWriter, field uint64, key string, value uint64) {
+	if b.set&field != 0 {
+		w.Uint(key, value)
+	}
+}
+
+func (b *eventBase) writeFloat(w eventFieldWriter, field uint64, key string, value float64) {
+	if b.set&field != 0 {
+		w.Float(key, value)
+	}
+}
+
+func (b *eventBase) writeBool(w eventFieldWriter, field uint64, key string, value bool) {
+	if b.set&field != 0 {
+		w.Bool(key, value)
+	}
+}
+
+// sortedFields merges the extra fields of an event, in key order, with its typed fields.
+type sortedFields struct {
+	keys   []string
+	values map[string]interface{}
+	next   int
+}
+
+func newSortedFields(values map[string]interface{}) sortedFields {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return sortedFields{keys: keys, values: values}
+}
+
+// extraFieldWriter receives the extra fields of an event.
+type extraFieldWriter interface {
+	writeExtra(key string, value interface{})
+}
+
+// writeThrough writes the fields that sort before key, and key itself if it is one of the fields. It returns
+// true if it was, in which case it takes the place of the typed field.
+func (f *sortedFields) writeThrough(key string, w extraFieldWriter) bool {
+	for f.next < len(f.keys) && f.keys[f.next] <= key {
+		extraKey := f.keys[f.next]
+		f.next++
+		w.writeExtra(extraKey, f.values[extraKey])
+		if extraKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRest writes the fields that have not been written yet.
+func (f *sortedFields) writeRest(w extraFieldWriter) {
+	for ; f.next < len(f.keys); f.next++ {
+		extraKey := f.keys[f.next]
+		w.writeExtra(extraKey, f.values[extraKey])
+	}
+}
+
+// rawEvent holds the fields common to the events decoded from raw sensor messages.
+type rawEvent struct {
+	eventBase
+
+	CbServer          string
+	ComputerName      string
+	EventGUID         string
+	EventType         string
+	ForkPID           int32
+	IngestTS          string
+	LinkProcess       string
+	LinkSensor        string
+	MD5               string
+	PID               int32
+	ProcessCreateTime float64
+	ProcessGUID       string
+	ProcessPath       string
+	SensorID          int32
+	SHA256            string
+	Timestamp         float64
+	Type              string
+}
+
+const (
+	rawFieldCbServer uint64 = 1 << iota
+	rawFieldComputerName
+	rawFieldEventGUID
+	rawFieldEventType
+	rawFieldForkPID
+	rawFieldIngestTS
+	rawFieldLinkProcess
+	rawFieldLinkSensor
+	rawFieldMD5
+	rawFieldPID
+	rawFieldProcessCreateTime
+	rawFieldProcessGUID
+	rawFieldProcessPath
+	rawFieldSensorID
+	rawFieldSHA256
+	rawFieldTimestamp
+	rawFieldType
+
+	// the fields of each family of raw events follow those of rawEvent
+	rawEventFieldCount = iota
+)
+
+func (e *rawEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "cb_server":
+		return e.setString(rawFieldCbServer, &e.CbServer, value)
+	case "computer_name":
+		return e.setString(rawFieldComputerName, &e.ComputerName, value)
+	case "event_guid":
+		return e.setString(rawFieldEventGUID, &e.EventGUID, value)
+	case "event_type":
+		return e.setString(rawFieldEventType, &e.EventType, value)
+	case "fork_pid":
+		return e.setInt32(rawFieldForkPID, &e.ForkPID, value)
+	case "ingest_ts":
+		return e.setString(rawFieldIngestTS, &e.IngestTS, value)
+	case "link_process":
+		return e.setString(rawFieldLinkProcess, &e.LinkProcess, value)
+	case "link_sensor":
+		return e.setString(rawFieldLinkSensor, &e.LinkSensor, value)
+	case "md5":
+		return e.setString(rawFieldMD5, &e.MD5, value)
+	case "pid":
+		return e.setInt32(rawFieldPID, &e.PID, value)
+	case "process_create_time":
+		return e.setFloat(rawFieldProcessCreateTime, &e.ProcessCreateTime, value)
+	case "process_guid":
+		return e.setString(rawFieldProcessGUID, &e.ProcessGUID, value)
+	case "process_path":
+		return e.setString(rawFieldProcessPath, &e.ProcessPath, value)
+	case "sensor_id":
+		return e.setInt32(rawFieldSensorID, &e.SensorID, value)
+	case "sha256":
+		return e.setString(rawFieldSHA256, &e.SHA256, value)
+	case "timestamp":
+		return e.setFloat(rawFieldTimestamp, &e.Timestamp, value)
+	case "type":
+		return e.setString(rawFieldType, &e.Type, value)
+	}
+	return false
+}
+
+func (e *rawEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "cb_server":
+		return e.CbServer, e.has(rawFieldCbServer)
+	case "computer_name":
+		return e.ComputerName, e.has(rawFieldComputerName)
+	case "event_guid":
+		return e.EventGUID, e.has(rawFieldEventGUID)
+	case "event_type":
+		return e.EventType, e.has(rawFieldEventType)
+	case "fork_pid":
+		return e.ForkPID, e.has(rawFieldForkPID)
+	case "ingest_ts":
+		return e.IngestTS, e.has(rawFieldIngestTS)
+	case "link_process":
+		return e.LinkProcess, e.has(rawFieldLinkProcess)
+	case "link_sensor":
+		return e.LinkSensor, e.has(rawFieldLinkSensor)
+	case "md5":
+		return e.MD5, e.has(rawFieldMD5)
+	case "pid":
+		return e.PID, e.has(rawFieldPID)
+	case "process_create_time":
+		return e.ProcessCreateTime, e.has(rawFieldProcessCreateTime)
+	case "process_guid":
+		return e.ProcessGUID, e.has(rawFieldProcessGUID)
+	case "process_path":
+		return e.ProcessPath, e.has(rawFieldProcessPath)
+	case "sensor_id":
+		return e.SensorID, e.has(rawFieldSensorID)
+	case "sha256":
+		return e.SHA256, e.has(rawFieldSHA256)
+	case "timestamp":
+		return e.Timestamp, e.has(rawFieldTimestamp)
+	case "type":
+		return e.Type, e.has(rawFieldType)
+	}
+	return nil, false
+}
+
+func (e *rawEvent) fields(m map[string]interface{}) {
+	if e.has(rawFieldCbServer) {
+		m["cb_server"] = e.CbServer
+	}
+	if e.has(rawFieldComputerName) {
+		m["computer_name"] = e.ComputerName
+	}
+	if e.has(rawFieldEventGUID) {
+		m["event_guid"] = e.EventGUID
+	}
+	if e.has(rawFieldEventType) {
+		m["event_type"] = e.EventType
+	}
+	if e.has(rawFieldForkPID) {
+		m["fork_pid"] = e.ForkPID
+	}
+	if e.has(rawFieldIngestTS) {
+		m["ingest_ts"] = e.IngestTS
+	}
+	if e.has(rawFieldLinkProcess) {
+		m["link_process"] = e.LinkProcess
+	}
+	if e.has(rawFieldLinkSensor) {
+		m["link_sensor"] = e.LinkSensor
+	}
+	if e.has(rawFieldMD5) {
+		m["md5"] = e.MD5
+	}
+	if e.has(rawFieldPID) {
+		m["pid"] = e.PID
+	}
+	if e.has(rawFieldProcessCreateTime) {
+		m["process_create_time"] = e.ProcessCreateTime
+	}
+	if e.has(rawFieldProcessGUID) {
+		m["process_guid"] = e.ProcessGUID
+	}
+	if e.has(rawFieldProcessPath) {
+		m["process_path"] = e.ProcessPath
+	}
+	if e.has(rawFieldSensorID) {
+		m["sensor_id"] = e.SensorID
+	}
+	if e.has(rawFieldSHA256) {
+		m["sha256"] = e.SHA256
+	}
+	if e.has(rawFieldTimestamp) {
+		m["timestamp"] = e.Timestamp
+	}
+	if e.has(rawFieldType) {
+		m["type"] = e.Type
+	}
+}
+
+// ProcessEvent is a process starting or ending (ingress.event.procstart, ingress.event.procend or
+// ingress.event.process).
+type ProcessEvent struct {
+	rawEvent
+
+	CommandLine           string
+	ExpectFollowonWithMD5 bool
+	LinkParent            string
+	ParentCreateTime      float64
+	ParentMD5             string
+	ParentPath            string
+	ParentProcessGUID     string
+	ParentSHA256          string
+	Path                  string
+	UID                   string
+	Username              string
+}
+
+const (
+	procFieldCommandLine uint64 = 1 << (rawEventFieldCount + iota)
+	procFieldExpectFollowonWithMD5
+	procFieldLinkParent
+	procFieldParentCreateTime
+	procFieldParentMD5
+	procFieldParentPath
+	procFieldParentProcessGUID
+	procFieldParentSHA256
+	procFieldPath
+	procFieldUID
+	procFieldUsername
+)
+
+func (e *ProcessEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "command_line":
+		return e.setString(procFieldCommandLine, &e.CommandLine, value)
+	case "expect_followon_w_md5":
+		return e.setBool(procFieldExpectFollowonWithMD5, &e.ExpectFollowonWithMD5, value)
+	case "link_parent":
+		return e.setString(procFieldLinkParent, &e.LinkParent, value)
+	case "parent_create_time":
+		return e.setFloat(procFieldParentCreateTime, &e.ParentCreateTime, value)
+	case "parent_md5":
+		return e.setString(procFieldParentMD5, &e.ParentMD5, value)
+	case "parent_path":
+		return e.setString(procFieldParentPath, &e.ParentPath, value)
+	case "parent_process_guid":
+		return e.setString(procFieldParentProcessGUID, &e.ParentProcessGUID, value)
+	case "parent_sha256":
+		return e.setString(procFieldParentSHA256, &e.ParentSHA256, value)
+	case "path":
+		return e.setString(procFieldPath, &e.Path, value)
+	case "uid":
+		return e.setString(procFieldUID, &e.UID, value)
+	case "username":
+		return e.setString(procFieldUsername, &e.Username, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *ProcessEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "command_line":
+		return e.CommandLine, e.has(procFieldCommandLine)
+	case "expect_followon_w_md5":
+		return e.ExpectFollowonWithMD5, e.has(procFieldExpectFollowonWithMD5)
+	case "link_parent":
+		return e.LinkParent, e.has(procFieldLinkParent)
+	case "parent_create_time":
+		return e.ParentCreateTime, e.has(procFieldParentCreateTime)
+	case "parent_md5":
+		return e.ParentMD5, e.has(procFieldParentMD5)
+	case "parent_path":
+		return e.ParentPath, e.has(procFieldParentPath)
+	case "parent_process_guid":
+		return e.ParentProcessGUID, e.has(procFieldParentProcessGUID)
+	case "parent_sha256":
+		return e.ParentSHA256, e.has(procFieldParentSHA256)
+	case "path":
+		return e.Path, e.has(procFieldPath)
+	case "uid":
+		return e.UID, e.has(procFieldUID)
+	case "username":
+		return e.Username, e.has(procFieldUsername)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *ProcessEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(procFieldCommandLine) {
+		m["command_line"] = e.CommandLine
+	}
+	if e.has(procFieldExpectFollowonWithMD5) {
+		m["expect_followon_w_md5"] = e.ExpectFollowonWithMD5
+	}
+	if e.has(procFieldLinkParent) {
+		m["link_parent"] = e.LinkParent
+	}
+	if e.has(procFieldParentCreateTime) {
+		m["parent_create_time"] = e.ParentCreateTime
+	}
+	if e.has(procFieldParentMD5) {
+		m["parent_md5"] = e.ParentMD5
+	}
+	if e.has(procFieldParentPath) {
+		m["parent_path"] = e.ParentPath
+	}
+	if e.has(procFieldParentProcessGUID) {
+		m["parent_process_guid"] = e.ParentProcessGUID
+	}
+	if e.has(procFieldParentSHA256) {
+		m["parent_sha256"] = e.ParentSHA256
+	}
+	if e.has(procFieldPath) {
+		m["path"] = e.Path
+	}
+	if e.has(procFieldUID) {
+		m["uid"] = e.UID
+	}
+	if e.has(procFieldUsername) {
+		m["username"] = e.Username
+	}
+}
+
+func (e *ProcessEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, procFieldCommandLine, "command_line", e.CommandLine)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeBool(w, procFieldExpectFollowonWithMD5, "expect_followon_w_md5", e.ExpectFollowonWithMD5)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeString(w, procFieldLinkParent, "link_parent", e.LinkParent)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeFloat(w, procFieldParentCreateTime, "parent_create_time", e.ParentCreateTime)
+	e.writeString(w, procFieldParentMD5, "parent_md5", e.ParentMD5)
+	e.writeString(w, procFieldParentPath, "parent_path", e.ParentPath)
+	e.writeString(w, procFieldParentProcessGUID, "parent_process_guid", e.ParentProcessGUID)
+	e.writeString(w, procFieldParentSHA256, "parent_sha256", e.ParentSHA256)
+	e.writeString(w, procFieldPath, "path", e.Path)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+	e.writeString(w, procFieldUID, "uid", e.UID)
+	e.writeString(w, procFieldUsername, "username", e.Username)
+}
+
+// ModloadEvent is a module loaded by a process (ingress.event.moduleload).
+type ModloadEvent struct {
+	rawEvent
+
+	Path string
+}
+
+const (
+	modloadFieldPath uint64 = 1 << (rawEventFieldCount + iota)
+)
+
+func (e *ModloadEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "path":
+		return e.setString(modloadFieldPath, &e.Path, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *ModloadEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "path":
+		return e.Path, e.has(modloadFieldPath)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *ModloadEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(modloadFieldPath) {
+		m["path"] = e.Path
+	}
+}
+
+func (e *ModloadEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeString(w, modloadFieldPath, "path", e.Path)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+}
+
+// FilemodEvent is a file modified by a process (ingress.event.filemod).
+type FilemodEvent struct {
+	rawEvent
+
+	Action       string
+	ActionType   int32
+	FileMD5      string
+	FileSHA256   string
+	FileType     int32
+	FileTypeName string
+	Path         string
+}
+
+const (
+	filemodFieldAction uint64 = 1 << (rawEventFieldCount + iota)
+	filemodFieldActionType
+	filemodFieldFileMD5
+	filemodFieldFileSHA256
+	filemodFieldFileType
+	filemodFieldFileTypeName
+	filemodFieldPath
+)
+
+func (e *FilemodEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "action":
+		return e.setString(filemodFieldAction, &e.Action, value)
+	case "actiontype":
+		return e.setInt32(filemodFieldActionType, &e.ActionType, value)
+	case "file_md5":
+		return e.setString(filemodFieldFileMD5, &e.FileMD5, value)
+	case "file_sha256":
+		return e.setString(filemodFieldFileSHA256, &e.FileSHA256, value)
+	case "filetype":
+		return e.setInt32(filemodFieldFileType, &e.FileType, value)
+	case "filetype_name":
+		return e.setString(filemodFieldFileTypeName, &e.FileTypeName, value)
+	case "path":
+		return e.setString(filemodFieldPath, &e.Path, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *FilemodEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "action":
+		return e.Action, e.has(filemodFieldAction)
+	case "actiontype":
+		return e.ActionType, e.has(filemodFieldActionType)
+	case "file_md5":
+		return e.FileMD5, e.has(filemodFieldFileMD5)
+	case "file_sha256":
+		return e.FileSHA256, e.has(filemodFieldFileSHA256)
+	case "filetype":
+		return e.FileType, e.has(filemodFieldFileType)
+	case "filetype_name":
+		return e.FileTypeName, e.has(filemodFieldFileTypeName)
+	case "path":
+		return e.Path, e.has(filemodFieldPath)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *FilemodEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(filemodFieldAction) {
+		m["action"] = e.Action
+	}
+	if e.has(filemodFieldActionType) {
+		m["actiontype"] = e.ActionType
+	}
+	if e.has(filemodFieldFileMD5) {
+		m["file_md5"] = e.FileMD5
+	}
+	if e.has(filemodFieldFileSHA256) {
+		m["file_sha256"] = e.FileSHA256
+	}
+	if e.has(filemodFieldFileType) {
+		m["filetype"] = e.FileType
+	}
+	if e.has(filemodFieldFileTypeName) {
+		m["filetype_name"] = e.FileTypeName
+	}
+	if e.has(filemodFieldPath) {
+		m["path"] = e.Path
+	}
+}
+
+func (e *FilemodEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, filemodFieldAction, "action", e.Action)
+	e.writeInt(w, filemodFieldActionType, "actiontype", int64(e.ActionType))
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeString(w, filemodFieldFileMD5, "file_md5", e.FileMD5)
+	e.writeString(w, filemodFieldFileSHA256, "file_sha256", e.FileSHA256)
+	e.writeInt(w, filemodFieldFileType, "filetype", int64(e.FileType))
+	e.writeString(w, filemodFieldFileTypeName, "filetype_name", e.FileTypeName)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeString(w, filemodFieldPath, "path", e.Path)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+}
+
+// NetconnEvent is a network connection made or accepted by a process (ingress.event.netconn).
+type NetconnEvent struct {
+	rawEvent
+
+	Direction   string
+	Domain      string
+	IPv4        string
+	LocalIP     string
+	LocalPort   uint16
+	Port        uint16
+	Protocol    int32
+	Proxy       bool
+	ProxyDomain string
+	ProxyIP     string
+	ProxyPort   uint16
+	RemoteIP    string
+	RemotePort  uint16
+}
+
+const (
+	netconnFieldDirection uint64 = 1 << (rawEventFieldCount + iota)
+	netconnFieldDomain
+	netconnFieldIPv4
+	netconnFieldLocalIP
+	netconnFieldLocalPort
+	netconnFieldPort
+	netconnFieldProtocol
+	netconnFieldProxy
+	netconnFieldProxyDomain
+	netconnFieldProxyIP
+	netconnFieldProxyPort
+	netconnFieldRemoteIP
+	netconnFieldRemotePort
+)
+
+func (e *NetconnEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "direction":
+		return e.setString(netconnFieldDirection, &e.Direction, value)
+	case "domain":
+		return e.setString(netconnFieldDomain, &e.Domain, value)
+	case "ipv4":
+		return e.setString(netconnFieldIPv4, &e.IPv4, value)
+	case "local_ip":
+		return e.setString(netconnFieldLocalIP, &e.LocalIP, value)
+	case "local_port":
+		return e.setUint16(netconnFieldLocalPort, &e.LocalPort, value)
+	case "port":
+		return e.setUint16(netconnFieldPort, &e.Port, value)
+	case "protocol":
+		return e.setInt32(netconnFieldProtocol, &e.Protocol, value)
+	case "proxy":
+		return e.setBool(netconnFieldProxy, &e.Proxy, value)
+	case "proxy_domain":
+		return e.setString(netconnFieldProxyDomain, &e.ProxyDomain, value)
+	case "proxy_ip":
+		return e.setString(netconnFieldProxyIP, &e.ProxyIP, value)
+	case "proxy_port":
+		return e.setUint16(netconnFieldProxyPort, &e.ProxyPort, value)
+	case "remote_ip":
+		return e.setString(netconnFieldRemoteIP, &e.RemoteIP, value)
+	case "remote_port":
+		return e.setUint16(netconnFieldRemotePort, &e.RemotePort, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *NetconnEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "direction":
+		return e.Direction, e.has(netconnFieldDirection)
+	case "domain":
+		return e.Domain, e.has(netconnFieldDomain)
+	case "ipv4":
+		return e.IPv4, e.has(netconnFieldIPv4)
+	case "local_ip":
+		return e.LocalIP, e.has(netconnFieldLocalIP)
+	case "local_port":
+		return e.LocalPort, e.has(netconnFieldLocalPort)
+	case "port":
+		return e.Port, e.has(netconnFieldPort)
+	case "protocol":
+		return e.Protocol, e.has(netconnFieldProtocol)
+	case "proxy":
+		return e.Proxy, e.has(netconnFieldProxy)
+	case "proxy_domain":
+		return e.ProxyDomain, e.has(netconnFieldProxyDomain)
+	case "proxy_ip":
+		return e.ProxyIP, e.has(netconnFieldProxyIP)
+	case "proxy_port":
+		return e.ProxyPort, e.has(netconnFieldProxyPort)
+	case "remote_ip":
+		return e.RemoteIP, e.has(netconnFieldRemoteIP)
+	case "remote_port":
+		return e.RemotePort, e.has(netconnFieldRemotePort)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *NetconnEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(netconnFieldDirection) {
+		m["direction"] = e.Direction
+	}
+	if e.has(netconnFieldDomain) {
+		m["domain"] = e.Domain
+	}
+	if e.has(netconnFieldIPv4) {
+		m["ipv4"] = e.IPv4
+	}
+	if e.has(netconnFieldLocalIP) {
+		m["local_ip"] = e.LocalIP
+	}
+	if e.has(netconnFieldLocalPort) {
+		m["local_port"] = e.LocalPort
+	}
+	if e.has(netconnFieldPort) {
+		m["port"] = e.Port
+	}
+	if e.has(netconnFieldProtocol) {
+		m["protocol"] = e.Protocol
+	}
+	if e.has(netconnFieldProxy) {
+		m["proxy"] = e.Proxy
+	}
+	if e.has(netconnFieldProxyDomain) {
+		m["proxy_domain"] = e.ProxyDomain
+	}
+	if e.has(netconnFieldProxyIP) {
+		m["proxy_ip"] = e.ProxyIP
+	}
+	if e.has(netconnFieldProxyPort) {
+		m["proxy_port"] = e.ProxyPort
+	}
+	if e.has(netconnFieldRemoteIP) {
+		m["remote_ip"] = e.RemoteIP
+	}
+	if e.has(netconnFieldRemotePort) {
+		m["remote_port"] = e.RemotePort
+	}
+}
+
+func (e *NetconnEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, netconnFieldDirection, "direction", e.Direction)
+	e.writeString(w, netconnFieldDomain, "domain", e.Domain)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeString(w, netconnFieldIPv4, "ipv4", e.IPv4)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, netconnFieldLocalIP, "local_ip", e.LocalIP)
+	e.writeUint(w, netconnFieldLocalPort, "local_port", uint64(e.LocalPort))
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeUint(w, netconnFieldPort, "port", uint64(e.Port))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeInt(w, netconnFieldProtocol, "protocol", int64(e.Protocol))
+	e.writeBool(w, netconnFieldProxy, "proxy", e.Proxy)
+	e.writeString(w, netconnFieldProxyDomain, "proxy_domain", e.ProxyDomain)
+	e.writeString(w, netconnFieldProxyIP, "proxy_ip", e.ProxyIP)
+	e.writeUint(w, netconnFieldProxyPort, "proxy_port", uint64(e.ProxyPort))
+	e.writeString(w, netconnFieldRemoteIP, "remote_ip", e.RemoteIP)
+	e.writeUint(w, netconnFieldRemotePort, "remote_port", uint64(e.RemotePort))
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+}
+
+// RegmodEvent is a registry modification made by a process (ingress.event.regmod).
+type RegmodEvent struct {
+	rawEvent
+
+	Action     string
+	ActionType int32
+	Path       string
+}
+
+const (
+	regmodFieldAction uint64 = 1 << (rawEventFieldCount + iota)
+	regmodFieldActionType
+	regmodFieldPath
+)
+
+func (e *RegmodEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "action":
+		return e.setString(regmodFieldAction, &e.Action, value)
+	case "actiontype":
+		return e.setInt32(regmodFieldActionType, &e.ActionType, value)
+	case "path":
+		return e.setString(regmodFieldPath, &e.Path, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *RegmodEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "action":
+		return e.Action, e.has(regmodFieldAction)
+	case "actiontype":
+		return e.ActionType, e.has(regmodFieldActionType)
+	case "path":
+		return e.Path, e.has(regmodFieldPath)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *RegmodEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(regmodFieldAction) {
+		m["action"] = e.Action
+	}
+	if e.has(regmodFieldActionType) {
+		m["actiontype"] = e.ActionType
+	}
+	if e.has(regmodFieldPath) {
+		m["path"] = e.Path
+	}
+}
+
+func (e *RegmodEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, regmodFieldAction, "action", e.Action)
+	e.writeInt(w, regmodFieldActionType, "actiontype", int64(e.ActionType))
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeString(w, regmodFieldPath, "path", e.Path)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+}
+
+// ChildprocEvent is a child process started or ended by a process (ingress.event.childproc).
+type ChildprocEvent struct {
+	rawEvent
+
+	ChildCreateTime  float64
+	ChildProcType    sensor_events.CbChildProcessMsg_CbChildProcType
+	ChildProcessGUID string
+	Created          bool
+	LinkChild        string
+	Path             string
+}
+
+const (
+	childprocFieldChildCreateTime uint64 = 1 << (rawEventFieldCount + iota)
+	childprocFieldChildProcType
+	childprocFieldChildProcessGUID
+	childprocFieldCreated
+	childprocFieldLinkChild
+	childprocFieldPath
+)
+
+func (e *ChildprocEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "child_create_time":
+		return e.setFloat(childprocFieldChildCreateTime, &e.ChildCreateTime, value)
+	case "child_proc_type":
+		childProcType, ok := value.(sensor_events.CbChildProcessMsg_CbChildProcType)
+		if ok {
+			e.ChildProcType = childProcType
+			e.set |= childprocFieldChildProcType
+		}
+		return ok
+	case "child_process_guid":
+		return e.setString(childprocFieldChildProcessGUID, &e.ChildProcessGUID, value)
+	case "created":
+		return e.setBool(childprocFieldCreated, &e.Created, value)
+	case "link_child":
+		return e.setString(childprocFieldLinkChild, &e.LinkChild, value)
+	case "path":
+		return e.setString(childprocFieldPath, &e.Path, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *ChildprocEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "child_create_time":
+		return e.ChildCreateTime, e.has(childprocFieldChildCreateTime)
+	case "child_proc_type":
+		return e.ChildProcType, e.has(childprocFieldChildProcType)
+	case "child_process_guid":
+		return e.ChildProcessGUID, e.has(childprocFieldChildProcessGUID)
+	case "created":
+		return e.Created, e.has(childprocFieldCreated)
+	case "link_child":
+		return e.LinkChild, e.has(childprocFieldLinkChild)
+	case "path":
+		return e.Path, e.has(childprocFieldPath)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *ChildprocEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(childprocFieldChildCreateTime) {
+		m["child_create_time"] = e.ChildCreateTime
+	}
+	if e.has(childprocFieldChildProcType) {
+		m["child_proc_type"] = e.ChildProcType
+	}
+	if e.has(childprocFieldChildProcessGUID) {
+		m["child_process_guid"] = e.ChildProcessGUID
+	}
+	if e.has(childprocFieldCreated) {
+		m["created"] = e.Created
+	}
+	if e.has(childprocFieldLinkChild) {
+		m["link_child"] = e.LinkChild
+	}
+	if e.has(childprocFieldPath) {
+		m["path"] = e.Path
+	}
+}
+
+func (e *ChildprocEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeFloat(w, childprocFieldChildCreateTime, "child_create_time", e.ChildCreateTime)
+	if e.has(childprocFieldChildProcType) {
+		w.Value("child_proc_type", e.ChildProcType)
+	}
+	e.writeString(w, childprocFieldChildProcessGUID, "child_process_guid", e.ChildProcessGUID)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeBool(w, childprocFieldCreated, "created", e.Created)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeString(w, childprocFieldLinkChild, "link_child", e.LinkChild)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeString(w, childprocFieldPath, "path", e.Path)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+}
+
+// CrossprocEvent is a handle opened to another process or a thread started in it
+// (ingress.event.crossprocopen and ingress.event.remotethread).
+type CrossprocEvent struct {
+	rawEvent
+
+	CrossProcessType  string
+	IsTarget          bool
+	LinkTarget        string
+	RequestedAccess   uint32
+	TargetCreateTime  uint64
+	TargetMD5         string
+	TargetPath        string
+	TargetPID         uint32
+	TargetProcessGUID string
+	TargetSHA256      string
+}
+
+const (
+	crossprocFieldCrossProcessType uint64 = 1 << (rawEventFieldCount + iota)
+	crossprocFieldIsTarget
+	crossprocFieldLinkTarget
+	crossprocFieldRequestedAccess
+	crossprocFieldTargetCreateTime
+	crossprocFieldTargetMD5
+	crossprocFieldTargetPath
+	crossprocFieldTargetPID
+	crossprocFieldTargetProcessGUID
+	crossprocFieldTargetSHA256
+)
+
+func (e *CrossprocEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "cross_process_type":
+		return e.setString(crossprocFieldCrossProcessType, &e.CrossProcessType, value)
+	case "is_target":
+		return e.setBool(crossprocFieldIsTarget, &e.IsTarget, value)
+	case "link_target":
+		return e.setString(crossprocFieldLinkTarget, &e.LinkTarget, value)
+	case "requested_access":
+		return e.setUint32(crossprocFieldRequestedAccess, &e.RequestedAccess, value)
+	case "target_create_time":
+		return e.setUint64(crossprocFieldTargetCreateTime, &e.TargetCreateTime, value)
+	case "target_md5":
+		return e.setString(crossprocFieldTargetMD5, &e.TargetMD5, value)
+	case "target_path":
+		return e.setString(crossprocFieldTargetPath, &e.TargetPath, value)
+	case "target_pid":
+		return e.setUint32(crossprocFieldTargetPID, &e.TargetPID, value)
+	case "target_process_guid":
+		return e.setString(crossprocFieldTargetProcessGUID, &e.TargetProcessGUID, value)
+	case "target_sha256":
+		return e.setString(crossprocFieldTargetSHA256, &e.TargetSHA256, value)
+	}
+	return e.rawEvent.setField(key, value)
+}
+
+func (e *CrossprocEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "cross_process_type":
+		return e.CrossProcessType, e.has(crossprocFieldCrossProcessType)
+	case "is_target":
+		return e.IsTarget, e.has(crossprocFieldIsTarget)
+	case "link_target":
+		return e.LinkTarget, e.has(crossprocFieldLinkTarget)
+	case "requested_access":
+		return e.RequestedAccess, e.has(crossprocFieldRequestedAccess)
+	case "target_create_time":
+		return e.TargetCreateTime, e.has(crossprocFieldTargetCreateTime)
+	case "target_md5":
+		return e.TargetMD5, e.has(crossprocFieldTargetMD5)
+	case "target_path":
+		return e.TargetPath, e.has(crossprocFieldTargetPath)
+	case "target_pid":
+		return e.TargetPID, e.has(crossprocFieldTargetPID)
+	case "target_process_guid":
+		return e.TargetProcessGUID, e.has(crossprocFieldTargetProcessGUID)
+	case "target_sha256":
+		return e.TargetSHA256, e.has(crossprocFieldTargetSHA256)
+	}
+	return e.rawEvent.field(key)
+}
+
+func (e *CrossprocEvent) fields(m map[string]interface{}) {
+	e.rawEvent.fields(m)
+	if e.has(crossprocFieldCrossProcessType) {
+		m["cross_process_type"] = e.CrossProcessType
+	}
+	if e.has(crossprocFieldIsTarget) {
+		m["is_target"] = e.IsTarget
+	}
+	if e.has(crossprocFieldLinkTarget) {
+		m["link_target"] = e.LinkTarget
+	}
+	if e.has(crossprocFieldRequestedAccess) {
+		m["requested_access"] = e.RequestedAccess
+	}
+	if e.has(crossprocFieldTargetCreateTime) {
+		m["target_create_time"] = e.TargetCreateTime
+	}
+	if e.has(crossprocFieldTargetMD5) {
+		m["target_md5"] = e.TargetMD5
+	}
+	if e.has(crossprocFieldTargetPath) {
+		m["target_path"] = e.TargetPath
+	}
+	if e.has(crossprocFieldTargetPID) {
+		m["target_pid"] = e.TargetPID
+	}
+	if e.has(crossprocFieldTargetProcessGUID) {
+		m["target_process_guid"] = e.TargetProcessGUID
+	}
+	if e.has(crossprocFieldTargetSHA256) {
+		m["target_sha256"] = e.TargetSHA256
+	}
+}
+
+func (e *CrossprocEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, rawFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, rawFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, crossprocFieldCrossProcessType, "cross_process_type", e.CrossProcessType)
+	e.writeString(w, rawFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, rawFieldEventType, "event_type", e.EventType)
+	e.writeInt(w, rawFieldForkPID, "fork_pid", int64(e.ForkPID))
+	e.writeString(w, rawFieldIngestTS, "ingest_ts", e.IngestTS)
+	e.writeBool(w, crossprocFieldIsTarget, "is_target", e.IsTarget)
+	e.writeString(w, rawFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, rawFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, crossprocFieldLinkTarget, "link_target", e.LinkTarget)
+	e.writeString(w, rawFieldMD5, "md5", e.MD5)
+	e.writeInt(w, rawFieldPID, "pid", int64(e.PID))
+	e.writeFloat(w, rawFieldProcessCreateTime, "process_create_time", e.ProcessCreateTime)
+	e.writeString(w, rawFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, rawFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeUint(w, crossprocFieldRequestedAccess, "requested_access", uint64(e.RequestedAccess))
+	e.writeInt(w, rawFieldSensorID, "sensor_id", int64(e.SensorID))
+	e.writeString(w, rawFieldSHA256, "sha256", e.SHA256)
+	e.writeUint(w, crossprocFieldTargetCreateTime, "target_create_time", e.TargetCreateTime)
+	e.writeString(w, crossprocFieldTargetMD5, "target_md5", e.TargetMD5)
+	e.writeString(w, crossprocFieldTargetPath, "target_path", e.TargetPath)
+	e.writeUint(w, crossprocFieldTargetPID, "target_pid", uint64(e.TargetPID))
+	e.writeString(w, crossprocFieldTargetProcessGUID, "target_process_guid", e.TargetProcessGUID)
+	e.writeString(w, crossprocFieldTargetSHA256, "target_sha256", e.TargetSHA256)
+	e.writeFloat(w, rawFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, rawFieldType, "type", e.Type)
+}
+
+// AlertEvent is an alert raised by the Cb server (alert.*). The server sends most of its fields as strings.
+type AlertEvent struct {
+	eventBase
+
+	AlertSeverity     string
+	AlertType         string
+	CbServer          string
+	ComputerName      string
+	CreatedTime       string
+	EventGUID         string
+	FeedID            string
+	FeedName          string
+	FeedRating        string
+	Hostname          string
+	IOCConfidence     string
+	IOCType           string
+	LinkMD5           string
+	LinkProcess       string
+	MD5               string
+	OSType            string
+	ProcessGUID       string
+	ProcessID         string
+	ProcessName       string
+	ProcessPath       string
+	ReportScore       string
+	SegmentID         string
+	SensorCriticality string
+	SensorID          string
+	Status            string
+	Timestamp         json.Number
+	Type              string
+	UniqueID          string
+	Username          string
+	WatchlistID       string
+	WatchlistName     string
+}
+
+const (
+	alertFieldAlertSeverity uint64 = 1 << iota
+	alertFieldAlertType
+	alertFieldCbServer
+	alertFieldComputerName
+	alertFieldCreatedTime
+	alertFieldEventGUID
+	alertFieldFeedID
+	alertFieldFeedName
+	alertFieldFeedRating
+	alertFieldHostname
+	alertFieldIOCConfidence
+	alertFieldIOCType
+	alertFieldLinkMD5
+	alertFieldLinkProcess
+	alertFieldMD5
+	alertFieldOSType
+	alertFieldProcessGUID
+	alertFieldProcessID
+	alertFieldProcessName
+	alertFieldProcessPath
+	alertFieldReportScore
+	alertFieldSegmentID
+	alertFieldSensorCriticality
+	alertFieldSensorID
+	alertFieldStatus
+	alertFieldTimestamp
+	alertFieldType
+	alertFieldUniqueID
+	alertFieldUsername
+	alertFieldWatchlistID
+	alertFieldWatchlistName
+)
+
+func (e *AlertEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "alert_severity":
+		return e.setString(alertFieldAlertSeverity, &e.AlertSeverity, value)
+	case "alert_type":
+		return e.setString(alertFieldAlertType, &e.AlertType, value)
+	case "cb_server":
+		return e.setString(alertFieldCbServer, &e.CbServer, value)
+	case "computer_name":
+		return e.setString(alertFieldComputerName, &e.ComputerName, value)
+	case "created_time":
+		return e.setString(alertFieldCreatedTime, &e.CreatedTime, value)
+	case "event_guid":
+		return e.setString(alertFieldEventGUID, &e.EventGUID, value)
+	case "feed_id":
+		return e.setString(alertFieldFeedID, &e.FeedID, value)
+	case "feed_name":
+		return e.setString(alertFieldFeedName, &e.FeedName, value)
+	case "feed_rating":
+		return e.setString(alertFieldFeedRating, &e.FeedRating, value)
+	case "hostname":
+		return e.setString(alertFieldHostname, &e.Hostname, value)
+	case "ioc_confidence":
+		return e.setString(alertFieldIOCConfidence, &e.IOCConfidence, value)
+	case "ioc_type":
+		return e.setString(alertFieldIOCType, &e.IOCType, value)
+	case "link_md5":
+		return e.setString(alertFieldLinkMD5, &e.LinkMD5, value)
+	case "link_process":
+		return e.setString(alertFieldLinkProcess, &e.LinkProcess, value)
+	case "md5":
+		return e.setString(alertFieldMD5, &e.MD5, value)
+	case "os_type":
+		return e.setString(alertFieldOSType, &e.OSType, value)
+	case "process_guid":
+		return e.setString(alertFieldProcessGUID, &e.ProcessGUID, value)
+	case "process_id":
+		return e.setString(alertFieldProcessID, &e.ProcessID, value)
+	case "process_name":
+		return e.setString(alertFieldProcessName, &e.ProcessName, value)
+	case "process_path":
+		return e.setString(alertFieldProcessPath, &e.ProcessPath, value)
+	case "report_score":
+		return e.setString(alertFieldReportScore, &e.ReportScore, value)
+	case "segment_id":
+		return e.setString(alertFieldSegmentID, &e.SegmentID, value)
+	case "sensor_criticality":
+		return e.setString(alertFieldSensorCriticality, &e.SensorCriticality, value)
+	case "sensor_id":
+		return e.setString(alertFieldSensorID, &e.SensorID, value)
+	case "status":
+		return e.setString(alertFieldStatus, &e.Status, value)
+	case "timestamp":
+		return e.setNumber(alertFieldTimestamp, &e.Timestamp, value)
+	case "type":
+		return e.setString(alertFieldType, &e.Type, value)
+	case "unique_id":
+		return e.setString(alertFieldUniqueID, &e.UniqueID, value)
+	case "username":
+		return e.setString(alertFieldUsername, &e.Username, value)
+	case "watchlist_id":
+		return e.setString(alertFieldWatchlistID, &e.WatchlistID, value)
+	case "watchlist_name":
+		return e.setString(alertFieldWatchlistName, &e.WatchlistName, value)
+	}
+	return false
+}
+
+func (e *AlertEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "alert_severity":
+		return e.AlertSeverity, e.has(alertFieldAlertSeverity)
+	case "alert_type":
+		return e.AlertType, e.has(alertFieldAlertType)
+	case "cb_server":
+		return e.CbServer, e.has(alertFieldCbServer)
+	case "computer_name":
+		return e.ComputerName, e.has(alertFieldComputerName)
+	case "created_time":
+		return e.CreatedTime, e.has(alertFieldCreatedTime)
+	case "event_guid":
+		return e.EventGUID, e.has(alertFieldEventGUID)
+	case "feed_id":
+		return e.FeedID, e.has(alertFieldFeedID)
+	case "feed_name":
+		return e.FeedName, e.has(alertFieldFeedName)
+	case "feed_rating":
+		return e.FeedRating, e.has(alertFieldFeedRating)
+	case "hostname":
+		return e.Hostname, e.has(alertFieldHostname)
+	case "ioc_confidence":
+		return e.IOCConfidence, e.has(alertFieldIOCConfidence)
+	case "ioc_type":
+		return e.IOCType, e.has(alertFieldIOCType)
+	case "link_md5":
+		return e.LinkMD5, e.has(alertFieldLinkMD5)
+	case "link_process":
+		return e.LinkProcess, e.has(alertFieldLinkProcess)
+	case "md5":
+		return e.MD5, e.has(alertFieldMD5)
+	case "os_type":
+		return e.OSType, e.has(alertFieldOSType)
+	case "process_guid":
+		return e.ProcessGUID, e.has(alertFieldProcessGUID)
+	case "process_id":
+		return e.ProcessID, e.has(alertFieldProcessID)
+	case "process_name":
+		return e.ProcessName, e.has(alertFieldProcessName)
+	case "process_path":
+		return e.ProcessPath, e.has(alertFieldProcessPath)
+	case "report_score":
+		return e.ReportScore, e.has(alertFieldReportScore)
+	case "segment_id":
+		return e.SegmentID, e.has(alertFieldSegmentID)
+	case "sensor_criticality":
+		return e.SensorCriticality, e.has(alertFieldSensorCriticality)
+	case "sensor_id":
+		return e.SensorID, e.has(alertFieldSensorID)
+	case "status":
+		return e.Status, e.has(alertFieldStatus)
+	case "timestamp":
+		return e.Timestamp, e.has(alertFieldTimestamp)
+	case "type":
+		return e.Type, e.has(alertFieldType)
+	case "unique_id":
+		return e.UniqueID, e.has(alertFieldUniqueID)
+	case "username":
+		return e.Username, e.has(alertFieldUsername)
+	case "watchlist_id":
+		return e.WatchlistID, e.has(alertFieldWatchlistID)
+	case "watchlist_name":
+		return e.WatchlistName, e.has(alertFieldWatchlistName)
+	}
+	return nil, false
+}
+
+func (e *AlertEvent) fields(m map[string]interface{}) {
+	if e.has(alertFieldAlertSeverity) {
+		m["alert_severity"] = e.AlertSeverity
+	}
+	if e.has(alertFieldAlertType) {
+		m["alert_type"] = e.AlertType
+	}
+	if e.has(alertFieldCbServer) {
+		m["cb_server"] = e.CbServer
+	}
+	if e.has(alertFieldComputerName) {
+		m["computer_name"] = e.ComputerName
+	}
+	if e.has(alertFieldCreatedTime) {
+		m["created_time"] = e.CreatedTime
+	}
+	if e.has(alertFieldEventGUID) {
+		m["event_guid"] = e.EventGUID
+	}
+	if e.has(alertFieldFeedID) {
+		m["feed_id"] = e.FeedID
+	}
+	if e.has(alertFieldFeedName) {
+		m["feed_name"] = e.FeedName
+	}
+	if e.has(alertFieldFeedRating) {
+		m["feed_rating"] = e.FeedRating
+	}
+	if e.has(alertFieldHostname) {
+		m["hostname"] = e.Hostname
+	}
+	if e.has(alertFieldIOCConfidence) {
+		m["ioc_confidence"] = e.IOCConfidence
+	}
+	if e.has(alertFieldIOCType) {
+		m["ioc_type"] = e.IOCType
+	}
+	if e.has(alertFieldLinkMD5) {
+		m["link_md5"] = e.LinkMD5
+	}
+	if e.has(alertFieldLinkProcess) {
+		m["link_process"] = e.LinkProcess
+	}
+	if e.has(alertFieldMD5) {
+		m["md5"] = e.MD5
+	}
+	if e.has(alertFieldOSType) {
+		m["os_type"] = e.OSType
+	}
+	if e.has(alertFieldProcessGUID) {
+		m["process_guid"] = e.ProcessGUID
+	}
+	if e.has(alertFieldProcessID) {
+		m["process_id"] = e.ProcessID
+	}
+	if e.has(alertFieldProcessName) {
+		m["process_name"] = e.ProcessName
+	}
+	if e.has(alertFieldProcessPath) {
+		m["process_path"] = e.ProcessPath
+	}
+	if e.has(alertFieldReportScore) {
+		m["report_score"] = e.ReportScore
+	}
+	if e.has(alertFieldSegmentID) {
+		m["segment_id"] = e.SegmentID
+	}
+	if e.has(alertFieldSensorCriticality) {
+		m["sensor_criticality"] = e.SensorCriticality
+	}
+	if e.has(alertFieldSensorID) {
+		m["sensor_id"] = e.SensorID
+	}
+	if e.has(alertFieldStatus) {
+		m["status"] = e.Status
+	}
+	if e.has(alertFieldTimestamp) {
+		m["timestamp"] = e.Timestamp
+	}
+	if e.has(alertFieldType) {
+		m["type"] = e.Type
+	}
+	if e.has(alertFieldUniqueID) {
+		m["unique_id"] = e.UniqueID
+	}
+	if e.has(alertFieldUsername) {
+		m["username"] = e.Username
+	}
+	if e.has(alertFieldWatchlistID) {
+		m["watchlist_id"] = e.WatchlistID
+	}
+	if e.has(alertFieldWatchlistName) {
+		m["watchlist_name"] = e.WatchlistName
+	}
+}
+
+func (e *AlertEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, alertFieldAlertSeverity, "alert_severity", e.AlertSeverity)
+	e.writeString(w, alertFieldAlertType, "alert_type", e.AlertType)
+	e.writeString(w, alertFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, alertFieldComputerName, "computer_name", e.ComputerName)
+	e.writeString(w, alertFieldCreatedTime, "created_time", e.CreatedTime)
+	e.writeString(w, alertFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeString(w, alertFieldFeedID, "feed_id", e.FeedID)
+	e.writeString(w, alertFieldFeedName, "feed_name", e.FeedName)
+	e.writeString(w, alertFieldFeedRating, "feed_rating", e.FeedRating)
+	e.writeString(w, alertFieldHostname, "hostname", e.Hostname)
+	e.writeString(w, alertFieldIOCConfidence, "ioc_confidence", e.IOCConfidence)
+	e.writeString(w, alertFieldIOCType, "ioc_type", e.IOCType)
+	e.writeString(w, alertFieldLinkMD5, "link_md5", e.LinkMD5)
+	e.writeString(w, alertFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, alertFieldMD5, "md5", e.MD5)
+	e.writeString(w, alertFieldOSType, "os_type", e.OSType)
+	e.writeString(w, alertFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, alertFieldProcessID, "process_id", e.ProcessID)
+	e.writeString(w, alertFieldProcessName, "process_name", e.ProcessName)
+	e.writeString(w, alertFieldProcessPath, "process_path", e.ProcessPath)
+	e.writeString(w, alertFieldReportScore, "report_score", e.ReportScore)
+	e.writeString(w, alertFieldSegmentID, "segment_id", e.SegmentID)
+	e.writeString(w, alertFieldSensorCriticality, "sensor_criticality", e.SensorCriticality)
+	e.writeString(w, alertFieldSensorID, "sensor_id", e.SensorID)
+	e.writeString(w, alertFieldStatus, "status", e.Status)
+	e.writeNumber(w, alertFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, alertFieldType, "type", e.Type)
+	e.writeString(w, alertFieldUniqueID, "unique_id", e.UniqueID)
+	e.writeString(w, alertFieldUsername, "username", e.Username)
+	e.writeString(w, alertFieldWatchlistID, "watchlist_id", e.WatchlistID)
+	e.writeString(w, alertFieldWatchlistName, "watchlist_name", e.WatchlistName)
+}
+
+// FeedHitEvent is a threat intelligence feed hit (feed.*.hit.*).
+type FeedHitEvent struct {
+	eventBase
+
+	CbServer     string
+	CbVersion    string
+	ComputerName string
+	Docs         map[string]interface{}
+	EventGUID    string
+	FeedID       json.Number
+	FeedName     string
+	Group        string
+	Hostname     string
+	IOCType      string
+	IOCValue     string
+	LinkMD5      string
+	LinkProcess  string
+	LinkSensor   string
+	MD5          string
+	OSType       string
+	ProcessGUID  string
+	ProcessID    string
+	ReportID     string
+	ReportScore  json.Number
+	ReportTitle  string
+	SegmentID    string
+	SensorID     json.Number
+	ServerName   string
+	Timestamp    json.Number
+	Type         string
+}
+
+const (
+	feedFieldCbServer uint64 = 1 << iota
+	feedFieldCbVersion
+	feedFieldComputerName
+	feedFieldDocs
+	feedFieldEventGUID
+	feedFieldFeedID
+	feedFieldFeedName
+	feedFieldGroup
+	feedFieldHostname
+	feedFieldIOCType
+	feedFieldIOCValue
+	feedFieldLinkMD5
+	feedFieldLinkProcess
+	feedFieldLinkSensor
+	feedFieldMD5
+	feedFieldOSType
+	feedFieldProcessGUID
+	feedFieldProcessID
+	feedFieldReportID
+	feedFieldReportScore
+	feedFieldReportTitle
+	feedFieldSegmentID
+	feedFieldSensorID
+	feedFieldServerName
+	feedFieldTimestamp
+	feedFieldType
+)
+
+func (e *FeedHitEvent) setField(key string, value interface{}) bool {
+	switch key {
+	case "cb_server":
+		return e.setString(feedFieldCbServer, &e.CbServer, value)
+	case "cb_version":
+		return e.setString(feedFieldCbVersion, &e.CbVersion, value)
+	case "computer_name":
+		return e.setString(feedFieldComputerName, &e.ComputerName, value)
+	case "docs":
+		return e.setDocs(value)
+	case "event_guid":
+		return e.setString(feedFieldEventGUID, &e.EventGUID, value)
+	case "feed_id":
+		return e.setNumber(feedFieldFeedID, &e.FeedID, value)
+	case "feed_name":
+		return e.setString(feedFieldFeedName, &e.FeedName, value)
+	case "group":
+		return e.setString(feedFieldGroup, &e.Group, value)
+	case "hostname":
+		return e.setString(feedFieldHostname, &e.Hostname, value)
+	case "ioc_type":
+		return e.setString(feedFieldIOCType, &e.IOCType, value)
+	case "ioc_value":
+		return e.setString(feedFieldIOCValue, &e.IOCValue, value)
+	case "link_md5":
+		return e.setString(feedFieldLinkMD5, &e.LinkMD5, value)
+	case "link_process":
+		return e.setString(feedFieldLinkProcess, &e.LinkProcess, value)
+	case "link_sensor":
+		return e.setString(feedFieldLinkSensor, &e.LinkSensor, value)
+	case "md5":
+		return e.setString(feedFieldMD5, &e.MD5, value)
+	case "os_type":
+		return e.setString(feedFieldOSType, &e.OSType, value)
+	case "process_guid":
+		return e.setString(feedFieldProcessGUID, &e.ProcessGUID, value)
+	case "process_id":
+		return e.setString(feedFieldProcessID, &e.ProcessID, value)
+	case "report_id":
+		return e.setString(feedFieldReportID, &e.ReportID, value)
+	case "report_score":
+		return e.setNumber(feedFieldReportScore, &e.ReportScore, value)
+	case "report_title":
+		return e.setString(feedFieldReportTitle, &e.ReportTitle, value)
+	case "segment_id":
+		return e.setString(feedFieldSegmentID, &e.SegmentID, value)
+	case "sensor_id":
+		return e.setNumber(feedFieldSensorID, &e.SensorID, value)
+	case "server_name":
+		return e.setString(feedFieldServerName, &e.ServerName, value)
+	case "timestamp":
+		return e.setNumber(feedFieldTimestamp, &e.Timestamp, value)
+	case "type":
+		return e.setString(feedFieldType, &e.Type, value)
+	}
+	return false
+}
+
+func (e *FeedHitEvent) field(key string) (interface{}, bool) {
+	switch key {
+	case "cb_server":
+		return e.CbServer, e.has(feedFieldCbServer)
+	case "cb_version":
+		return e.CbVersion, e.has(feedFieldCbVersion)
+	case "computer_name":
+		return e.ComputerName, e.has(feedFieldComputerName)
+	case "docs":
+		return []map[string]interface{}{e.Docs}, e.has(feedFieldDocs)
+	case "event_guid":
+		return e.EventGUID, e.has(feedFieldEventGUID)
+	case "feed_id":
+		return e.FeedID, e.has(feedFieldFeedID)
+	case "feed_name":
+		return e.FeedName, e.has(feedFieldFeedName)
+	case "group":
+		return e.Group, e.has(feedFieldGroup)
+	case "hostname":
+		return e.Hostname, e.has(feedFieldHostname)
+	case "ioc_type":
+		return e.IOCType, e.has(feedFieldIOCType)
+	case "ioc_value":
+		return e.IOCValue, e.has(feedFieldIOCValue)
+	case "link_md5":
+		return e.LinkMD5, e.has(feedFieldLinkMD5)
+	case "link_process":
+		return e.LinkProcess, e.has(feedFieldLinkProcess)
+	case "link_sensor":
+		return e.LinkSensor, e.has(feedFieldLinkSensor)
+	case "md5":
+		return e.MD5, e.has(feedFieldMD5)
+	case "os_type":
+		return e.OSType, e.has(feedFieldOSType)
+	case "process_guid":
+		return e.ProcessGUID, e.has(feedFieldProcessGUID)
+	case "process_id":
+		return e.ProcessID, e.has(feedFieldProcessID)
+	case "report_id":
+		return e.ReportID, e.has(feedFieldReportID)
+	case "report_score":
+		return e.ReportScore, e.has(feedFieldReportScore)
+	case "report_title":
+		return e.ReportTitle, e.has(feedFieldReportTitle)
+	case "segment_id":
+		return e.SegmentID, e.has(feedFieldSegmentID)
+	case "sensor_id":
+		return e.SensorID, e.has(feedFieldSensorID)
+	case "server_name":
+		return e.ServerName, e.has(feedFieldServerName)
+	case "timestamp":
+		return e.Timestamp, e.has(feedFieldTimestamp)
+	case "type":
+		return e.Type, e.has(feedFieldType)
+	}
+	return nil, false
+}
+
+func (e *FeedHitEvent) fields(m map[string]interface{}) {
+	if e.has(feedFieldCbServer) {
+		m["cb_server"] = e.CbServer
+	}
+	if e.has(feedFieldCbVersion) {
+		m["cb_version"] = e.CbVersion
+	}
+	if e.has(feedFieldComputerName) {
+		m["computer_name"] = e.ComputerName
+	}
+	if e.has(feedFieldDocs) {
+		m["docs"] = []map[string]interface{}{e.Docs}
+	}
+	if e.has(feedFieldEventGUID) {
+		m["event_guid"] = e.EventGUID
+	}
+	if e.has(feedFieldFeedID) {
+		m["feed_id"] = e.FeedID
+	}
+	if e.has(feedFieldFeedName) {
+		m["feed_name"] = e.FeedName
+	}
+	if e.has(feedFieldGroup) {
+		m["group"] = e.Group
+	}
+	if e.has(feedFieldHostname) {
+		m["hostname"] = e.Hostname
+	}
+	if e.has(feedFieldIOCType) {
+		m["ioc_type"] = e.IOCType
+	}
+	if e.has(feedFieldIOCValue) {
+		m["ioc_value"] = e.IOCValue
+	}
+	if e.has(feedFieldLinkMD5) {
+		m["link_md5"] = e.LinkMD5
+	}
+	if e.has(feedFieldLinkProcess) {
+		m["link_process"] = e.LinkProcess
+	}
+	if e.has(feedFieldLinkSensor) {
+		m["link_sensor"] = e.LinkSensor
+	}
+	if e.has(feedFieldMD5) {
+		m["md5"] = e.MD5
+	}
+	if e.has(feedFieldOSType) {
+		m["os_type"] = e.OSType
+	}
+	if e.has(feedFieldProcessGUID) {
+		m["process_guid"] = e.ProcessGUID
+	}
+	if e.has(feedFieldProcessID) {
+		m["process_id"] = e.ProcessID
+	}
+	if e.has(feedFieldReportID) {
+		m["report_id"] = e.ReportID
+	}
+	if e.has(feedFieldReportScore) {
+		m["report_score"] = e.ReportScore
+	}
+	if e.has(feedFieldReportTitle) {
+		m["report_title"] = e.ReportTitle
+	}
+	if e.has(feedFieldSegmentID) {
+		m["segment_id"] = e.SegmentID
+	}
+	if e.has(feedFieldSensorID) {
+		m["sensor_id"] = e.SensorID
+	}
+	if e.has(feedFieldServerName) {
+		m["server_name"] = e.ServerName
+	}
+	if e.has(feedFieldTimestamp) {
+		m["timestamp"] = e.Timestamp
+	}
+	if e.has(feedFieldType) {
+		m["type"] = e.Type
+	}
+}
+
+func (e *FeedHitEvent) writeFields(w eventFieldWriter) {
+	e.writeString(w, feedFieldCbServer, "cb_server", e.CbServer)
+	e.writeString(w, feedFieldCbVersion, "cb_version", e.CbVersion)
+	e.writeString(w, feedFieldComputerName, "computer_name", e.ComputerName)
+	if e.has(feedFieldDocs) {
+		w.Docs(e.Docs)
+	}
+	e.writeString(w, feedFieldEventGUID, "event_guid", e.EventGUID)
+	e.writeNumber(w, feedFieldFeedID, "feed_id", e.FeedID)
+	e.writeString(w, feedFieldFeedName, "feed_name", e.FeedName)
+	e.writeString(w, feedFieldGroup, "group", e.Group)
+	e.writeString(w, feedFieldHostname, "hostname", e.Hostname)
+	e.writeString(w, feedFieldIOCType, "ioc_type", e.IOCType)
+	e.writeString(w, feedFieldIOCValue, "ioc_value", e.IOCValue)
+	e.writeString(w, feedFieldLinkMD5, "link_md5", e.LinkMD5)
+	e.writeString(w, feedFieldLinkProcess, "link_process", e.LinkProcess)
+	e.writeString(w, feedFieldLinkSensor, "link_sensor", e.LinkSensor)
+	e.writeString(w, feedFieldMD5, "md5", e.MD5)
+	e.writeString(w, feedFieldOSType, "os_type", e.OSType)
+	e.writeString(w, feedFieldProcessGUID, "process_guid", e.ProcessGUID)
+	e.writeString(w, feedFieldProcessID, "process_id", e.ProcessID)
+	e.writeString(w, feedFieldReportID, "report_id", e.ReportID)
+	e.writeNumber(w, feedFieldReportScore, "report_score", e.ReportScore)
+	e.writeString(w, feedFieldReportTitle, "report_title", e.ReportTitle)
+	e.writeString(w, feedFieldSegmentID, "segment_id", e.SegmentID)
+	e.writeNumber(w, feedFieldSensorID, "sensor_id", e.SensorID)
+	e.writeString(w, feedFieldServerName, "server_name", e.ServerName)
+	e.writeNumber(w, feedFieldTimestamp, "timestamp", e.Timestamp)
+	e.writeString(w, feedFieldType, "type", e.Type)
+}
+
+// header returns the fields common to the raw events.
+func (e *rawEvent) header() *rawEvent {
+	return e
+}
+
+// setDocs sets the single document of a feed hit. Hits with any other docs, or a document that would replace the
+// type of the event in LEEF messages, are left to the map encoders.
+func (e *FeedHitEvent) setDocs(value interface{}) bool {
+	docs, ok := value.([]map[string]interface{})
+	if !ok || len(docs) != 1 {
+		return false
+	}
+	if _, ok := docs[0]["type"]; ok {
+		return false
+	}
+
+	e.Docs = docs[0]
+	e.set |= feedFieldDocs
+	return true
+}
+
+// leefFields returns the fields of the document, which LEEF messages promote to the top level, along with the
+// connection fields for its ioc_attr.
+func (e *FeedHitEvent) leefFields() (map[string]interface{}, error) {
+	if !e.has(feedFieldDocs) {
+		return e.eventBase.leefFields()
+	}
+
+	fields := make(map[string]interface{}, len(e.Docs))
+	for key, value := range e.Docs {
+		if key != "docs" {
+			fields[key] = value
+		}
+	}
+
+	iocAttr, ok := e.Docs["ioc_attr"]
+	if !ok {
+		iocAttr, ok = e.extra["ioc_attr"]
+	}
+	if ok {
+		connection, err := leef.IOCFields(iocAttr)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range connection {
+			fields[key] = value
+		}
+	}
+	return fields, nil
+}
+
+// leefFields adds the normalized connection fields of the event to those for its ioc_attr.
+func (e *NetconnEvent) leefFields() (map[string]interface{}, error) {
+	fields, err := e.eventBase.leefFields()
+	if err != nil {
+		return nil, err
+	}
+
+	connection := make(map[string]interface{}, 6)
+	e.connectionField(connection, netconnFieldDirection, "direction", e.Direction)
+	e.connectionField(connection, netconnFieldLocalIP, "local_ip", e.LocalIP)
+	e.connectionField(connection, netconnFieldRemoteIP, "remote_ip", e.RemoteIP)
+	e.connectionField(connection, netconnFieldProtocol, "protocol", e.Protocol)
+	e.connectionField(connection, netconnFieldLocalPort, "local_port", e.LocalPort)
+	e.connectionField(connection, netconnFieldRemotePort, "remote_port", e.RemotePort)
+
+	normalized := leef.ConnectionFields(connection)
+	if fields == nil {
+		return normalized, nil
+	}
+	for key, value := range normalized {
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// connectionField looks up one of the fields that the connection fields are normalized from, which may be an
+// extra field if its value is not of the expected type.
+func (e *NetconnEvent) connectionField(connection map[string]interface{}, field uint64, key string,
+	value interface{}) {
+	if e.has(field) {
+		connection[key] = value
+	} else if extra, ok := e.extra[key]; ok {
+		connection[key] = extra
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/carbonblack/cb-event-forwarder/leef"
+	"github.com/carbonblack/cb-event-forwarder/sensor_events"
+	"github.com/golang/protobuf/proto"
+	"github.com/streadway/amqp"
+)
+
+// copyEvent returns a copy of the top level of an event, which leef.Encode rewrites.
+func copyEvent(msg map[string]interface{}) map[string]interface{} {
+	msgCopy := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		msgCopy[k] = v
+	}
+	return msgCopy
+}
+
+// checkTypedEvent compares the typed encodings of an event to the encodings of its map.
+func checkTypedEvent(t *testing.T, msg map[string]interface{}, event typedEvent) {
+	expected, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encodeTypedEventJSON(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != string(expected) {
+		t.Errorf("Typed %T differs from json.Marshal:\n%s\n%s", event, encoded, expected)
+	}
+
+	expectedLEEF, err := leef.Encode(copyEvent(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedLEEF, err := encodeTypedEventLEEF(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodedLEEF != expectedLEEF {
+		t.Errorf("Typed %T differs from leef.Encode:\n%s\n%s", event, encodedLEEF, expectedLEEF)
+	}
+}
+
+func TestTypedEventsMatchMapEncoders(t *testing.T) {
+	families := make(map[string]int)
+	for _, msg := range rawTestEvents(t) {
+		msg["event_guid"] = fmt.Sprintf("cbserver|%v|00000000-0000-0000-0000-000000000000", msg["process_guid"])
+
+		event := newTypedEvent(msg)
+		if event == nil {
+			continue
+		}
+		families[fmt.Sprintf("%T", event)]++
+		checkTypedEvent(t, msg, event)
+	}
+
+	for _, family := range []string{"*main.ProcessEvent", "*main.ModloadEvent", "*main.FilemodEvent",
+		"*main.NetconnEvent", "*main.RegmodEvent", "*main.ChildprocEvent", "*main.CrossprocEvent",
+		"*main.AlertEvent", "*main.FeedHitEvent"} {
+		if families[family] == 0 {
+			t.Errorf("No test events of family %s", family)
+		}
+	}
+}
+
+func TestTypedEventsWithExtraFields(t *testing.T) {
+	tests := []map[string]interface{}{
+		// fields removed, added and of other types than the family expects
+		{"type": "ingress.event.netconn", "direction": "inbound", "local_ip": "10.0.0.1", "local_port": "443",
+			"remote_ip": nil, "remote_port": uint16(50000), "protocol": int32(6), "a": "first", "md5x": 1.5,
+			"pid": json.Number("12"), "zzz": []string{"x"}, "ioc_attr": `{"protocol": 17, "local_ip": "10.0.0.2"}`},
+		{"type": "ingress.event.procstart", "command_line": "a=b\tc\\d\n", "username": "é <&>",
+			"parent_create_time": 1e21, "timestamp": 1.5e-7, "uid": "", "cb_version": []string{"6.1"}},
+		{"type": "ingress.event.childproc", "child_proc_type": sensor_events.CbChildProcessMsg_CbChildProcType(1),
+			"created": true, "sensor_id": int32(-3)},
+		{"type": "ingress.event.crossprocopen", "target_pid": uint32(1 << 31), "target_create_time": uint64(1 << 63),
+			"requested_access": uint32(0x1fffff), "is_target": false},
+
+		// a feed hit whose document replaces fields of the event and has its own ioc_attr
+		{"type": "feed.ingress.hit.process", "feed_id": json.Number("7"), "md5": "ABC", "ioc_attr": map[string]interface{}{
+			"local_ip": "1.2.3.4"}, "docs": []map[string]interface{}{{"md5": "DEF", "cb_version": json.Number("510"),
+			"ioc_attr": map[string]interface{}{"direction": "inbound", "remote_ip": "5.6.7.8"}, "zz": true}}},
+		{"type": "feed.storage.hit.binary", "docs": []map[string]interface{}{{"process_guid": "x"}},
+			"report_score": 100},
+		{"type": "alert.watchlist.hit.query.process", "ioc_attr": map[string]interface{}{}, "sensor_id": json.Number("4"),
+			"timestamp": json.Number("1441439437.029"), "status": "Unresolved"},
+	}
+
+	for _, msg := range tests {
+		event := newTypedEvent(msg)
+		if event == nil {
+			t.Fatalf("Expected a typed event for %v", msg)
+		}
+		checkTypedEvent(t, msg, event)
+	}
+}
+
+func TestTypedEventFallback(t *testing.T) {
+	for _, msg := range []map[string]interface{}{
+		{"type": "ingress.event.tamper"},
+		{"type": "feed.synchronized"},
+		{"docs": []map[string]interface{}{{}}},
+		{"type": "feed.query.hit.process", "docs": []map[string]interface{}{{}, {}}},
+		{"type": "feed.query.hit.process", "docs": []map[string]interface{}{{"type": "ingress.event.netconn"}}},
+		{"type": "ingress.event.regmod", "docs": []interface{}{"not a document"}},
+		{"type": "feed.storage.hit.binary", "docs": []interface{}{map[string]interface{}{"process_guid": "x"}}},
+	} {
+		if event := newTypedEvent(msg); event != nil {
+			t.Errorf("Expected %v to be left to the map encoders, got %T", msg, event)
+		}
+	}
+}
+
+// goldenEvents are the raw events whose output is recorded in tests/golden, from the first five files of each.
+var goldenEvents = []struct {
+	format, routingKey string
+}{
+	{"protobuf", "ingress.event.process"},
+	{"protobuf", "ingress.event.procend"},
+	{"protobuf", "ingress.event.moduleload"},
+	{"protobuf", "ingress.event.filemod"},
+	{"protobuf", "ingress.event.netconn"},
+	{"protobuf", "ingress.event.regmod"},
+	{"protobuf", "ingress.event.childproc"},
+	{"protobuf", "ingress.event.crossprocopen"},
+	{"protobuf", "ingress.event.remotethread"},
+	{"protobuf", "ingress.event.processmeta"},
+	{"protobuf", "ingress.event.stats"},
+	{"protobuf", "ingress.event.vtwrite"},
+	{"json", "alert.watchlist.hit.query.binary"},
+	{"json", "alert.watchlist.hit.query.process"},
+	{"json", "feed.ingress.hit.process"},
+	{"json", "feed.query.hit.process"},
+	{"json", "feed.storage.hit.binary"},
+}
+
+// netconnV2Messages returns netconn messages of the second version, through a web proxy and over IPv6, which none
+// of the recorded events are.
+func netconnV2Messages(t testing.TB) [][]byte {
+	env := &sensor_events.CbEnvironmentMsg{
+		Endpoint: &sensor_events.CbEndpointEnvironmentMsg{SensorId: proto.Int32(1),
+			SensorHostName: proto.String("JASON-WIN81-VM")},
+		Server: &sensor_events.CbServerEnvironmentMsg{NodeId: proto.Int32(0)},
+	}
+	header := &sensor_events.CbHeaderMsg{
+		Version:           proto.Int32(4),
+		Timestamp:         proto.Int64(130921708410000000),
+		ProcessCreateTime: proto.Int64(130921707940000000),
+		ProcessPid:        proto.Int32(2932),
+		ProcessPath:       proto.String(`c:\program files\internet explorer\iexplore.exe`),
+		ProcessMd5:        []byte{0xae, 0x2d, 0x3f, 0x41, 0x5a, 0x66, 0x57, 0x6b, 0x5d, 0x4d, 0x3d, 0x1a, 0x40, 0x2f, 0x2b, 0x46},
+	}
+
+	msgs := []*sensor_events.CbEventMsg{
+		{Header: header, Env: env, Networkv2: &sensor_events.CbNetConnMsgv2{
+			Protocol:        sensor_events.CbNetConnMsgv2_ProtoTcp.Enum(),
+			Utf8Netpath:     []byte("www.example.com"),
+			Outbound:        proto.Bool(true),
+			ProxyConnection: proto.Bool(true),
+			ProxyIpAddress:  &sensor_events.CbIpAddr{Ipv4Address: proto.Uint32(0x0a00000a)},
+			ProxyPort:       proto.Uint32(0x901f),
+			ProxyNetPath:    proto.String("proxy.example.com"),
+			RemoteIpAddress: &sensor_events.CbIpAddr{BIsIpv6: proto.Bool(true), Ipv6High: proto.Uint64(0xb80d0120),
+				Ipv6Low: proto.Uint64(0x0100000000000000), Ipv6Scope: proto.String("2")},
+			RemotePort:     proto.Uint32(0xbb01),
+			LocalIpAddress: &sensor_events.CbIpAddr{Ipv4Address: proto.Uint32(0x0a00a8c0)},
+			LocalPort:      proto.Uint32(0x39c3),
+		}},
+		{Header: header, Env: env, Networkv2: &sensor_events.CbNetConnMsgv2{
+			Protocol:        sensor_events.CbNetConnMsgv2_ProtoUdp.Enum(),
+			Outbound:        proto.Bool(false),
+			RemoteIpAddress: &sensor_events.CbIpAddr{Ipv4Address: proto.Uint32(0x08080808)},
+			RemotePort:      proto.Uint32(0x3500),
+			LocalIpAddress:  &sensor_events.CbIpAddr{Ipv4Address: proto.Uint32(0x0a00a8c0)},
+			LocalPort:       proto.Uint32(0xd2f0),
+		}},
+	}
+
+	bodies := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		body, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[i] = body
+	}
+	return bodies
+}
+
+// decodeEvents decodes a message the way the forwarder does.
+func decodeEvents(format, routingKey string, body []byte) ([]*Event, error) {
+	if format == "protobuf" {
+		event, err := ProcessProtobufMessage(routingKey, body, amqp.Table{})
+		if err != nil || event == nil {
+			return nil, err
+		}
+		return []*Event{event}, nil
+	}
+
+	var msg map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return ProcessJSONMessage(msg, routingKey)
+}
+
+// TestGoldenEvents compares the output of the typed encoders, and of the map encoders for the same events
+// converted to maps, with the output recorded in tests/golden.
+func TestGoldenEvents(t *testing.T) {
+	config.CbServerURL = "https://cbtests/"
+	config.EventMap = make(map[string]bool)
+	for _, golden := range goldenEvents {
+		config.EventMap[golden.routingKey] = true
+	}
+	publishLiveConfiguration(&config)
+
+	for _, golden := range goldenEvents {
+		dir := path.Join("./tests/raw_data", golden.format, golden.routingKey)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var events []*Event
+		for _, file := range files {
+			if len(events) == 5 {
+				break
+			}
+			body, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decodeEvents(golden.format, golden.routingKey, body)
+			if err != nil || len(decoded) == 0 {
+				continue
+			}
+			events = append(events, decoded...)
+		}
+		if golden.routingKey == "ingress.event.netconn" {
+			for _, body := range netconnV2Messages(t) {
+				decoded, err := decodeEvents(golden.format, golden.routingKey, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				events = append(events, decoded...)
+			}
+		}
+
+		var typedJSON, typedLEEF, mapJSON, mapLEEF []string
+		for _, event := range events {
+			if event.typed == nil && newEvent(map[string]interface{}{"type": golden.routingKey}).typed != nil {
+				t.Fatalf("%s: expected a typed event", golden.routingKey)
+			}
+			if _, ok := event.Get("ingest_ts"); ok {
+				event.Set("ingest_ts", "2017-01-01T00:00:00.000Z")
+			}
+			event.Set("cb_server", "cbserver")
+			event.Set("event_guid", "cbserver|golden")
+
+			typedJSON = append(typedJSON, encodeGoldenEvent(t, event, JSONOutputFormat))
+			typedLEEF = append(typedLEEF, encodeGoldenEvent(t, event, LEEFOutputFormat))
+
+			event.Map()
+			mapJSON = append(mapJSON, encodeGoldenEvent(t, event, JSONOutputFormat))
+			mapLEEF = append(mapLEEF, encodeGoldenEvent(t, event, LEEFOutputFormat))
+		}
+
+		for _, output := range []struct {
+			name     string
+			ext      string
+			typed    []string
+			fromMaps []string
+		}{{"JSON", ".json", typedJSON, mapJSON}, {"LEEF", ".leef", typedLEEF, mapLEEF}} {
+			expected, err := ioutil.ReadFile(path.Join("./tests/golden", golden.routingKey+output.ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedLines := strings.Split(strings.TrimSuffix(string(expected), "\n"), "\n")
+			compareGoldenLines(t, golden.routingKey+" typed "+output.name, output.typed, expectedLines)
+			compareGoldenLines(t, golden.routingKey+" map "+output.name, output.fromMaps, expectedLines)
+		}
+	}
+}
+
+func encodeGoldenEvent(t *testing.T, event *Event, outputFormat int) string {
+	encoded, err := encodeMessage(event, outputFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func compareGoldenLines(t *testing.T, name string, lines, expected []string) {
+	if len(lines) != len(expected) {
+		t.Errorf("%s: expected %d events, got %d", name, len(expected), len(lines))
+		return
+	}
+	for i := range lines {
+		if lines[i] != expected[i] {
+			t.Errorf("%s: event %d differs:\n%s\n%s", name, i, lines[i], expected[i])
+		}
+	}
+}
+
+func TestEventFields(t *testing.T) {
+	event := newEvent(map[string]interface{}{"type": "ingress.event.netconn", "remote_port": uint16(443),
+		"local_port": "80", "ioc_attr": map[string]interface{}{"remote_ip": "10.0.0.1"}})
+	if event.typed == nil {
+		t.Fatal("Expected a typed event")
+	}
+
+	if value, ok := event.Get("remote_port"); !ok || value != uint16(443) {
+		t.Errorf("Wrong typed field: %v", value)
+	}
+	if value, ok := event.Get("local_port"); !ok || value != "80" {
+		t.Errorf("Wrong extra field: %v", value)
+	}
+	if _, ok := event.Get("remote_ip"); ok {
+		t.Error("Unset typed fields should be missing")
+	}
+	if value, ok := event.Lookup("ioc_attr.remote_ip"); !ok || value != "10.0.0.1" {
+		t.Errorf("Wrong nested field: %v", value)
+	}
+
+	// values of the expected type are typed, others are kept as extra fields until they are replaced
+	event.Set("protocol", int32(6))
+	event.Set("local_port", uint16(80))
+	event.Set("direction", 1)
+	event.Set("direction", "inbound")
+	if event.typed == nil {
+		t.Fatal("Expected the event to stay typed")
+	}
+	if value, _ := event.Get("direction"); value != "inbound" {
+		t.Errorf("Wrong replaced extra field: %v", value)
+	}
+
+	// a typed field given a value of another type makes the event a map
+	event.Set("remote_port", "443")
+	if event.typed != nil {
+		t.Fatal("Expected the event to be converted to a map")
+	}
+	expected := map[string]interface{}{"type": "ingress.event.netconn", "remote_port": "443",
+		"local_port": uint16(80), "protocol": int32(6), "direction": "inbound",
+		"ioc_attr": map[string]interface{}{"remote_ip": "10.0.0.1"}}
+	if msg := event.Map(); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Wrong map for the event:\n%v\n%v", msg, expected)
+	}
+}
+
+func TestTypedEventErrors(t *testing.T) {
+	event := newTypedEvent(map[string]interface{}{"type": "ingress.event.filemod", "timestamp": 0.0,
+		"process_create_time": json.Number("not a number")})
+	if _, err := encodeTypedEventJSON(event); err == nil {
+		t.Error("Expected an error encoding an invalid number")
+	}
+
+	event = newTypedEvent(map[string]interface{}{"type": "alert.watchlist.hit.query.process", "ioc_attr": "{"})
+	if _, err := encodeTypedEventLEEF(event); err == nil {
+		t.Error("Expected an error encoding an invalid ioc_attr")
+	}
+}
+
+func BenchmarkTypedEventJSON(b *testing.B) {
+	events := rawTestEvents(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := events[i%len(events)]
+		if event := newTypedEvent(msg); event != nil {
+			encodeTypedEventJSON(event)
+		} else {
+			encodeEventJSON(msg)
+		}
+	}
+}
+
+func BenchmarkTypedEventLEEF(b *testing.B) {
+	events := rawTestEvents(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := events[i%len(events)]
+		if event := newTypedEvent(msg); event != nil {
+			encodeTypedEventLEEF(event)
+		} else {
+			leef.Encode(copyEvent(msg))
+		}
+	}
+}
+
+func BenchmarkEventLEEFEncode(b *testing.B) {
+	events := rawTestEvents(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		leef.Encode(copyEvent(events[i%len(events)]))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -29,6 +30,10 @@ type FileOutput struct {
 	lastRolledOver      time.Time
 	sync.RWMutex
 	bufferOutput BufferOutput
+
+	// number of messages written to the buffer, and who to tell once they reach the file
+	received    int64
+	acknowledge DeliveryAcknowledger
 }
 
 type FileStatistics struct {
@@ -50,6 +55,15 @@ func (o *FileOutput) Key() string {
 	return fmt.Sprintf("file:%s", o.outputFileName)
 }
 
+func (o *FileOutput) SetAcknowledger(ack DeliveryAcknowledger) {
+	o.acknowledge = ack
+}
+
+// Probe checks that the output file can be created.
+func (o *FileOutput) Probe(fileName string) error {
+	return checkWritableDirectory(filepath.Dir(fileName))
+}
+
 func (o *FileOutput) Initialize(fileName string) error {
 	o.Lock()
 	defer o.Unlock()
@@ -100,25 +114,27 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	}
 
 	go func() {
+		// closing errorChan tells the dispatcher that this output has stopped
+		defer close(errorChan)
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
-		term := make(chan os.Signal, 1)
-		signal.Notify(term, syscall.SIGTERM)
-		signal.Notify(term, syscall.SIGINT)
-
 		defer o.closeFile()
 		defer o.flushOutput(true)
 		defer signal.Stop(hup)
-		defer signal.Stop(term)
 
 		for {
 
 			select {
-			case message := <-messages:
+			case message, ok := <-messages:
+				if !ok {
+					log.Infof("Closing %s", o.outputFileName)
+					return
+				}
 				if err := o.output(message); err != nil {
 					errorChan <- err
 					return
@@ -140,12 +156,6 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 					errorChan <- err
 					return
 				}
-
-			case <-term:
-				// handle exit gracefully
-				log.Info("Received SIGTERM. Exiting")
-				errorChan <- errors.New("SIGTERM received")
-				return
 			}
 		}
 	}()
@@ -179,6 +189,7 @@ func (o *FileOutput) flushOutput(force bool) error {
 
 			o.bufferOutput.buffer.Reset()
 			o.bufferOutput.lastFlush = time.Now()
+			o.acknowledgeFlushed()
 			return nil
 
 		} else {
@@ -190,6 +201,7 @@ func (o *FileOutput) flushOutput(force bool) error {
 
 			o.bufferOutput.buffer.Reset()
 			o.bufferOutput.lastFlush = time.Now()
+			o.acknowledgeFlushed()
 			return nil
 		}
 
@@ -197,16 +209,27 @@ func (o *FileOutput) flushOutput(force bool) error {
 	return nil
 }
 
+func (o *FileOutput) acknowledgeFlushed() {
+	if o.acknowledge != nil {
+		o.acknowledge(o.received, nil)
+	}
+}
+
 func (o *FileOutput) output(s string) error {
 	/*
 	 * Write to our buffer first
 	 */
 	o.bufferOutput.buffer.WriteString(s + "\n")
+	o.received++
 	err := o.flushOutput(false)
 	return err
 }
 
 func (o *FileOutput) rollOverFile(tf string) (string, error) {
+	// make sure everything buffered so far ends up in the file being rolled over
+	if err := o.flushOutput(true); err != nil {
+		return "", err
+	}
 	o.closeFile()
 
 	newName, err := o.rollOverRename(tf)
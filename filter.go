@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+/*
+ * Event filters
+ *
+ * Filter rules are applied to each event after it has been processed and before it is handed to the outputs.
+ * An event is dropped if it matches any exclude rule, or if include rules apply to its type and it matches none
+ * of them.
+ */
+
+const (
+	FilterInclude = iota
+	FilterExclude
+)
+
+var (
+	filterRuleMatches  = expvar.NewMap("filter_rule_matches")
+	filteredEventCount = expvar.NewInt("filtered_event_count")
+)
+
+type FilterRule struct {
+	Name       string
+	Action     int
+	Field      string
+	EventTypes []string
+
+	matcher func(value string) bool
+}
+
+// Matches returns true if the rule's field is present in the event and its value matches.
+func (r *FilterRule) Matches(event *Event) bool {
+	value, ok := event.Lookup(r.Field)
+	if !ok {
+		return false
+	}
+	return r.matcher(value)
+}
+
+// lookupField returns the string form of a field in msg. Fields of nested objects are named with a dotted path.
+func lookupField(msg map[string]interface{}, field string) (string, bool) {
+	var value interface{} = msg
+	for _, part := range strings.Split(field, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = m[part]
+		if !ok {
+			return "", false
+		}
+	}
+	return fieldString(value)
+}
+
+// fieldString returns the string form of the value of a field.
+func fieldString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// filterEvent returns true if the event should be sent to the outputs.
+func filterEvent(event *Event) bool {
+	rules := currentLiveConfiguration().FilterRules
+	if len(rules) == 0 {
+		return true
+	}
+
+	routingKey := event.Type()
+	hasIncludeRules := false
+	included := false
+
+	for _, rule := range rules {
+		if !eventTypesMatch(rule.EventTypes, routingKey) {
+			continue
+		}
+
+		matched := rule.Matches(event)
+		if matched {
+			filterRuleMatches.Add(rule.Name, 1)
+		}
+
+		switch rule.Action {
+		case FilterExclude:
+			if matched {
+				filteredEventCount.Add(1)
+				metricFilteredEvents.Add(1, routingKey)
+				return false
+			}
+		case FilterInclude:
+			hasIncludeRules = true
+			included = included || matched
+		}
+	}
+
+	if hasIncludeRules && !included {
+		filteredEventCount.Add(1)
+		metricFilteredEvents.Add(1, routingKey)
+		return false
+	}
+	return true
+}
+
+/*
+ * Matchers
+ */
+
+func splitFilterValues(val string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(val, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// globToRegexp converts a glob using '*' and '?' wildcards into an anchored regular expression. Backslashes are
+// treated literally so that Windows paths can be matched.
+func globToRegexp(glob string, ignoreCase bool) (*regexp.Regexp, error) {
+	expr := ""
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(r))
+		}
+	}
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile("^" + expr + "$")
+}
+
+func newGlobMatcher(val string, ignoreCase bool) (func(string) bool, error) {
+	globs := make([]*regexp.Regexp, 0)
+	for _, glob := range splitFilterValues(val) {
+		re, err := globToRegexp(glob, ignoreCase)
+		if err != nil {
+			return nil, err
+		}
+		globs = append(globs, re)
+	}
+
+	return func(value string) bool {
+		for _, re := range globs {
+			if re.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func newValuesMatcher(val string, ignoreCase bool) (func(string) bool, error) {
+	values := make(map[string]bool)
+	for _, v := range splitFilterValues(val) {
+		if ignoreCase {
+			v = strings.ToLower(v)
+		}
+		values[v] = true
+	}
+
+	return func(value string) bool {
+		if ignoreCase {
+			value = strings.ToLower(value)
+		}
+		return values[value]
+	}, nil
+}
+
+func newCIDRMatcher(val string) (func(string) bool, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range splitFilterValues(val) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return func(value string) bool {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return false
+		}
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func newRegexpMatcher(val string, ignoreCase bool) (func(string) bool, error) {
+	if ignoreCase {
+		val = "(?i)" + val
+	}
+	re, err := regexp.Compile(val)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestFilterRules(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[filter:backup-agent]
+action=exclude
+field=process_path
+glob=c:\program files\backup\*.exe
+ignore_case=true
+event_types=ingress.event.filemod
+
+[filter:internal-netconns]
+action=exclude
+field=remote_ip
+cidr=10.0.0.0/8, 192.168.0.0/16
+
+[filter:production-sensors]
+action=include
+field=sensor_id
+values=7, 12
+
+[filter:encoded-powershell]
+action=include
+field=command_line
+regex=(?i)powershell.*-enc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseFilterRules(input, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+	if len(c.FilterRules) != 4 {
+		t.Fatalf("Expected 4 filter rules, got %d", len(c.FilterRules))
+	}
+
+	publishLiveConfiguration(&c)
+	defer publishLiveConfiguration(&config)
+
+	tests := []struct {
+		msg      map[string]interface{}
+		expected bool
+	}{
+		{map[string]interface{}{"type": "ingress.event.filemod", "sensor_id": json.Number("7"),
+			"process_path": `C:\Program Files\Backup\agent.exe`}, false},
+		{map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": json.Number("7"),
+			"process_path": `C:\Program Files\Backup\agent.exe`}, true},
+		{map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": 12, "remote_ip": "10.1.2.3"}, false},
+		{map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": 12, "remote_ip": "8.8.8.8"}, true},
+		{map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": 3}, false},
+		{map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": 3,
+			"command_line": "PowerShell.exe -EncodedCommand ZQBjAGgAbwA="}, true},
+	}
+
+	for i, test := range tests {
+		if filterEvent(newEvent(test.msg)) != test.expected {
+			t.Errorf("Event %d: expected filterEvent to return %v", i, test.expected)
+		}
+	}
+}
+
+func TestFilterRuleErrors(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[filter:two-matchers]
+action=exclude
+field=process_path
+glob=*.exe
+regex=.*
+
+[filter:bad-cidr]
+action=exclude
+field=remote_ip
+cidr=10.0.0.0/33
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseFilterRules(input, &errs)
+	if len(errs.Errors) != 2 || len(c.FilterRules) != 0 {
+		t.Errorf("Expected both rules to be rejected, got errors %v", errs.Errors)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,8 +12,9 @@ import (
 
 /* This is the HTTP implementation of the OutputHandler interface defined in main.go */
 type HttpBehavior struct {
-	dest    string
-	headers map[string]string
+	dest         string
+	headers      map[string]string
+	outputConfig *OutputConfiguration
 
 	client *http.Client
 
@@ -27,7 +29,7 @@ type HttpStatistics struct {
 
 /* Construct the HttpBehavior object */
 func (this *HttpBehavior) Initialize(dest string) error {
-	this.httpPostTemplate = config.HttpPostTemplate
+	this.httpPostTemplate = this.outputConfig.HttpPostTemplate
 	this.firstEventTemplate = template.Must(template.New("first_event").Parse(`{{.}}`))
 	this.subsequentEventTemplate = template.Must(template.New("subsequent_event").Parse("\n, {{.}}"))
 
@@ -36,20 +38,33 @@ func (this *HttpBehavior) Initialize(dest string) error {
 	this.dest = dest
 
 	/* add authorization token, if applicable */
-	if config.HttpAuthorizationToken != nil {
-		this.headers["Authorization"] = *config.HttpAuthorizationToken
+	if this.outputConfig.HttpAuthorizationToken != nil {
+		this.headers["Authorization"] = *this.outputConfig.HttpAuthorizationToken
 	}
 
-	this.headers["Content-Type"] = *config.HttpContentType
+	this.headers["Content-Type"] = *this.outputConfig.HttpContentType
 
 	transport := &http.Transport{
-		TLSClientConfig: config.TLSConfig,
+		TLSClientConfig: this.outputConfig.TLSConfig,
 	}
 	this.client = &http.Client{Transport: transport}
 
 	return nil
 }
 
+// Probe sends a HEAD request to the destination. Any response other than an authorization failure or a server
+// error shows that it can be reached, since the destination may only accept POST.
+func (this *HttpBehavior) Probe() error {
+	status, err := probeHTTP(this.client, "HEAD", this.dest, this.headers)
+	if err != nil {
+		return err
+	}
+	if status == 401 || status == 403 || status >= 500 {
+		return errors.New(fmt.Sprintf("%s returned HTTP %d", this.dest, status))
+	}
+	return nil
+}
+
 func (this *HttpBehavior) String() string {
 	return "HTTP POST " + this.Key()
 }
@@ -86,7 +101,8 @@ func (this *HttpBehavior) Upload(fileName string, fp *os.File) UploadStatus {
 		defer writer.Close()
 
 		// spawn goroutine to read from the file
-		go convertFileIntoTemplate(fp, uploadData.Events, this.firstEventTemplate, this.subsequentEventTemplate)
+		go convertFileIntoTemplate(fp, uploadData.Events, this.firstEventTemplate, this.subsequentEventTemplate,
+			this.outputConfig.CommaSeparateEvents)
 
 		this.httpPostTemplate.Execute(writer, uploadData)
 	}()
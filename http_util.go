@@ -21,7 +21,8 @@ type UploadEvent struct {
 	EventText string
 }
 
-func convertFileIntoTemplate(fp *os.File, events chan<- UploadEvent, firstEventTemplate, subsequentEventTemplate *template.Template) {
+func convertFileIntoTemplate(fp *os.File, events chan<- UploadEvent, firstEventTemplate, subsequentEventTemplate *template.Template,
+	commaSeparateEvents bool) {
 	defer close(events)
 
 	var fileReader io.ReadCloser
@@ -52,7 +53,7 @@ func convertFileIntoTemplate(fp *os.File, events chan<- UploadEvent, firstEventT
 			continue
 		}
 
-		if config.CommaSeparateEvents {
+		if commaSeparateEvents {
 			if i == 0 {
 				err = firstEventTemplate.Execute(&b, eventText)
 			} else {
@@ -229,11 +229,11 @@ func PrettyPrintMap(msg map[string]interface{}) {
 	fmt.Print(string(b))
 }
 
-func ProcessJSONMessage(msg map[string]interface{}, routingKey string) ([]map[string]interface{}, error) {
+func ProcessJSONMessage(msg map[string]interface{}, routingKey string) ([]*Event, error) {
 	msg["type"] = fixupMessageType(routingKey)
 	fixupMessage(routingKey, msg)
 
-	msgs := make([]map[string]interface{}, 0, 1)
+	events := make([]*Event, 0, 1)
 
 	// explode watchlist/feed hit messages that include a "docs" array
 	if val, ok := msg["docs"]; ok {
@@ -248,28 +248,28 @@ func ProcessJSONMessage(msg map[string]interface{}, routingKey string) ([]map[st
 			fixupMessage(routingKey, newDoc)
 			newSlice = append(newSlice, newDoc)
 			newMsg["docs"] = newSlice
-			msgs = append(msgs, newMsg)
+			events = append(events, newEvent(newMsg))
 		}
 	} else {
-		msgs = append(msgs, msg)
+		events = append(events, newEvent(msg))
 	}
 
-	return msgs, nil
+	return events, nil
 }
 
 /*
  * Used to perform postprocessing on messages.  For exmaple, for feed hits we need to grab the report_title.
  * To do this we must query the Cb Response Server's REST API to get the report_title.  NOTE: In order to do this
  * functionality we need the Cb Response Server URL and API Token set within the config.
+ * Watchlist hits, feed hits and alerts are also enriched with process and sensor details if [enrichment] is enabled.
  */
-func PostprocessJSONMessage(msg map[string]interface{}) map[string]interface{} {
+func PostprocessJSONMessage(event *Event) {
 
-	if val, ok := msg["type"]; ok {
-		messageType := val.(string)
+	if messageType, ok := event.GetString("type"); ok {
 
 		if strings.HasPrefix(messageType, "feed.") {
-			feedId, feedIdPresent := msg["feed_id"]
-			reportId, reportIdPresent := msg["report_id"]
+			feedId, feedIdPresent := event.Get("feed_id")
+			reportId, reportIdPresent := event.Get("report_id")
 
 			/*
 			 * First make sure these fields are present
@@ -292,8 +292,8 @@ func PostprocessJSONMessage(msg map[string]interface{}) map[string]interface{} {
 							/*
 							 * Finally save the report_title into this message
 							 */
-							msg["report_title"] = reportTitle
-							msg["report_score"] = reportScore
+							event.Set("report_title", reportTitle)
+							event.Set("report_score", reportScore)
 							/*
 								log.Infof("report title for id %s:%s == %s\n",
 									feedId.(json.Number).String(),
@@ -313,5 +313,8 @@ func PostprocessJSONMessage(msg map[string]interface{}) map[string]interface{} {
 		}
 
 	}
-	return msg
+
+	if eventEnricher != nil {
+		eventEnricher.Enrich(event)
+	}
 }
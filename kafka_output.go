@@ -1,8 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"sync"
+	"text/template"
 	"time"
 
 	"fmt"
@@ -15,12 +17,43 @@ import (
 	"syscall"
 )
 
+// functions available to topic_template, in addition to the text/template builtins
+var kafkaTopicFuncs = template.FuncMap{
+	"replace":    func(s, old, new string) string { return strings.Replace(s, old, new, -1) },
+	"trimPrefix": strings.TrimPrefix,
+	"lower":      strings.ToLower,
+}
+
+// parseKafkaTopicTemplate parses a topic_template. Executing the template fails if it refers to a field the
+// event does not have; optional fields can be looked up with index instead.
+func parseKafkaTopicTemplate(text string) (*template.Template, error) {
+	return template.New("kafka_topic").Option("missingkey=error").Funcs(kafkaTopicFuncs).Parse(text)
+}
+
 type KafkaOutput struct {
 	brokers           []string
+	outputConfig      *OutputConfiguration
 	topicSuffix       string
 	producer          sarama.AsyncProducer
 	droppedEventCount int64
 	eventSentCount    int64
+	retriedEventCount int64
+
+	// topics and partition keys computed from the original events, in the same order as the message channel
+	addresses     []kafkaAddress
+	addressesLock sync.Mutex
+
+	// the producer reports results out of order; completed holds them until they can be acknowledged in order
+	received     int64
+	acknowledged int64
+	completed    map[int64]error
+	acknowledge  DeliveryAcknowledger
+	ackLock      sync.Mutex
+
+	// resends scheduled by resend; once closing is set no more are scheduled, so that the producer can be closed
+	// after the pending ones have been handed to it
+	resends sync.WaitGroup
+	closing bool
 
 	sync.RWMutex
 }
@@ -28,22 +61,113 @@ type KafkaOutput struct {
 type KafkaStatistics struct {
 	DroppedEventCount int64 `json:"dropped_event_count"`
 	EventSentCount    int64 `json:"event_sent_count"`
+	RetriedEventCount int64 `json:"retried_event_count"`
+}
+
+type kafkaAddress struct {
+	topic string
+	key   string
+}
+
+// kafkaMetadata travels with each message through the producer
+type kafkaMetadata struct {
+	sequence int64
+	attempts int
+}
+
+func (o *KafkaOutput) SetAcknowledger(ack DeliveryAcknowledger) {
+	o.acknowledge = ack
+	o.completed = make(map[int64]error)
+}
+
+func (o *KafkaOutput) messageCompleted(metadata interface{}, err error) {
+	m, ok := metadata.(*kafkaMetadata)
+	if !ok || o.acknowledge == nil {
+		return
+	}
+
+	o.ackLock.Lock()
+	defer o.ackLock.Unlock()
+
+	o.completed[m.sequence] = err
+	for {
+		err, ok := o.completed[o.acknowledged+1]
+		if !ok {
+			break
+		}
+		delete(o.completed, o.acknowledged+1)
+		o.acknowledged++
+		o.acknowledge(o.acknowledged, err)
+	}
+}
+
+// Address computes the topic and partition key for an event; it is called by the dispatcher just before the
+// encoded event is queued on the message channel.
+func (o *KafkaOutput) Address(event *Event) {
+	var address kafkaAddress
+
+	if len(o.outputConfig.KafkaPartitionKey) > 0 {
+		address.key, _ = event.Lookup(o.outputConfig.KafkaPartitionKey)
+	}
+
+	if o.outputConfig.KafkaTopicTemplate != nil {
+		var topic bytes.Buffer
+		if err := o.outputConfig.KafkaTopicTemplate.Execute(&topic, event.copyMap()); err != nil {
+			log.Infof("Could not apply topic_template, using the default topic: %s", err)
+		} else {
+			address.topic = topic.String()
+		}
+	}
+
+	if len(address.topic) == 0 {
+		if eventType, ok := event.GetString("type"); ok {
+			address.topic = strings.Replace(eventType, "ingress.event.", "", -1)
+		}
+	}
+
+	if len(address.topic) > 0 {
+		address.topic += o.topicSuffix
+	}
+
+	o.addressesLock.Lock()
+	o.addresses = append(o.addresses, address)
+	o.addressesLock.Unlock()
+}
+
+// Unaddress withdraws the address of the last event, which the dispatcher could not queue.
+func (o *KafkaOutput) Unaddress() {
+	o.addressesLock.Lock()
+	o.addresses = o.addresses[:len(o.addresses)-1]
+	o.addressesLock.Unlock()
+}
+
+// nextAddress returns the address of the message just read from the message channel. The dispatcher adds it
+// before it queues the message, so it is always there.
+func (o *KafkaOutput) nextAddress() kafkaAddress {
+	o.addressesLock.Lock()
+	defer o.addressesLock.Unlock()
+
+	address := o.addresses[0]
+	o.addresses = o.addresses[1:]
+	return address
 }
 
 func (o *KafkaOutput) Initialize(unused string) error {
 	o.Lock()
 	defer o.Unlock()
 
-	o.brokers = strings.Split(*config.KafkaBrokers, ",")
-	o.topicSuffix = *config.KafkaTopicSuffix
-
-	kafkaConfig := sarama.NewConfig()
-	kafkaConfig.Producer.Return.Successes = true
+	if o.outputConfig.KafkaBrokers == nil {
+		return errors.New("No kafka brokers configured")
+	}
 
-	producer, err := sarama.NewAsyncProducer(o.brokers, kafkaConfig)
+	o.brokers = strings.Split(*o.outputConfig.KafkaBrokers, ",")
+	if o.outputConfig.KafkaTopicSuffix != nil {
+		o.topicSuffix = *o.outputConfig.KafkaTopicSuffix
+	}
 
+	producer, err := sarama.NewAsyncProducer(o.brokers, o.producerConfig())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	o.producer = producer
@@ -51,17 +175,75 @@ func (o *KafkaOutput) Initialize(unused string) error {
 	return nil
 }
 
+// Probe fetches the cluster metadata from the brokers.
+func (o *KafkaOutput) Probe(unused string) error {
+	if o.outputConfig.KafkaBrokers == nil {
+		return errors.New("No kafka brokers configured")
+	}
+
+	kafkaConfig := o.producerConfig()
+	kafkaConfig.Net.DialTimeout = probeTimeout
+	kafkaConfig.Metadata.Retry.Max = 0
+
+	client, err := sarama.NewClient(strings.Split(*o.outputConfig.KafkaBrokers, ","), kafkaConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if len(client.Brokers()) == 0 {
+		return errors.New("The cluster metadata does not list any brokers")
+	}
+	return nil
+}
+
+func (o *KafkaOutput) producerConfig() *sarama.Config {
+	kafkaConfig := sarama.NewConfig()
+	kafkaConfig.ClientID = "cb-event-forwarder"
+	kafkaConfig.Version = o.outputConfig.KafkaVersion
+
+	kafkaConfig.Producer.Return.Successes = true
+	kafkaConfig.Producer.RequiredAcks = o.outputConfig.KafkaRequiredAcks
+	kafkaConfig.Producer.Compression = o.outputConfig.KafkaCompression
+	kafkaConfig.Producer.Retry.Max = o.outputConfig.KafkaRetryMax
+	kafkaConfig.Producer.Retry.Backoff = o.outputConfig.KafkaRetryBackoff
+
+	if o.outputConfig.KafkaIdempotent {
+		// the idempotent producer can only keep messages in order with a single request in flight
+		kafkaConfig.Producer.Idempotent = true
+		kafkaConfig.Net.MaxOpenRequests = 1
+	} else if len(o.outputConfig.KafkaPartitionKey) > 0 {
+		// keyed messages are only retried by the producer, which keeps them in order with one request in flight
+		kafkaConfig.Net.MaxOpenRequests = 1
+	}
+
+	if o.outputConfig.KafkaUseTLS {
+		kafkaConfig.Net.TLS.Enable = true
+		kafkaConfig.Net.TLS.Config = o.outputConfig.TLSConfig
+	}
+
+	if len(o.outputConfig.KafkaSASLMechanism) > 0 {
+		kafkaConfig.Net.SASL.Enable = true
+		kafkaConfig.Net.SASL.Mechanism = sarama.SASLMechanism(o.outputConfig.KafkaSASLMechanism)
+		kafkaConfig.Net.SASL.User = o.outputConfig.KafkaSASLUsername
+		kafkaConfig.Net.SASL.Password = o.outputConfig.KafkaSASLPassword
+
+		switch o.outputConfig.KafkaSASLMechanism {
+		case sarama.SASLTypeSCRAMSHA256:
+			kafkaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{HashGeneratorFcn: scramSHA256} }
+		case sarama.SASLTypeSCRAMSHA512:
+			kafkaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{HashGeneratorFcn: scramSHA512} }
+		}
+	}
+
+	return kafkaConfig
+}
+
 func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	go func() {
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
-		defer func() {
-			if err := o.producer.Close(); err != nil {
-				log.Fatalln(err)
-			}
-		}()
-
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
@@ -69,34 +251,54 @@ func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
 
 		for {
 			select {
-			case message := <-messages:
-				var parsedMsg map[string]interface{}
+			case message, ok := <-messages:
+				if !ok {
+					o.close()
+					return
+				}
 
-				json.Unmarshal([]byte(message), &parsedMsg)
-				topic := parsedMsg["type"]
-				if topicString, ok := topic.(string); ok {
-					topicString = strings.Replace(topicString, "ingress.event.", "", -1)
-					topicString += o.topicSuffix
+				address := o.nextAddress()
+				o.received++
 
-					o.output(topicString, message)
+				if len(address.topic) > 0 {
+					o.output(address, message, &kafkaMetadata{sequence: o.received})
 				} else {
 					log.Info("ERROR: Topic was not a string")
+					o.messageCompleted(&kafkaMetadata{sequence: o.received}, nil)
 				}
 			}
 		}
 
 	}()
 
+	// the producer closes both channels once it has been closed and every message has been sent or has failed;
+	// closing errorChan then tells the dispatcher that this output has stopped
+	var results sync.WaitGroup
+	results.Add(2)
+	go func() {
+		results.Wait()
+		close(errorChan)
+	}()
+
 	go func() {
-		for range o.producer.Successes() {
+		defer results.Done()
+		for message := range o.producer.Successes() {
 			atomic.AddInt64(&o.eventSentCount, 1)
+			o.messageCompleted(message.Metadata, nil)
 		}
 	}()
 
 	go func() {
+		defer results.Done()
 		for err := range o.producer.Errors() {
+			if o.resend(err) {
+				continue
+			}
+
 			log.Info(err)
 			atomic.AddInt64(&o.droppedEventCount, 1)
+			metricOutputDroppedEvents.Add(1, o.outputConfig.Name)
+			o.messageCompleted(err.Msg.Metadata, err)
 			errorChan <- err
 		}
 	}()
@@ -104,11 +306,77 @@ func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	return nil
 }
 
+// resend schedules another attempt for a message the producer gave up on, backing off exponentially from one
+// second up to 30 seconds. It returns false once the message has used up resend_max attempts, if the error
+// would not go away by retrying, or if the output is closing.
+//
+// Messages with a partition key are never resent: a resent message would land behind later messages with the
+// same key, so those are left to the producer's own retries, which keep each partition in order.
+func (o *KafkaOutput) resend(err *sarama.ProducerError) bool {
+	metadata, ok := err.Msg.Metadata.(*kafkaMetadata)
+	if !ok || err.Msg.Key != nil || metadata.attempts >= o.outputConfig.KafkaResendMax {
+		return false
+	}
+
+	switch err.Err {
+	case sarama.ErrMessageSizeTooLarge, sarama.ErrMessageSetSizeTooLarge, sarama.ErrInvalidMessage,
+		sarama.ErrInvalidMessageSize:
+		return false
+	}
+
+	o.Lock()
+	if o.closing {
+		o.Unlock()
+		return false
+	}
+	o.resends.Add(1)
+	o.Unlock()
+
+	metadata.attempts++
+	atomic.AddInt64(&o.retriedEventCount, 1)
+
+	backoff := time.Duration(1<<uint(metadata.attempts-1)) * time.Second
+	if backoff > 30*time.Second {
+		backoff = 30 * time.Second
+	}
+	log.Infof("Resending message to topic %s in %s (attempt %d of %d): %s", err.Msg.Topic, backoff,
+		metadata.attempts, o.outputConfig.KafkaResendMax, err.Err)
+
+	message := &sarama.ProducerMessage{
+		Topic:    err.Msg.Topic,
+		Key:      err.Msg.Key,
+		Value:    err.Msg.Value,
+		Metadata: metadata,
+	}
+	time.AfterFunc(backoff, func() {
+		defer o.resends.Done()
+		o.producer.Input() <- message
+	})
+
+	return true
+}
+
+// close hands any scheduled resends to the producer and then closes it, which sends everything it still holds.
+func (o *KafkaOutput) close() {
+	o.Lock()
+	o.closing = true
+	o.Unlock()
+
+	o.resends.Wait()
+
+	log.Infof("Sending the remaining messages to %s", o.String())
+	o.producer.AsyncClose()
+}
+
 func (o *KafkaOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return KafkaStatistics{DroppedEventCount: o.droppedEventCount, EventSentCount: o.eventSentCount}
+	return KafkaStatistics{
+		DroppedEventCount: atomic.LoadInt64(&o.droppedEventCount),
+		EventSentCount:    atomic.LoadInt64(&o.eventSentCount),
+		RetriedEventCount: atomic.LoadInt64(&o.retriedEventCount),
+	}
 }
 
 func (o *KafkaOutput) String() string {
@@ -125,10 +393,16 @@ func (o *KafkaOutput) Key() string {
 	return fmt.Sprintf("brokers:%s", o.brokers)
 }
 
-func (o *KafkaOutput) output(topic string, m string) {
+func (o *KafkaOutput) output(address kafkaAddress, m string, metadata *kafkaMetadata) {
+	var key sarama.Encoder
+	if len(address.key) > 0 {
+		key = sarama.StringEncoder(address.key)
+	}
+
 	o.producer.Input() <- &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   nil,
-		Value: sarama.StringEncoder(m),
+		Topic:    address.topic,
+		Key:      key,
+		Value:    sarama.StringEncoder(m),
+		Metadata: metadata,
 	}
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestKafkaConfiguration(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[output:kafka]
+output_type=kafka
+brokers=kafka01:9093,kafka02:9093
+topic_template=cb-{{replace .type "." "-"}}
+partition_key=sensor_id
+use_tls=true
+sasl_mechanism=scram-sha-512
+sasl_username=forwarder
+sasl_password=secret
+required_acks=all
+idempotent=true
+compression=zstd
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	output := parseOutputConfiguration(input, "kafka", "output:kafka", "kafka", JSONOutputFormat, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	o := &KafkaOutput{outputConfig: output}
+	kafkaConfig := o.producerConfig()
+	if err := kafkaConfig.Validate(); err != nil {
+		t.Fatalf("Invalid producer configuration: %s", err)
+	}
+
+	if !kafkaConfig.Net.TLS.Enable || kafkaConfig.Net.TLS.Config == nil {
+		t.Errorf("Expected TLS to be enabled")
+	}
+	if kafkaConfig.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || kafkaConfig.Net.SASL.User != "forwarder" {
+		t.Errorf("Unexpected SASL configuration: %v", kafkaConfig.Net.SASL)
+	}
+	if !kafkaConfig.Producer.Idempotent || kafkaConfig.Producer.RequiredAcks != sarama.WaitForAll {
+		t.Errorf("Expected an idempotent producer waiting for all replicas")
+	}
+	if kafkaConfig.Producer.Compression != sarama.CompressionZSTD || !kafkaConfig.Version.IsAtLeast(sarama.V2_1_0_0) {
+		t.Errorf("Expected zstd compression with a protocol version of at least 2.1")
+	}
+}
+
+func TestKafkaConfigurationErrors(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[output:kafka]
+output_type=kafka
+topic_template={{.type
+sasl_mechanism=GSSAPI
+idempotent=true
+compression=brotli
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	parseOutputConfiguration(input, "kafka", "output:kafka", "kafka", JSONOutputFormat, &errs)
+
+	// missing brokers, topic_template, sasl_mechanism, missing sasl_username, idempotent without
+	// required_acks=all, compression
+	if len(errs.Errors) != 6 {
+		t.Errorf("Expected 6 configuration errors, got %v", errs.Errors)
+	}
+}
+
+func TestKafkaAddress(t *testing.T) {
+	topicTemplate := `{{with index . "watchlist_name"}}watchlist-{{lower .}}{{else}}{{trimPrefix .type "ingress.event."}}{{end}}`
+	output := &OutputConfiguration{KafkaPartitionKey: "sensor_id"}
+	output.KafkaTopicTemplate, _ = parseKafkaTopicTemplate(topicTemplate)
+
+	o := &KafkaOutput{outputConfig: output, topicSuffix: "-test"}
+
+	tests := []struct {
+		msg      map[string]interface{}
+		expected kafkaAddress
+	}{
+		{map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": json.Number("7")},
+			kafkaAddress{topic: "procstart-test", key: "7"}},
+		{map[string]interface{}{"type": "watchlist.hit.process", "watchlist_name": "Newly Loaded"},
+			kafkaAddress{topic: "watchlist-newly loaded-test"}},
+		{map[string]interface{}{"sensor_id": 3}, kafkaAddress{key: "3"}},
+	}
+
+	for i, test := range tests {
+		o.Address(newEvent(test.msg))
+		if address := o.nextAddress(); address != test.expected {
+			t.Errorf("Event %d: expected %v, got %v", i, test.expected, address)
+		}
+	}
+
+	// without a template, the topic is the event type with the ingress.event. prefix removed
+	output.KafkaTopicTemplate = nil
+	o.Address(newEvent(map[string]interface{}{"type": "ingress.event.netconn"}))
+	if address := o.nextAddress(); address.topic != "netconn-test" || address.key != "" {
+		t.Errorf("Unexpected default address %v", address)
+	}
+}
+
+func TestKafkaAddressOfDroppedMessage(t *testing.T) {
+	output := &OutputConfiguration{Name: "kafka", KafkaPartitionKey: "sensor_id"}
+	o := &KafkaOutput{outputConfig: output}
+
+	// nothing reads the unbuffered channel of a stopped output, so the first message is dropped
+	route := &outputRoute{output: output, handler: o, messages: make(chan string), stopped: make(chan struct{})}
+	close(route.stopped)
+	route.send(newEvent(map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": 1}), "dropped", nil)
+	if len(o.addresses) != 0 {
+		t.Fatalf("The dropped message left its address behind: %v", o.addresses)
+	}
+
+	route.messages = make(chan string, 1)
+	route.stopped = make(chan struct{})
+	route.send(newEvent(map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": 2}), "queued", nil)
+	if address := o.nextAddress(); address.topic != "netconn" || address.key != "2" {
+		t.Errorf("The queued message got the address %v", address)
+	}
+}
+
+func TestKafkaKeyedMessagesAreNotResent(t *testing.T) {
+	output := &OutputConfiguration{KafkaPartitionKey: "sensor_id", KafkaResendMax: 5, KafkaRetryMax: 3}
+	o := &KafkaOutput{outputConfig: output}
+
+	if maxOpenRequests := o.producerConfig().Net.MaxOpenRequests; maxOpenRequests != 1 {
+		t.Errorf("Expected a single request in flight with a partition key, got %d", maxOpenRequests)
+	}
+
+	metadata := &kafkaMetadata{sequence: 1}
+	err := &sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{Key: sarama.StringEncoder("7"), Metadata: metadata},
+		Err: sarama.ErrNotLeaderForPartition,
+	}
+	if o.resend(err) || metadata.attempts != 0 {
+		t.Error("A message with a partition key was resent")
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// test vector from RFC 7677
+	client := &scramClient{HashGeneratorFcn: scramSHA256}
+	if err := client.Begin("user", "pencil", ""); err != nil {
+		t.Fatal(err)
+	}
+	client.Client.WithNonceGenerator(func() string { return "rOprNGfwEbeRWgbNEkqO" })
+	client.ClientConversation = client.Client.NewConversation()
+
+	steps := []struct {
+		challenge string
+		expected  string
+	}{
+		{"", "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"},
+		{"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="},
+		{"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", ""},
+	}
+
+	for i, step := range steps {
+		if client.Done() {
+			t.Fatalf("SCRAM exchange finished early at step %d", i)
+		}
+		response, err := client.Step(step.challenge)
+		if err != nil {
+			t.Fatalf("Step %d: %s", i, err)
+		}
+		if response != step.expected {
+			t.Errorf("Step %d: expected %s, got %s", i, step.expected, response)
+		}
+	}
+
+	if !client.Done() {
+		t.Errorf("Expected the SCRAM exchange to be done")
+	}
+}
@@ -1,12 +1,14 @@
 package leef
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -43,7 +45,10 @@ func generateHeader(cbVersion, eventType string) string {
 		eventType)
 }
 
-func normalizeAddToMap(msg map[string]interface{}, temp map[string]interface{}) {
+// ConnectionFields returns the fields QRadar normalizes connections to (src, dst, proto, srcPort and dstPort) for
+// the local_ip, remote_ip, protocol, local_port and remote_port in fields, swapping source and destination if
+// its direction is inbound.
+func ConnectionFields(fields map[string]interface{}) map[string]interface{} {
 	outboundConnections := map[string]string{
 		"local_ip":    "src",
 		"remote_ip":   "dst",
@@ -60,22 +65,206 @@ func normalizeAddToMap(msg map[string]interface{}, temp map[string]interface{})
 	}
 
 	leefMap := outboundConnections
-	if directionality, ok := temp["direction"]; ok {
+	if directionality, ok := fields["direction"]; ok {
 		if directionality == "inbound" {
 			leefMap = inboundConnections
 		}
 	}
 
-	for key, value := range temp {
+	normalized := make(map[string]interface{})
+	for key, value := range fields {
 		if newKey, ok := leefMap[key]; ok {
-			msg[newKey] = value
+			normalized[newKey] = value
 		}
 	}
+	return normalized
+}
+
+// IOCFields returns the normalized connection fields that Encode adds for an ioc_attr, which is either a map or
+// the same map encoded as JSON.
+func IOCFields(ioc_attr interface{}) (map[string]interface{}, error) {
+	val := reflect.ValueOf(ioc_attr)
+
+	//
+	// We weren't sure if we had seen ioc_attr as a string before.
+	// We are just handling this case.  Decode as json and add appropriate fields to top level
+	//
+
+	if val.Kind() == reflect.String {
+		var temp map[string]interface{}
+		decoder := json.NewDecoder(strings.NewReader(ioc_attr.(string)))
+
+		// Ensure that we decode numbers in the JSON as integers and *not* float64s
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&temp); err != nil {
+			return nil, errors.New("Received error when unmarshaling JSON ioc_attr")
+		}
+		return ConnectionFields(temp), nil
+
+	} else if val.Kind() == reflect.Map {
+		//
+		// This is the expected case.  Map appropriate fields to the top level
+		//
+		if kv, ok := ioc_attr.(map[string]interface{}); ok {
+			return ConnectionFields(kv), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Writer builds a LEEF message one field at a time. Fields must be added in key order. The type and cb_version
+// fields also set the event type and the version in the header.
+type Writer struct {
+	kvPairs     bytes.Buffer
+	messageType string
+	cbVersion   string
+}
+
+func NewWriter() *Writer {
+	// message type applied to messages without an explicit message type.
+	return &Writer{messageType: "unknown.event.type", cbVersion: productVersion}
+}
+
+func (w *Writer) key(key string) {
+	if w.kvPairs.Len() > 0 {
+		w.kvPairs.WriteByte('\t')
+	}
+	w.kvPairs.WriteString(key)
+	w.kvPairs.WriteByte('=')
+}
+
+// header promotes the "type" and "cb_version" to the message header.
+func (w *Writer) header(key, value string) {
+	if key == "type" {
+		w.messageType = value
+	} else if key == "cb_version" {
+		w.cbVersion = value
+	}
+}
+
+// AddString adds a string, with the appropriate character escaping.
+func (w *Writer) AddString(key, value string) {
+	w.header(key, value)
+	w.key(key)
+	formatter.WriteString(&w.kvPairs, value)
+}
+
+func (w *Writer) AddNumber(key string, value json.Number) {
+	w.AddString(key, value.String())
+}
+
+func (w *Writer) AddInt(key string, value int64) {
+	w.key(key)
+	w.kvPairs.WriteString(strconv.FormatInt(value, 10))
+}
+
+func (w *Writer) AddUint(key string, value uint64) {
+	w.key(key)
+	w.kvPairs.WriteString(strconv.FormatUint(value, 10))
+}
+
+func (w *Writer) AddBool(key string, value bool) {
+	w.key(key)
+	w.kvPairs.WriteString(strconv.FormatBool(value))
+}
+
+// AddFloat adds a float formatted as fmt's %v does.
+func (w *Writer) AddFloat(key string, value float64) {
+	w.key(key)
+	w.kvPairs.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Add adds a value of any type. Nil values are left out.
+func (w *Writer) Add(key string, value interface{}) {
+	if !reflect.ValueOf(value).IsValid() {
+		return
+	}
+
+	msg_func := func(key string, value interface{}) string {
+		var val string
+
+		the_type := reflect.ValueOf(value).Type()
+		the_kind := the_type.Kind()
+
+		switch typed_msg_val := value.(type) {
+
+		case map[string]interface{}:
+
+			if len(typed_msg_val) == 0 {
+				val = ""
+			} else {
+				t, err := json.Marshal(typed_msg_val)
+				if err != nil {
+					log.Infof("Could not marshal key %s with value %v into JSON: %s, skipping", key, value, err.Error())
+					return ""
+				}
+				val = string(t)
+			}
+
+		case []string:
+			// if the value is a map, array or slice, then format as JSON
+			length_of_array := len(typed_msg_val)
+			if length_of_array == 0 {
+				val = ""
+			} else if length_of_array == 1 {
+				w.header(key, typed_msg_val[0])
+				val = typed_msg_val[0]
+			} else {
+				t, err := json.Marshal(typed_msg_val)
+				if err != nil {
+					log.Infof("Could not marshal key %s with value %v into JSON: %s, skipping", key, value, err.Error())
+					return ""
+				}
+				val = string(t)
+			}
+
+		case json.Number:
+			val_str := typed_msg_val.String()
+			w.header(key, val_str)
+			val = formatter.Replace(val_str)
+
+		case string:
+			// make sure to format strings with the appropriate character escaping
+			// also make sure we reflect the "type" and "cb_version" on to the message header, if present
+			w.header(key, typed_msg_val)
+			val = formatter.Replace(typed_msg_val)
+		case int, int32, int64, uint32, uint64, uint:
+			val = fmt.Sprintf("%d", typed_msg_val)
+		case bool:
+			val = fmt.Sprintf("%t", typed_msg_val)
+		default:
+			// simplify and use fmt.Sprintf to format the output
+			log.Debugf("Default case for leef encode: type/kind  = %s/%s ", the_type, the_kind)
+			val = fmt.Sprintf("%v", typed_msg_val)
+		}
+		return val
+	}
+
+	ret_val := msg_func(key, value)
+	log.Debugf("adding key = val to kvPairs %s=%s", key, ret_val)
+
+	w.key(key)
+	w.kvPairs.WriteString(ret_val)
+}
+
+// Encoded returns the LEEF message: the header followed by the fields, separated by tabs.
+func (w *Writer) Encoded() string {
+	messageType := w.messageType
+
+	// override "procstart" with "process" as this is what the LEEF decoder in QRadar is expecting
+	if messageType == "ingress.event.procstart" {
+		messageType = "ingress.event.process"
+	}
+
+	log.Debugf("kvPairs = %s", w.kvPairs.String())
+
+	return generateHeader(w.cbVersion, messageType) + w.kvPairs.String()
 }
 
 func Encode(msg map[string]interface{}) (string, error) {
 	keyNames := make([]string, 0)
-	kvPairs := make([]string, 0)
 
 	// promote "docs" up to the root
 	if val, ok := msg["docs"]; ok {
@@ -122,38 +311,15 @@ func Encode(msg map[string]interface{}) (string, error) {
 	//
 
 	if ioc_attr, ok := msg["ioc_attr"]; ok {
-		val := reflect.ValueOf(ioc_attr)
-
 		//
-		// We weren't sure if we had seen ioc_attr as a string before.
-		// We are just handling this case.  Decode as json and add appropriate fields to top level
+		// Add fields from ioc_attr into msg using QRadar normalized IP fields
 		//
-
-		if val.Kind() == reflect.String {
-			var temp map[string]interface{}
-			decoder := json.NewDecoder(strings.NewReader(ioc_attr.(string)))
-
-			// Ensure that we decode numbers in the JSON as integers and *not* float64s
-			decoder.UseNumber()
-
-			if err := decoder.Decode(&temp); err != nil {
-				return "", errors.New("Received error when unmarshaling JSON ioc_attr")
-			}
-			//
-			// Add fields from temp into msg using QRadar normalized IP fields
-			//
-			normalizeAddToMap(msg, temp)
-
-		} else if val.Kind() == reflect.Map {
-			//
-			// This is the expected case.  Map appropriate fields to the top level
-			//
-			if kv, ok := ioc_attr.(map[string]interface{}); ok {
-				//
-				// Add fields from kv into msg using QRadar normalized IP fields
-				//
-				normalizeAddToMap(msg, kv)
-			}
+		fields, err := IOCFields(ioc_attr)
+		if err != nil {
+			return "", err
+		}
+		for key, value := range fields {
+			msg[key] = value
 		}
 	}
 
@@ -162,112 +328,22 @@ func Encode(msg map[string]interface{}) (string, error) {
 	//
 
 	if msg["type"] == "ingress.event.netconn" {
-		normalizeAddToMap(msg, msg)
+		for key, value := range ConnectionFields(msg) {
+			msg[key] = value
+		}
 	}
 
 	for key, _ := range msg {
 		keyNames = append(keyNames, key)
 	}
 
-	// message type applied to messages without an explicit message type.
-	// the code below will promote the "type" to messageType in the LEEF header.
-	messageType := "unknown.event.type"
-	cbVersion := productVersion
+	// the "type" and "cb_version" are promoted to the LEEF header by the writer
+	w := NewWriter()
 
 	sort.Strings(keyNames)
 	for _, key := range keyNames {
-		if !reflect.ValueOf(msg[key]).IsValid() {
-			continue
-		}
-
-		msg_func := func(msg map[string]interface{}, key string) string {
-			var val string
-
-			the_type := reflect.ValueOf(msg[key]).Type()
-			the_kind := the_type.Kind()
-
-			switch typed_msg_val := msg[key].(type) {
-
-			case map[string]interface{}:
-
-				if len(typed_msg_val) == 0 {
-					val = ""
-				} else {
-					t, err := json.Marshal(typed_msg_val)
-					if err != nil {
-						log.Infof("Could not marshal key %s with value %v into JSON: %s, skipping", key, msg[key], err.Error())
-						return ""
-					}
-					val = string(t)
-				}
-
-			case []string:
-				// if the value is a map, array or slice, then format as JSON
-				length_of_array := len(typed_msg_val)
-				if length_of_array == 0 {
-					val = ""
-				} else if length_of_array == 1 {
-					if key == "type" {
-						messageType = typed_msg_val[0]
-					} else if key == "cb_version" {
-						cbVersion = typed_msg_val[0]
-					}
-					val = typed_msg_val[0]
-				} else {
-					t, err := json.Marshal(typed_msg_val)
-					if err != nil {
-						log.Infof("Could not marshal key %s with value %v into JSON: %s, skipping", key, msg[key], err.Error())
-						return ""
-					}
-					val = string(t)
-				}
-
-			case json.Number:
-				val_str := typed_msg_val.String()
-				if key == "type" {
-					messageType = val_str
-				} else if key == "cb_version" {
-					cbVersion = val_str
-				}
-				val = formatter.Replace(val_str)
-
-			case string:
-				// make sure to format strings with the appropriate character escaping
-				// also make sure we reflect the "type" and "cb_version" on to the message header, if present
-				if key == "type" {
-					messageType = typed_msg_val
-				} else if key == "cb_version" {
-					cbVersion = typed_msg_val
-				}
-				val = formatter.Replace(typed_msg_val)
-			case int, int32, int64, uint32, uint64, uint:
-				val = fmt.Sprintf("%d", typed_msg_val)
-			case bool:
-				val = fmt.Sprintf("%t", typed_msg_val)
-			default:
-				// simplify and use fmt.Sprintf to format the output
-				log.Debugf("Default case for leef encode: type/kind  = %s/%s ", the_type, the_kind)
-				val = fmt.Sprintf("%v", typed_msg_val)
-			}
-			return val
-		}
-
-		ret_val := msg_func(msg, key)
-		log.Debugf("adding key = val to kvPairs %s=%s", key, ret_val)
-
-		kvPairs = append(kvPairs, fmt.Sprintf("%s=%s", key, ret_val))
-	}
-
-	// override "procstart" with "process" as this is what the LEEF decoder in QRadar is expecting
-	if messageType == "ingress.event.procstart" {
-		messageType = "ingress.event.process"
+		w.Add(key, msg[key])
 	}
 
-	log.Debugf("kvPairs = %s", kvPairs)
-
-	joined_kv := strings.Join(kvPairs, "\t")
-
-	ret := fmt.Sprintf("%s%s", generateHeader(cbVersion, messageType), joined_kv)
-
-	return ret, nil
+	return w.Encoded(), nil
 }
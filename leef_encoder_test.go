@@ -21,12 +21,12 @@ func generateLeefOutput(exampleJsonInput string) error {
 		return err
 	}
 
-	msgs, err := ProcessJSONMessage(msg, "watchlist.hit.test")
+	events, err := ProcessJSONMessage(msg, "watchlist.hit.test")
 	if err != nil {
 		return err
 	}
 
-	for i, msg := range msgs {
+	for i, msg := range eventMaps(events) {
 		if _, err := leef.Encode(msg); err != nil {
 			return errors.New(fmt.Sprintf("Error encoding message %s [index %d]: %s", msg, i, err))
 		}
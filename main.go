@@ -15,14 +15,14 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/carbonblack/cb-event-forwarder/leef"
 	"github.com/carbonblack/cb-event-forwarder/sensor_events"
 	"github.com/pborman/uuid"
 	"github.com/streadway/amqp"
@@ -33,6 +33,7 @@ import _ "net/http/pprof"
 var (
 	checkConfiguration = flag.Bool("check", false, "Check the configuration file and exit")
 	debug              = flag.Bool("debug", false, "Enable debugging mode")
+	replay             = flag.String("replay", "", "Replay the deliveries captured in this directory instead of consuming from RabbitMQ")
 )
 
 var version = "NOT FOR RELEASE"
@@ -58,7 +59,6 @@ type Status struct {
 var status Status
 
 var (
-	results       chan string
 	output_errors chan error
 )
 
@@ -91,10 +91,12 @@ func init() {
 		return time.Now().Sub(status.StartTime).Seconds()
 	}))
 	expvar.Publish("subscribed_events", expvar.Func(func() interface{} {
-		return config.EventTypes
+		return currentLiveConfiguration().EventTypes
+	}))
+	expvar.Publish("message_processors", expvar.Func(func() interface{} {
+		return messageProcessors.Status()
 	}))
 
-	results = make(chan string, 100)
 	output_errors = make(chan error)
 
 	status.StartTime = time.Now()
@@ -107,6 +109,7 @@ type Consumer struct {
 	conn    *amqp.Connection
 	channel *amqp.Channel
 	tag     string
+	queue   string
 }
 
 type OutputHandler interface {
@@ -124,6 +127,7 @@ type OutputHandler interface {
 // TODO: change this into an error channel
 func reportError(d string, errmsg string, err error) {
 	status.ErrorCount.Add(1)
+	metricErrors.Add(1)
 	log.Errorf("%s when processing %s: %s", errmsg, d, err)
 }
 
@@ -157,18 +161,30 @@ func reportBundleDetails(routingKey string, body []byte, headers amqp.Table) {
 	}
 }
 
-func processMessage(body []byte, routingKey, contentType string, headers amqp.Table, exchangeName string) {
+func processMessage(body []byte, routingKey, contentType string, headers amqp.Table, exchangeName string,
+	delivery *pendingDelivery) {
 	status.InputEventCount.Add(1)
+	metricInputDeliveries.Add(1, exchangeName, routingKey)
+	metricInputBytes.Add(float64(len(body)), exchangeName, routingKey)
+	defer metricProcessingDuration.ObserveSince(time.Now(), contentType)
 
 	var err error
-	var msgs []map[string]interface{}
+	var events []*Event
+
+	// the events of bundles are processed as they are decoded. A bundle that turns out to be malformed or
+	// truncated has had the events before the error forwarded already; the rest of it is lost, and the delivery
+	// is acknowledged like any other.
+	processBundleEvent := func(event *Event) {
+		processEvent(event, body, delivery)
+	}
 
 	//
 	// Process message based on ContentType
 	//
 	if contentType == "application/zip" {
-		msgs, err = ProcessRawZipBundle(routingKey, body, headers)
+		err = ProcessRawZipBundleFunc(routingKey, body, headers, processBundleEvent)
 		if err != nil {
+			metricPartialBundles.Add(1, routingKey)
 			reportBundleDetails(routingKey, body, headers)
 			reportError(routingKey, "Could not process raw zip bundle", err)
 			return
@@ -177,16 +193,21 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 		// if we receive a protobuf through the raw sensor exchange, it's actually a protobuf "bundle" and not a
 		// single protobuf
 		if exchangeName == "api.rawsensordata" {
-			msgs, err = ProcessProtobufBundle(routingKey, body, headers)
+			err = ProcessProtobufBundleFunc(routingKey, body, headers, processBundleEvent)
+			if err != nil {
+				metricPartialBundles.Add(1, routingKey)
+				reportBundleDetails(routingKey, body, headers)
+				reportError(routingKey, "Could not process raw protobuf bundle", err)
+				return
+			}
 		} else {
-			msg, err := ProcessProtobufMessage(routingKey, body, headers)
+			event, err := ProcessProtobufMessage(routingKey, body, headers)
 			if err != nil {
 				reportBundleDetails(routingKey, body, headers)
 				reportError(routingKey, "Could not process body", err)
 				return
-			} else if msg != nil {
-				msgs = make([]map[string]interface{}, 0, 1)
-				msgs = append(msgs, msg)
+			} else if event != nil {
+				events = append(events, event)
 			}
 		}
 	} else if contentType == "application/json" {
@@ -203,69 +224,84 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 			return
 		}
 
-		msgs, err = ProcessJSONMessage(msg, routingKey)
+		events, err = ProcessJSONMessage(msg, routingKey)
 	} else {
 		reportError(string(body), "Unknown content-type", errors.New(contentType))
 		return
 	}
 
-	for _, msg := range msgs {
-		if config.PerformFeedPostprocessing {
-			go func(msg map[string]interface{}) {
-				outputMsg := PostprocessJSONMessage(msg)
-				outputMessage(outputMsg)
-			}(msg)
-		} else {
-			err = outputMessage(msg)
-			if err != nil {
-				reportError(string(body), "Error marshaling message", err)
-			}
-		}
+	for _, event := range events {
+		processEvent(event, body, delivery)
 	}
 }
 
-func outputMessage(msg map[string]interface{}) error {
-	var err error
+// processEvent filters, deduplicates and rate limits an event decoded from body, and forwards it if it is kept.
+func processEvent(event *Event, body []byte, delivery *pendingDelivery) {
+	metricEvents.Add(1, event.Type())
 
-	//
-	// Marshal result into the correct output format
-	//
-	msg["cb_server"] = config.ServerName
-	event_uuid := uuid.NewRandom()
-	msg["event_guid"] = fmt.Sprintf("%s|%s|%s", config.ServerName, msg["process_guid"], event_uuid.String())
+	if !filterEvent(event) {
+		return
+	}
 
-	var outmsg string
+	if eventDeduplicator != nil && !eventDeduplicator.Check(event) {
+		return
+	}
 
-	switch config.OutputFormat {
-	case JSONOutputFormat:
-		var b []byte
-		b, err = json.Marshal(msg)
-		outmsg = string(b)
-	case LEEFOutputFormat:
-		outmsg, err = leef.Encode(msg)
-	default:
-		panic("Impossible: invalid output_format, exiting immediately")
+	if eventRateLimiter != nil && !eventRateLimiter.Allow(event) {
+		return
 	}
 
-	if len(outmsg) > 0 && err == nil {
-		status.OutputEventCount.Add(1)
-		results <- string(outmsg)
-	} else {
-		return err
+	err := forwardEvent(event, delivery)
+	if err != nil {
+		reportError(string(body), "Error marshaling message", err)
 	}
+}
 
-	return nil
+func outputMessage(event *Event, delivery *pendingDelivery) error {
+	event.Set("cb_server", config.ServerName)
+	event_uuid := uuid.NewRandom()
+	processGUID, _ := event.Get("process_guid")
+	event.Set("event_guid", fmt.Sprintf("%s|%s|%s", config.ServerName, processGUID, event_uuid.String()))
+
+	// route on the original event type even if a transform renames or removes it
+	routingKey := event.Type()
+	transformEvent(event, routingKey)
+
+	//
+	// Marshal result into the format of each output and hand it off
+	//
+	return dispatchMessage(event, routingKey, delivery)
 }
 
 func worker(deliveries <-chan amqp.Delivery) {
 	defer wg.Done()
 
+	messageProcessors.started()
+	defer messageProcessors.exited()
+
 	for delivery := range deliveries {
+		started := messageProcessors.begin()
+
+		if deliveryCapture != nil {
+			deliveryCapture.Record(delivery)
+		}
+
+		var pending *pendingDelivery
+		if config.AtLeastOnceDelivery {
+			pending = newPendingDelivery(delivery)
+		}
+
 		processMessage(delivery.Body,
 			delivery.RoutingKey,
 			delivery.ContentType,
 			delivery.Headers,
-			delivery.Exchange)
+			delivery.Exchange,
+			pending)
+
+		// acknowledges the delivery now if none of its events are still waiting on an output
+		pending.done()
+
+		messageProcessors.end(started)
 	}
 
 	log.Info("Worker exiting")
@@ -292,7 +328,7 @@ func logFileProcessingLoop() <-chan error {
 			msg_map := make(map[string]interface{})
 			msg_map["message"] = strings.TrimSuffix(delivery, "\n")
 			msg_map["type"] = label
-			outputMessage(msg_map)
+			outputMessage(newEvent(msg_map), nil)
 		}
 
 	}
@@ -315,7 +351,8 @@ func logFileProcessingLoop() <-chan error {
 func messageProcessingLoop(uri, queueName string, autoDelete bool, consumerTag string) error {
 	connection_error := make(chan *amqp.Error, 1)
 
-	c, deliveries, err := NewConsumer(uri, queueName, autoDelete, consumerTag, config.UseRawSensorExchange, config.EventTypes)
+	live := currentLiveConfiguration()
+	c, deliveries, err := NewConsumer(uri, queueName, autoDelete, consumerTag, live.UseRawSensorExchange, live.EventTypes)
 	if err != nil {
 		status.LastConnectError = err.Error()
 		status.ErrorTime = time.Now()
@@ -327,27 +364,27 @@ func messageProcessingLoop(uri, queueName string, autoDelete bool, consumerTag s
 
 	c.conn.NotifyClose(connection_error)
 
-	numProcessors := runtime.NumCPU() * 2
-	log.Infof("Starting %d message processors\n", numProcessors)
-
-	wg.Add(numProcessors)
-	for i := 0; i < numProcessors; i++ {
-		go worker(deliveries)
+	// registered before checking for shutdown, so that shutdown either sees the consumer or it sees shutdown
+	registerConsumer(c)
+	if shuttingDown() {
+		unregisterConsumer(c)
+		c.Shutdown()
+		return nil
 	}
 
+	numProcessors := config.MessageProcessorCount
+	log.Infof("Starting %d message processors\n", numProcessors)
+	startMessageProcessors(deliveries, numProcessors)
+
 	for {
 		select {
-		case output_error := <-output_errors:
-			log.Errorf("ERROR during output: %s", output_error.Error())
-
-			// hack to exit if the error happens while we are writing to a file
-			if config.OutputType == FileOutputType || config.OutputType == SplunkOutputType || config.OutputType == HttpOutputType {
-				log.Error("File output error; exiting immediately.")
-				c.Shutdown()
-				wg.Wait()
-				os.Exit(1)
-			}
+		case <-shutdownRequested:
+			// shutdown cancels the consumer and closes the connection once the outputs have drained
+			log.Infof("Consumer %s is shutting down", consumerTag)
+			wg.Wait()
+			return nil
 		case close_error := <-connection_error:
+			unregisterConsumer(c)
 			status.IsConnected = false
 			status.LastConnectError = close_error.Error()
 			status.ErrorTime = time.Now()
@@ -361,6 +398,7 @@ func messageProcessingLoop(uri, queueName string, autoDelete bool, consumerTag s
 		}
 	}
 	log.Info("Loop exited for unknown reason")
+	unregisterConsumer(c)
 	c.Shutdown()
 	wg.Wait()
 
@@ -368,71 +406,36 @@ func messageProcessingLoop(uri, queueName string, autoDelete bool, consumerTag s
 }
 
 func startOutputs() error {
-	// Configure the specific output.
-	// Valid options are: 'udp', 'tcp', 'file', 's3', 'syslog' ,"http",'splunk'
-	var outputHandler OutputHandler
-
-	parameters := config.OutputParameters
-
-	switch config.OutputType {
-	case FileOutputType:
-		outputHandler = &FileOutput{}
-	case TCPOutputType:
-		outputHandler = &NetOutput{}
-		parameters = "tcp:" + parameters
-	case UDPOutputType:
-		outputHandler = &NetOutput{}
-		parameters = "udp:" + parameters
-	case S3OutputType:
-		outputHandler = &BundledOutput{behavior: &S3Behavior{}}
-	case SyslogOutputType:
-		outputHandler = &SyslogOutput{}
-	case HttpOutputType:
-		outputHandler = &BundledOutput{behavior: &HttpBehavior{}}
-	case SplunkOutputType:
-		outputHandler = &BundledOutput{behavior: &SplunkBehavior{}}
-	case KafkaOutputType:
-		outputHandler = &KafkaOutput{}
-	default:
-		return errors.New(fmt.Sprintf("No valid output handler found (%d)", config.OutputType))
-	}
-
-	err := outputHandler.Initialize(parameters)
-	if err != nil {
-		return err
+	// Configure each of the outputs.
+	// Valid output types are: 'udp', 'tcp', 'file', 's3', 'syslog' ,"http",'splunk', 'kafka', 'elasticsearch'
+	outputRoutes = make([]*outputRoute, 0, len(config.Outputs))
+
+	for _, output := range config.Outputs {
+		route, err := newOutputRoute(output)
+		if err != nil {
+			return err
+		}
+		outputRoutes = append(outputRoutes, route)
 	}
 
 	expvar.Publish("output_status", expvar.Func(func() interface{} {
-		ret := make(map[string]interface{})
-		ret[outputHandler.Key()] = outputHandler.Statistics()
+		outputsLock.RLock()
+		defer outputsLock.RUnlock()
 
-		switch config.OutputFormat {
-		case LEEFOutputFormat:
-			ret["format"] = "leef"
-		case JSONOutputFormat:
-			ret["format"] = "json"
-		}
-
-		switch config.OutputType {
-		case FileOutputType:
-			ret["type"] = "file"
-		case UDPOutputType:
-			ret["type"] = "net"
-		case TCPOutputType:
-			ret["type"] = "net"
-		case S3OutputType:
-			ret["type"] = "s3"
-		case HttpOutputType:
-			ret["type"] = "http"
-		case SplunkOutputType:
-			ret["type"] = "splunk"
+		ret := make(map[string]interface{})
+		for _, route := range outputRoutes {
+			ret[route.output.Name] = outputStatus(route)
 		}
-
 		return ret
 	}))
 
-	log.Infof("Initialized output: %s\n", outputHandler.String())
-	return outputHandler.Go(results, output_errors)
+	for _, route := range outputRoutes {
+		if err := route.start(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func monitorLog(logToMonitor string) {
@@ -445,7 +448,7 @@ func monitorLog(logToMonitor string) {
 		logJson["type"] = "log"
 		logJson["filename"] = logToMonitor
 
-		err := outputMessage(logJson)
+		err := outputMessage(newEvent(logJson), nil)
 
 		if err != nil {
 			log.Fatal(err)
@@ -462,23 +465,36 @@ func monitorLogs(logsToMonitor []string) {
 	}
 }
 
+// applyCommandLineOptions overrides the configuration file with the options given on the command line.
+func applyCommandLineOptions(c *Configuration) {
+	if len(*replay) > 0 {
+		c.InputType = DirectoryInputType
+		c.InputDirectory = *replay
+		c.AMQPDisabled = true
+	}
+}
+
 func main() {
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	configLocation := "/etc/cb/integrations/event-forwarder/cb-event-forwarder.conf"
-
 	if flag.NArg() > 0 {
 		configLocation = flag.Arg(0)
 	}
 	log.Printf("configLocation: %s", configLocation)
 
+	if *checkConfiguration {
+		os.Exit(runConfigurationCheck(configLocation, os.Stdout))
+	}
+
 	config, err = ParseConfig(configLocation)
 	if err != nil {
 		log.Fatal(err)
 	}
+	applyCommandLineOptions(&config)
+	publishLiveConfiguration(&config)
 
 	if config.PerformFeedPostprocessing {
 		apiVersion, err := GetCbVersion()
@@ -487,13 +503,13 @@ func main() {
 		} else {
 			log.Infof("Enabling feed post-processing for server %s version %s.", config.CbServerURL, apiVersion)
 		}
-	}
 
-	if *checkConfiguration {
-		if err := startOutputs(); err != nil {
-			log.Fatal(err)
-		}
-		os.Exit(0)
+		log.Infof("Post processing events with %d workers and a queue of %d events", config.PostprocessWorkers,
+			config.PostprocessQueueSize)
+		eventPostprocessor = NewPostprocessor(config)
+		expvar.Publish("postprocess_queue_depth", expvar.Func(func() interface{} {
+			return eventPostprocessor.QueueDepth()
+		}))
 	}
 
 	addrs, err := net.InterfaceAddrs()
@@ -525,6 +541,47 @@ func main() {
 		log.Fatalf("Could not startOutputs: %s", err)
 	}
 
+	if len(config.CaptureDirectory) > 0 {
+		deliveryCapture, err = NewDeliveryCapture(config)
+		if err != nil {
+			log.Fatalf("Could not start capturing deliveries to %s: %s", config.CaptureDirectory, err)
+		}
+	}
+
+	if config.RateLimit > 0 {
+		log.Infof("Rate limiting events to %g per second per sensor, with bursts of up to %d", config.RateLimit,
+			config.RateLimitBurst)
+		eventRateLimiter = NewRateLimiter(config)
+		expvar.Publish("rate_limit", expvar.Func(func() interface{} {
+			return eventRateLimiter.Status()
+		}))
+		go eventRateLimiter.reportSuppressed()
+	}
+
+	if config.DedupWindow > 0 {
+		log.Infof("Deduplicating repeated events within %s", config.DedupWindow)
+		eventDeduplicator = NewDeduplicator(config)
+		expvar.Publish("dedup", expvar.Func(func() interface{} {
+			return eventDeduplicator.Status()
+		}))
+		go eventDeduplicator.sendExpired()
+	}
+
+	if config.ProcessTableEnabled {
+		log.Infof("Tracking up to %d processes to add their command line and parent to raw events",
+			config.ProcessTableSize)
+		processTable = NewProcessTable(config)
+		expvar.Publish("process_table", expvar.Func(func() interface{} {
+			return processTable.Status()
+		}))
+	}
+
+	if config.EnrichmentEnabled {
+		log.Infof("Enriching %v events with process and sensor details from the Cb API",
+			config.EnrichmentEventTypes)
+		eventEnricher = NewEnricher(config)
+	}
+
 	dirs := [...]string{
 		"/usr/share/cb/integrations/event-forwarder/content",
 		"./static",
@@ -556,7 +613,7 @@ func main() {
 					return
 				}
 
-				err = outputMessage(parsedMsg)
+				err = outputMessage(newEvent(parsedMsg), nil)
 				if err != nil {
 					errMsg, _ := json.Marshal(map[string]string{"status": "error", "error": err.Error()})
 					_, _ = w.Write(errMsg)
@@ -564,10 +621,10 @@ func main() {
 				}
 				log.Errorf("Sent test message: %s\n", string(msg))
 			} else {
-				err = outputMessage(map[string]interface{}{
+				err = outputMessage(newEvent(map[string]interface{}{
 					"type":    "debug.message",
 					"message": fmt.Sprintf("Debugging test message sent at %s", time.Now().String()),
-				})
+				}), nil)
 				if err != nil {
 					errMsg, _ := json.Marshal(map[string]string{"status": "error", "error": err.Error()})
 					_, _ = w.Write(errMsg)
@@ -581,12 +638,12 @@ func main() {
 		})
 	}
 
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/reload", reloadHandler)
+
 	go http.ListenAndServe(fmt.Sprintf(":%d", config.HTTPServerPort), nil)
 
-	numConsumers := 1
-	if runtime.NumCPU() > 1 && config.OutputType == KafkaOutputType {
-		numConsumers = runtime.NumCPU() / 2
-	}
+	numConsumers := config.AMQPConsumerCount
 
 	queueName := fmt.Sprintf("cb-event-forwarder:%s:%d", hostname, os.Getpid())
 
@@ -600,14 +657,34 @@ func main() {
 		numConsumers = 0
 		log.Infof("AMQP processing is disabled, not starting AMQP processing loop")
 	}
+	if config.InputType == DirectoryInputType {
+		go func() {
+			exitCode := 0
+			if err := replayDirectory(config.InputDirectory); err != nil {
+				log.Errorf("Could not replay deliveries from %s: %s", config.InputDirectory, err)
+				exitCode = 1
+			}
+
+			// nothing more will arrive; send what was replayed and exit
+			requestShutdown(exitCode)
+		}()
+	}
 	for i := 0; i < numConsumers; i++ {
 		go func(consumerNumber int) {
 			log.Infof("Starting AMQP loop %d to %s on queue %s", consumerNumber, config.AMQPURL(), queueName)
 			for {
 				err := messageProcessingLoop(config.AMQPURL(), queueName, config.AMQPAutoDeleteQueue, fmt.Sprintf("go-event-consumer-%d", consumerNumber))
+				if shuttingDown() {
+					log.Infof("AMQP loop %d exited", consumerNumber)
+					return
+				}
 
 				log.Infof("AMQP loop %d exited: %s. Sleeping for 30 seconds then retrying.", consumerNumber, err)
-				time.Sleep(30 * time.Second)
+				select {
+				case <-time.After(30 * time.Second):
+				case <-shutdownRequested:
+					return
+				}
 			}
 		}(i)
 	}
@@ -628,9 +705,49 @@ func main() {
 		log.Info("Not starting file processing loop")
 	}
 
-	for {
-		time.Sleep(30 * time.Second)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	// the file and bundled outputs also roll over their files on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	exitCode := 0
+	for exiting := false; !exiting; {
+		select {
+		case sig := <-term:
+			log.Infof("Received %s", sig)
+			exiting = true
+		case exitCode = <-fatalErrors:
+			exiting = true
+		case <-hup:
+			// outputs report their errors here while they are restarted, so reload in the background
+			go reloadConfiguration()
+		case output_error := <-output_errors:
+			log.Errorf("ERROR during output: %s", output_error.Error())
+
+			// the file and bundled outputs stop on errors; exit rather than keep queueing events for them
+			if outputErr, ok := output_error.(OutputError); ok {
+				outputType := outputErr.Output.OutputType
+				if outputType == FileOutputType || outputType == SplunkOutputType || outputType == HttpOutputType ||
+					outputType == ElasticsearchOutputType {
+					log.Error("File output error; shutting down.")
+					exitCode = 1
+					exiting = true
+				}
+			}
+		}
 	}
 
-	log.Info("cb-event-forwarder exiting")
+	// a second SIGTERM or SIGINT kills the forwarder instead of waiting for the shutdown to finish
+	signal.Stop(term)
+
+	// keep reading errors from outputs while they drain
+	go func() {
+		for output_error := range output_errors {
+			log.Errorf("ERROR during output: %s", output_error.Error())
+		}
+	}()
+
+	os.Exit(shutdown(exitCode))
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Message processors, which keep count of how many of them are busy so that message_processor_count can be
+ * sized from their utilization.
+ */
+
+var messageProcessors processorStats
+
+type processorStats struct {
+	running int64
+	busy    int64
+}
+
+type ProcessorStatus struct {
+	Running     int64   `json:"running"`
+	Busy        int64   `json:"busy"`
+	Utilization float64 `json:"utilization"`
+}
+
+func (s *processorStats) started() {
+	atomic.AddInt64(&s.running, 1)
+}
+
+func (s *processorStats) exited() {
+	atomic.AddInt64(&s.running, -1)
+}
+
+// begin marks a processor busy with a delivery, and returns the time it started.
+func (s *processorStats) begin() time.Time {
+	atomic.AddInt64(&s.busy, 1)
+	return time.Now()
+}
+
+// end marks a processor idle again once it has handed the events of a delivery on.
+func (s *processorStats) end(started time.Time) {
+	atomic.AddInt64(&s.busy, -1)
+	metricMessageProcessorBusySeconds.Add(time.Since(started).Seconds())
+}
+
+// Status returns the number of running and busy processors, and the fraction of the running processors that are
+// busy.
+func (s *processorStats) Status() ProcessorStatus {
+	status := ProcessorStatus{Running: atomic.LoadInt64(&s.running), Busy: atomic.LoadInt64(&s.busy)}
+	if status.Running > 0 {
+		status.Utilization = float64(status.Busy) / float64(status.Running)
+	}
+	return status
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageProcessorConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "processors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "cb-event-forwarder.conf")
+	err = ioutil.WriteFile(fn, []byte(`
+[bridge]
+server_name=cbserver
+cb_server_hostname=localhost
+rabbit_mq_password=secret
+output_type=file
+outfile=`+filepath.Join(dir, "events.json")+`
+message_processor_count=3
+rabbit_mq_consumer_count=2
+output_queue_size=500
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MessageProcessorCount != 3 || c.AMQPConsumerCount != 2 || c.OutputQueueSize != 500 {
+		t.Errorf("Wrong pool sizes: %d processors, %d consumers, output queue of %d", c.MessageProcessorCount,
+			c.AMQPConsumerCount, c.OutputQueueSize)
+	}
+}
+
+func TestMessageProcessorUtilization(t *testing.T) {
+	var stats processorStats
+	for i := 0; i < 4; i++ {
+		stats.started()
+	}
+
+	started := stats.begin()
+	if status := stats.Status(); status.Running != 4 || status.Busy != 1 || status.Utilization != 0.25 {
+		t.Errorf("Wrong status with one busy processor: %+v", status)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	stats.end(started)
+	if status := stats.Status(); status.Busy != 0 || status.Utilization != 0 {
+		t.Errorf("Wrong status with no busy processors: %+v", status)
+	}
+
+	for i := 0; i < 4; i++ {
+		stats.exited()
+	}
+	if status := stats.Status(); status.Running != 0 || status.Utilization != 0 {
+		t.Errorf("Wrong status with no processors: %+v", status)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Prometheus metrics, served on /metrics alongside the expvar statistics on /debug/vars.
+ */
+
+var (
+	metricInputDeliveries = newCounterVec("cb_event_forwarder_input_deliveries_total",
+		"AMQP deliveries received.", "exchange", "routing_key")
+	metricInputBytes = newCounterVec("cb_event_forwarder_input_bytes_total",
+		"Bytes of AMQP delivery bodies received.", "exchange", "routing_key")
+	metricEvents = newCounterVec("cb_event_forwarder_events_total",
+		"Events produced from deliveries, before filtering.", "type")
+	metricFilteredEvents = newCounterVec("cb_event_forwarder_filtered_events_total",
+		"Events dropped by filter rules.", "type")
+	metricRateLimitedEvents = newCounterVec("cb_event_forwarder_rate_limited_events_total",
+		"Events suppressed by the per-sensor rate limit.", "type")
+	metricDeduplicatedEvents = newCounterVec("cb_event_forwarder_deduplicated_events_total",
+		"Repeated events suppressed by deduplication.", "type")
+	metricProcessTableLookups = newCounterVec("cb_event_forwarder_process_table_lookups_total",
+		"Raw events looked up in the process table, by result.", "result")
+	metricEnrichments = newCounterVec("cb_event_forwarder_enrichments_total",
+		"Events passed through enrichment, by result.", "result")
+	metricErrors = newCounterVec("cb_event_forwarder_errors_total",
+		"Errors processing deliveries or events.")
+	metricPartialBundles = newCounterVec("cb_event_forwarder_partial_bundles_total",
+		"Malformed or truncated bundles whose events were forwarded up to the error.", "routing_key")
+	metricProcessingDuration = newHistogramVec("cb_event_forwarder_processing_duration_seconds",
+		"Time taken to decode a delivery and hand its events to the outputs.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "content_type")
+	metricOutputEvents = newCounterVec("cb_event_forwarder_output_events_total",
+		"Events queued on each output.", "output", "output_type")
+	metricOutputBytes = newCounterVec("cb_event_forwarder_output_bytes_total",
+		"Bytes of encoded events queued on each output.", "output", "output_type")
+	metricOutputDroppedEvents = newCounterVec("cb_event_forwarder_output_dropped_events_total",
+		"Events an output could not deliver and discarded.", "output")
+	metricPostprocessQueueDepth = newGaugeFunc("cb_event_forwarder_postprocess_queue_depth",
+		"Events waiting for a post processing worker.", func() float64 {
+			if eventPostprocessor == nil {
+				return 0
+			}
+			return float64(eventPostprocessor.QueueDepth())
+		})
+	metricMessageProcessors = newGaugeFunc("cb_event_forwarder_message_processors",
+		"Message processors running.", func() float64 {
+			return float64(messageProcessors.Status().Running)
+		})
+	metricMessageProcessorsBusy = newGaugeFunc("cb_event_forwarder_message_processors_busy",
+		"Message processors busy with a delivery.", func() float64 {
+			return float64(messageProcessors.Status().Busy)
+		})
+	metricMessageProcessorBusySeconds = newCounterVec("cb_event_forwarder_message_processor_busy_seconds_total",
+		"Time spent by all message processors on deliveries.")
+	metricUploadDuration = newHistogramVec("cb_event_forwarder_upload_duration_seconds",
+		"Time taken by bundled outputs (S3, HTTP, Splunk, Elasticsearch) to upload a bundle.",
+		[]float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}, "output", "result")
+)
+
+// metrics lists every metric in the order it is exposed.
+var metrics = []metricWriter{
+	metricInputDeliveries,
+	metricInputBytes,
+	metricEvents,
+	metricFilteredEvents,
+	metricRateLimitedEvents,
+	metricDeduplicatedEvents,
+	metricProcessTableLookups,
+	metricEnrichments,
+	metricErrors,
+	metricPartialBundles,
+	metricProcessingDuration,
+	metricOutputEvents,
+	metricOutputBytes,
+	metricOutputDroppedEvents,
+	metricPostprocessQueueDepth,
+	metricMessageProcessors,
+	metricMessageProcessorsBusy,
+	metricMessageProcessorBusySeconds,
+	metricUploadDuration,
+}
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+// metricLabels holds the label names of a metric and formats their values.
+type metricLabels []string
+
+// key returns the identifier of a set of label values, in the exposition format.
+func (labels metricLabels) key(values []string) string {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metric has %d labels, got %d values", len(labels), len(values)))
+	}
+
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricName returns the name of a sample, with its labels if it has any.
+func metricName(name string, labels ...string) string {
+	nonEmpty := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if len(label) > 0 {
+			nonEmpty = append(nonEmpty, label)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels metricLabels
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Add increments the counter with the given label values, which must be in the order of the label names.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	key := c.labels.key(labelValues)
+
+	c.Lock()
+	c.values[key] += value
+	c.Unlock()
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s %s\n", metricName(c.name, key), formatMetricValue(c.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge without labels whose value is read when the metrics are served.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(g.value()))
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  metricLabels
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// Observe records a value in the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.labels.key(labelValues)
+
+	h.Lock()
+	defer h.Unlock()
+
+	values, ok := h.values[key]
+	if !ok {
+		values = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = values
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			values.counts[i]++
+		}
+	}
+	values.count++
+	values.sum += value
+}
+
+// ObserveSince records the time elapsed since start, in seconds.
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := h.values[key]
+		for i, bound := range h.buckets {
+			le := `le="` + formatMetricValue(bound) + `"`
+			fmt.Fprintf(w, "%s %d\n", metricName(h.name+"_bucket", key, le), values.counts[i])
+		}
+		fmt.Fprintf(w, "%s %d\n", metricName(h.name+"_bucket", key, `le="+Inf"`), values.count)
+		fmt.Fprintf(w, "%s %s\n", metricName(h.name+"_sum", key), formatMetricValue(values.sum))
+		fmt.Fprintf(w, "%s %d\n", metricName(h.name+"_count", key), values.count)
+	}
+}
+
+// metricsHandler serves every metric in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		metric.writeTo(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	counter := newCounterVec("test_events_total", "Events.", "type")
+	counter.Add(1, "ingress.event.procstart")
+	counter.Add(2, `quoted "type"`)
+	counter.Add(1, "ingress.event.procstart")
+
+	unlabeled := newCounterVec("test_errors_total", "Errors.")
+	unlabeled.Add(1)
+
+	histogram := newHistogramVec("test_duration_seconds", "Duration.", []float64{.1, 1}, "output")
+	histogram.Observe(.05, "s3")
+	histogram.Observe(.5, "s3")
+	histogram.Observe(5, "s3")
+
+	savedMetrics := metrics
+	metrics = []metricWriter{counter, unlabeled, histogram}
+	defer func() { metrics = savedMetrics }()
+
+	request, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, request)
+
+	expected := `# HELP test_events_total Events.
+# TYPE test_events_total counter
+test_events_total{type="ingress.event.procstart"} 2
+test_events_total{type="quoted \"type\""} 2
+# HELP test_errors_total Errors.
+# TYPE test_errors_total counter
+test_errors_total 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{output="s3",le="0.1"} 1
+test_duration_seconds_bucket{output="s3",le="1"} 2
+test_duration_seconds_bucket{output="s3",le="+Inf"} 3
+test_duration_seconds_sum{output="s3"} 5.55
+test_duration_seconds_count{output="s3"} 3
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("Unexpected metrics:\n%s\nexpected:\n%s", body, expected)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", recorder.Header().Get("Content-Type"))
+	}
+}
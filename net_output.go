@@ -20,6 +20,8 @@ type NetOutput struct {
 	protocolName   string
 	outputSocket   net.Conn
 	addNewline     bool
+	outputConfig   *OutputConfiguration
+	spool          *DiskSpool
 
 	connectTime                 time.Time
 	reconnectTime               time.Time
@@ -27,6 +29,9 @@ type NetOutput struct {
 	droppedEventCount           int64
 	droppedEventSinceConnection int64
 
+	received    int64
+	acknowledge DeliveryAcknowledger
+
 	sync.RWMutex
 }
 
@@ -36,6 +41,8 @@ type NetStatistics struct {
 	RemoteHostname    string    `json:"remote_hostname"`
 	DroppedEventCount int64     `json:"dropped_event_count"`
 	Connected         bool      `json:"connected"`
+	SpoolDepth        int64     `json:"spool_depth"`
+	SpoolBytes        int64     `json:"spool_bytes"`
 }
 
 // Initialize() expects a connection string in the following format:
@@ -61,6 +68,14 @@ func (o *NetOutput) Initialize(netConn string) error {
 	}
 
 	var err error
+	if o.spool == nil && o.outputConfig != nil && len(o.outputConfig.SpoolDirectory) > 0 {
+		o.spool, err = OpenDiskSpool(o.outputConfig.SpoolDirectory, o.outputConfig.SpoolSegmentSize,
+			o.outputConfig.SpoolMaxSize)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error opening spool '%s': %s", o.outputConfig.SpoolDirectory, err))
+		}
+	}
+
 	o.outputSocket, err = net.Dial(o.protocolName, o.remoteHostname)
 
 	if err != nil {
@@ -72,6 +87,26 @@ func (o *NetOutput) Initialize(netConn string) error {
 	return nil
 }
 
+// Probe connects to a TCP destination and disconnects again, or looks up the address of a UDP destination.
+func (o *NetOutput) Probe(netConn string) error {
+	connSpecification := strings.SplitN(netConn, ":", 2)
+	if len(connSpecification) != 2 {
+		return errors.New(fmt.Sprintf("Invalid destination '%s'", netConn))
+	}
+
+	if o.outputConfig != nil && len(o.outputConfig.SpoolDirectory) > 0 {
+		if err := checkWritableDirectory(o.outputConfig.SpoolDirectory); err != nil {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(connSpecification[0], "udp") {
+		_, err := net.ResolveUDPAddr(connSpecification[0], connSpecification[1])
+		return err
+	}
+	return probeTCP(connSpecification[0], connSpecification[1])
+}
+
 func (o *NetOutput) markConnected() {
 	o.connectTime = time.Now()
 	log.Infof("Connected to %s at %s.", o.netConn, o.connectTime)
@@ -83,6 +118,18 @@ func (o *NetOutput) markConnected() {
 	}
 }
 
+// disconnect closes the connection to the destination when the output stops.
+func (o *NetOutput) disconnect() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.outputSocket.Close()
+		o.connected = false
+	}
+	log.Infof("Disconnected from %s", o.netConn)
+}
+
 func (o *NetOutput) closeAndScheduleReconnection() {
 	o.Lock()
 	defer o.Unlock()
@@ -98,6 +145,10 @@ func (o *NetOutput) closeAndScheduleReconnection() {
 	log.Infof("Lost connection to %s. Will try to reconnect at %s.", o.netConn, o.reconnectTime)
 }
 
+func (o *NetOutput) SetAcknowledger(ack DeliveryAcknowledger) {
+	o.acknowledge = ack
+}
+
 func (o *NetOutput) Key() string {
 	o.RLock()
 	defer o.RUnlock()
@@ -116,39 +167,112 @@ func (o *NetOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return NetStatistics{
+	stats := NetStatistics{
 		LastOpenTime:      o.connectTime,
 		Protocol:          o.protocolName,
 		RemoteHostname:    o.remoteHostname,
 		DroppedEventCount: o.droppedEventCount,
 		Connected:         o.connected,
 	}
+	if o.spool != nil {
+		spoolStats := o.spool.Statistics()
+		stats.SpoolDepth = spoolStats.Depth
+		stats.SpoolBytes = spoolStats.Bytes
+	}
+	return stats
 }
 
-func (o *NetOutput) output(m string) error {
+func (o *NetOutput) write(m string) error {
 	if o.addNewline {
 		m = m + "\r\n"
 	}
 
+	_, err := o.outputSocket.Write([]byte(m))
+	if err != nil {
+		o.closeAndScheduleReconnection()
+	}
+	return err
+}
+
+func (o *NetOutput) output(m string) error {
+	if o.spool != nil && (!o.connected || o.spool.Depth() > 0) {
+		// once anything is spooled, new events queue up behind it so they are sent in order
+		return o.spoolEvent(m)
+	}
+
 	if !o.connected {
 		// drop this event on the floor...
 		atomic.AddInt64(&o.droppedEventCount, 1)
+		metricOutputDroppedEvents.Add(1, o.outputConfig.Name)
 		return nil
 	}
 
-	_, err := o.outputSocket.Write([]byte(m))
-	if err != nil {
-		o.closeAndScheduleReconnection()
+	err := o.write(m)
+	if err != nil && o.spool != nil {
+		log.Errorf("Error sending to %s, spooling event: %s", o.netConn, err)
+		return o.spoolEvent(m)
 	}
 	return err
 }
 
+func (o *NetOutput) spoolEvent(m string) error {
+	err := o.spool.Write(m)
+	if err == ErrSpoolFull {
+		atomic.AddInt64(&o.droppedEventCount, 1)
+		metricOutputDroppedEvents.Add(1, o.outputConfig.Name)
+		if o.acknowledge == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// replaySpool sends up to 1000 spooled events, stopping at the first error.
+func (o *NetOutput) replaySpool() {
+	for i := 0; i < 1000; i++ {
+		m, ok, err := o.spool.Peek()
+		if err != nil {
+			log.Errorf("Error reading spool for %s: %s", o.netConn, err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		if err := o.write(m); err != nil {
+			log.Errorf("Error replaying spooled events to %s: %s", o.netConn, err)
+			return
+		}
+		o.spool.Pop()
+
+		if o.spool.Depth() == 0 {
+			log.Infof("Finished replaying spooled events to %s", o.netConn)
+			return
+		}
+	}
+}
+
+// accepting returns false when messages should be left queued: with acknowledgements enabled we stop reading
+// rather than dropping events.
+func (o *NetOutput) accepting() bool {
+	if o.acknowledge == nil {
+		return true
+	}
+	if o.spool != nil {
+		return !o.spool.Full()
+	}
+	return o.connected
+}
+
 func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
 	}
 
 	go func() {
+		// closing errorChan tells the dispatcher that this output has stopped
+		defer close(errorChan)
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
@@ -157,10 +281,39 @@ func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
 
 		defer signal.Stop(hup)
 
+		// always ready; selected to replay the spool in between incoming messages
+		replayReady := make(chan struct{})
+		close(replayReady)
+
 		for {
+			// when acknowledging deliveries, leave messages queued while disconnected instead of dropping them
+			input := messages
+			if !o.accepting() {
+				input = nil
+			}
+
+			var replay chan struct{}
+			if o.spool != nil && o.connected && o.spool.Depth() > 0 {
+				replay = replayReady
+			}
+
 			select {
-			case message := <-messages:
-				if err := o.output(message); err != nil {
+			case <-replay:
+				o.replaySpool()
+
+			case message, ok := <-input:
+				if !ok {
+					// anything still spooled stays on disk and is sent after the next start
+					o.disconnect()
+					return
+				}
+
+				o.received++
+				err := o.output(message)
+				if o.acknowledge != nil {
+					o.acknowledge(o.received, err)
+				}
+				if err != nil {
 					errorChan <- err
 				}
 
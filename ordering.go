@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/streadway/amqp"
+)
+
+/*
+ * With event_ordering=sensor, message processing and post processing are sharded by sensor so that the events
+ * of each sensor are sent in the order in which they arrived.
+ */
+
+const (
+	UnorderedEvents = iota
+	SensorOrderedEvents
+)
+
+// shardQueueSize is the number of deliveries that can wait for each message processor when they are sharded, so
+// that a processor that is briefly busy does not hold up the deliveries for the others.
+const shardQueueSize = 16
+
+// shardForSensor returns the shard in [0, n) for a sensor.
+func shardForSensor(sensorID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(sensorID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// deliverySensorID returns the sensor that a delivery came from, or false if it cannot be told without decoding
+// the whole delivery.
+func deliverySensorID(delivery amqp.Delivery) (string, bool) {
+	if sensorID, ok := delivery.Headers["sensorId"]; ok {
+		val, err := parseIntFromHeader(sensorID)
+		if err == nil {
+			return fmt.Sprintf("%d", val), true
+		}
+	}
+
+	if delivery.ContentType == "application/json" {
+		var msg struct {
+			SensorID json.Number `json:"sensor_id"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(delivery.Body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&msg); err == nil && msg.SensorID != "" {
+			return msg.SensorID.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// eventSensorID returns the sensor_id of an event, or false if it has none.
+func eventSensorID(event *Event) (string, bool) {
+	sensorID, ok := event.Get("sensor_id")
+	if !ok || sensorID == nil {
+		return "", false
+	}
+	return fmt.Sprint(sensorID), true
+}
+
+// startMessageProcessors starts n message processors for the deliveries, which are handed to the processors by
+// sensor if event_ordering is sensor. The processors exit once the deliveries channel is closed.
+func startMessageProcessors(deliveries <-chan amqp.Delivery, n int) {
+	wg.Add(n)
+
+	if config.EventOrdering != SensorOrderedEvents {
+		for i := 0; i < n; i++ {
+			go worker(deliveries)
+		}
+		return
+	}
+
+	shards := make([]chan amqp.Delivery, n)
+	for i := range shards {
+		shards[i] = make(chan amqp.Delivery, shardQueueSize)
+		go worker(shards[i])
+	}
+
+	go func() {
+		next := 0
+		for delivery := range deliveries {
+			shard := next
+			if sensorID, ok := deliverySensorID(delivery); ok {
+				shard = shardForSensor(sensorID, n)
+			} else {
+				next = (next + 1) % n
+			}
+			shards[shard] <- delivery
+		}
+
+		for _, shard := range shards {
+			close(shard)
+		}
+	}()
+}
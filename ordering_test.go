@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDeliverySensorID(t *testing.T) {
+	for _, test := range []struct {
+		delivery amqp.Delivery
+		sensorID string
+		ok       bool
+	}{
+		{amqp.Delivery{ContentType: "application/protobuf", Headers: amqp.Table{"sensorId": int32(12)}}, "12", true},
+		{amqp.Delivery{ContentType: "application/json", Body: []byte(`{"type": "alert.watchlist.hit.query.process", "sensor_id": 7}`)}, "7", true},
+		{amqp.Delivery{ContentType: "application/json", Body: []byte(`{"type": "binaryinfo.observed", "md5": "ABCD"}`)}, "", false},
+		{amqp.Delivery{ContentType: "application/protobuf", Body: []byte{0x0a, 0x00}}, "", false},
+	} {
+		sensorID, ok := deliverySensorID(test.delivery)
+		if sensorID != test.sensorID || ok != test.ok {
+			t.Errorf("Expected sensor %q (%v) for %s delivery, got %q (%v)", test.sensorID, test.ok,
+				test.delivery.ContentType, sensorID, ok)
+		}
+	}
+}
+
+func TestSensorOrderedPostprocessing(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config.EventOrdering = SensorOrderedEvents
+	config.PostprocessWorkers = 4
+	config.PostprocessQueueSize = 40
+
+	output := &OutputConfiguration{Name: "default", OutputFormat: JSONOutputFormat}
+	route := &outputRoute{output: output, messages: make(chan string, 1000), stopped: make(chan struct{})}
+	savedRoutes := outputRoutes
+	outputRoutes = []*outputRoute{route}
+	defer func() { outputRoutes = savedRoutes }()
+
+	postprocessor := NewPostprocessor(config)
+	for i := 0; i < 100; i++ {
+		for sensorID := 1; sensorID <= 8; sensorID++ {
+			postprocessor.Enqueue(newEvent(map[string]interface{}{"type": "ingress.event.netconn",
+				"sensor_id": int32(sensorID), "sequence": i}), nil)
+		}
+	}
+
+	if !waitUntil(postprocessor.Drained(), time.Now().Add(10*time.Second)) {
+		t.Fatal("Post processing did not finish")
+	}
+
+	last := make(map[float64]float64)
+	for i := 0; i < 800; i++ {
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(<-route.messages), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		sensorID, sequence := msg["sensor_id"].(float64), msg["sequence"].(float64)
+		if previous, ok := last[sensorID]; ok && sequence != previous+1 {
+			t.Fatalf("Event %v from sensor %v was sent after event %v", sequence, sensorID, previous)
+		}
+		last[sensorID] = sequence
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/carbonblack/cb-event-forwarder/cef"
+	"github.com/carbonblack/cb-event-forwarder/leef"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * The output dispatcher fans each processed event out to every configured output whose event_types
+ * filter matches the event's routing key. Each output has its own message channel, so a slow output
+ * only applies backpressure to the events routed to it.
+ */
+
+type OutputError struct {
+	Output *OutputConfiguration
+	Err    error
+}
+
+func (e OutputError) Error() string {
+	return fmt.Sprintf("output %s: %s", e.Output.Name, e.Err.Error())
+}
+
+type outputRoute struct {
+	output   *OutputConfiguration
+	handler  OutputHandler
+	messages chan string
+	errors   chan error
+
+	// closed once the output has stopped, which it signals by closing its error channel
+	stopped chan struct{}
+
+	// closed when the forwarder shuts down, so that senders blocked on a full message channel give up
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// with at-least-once delivery, the deliveries behind the queued messages and whether the output
+	// acknowledges them itself
+	deliveries   deliveryQueue
+	acknowledges bool
+	sendLock     sync.Mutex
+}
+
+var outputRoutes []*outputRoute
+
+// outputsLock is held for reading while messages are queued, so that closeOutputs never closes a channel that
+// is being sent to.
+var (
+	outputsLock   sync.RWMutex
+	outputsClosed bool
+)
+
+var errOutputsClosed = errors.New("outputs have been shut down")
+
+// AddressingOutputHandler is implemented by outputs that address each message using fields of the original
+// event, such as a Kafka topic or partition key, so that they do not depend on the output format. Address is
+// called for every message routed to the output, in the same order as the messages are queued on its channel.
+// Unaddress withdraws the last address when its message could not be queued after all.
+type AddressingOutputHandler interface {
+	Address(event *Event)
+	Unaddress()
+}
+
+// accepts returns true if events with the given routing key should be sent to this output. An output
+// without any event_types configured receives every event.
+func (r *outputRoute) accepts(routingKey string) bool {
+	return eventTypesMatch(r.output.EventTypes, routingKey)
+}
+
+// eventTypesMatch returns true if routingKey matches any of the patterns, or if there are no patterns.
+func eventTypesMatch(patterns []string, routingKey string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if routingKeyMatches(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues a message on the output. The message is numbered and addressed under sendLock so that the
+// sequence recorded in the delivery queue and the address match the order in which the output reads its channel.
+func (r *outputRoute) send(event *Event, outmsg string, delivery *pendingDelivery) {
+	addresser, addressed := r.handler.(AddressingOutputHandler)
+	if !config.AtLeastOnceDelivery && !addressed {
+		r.queue(outmsg)
+		return
+	}
+
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+
+	if addressed {
+		addresser.Address(event)
+	}
+
+	var sequence int64
+	if config.AtLeastOnceDelivery {
+		sequence = r.deliveries.push(delivery)
+	}
+
+	if !r.queue(outmsg) {
+		// the message will never be read, so its address must not be paired with the next one
+		if addressed {
+			addresser.Unaddress()
+		}
+		if config.AtLeastOnceDelivery {
+			r.deliveries.acknowledge(sequence, errOutputsClosed)
+		}
+		return
+	}
+
+	if config.AtLeastOnceDelivery && !r.acknowledges {
+		r.deliveries.acknowledge(sequence, nil)
+	}
+}
+
+// queue puts a message on the output's channel. It returns false, dropping the message, if the output has
+// stopped and will never read it, or if the forwarder is shutting down while the channel is full.
+func (r *outputRoute) queue(outmsg string) bool {
+	select {
+	case r.messages <- outmsg:
+		return true
+	case <-r.stopped:
+	case <-r.closing:
+	}
+	metricOutputDroppedEvents.Add(1, r.output.Name)
+	return false
+}
+
+// closeOutputs closes the channel of every output, so that each writes out the messages it has left and stops.
+// Messages dispatched afterwards are discarded.
+func closeOutputs() {
+	// dispatchers hold outputsLock while they wait for room on an output's channel, and an output that has
+	// stopped reading would otherwise keep the lock from ever being taken
+	for _, route := range outputRoutes {
+		route.closingOnce.Do(func() {
+			if route.closing != nil {
+				close(route.closing)
+			}
+		})
+	}
+
+	outputsLock.Lock()
+	defer outputsLock.Unlock()
+
+	if outputsClosed {
+		return
+	}
+	outputsClosed = true
+
+	for _, route := range outputRoutes {
+		close(route.messages)
+	}
+}
+
+// routingKeyMatches implements AMQP topic exchange semantics: words are separated by '.', '*' matches
+// exactly one word and '#' matches zero or more words.
+func routingKeyMatches(pattern, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+// encodeMessage encodes the event in the output format, with the typed encoders if it is a typed event.
+func encodeMessage(event *Event, outputFormat int) (string, error) {
+	switch outputFormat {
+	case JSONOutputFormat:
+		if event.typed != nil {
+			return encodeTypedEventJSON(event.typed)
+		}
+		return encodeEventJSON(event.msg)
+	case LEEFOutputFormat:
+		if event.typed != nil {
+			return encodeTypedEventLEEF(event.typed)
+		}
+		// the encoder rewrites the message in place; encode a copy so other outputs see the original
+		return leef.Encode(event.copyMap())
+	case CEFOutputFormat:
+		return cef.Encode(event.copyMap())
+	default:
+		return "", errors.New(fmt.Sprintf("Invalid output format (%d)", outputFormat))
+	}
+}
+
+// dispatchMessage encodes the message once per output format in use and queues it on every output
+// that accepts its routing key. delivery is the AMQP delivery the message came from, or nil. Every format is
+// encoded before the message is queued anywhere; if a format cannot be encoded, the outputs that use it are
+// skipped and count the message as dropped, the others still get it, and the encoding error is returned.
+func dispatchMessage(event *Event, routingKey string, delivery *pendingDelivery) error {
+	outputsLock.RLock()
+	defer outputsLock.RUnlock()
+
+	if outputsClosed {
+		return errOutputsClosed
+	}
+
+	routes := make([]*outputRoute, 0, len(outputRoutes))
+	encoded := make(map[int]string)
+	encodeErrors := make(map[int]error)
+
+	for _, route := range outputRoutes {
+		if !route.accepts(routingKey) {
+			continue
+		}
+		routes = append(routes, route)
+
+		format := route.output.OutputFormat
+		if _, ok := encoded[format]; ok {
+			continue
+		}
+		if _, ok := encodeErrors[format]; ok {
+			continue
+		}
+
+		outmsg, err := encodeMessage(event, format)
+		if err != nil {
+			encodeErrors[format] = err
+			continue
+		}
+		encoded[format] = outmsg
+	}
+
+	delivered := false
+	var encodeErr error
+
+	for _, route := range routes {
+		outmsg, ok := encoded[route.output.OutputFormat]
+		if !ok {
+			encodeErr = encodeErrors[route.output.OutputFormat]
+			metricOutputDroppedEvents.Add(1, route.output.Name)
+			continue
+		}
+
+		if len(outmsg) > 0 {
+			route.send(event, outmsg, delivery)
+			metricOutputEvents.Add(1, route.output.Name, route.output.OutputTypeName)
+			metricOutputBytes.Add(float64(len(outmsg)), route.output.Name, route.output.OutputTypeName)
+			delivered = true
+		}
+	}
+
+	if delivered {
+		status.OutputEventCount.Add(1)
+	}
+
+	return encodeErr
+}
+
+func newOutputHandler(output *OutputConfiguration) (OutputHandler, string, error) {
+	parameters := output.OutputParameters
+
+	switch output.OutputType {
+	case FileOutputType:
+		return &FileOutput{}, parameters, nil
+	case TCPOutputType:
+		return &NetOutput{outputConfig: output}, "tcp:" + parameters, nil
+	case UDPOutputType:
+		return &NetOutput{outputConfig: output}, "udp:" + parameters, nil
+	case S3OutputType:
+		return &BundledOutput{behavior: &S3Behavior{outputConfig: output}, outputConfig: output}, parameters, nil
+	case SyslogOutputType:
+		return &SyslogOutput{outputConfig: output}, parameters, nil
+	case HttpOutputType:
+		return &BundledOutput{behavior: &HttpBehavior{outputConfig: output}, outputConfig: output}, parameters, nil
+	case SplunkOutputType:
+		return &BundledOutput{behavior: &SplunkBehavior{outputConfig: output}, outputConfig: output}, parameters, nil
+	case KafkaOutputType:
+		return &KafkaOutput{outputConfig: output}, parameters, nil
+	case ElasticsearchOutputType:
+		return &BundledOutput{behavior: &ElasticsearchBehavior{outputConfig: output}, outputConfig: output}, parameters, nil
+	default:
+		return nil, "", errors.New(fmt.Sprintf("No valid output handler found for output %s (%d)",
+			output.Name, output.OutputType))
+	}
+}
+
+// newOutputRoute creates and initializes the handler for an output. The handler does not read its messages until
+// the route is started.
+func newOutputRoute(output *OutputConfiguration) (*outputRoute, error) {
+	outputHandler, parameters, err := newOutputHandler(output)
+	if err != nil {
+		return nil, err
+	}
+
+	err = outputHandler.Initialize(parameters)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not initialize output %s: %s", output.Name, err))
+	}
+
+	route := &outputRoute{
+		output:   output,
+		handler:  outputHandler,
+		messages: make(chan string, config.OutputQueueSize),
+		errors:   make(chan error),
+		stopped:  make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+
+	if config.AtLeastOnceDelivery {
+		if acknowledger, ok := outputHandler.(AcknowledgingOutputHandler); ok {
+			acknowledger.SetAcknowledger(route.deliveries.acknowledge)
+			route.acknowledges = true
+		}
+	}
+
+	return route, nil
+}
+
+func (r *outputRoute) start() error {
+	if len(r.output.EventTypes) > 0 {
+		log.Infof("Initialized output %s: %s (event types: %s)\n", r.output.Name, r.handler.String(),
+			strings.Join(r.output.EventTypes, ", "))
+	} else {
+		log.Infof("Initialized output %s: %s\n", r.output.Name, r.handler.String())
+	}
+
+	if err := r.handler.Go(r.messages, r.errors); err != nil {
+		return err
+	}
+	go r.forwardOutputErrors()
+
+	return nil
+}
+
+func outputStatus(route *outputRoute) map[string]interface{} {
+	ret := make(map[string]interface{})
+	ret[route.handler.Key()] = route.handler.Statistics()
+
+	switch route.output.OutputFormat {
+	case LEEFOutputFormat:
+		ret["format"] = "leef"
+	case CEFOutputFormat:
+		ret["format"] = "cef"
+	case JSONOutputFormat:
+		ret["format"] = "json"
+	}
+
+	switch route.output.OutputType {
+	case FileOutputType:
+		ret["type"] = "file"
+	case UDPOutputType:
+		ret["type"] = "net"
+	case TCPOutputType:
+		ret["type"] = "net"
+	case S3OutputType:
+		ret["type"] = "s3"
+	case HttpOutputType:
+		ret["type"] = "http"
+	case SplunkOutputType:
+		ret["type"] = "splunk"
+	case SyslogOutputType:
+		ret["type"] = "syslog"
+	case KafkaOutputType:
+		ret["type"] = "kafka"
+	case ElasticsearchOutputType:
+		ret["type"] = "elasticsearch"
+	}
+
+	ret["event_types"] = route.output.EventTypes
+
+	return ret
+}
+
+// forwardOutputErrors tags errors reported by an output handler with the output they came from. Output handlers
+// close their error channel when they stop.
+func (r *outputRoute) forwardOutputErrors() {
+	for err := range r.errors {
+		output_errors <- OutputError{Output: r.output, Err: err}
+	}
+	close(r.stopped)
+}
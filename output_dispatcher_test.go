@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestRoutingKeyMatches(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		routingKey string
+		expected   bool
+	}{
+		{"ingress.event.procstart", "ingress.event.procstart", true},
+		{"ingress.event.procstart", "ingress.event.procend", false},
+		{"ingress.event.*", "ingress.event.netconn", true},
+		{"ingress.event.*", "ingress.event", false},
+		{"ingress.#", "ingress.event.netconn", true},
+		{"ingress.#", "ingress", true},
+		{"#", "watchlist.hit.process", true},
+		{"watchlist.#.process", "watchlist.storage.hit.process", true},
+		{"watchlist.#.process", "watchlist.hit.binary", false},
+		{"*.hit.*", "watchlist.hit.process", true},
+		{"alert.#", "watchlist.hit.process", false},
+	}
+
+	for _, test := range tests {
+		if routingKeyMatches(test.pattern, test.routingKey) != test.expected {
+			t.Errorf("routingKeyMatches(%s, %s) should be %v", test.pattern, test.routingKey, test.expected)
+		}
+	}
+}
+
+func TestParseNamedOutput(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[output:alerts]
+output_type=splunk
+output_format=leef
+splunkout=https://splunk.example.com:8088/services/collector
+hec_token=secret
+event_types=alert.#, watchlist.hit.*
+bundle_send_timeout=30
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	output := parseOutputConfiguration(input, "alerts", "output:alerts", "splunk", JSONOutputFormat, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	if output.OutputType != SplunkOutputType || output.OutputFormat != LEEFOutputFormat {
+		t.Errorf("Wrong output type or format: %d, %d", output.OutputType, output.OutputFormat)
+	}
+	if output.OutputParameters != "https://splunk.example.com:8088/services/collector" {
+		t.Errorf("Wrong output parameters: %s", output.OutputParameters)
+	}
+	if output.SplunkToken == nil || *output.SplunkToken != "secret" {
+		t.Error("hec_token was not read from the named section")
+	}
+	if len(output.EventTypes) != 2 || output.EventTypes[0] != "alert.#" || output.EventTypes[1] != "watchlist.hit.*" {
+		t.Errorf("Wrong event types: %v", output.EventTypes)
+	}
+	if output.BundleSendTimeout.Seconds() != 30 {
+		t.Errorf("Wrong bundle send timeout: %s", output.BundleSendTimeout)
+	}
+
+	route := &outputRoute{output: output}
+	if !route.accepts("alert.watchlist.hit.ingress.process") || route.accepts("ingress.event.procstart") {
+		t.Error("Output did not filter events by event_types")
+	}
+}
+
+func TestDispatchSkipsOutputsThatCannotEncode(t *testing.T) {
+	leefOutput := &OutputConfiguration{Name: "leef-out", OutputFormat: LEEFOutputFormat}
+	jsonOutput := &OutputConfiguration{Name: "json-out", OutputFormat: JSONOutputFormat}
+	leefRoute := &outputRoute{output: leefOutput, messages: make(chan string, 1), stopped: make(chan struct{})}
+	jsonRoute := &outputRoute{output: jsonOutput, messages: make(chan string, 1), stopped: make(chan struct{})}
+
+	savedRoutes := outputRoutes
+	outputRoutes = []*outputRoute{leefRoute, jsonRoute}
+	defer func() { outputRoutes = savedRoutes }()
+
+	dropped := func() float64 {
+		metricOutputDroppedEvents.Lock()
+		defer metricOutputDroppedEvents.Unlock()
+		return metricOutputDroppedEvents.values[metricOutputDroppedEvents.labels.key([]string{"leef-out"})]
+	}
+	droppedBefore := dropped()
+
+	// LEEF messages cannot be encoded with an invalid ioc_attr
+	event := newEvent(map[string]interface{}{"type": "alert.watchlist.hit.query.process", "ioc_attr": "{"})
+	if err := dispatchMessage(event, "alert.watchlist.hit.query.process", nil); err == nil {
+		t.Error("Expected the encoding error to be returned")
+	}
+
+	if len(leefRoute.messages) != 0 || dropped() != droppedBefore+1 {
+		t.Errorf("Expected the LEEF output to count the event as dropped, queued %d", len(leefRoute.messages))
+	}
+	if len(jsonRoute.messages) != 1 {
+		t.Error("Expected the JSON output to get the event")
+	}
+}
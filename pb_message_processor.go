@@ -6,11 +6,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/carbonblack/cb-event-forwarder/sensor_events"
@@ -45,17 +47,61 @@ func (inmsg *ConvertedCbMessage) getStringByGuid(guid int64) (string, error) {
 	return "", errors.New(fmt.Sprintf("Could not find string for id %d", guid))
 }
 
-func ProcessProtobufBundle(routingKey string, body []byte, headers amqp.Table) ([]map[string]interface{}, error) {
-	msgs := make([]map[string]interface{}, 0, 1)
-	var err error
+/*
+ * Bundles of length prefixed CbEventMsgs are decoded one message at a time, and each event is handed on as soon
+ * as it is decoded.
+ */
+
+// bundleBuffers holds the buffers that messages are read into from zip files.
+var bundleBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 0, 64*1024)
+	return &buf
+}}
+
+// protobufBundle decodes the messages of a single bundle.
+type protobufBundle struct {
+	routingKey string
+	headers    amqp.Table
+
+	// built from the headers for the first message without an environment of its own
+	env      *sensor_events.CbEnvironmentMsg
+	envErr   error
+	envBuilt bool
+
+	// index of the next message, for error messages
+	index int
+}
 
-	err = nil
-	totalLength := uint64(len(body))
-	i := 0
+func newProtobufBundle(routingKey string, headers amqp.Table) *protobufBundle {
+	return &protobufBundle{routingKey: routingKey, headers: headers}
+}
+
+func (b *protobufBundle) environment() (*sensor_events.CbEnvironmentMsg, error) {
+	if !b.envBuilt {
+		b.env, b.envErr = createEnvMessage(b.headers)
+		b.envBuilt = true
+	}
+	return b.env, b.envErr
+}
+
+// decodeMessage decodes a single message and passes its event, if it has one, to fn. Errors in a message are
+// logged and do not stop the rest of the bundle from being decoded.
+func (b *protobufBundle) decodeMessage(body []byte, fn func(*Event)) {
+	event, err := processProtobufMessage(b.routingKey, body, b.environment)
+	if err != nil {
+		log.Infof("Error in ProcessProtobufBundle for event index %d: %s. Continuing to next message.", b.index,
+			err.Error())
+	} else if event != nil {
+		fn(event)
+	}
+	b.index++
+}
 
+// decodeBytes decodes the messages in body.
+func (b *protobufBundle) decodeBytes(body []byte, fn func(*Event)) error {
+	totalLength := uint64(len(body))
 	if totalLength < 4 {
-		err = fmt.Errorf("Error in ProcessProtobufBundle: body length is < 4 bytes. Giving up.")
-		return msgs, err
+		return fmt.Errorf("Error in ProcessProtobufBundle: body length is < 4 bytes. Giving up.")
 	}
 
 	var bytesRead uint64
@@ -64,33 +110,79 @@ func ProcessProtobufBundle(routingKey string, body []byte, headers amqp.Table) (
 		bytesRead += 4
 
 		if messageLength+bytesRead > totalLength {
-			err = fmt.Errorf("Error in ProcessProtobufBundle for event index %d: Length %d is insane. Giving up.",
-				messageLength)
-			break
+			return fmt.Errorf("Error in ProcessProtobufBundle for event index %d: Length %d is insane. Giving up.",
+				b.index, messageLength)
 		}
 
-		msg, err := ProcessProtobufMessage(routingKey, body[bytesRead:bytesRead+messageLength], headers)
-		if err != nil {
-			log.Infof("Error in ProcessProtobufBundle for event index %d: %s. Continuing to next message.", i, err.Error())
-		} else if msg != nil {
-			msgs = append(msgs, msg)
+		b.decodeMessage(body[bytesRead:bytesRead+messageLength], fn)
+		bytesRead += messageLength
+	}
+
+	return b.checkTrailer(totalLength - bytesRead)
+}
+
+// checkTrailer returns an error if the bytes left after the last message are too few for a length, as when the
+// bundle was truncated in the middle of one.
+func (b *protobufBundle) checkTrailer(remaining uint64) error {
+	if remaining > 0 && remaining < 4 {
+		return fmt.Errorf("Error in ProcessProtobufBundle for event index %d: %d trailing bytes. Giving up.",
+			b.index, remaining)
+	}
+	return nil
+}
+
+// decodeReader decodes the messages read from r, which holds totalLength bytes.
+func (b *protobufBundle) decodeReader(r io.Reader, totalLength uint64, fn func(*Event)) error {
+	bufp := bundleBuffers.Get().(*[]byte)
+	defer bundleBuffers.Put(bufp)
+
+	var prefix [4]byte
+	var bytesRead uint64
+	for bytesRead+4 < totalLength {
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			return err
+		}
+		messageLength := (uint64)(binary.LittleEndian.Uint32(prefix[:]))
+		bytesRead += 4
+
+		if messageLength+bytesRead > totalLength {
+			return fmt.Errorf("Error in ProcessProtobufBundle for event index %d: Length %d is insane. Giving up.",
+				b.index, messageLength)
+		}
+
+		if uint64(cap(*bufp)) < messageLength {
+			*bufp = make([]byte, messageLength)
+		}
+		buf := (*bufp)[:messageLength]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
 		}
 
+		b.decodeMessage(buf, fn)
 		bytesRead += messageLength
-		i += 1
 	}
-
-	if err != nil && bytesRead < totalLength {
-		err = fmt.Errorf("Error in ProcessProtobufBundle: messages did not fill entire bundle; %d bytes left",
-			totalLength-bytesRead)
+	if err := b.checkTrailer(totalLength - bytesRead); err != nil {
+		return err
 	}
 
-	return msgs, err
+	// reading to the end verifies the checksum of zip files
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
 }
 
-func ProcessRawZipBundle(routingKey string, body []byte, headers amqp.Table) ([]map[string]interface{}, error) {
-	msgs := make([]map[string]interface{}, 0, 1)
+// ProcessProtobufBundleFunc decodes a bundle of length prefixed messages, calling fn with each event as it is
+// decoded. It returns an error if the bundle is malformed; the events before the error have already been passed
+// to fn.
+func ProcessProtobufBundleFunc(routingKey string, body []byte, headers amqp.Table,
+	fn func(*Event)) error {
+	return newProtobufBundle(routingKey, headers).decodeBytes(body, fn)
+}
 
+// ProcessRawZipBundleFunc decodes a zip archive of bundles, calling fn with each event as it is decoded. Bodies
+// that are not zip archives are decoded as a single bundle. A file that cannot be decoded does not stop the rest
+// of the archive from being decoded; the first such error is returned at the end.
+func ProcessRawZipBundleFunc(routingKey string, body []byte, headers amqp.Table,
+	fn func(*Event)) error {
 	bodyReader := bytes.NewReader(body)
 	zipReader, err := zip.NewReader(bodyReader, (int64)(len(body)))
 
@@ -101,30 +193,50 @@ func ProcessRawZipBundle(routingKey string, body []byte, headers amqp.Table) ([]
 	// a protobuf bundle instead.
 
 	if err != nil {
-		return ProcessProtobufBundle(routingKey, body, headers)
+		return ProcessProtobufBundleFunc(routingKey, body, headers, fn)
 	}
 
+	var firstErr error
+	bundle := newProtobufBundle(routingKey, headers)
 	for i, zf := range zipReader.File {
 		src, err := zf.Open()
 		if err != nil {
 			log.Errorf("Error opening raw sensor event zip file content: %s. Continuing.", err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
 			continue
 		}
 
-		unzippedFile, err := ioutil.ReadAll(src)
+		err = bundle.decodeReader(src, zf.UncompressedSize64, fn)
 		src.Close()
 		if err != nil {
-			log.Errorf("Error opening raw sensor event file id %d from package: %s", i, err.Error())
-			continue
-		}
-
-		newMsgs, err := ProcessProtobufBundle(routingKey, unzippedFile, headers)
-		if err != nil {
-			log.Errorf("Errors above from processing zip filename %s", zf.Name)
+			log.Errorf("Error processing raw sensor event file id %d (%s) from package: %s", i, zf.Name,
+				err.Error())
+			if firstErr == nil {
+				firstErr = fmt.Errorf("file id %d (%s): %s", i, zf.Name, err)
+			}
 		}
-		msgs = append(msgs, newMsgs...)
 	}
-	return msgs, nil
+	return firstErr
+}
+
+// ProcessProtobufBundle returns all of the events in a bundle of length prefixed messages.
+func ProcessProtobufBundle(routingKey string, body []byte, headers amqp.Table) ([]*Event, error) {
+	events := make([]*Event, 0, 1)
+	err := ProcessProtobufBundleFunc(routingKey, body, headers, func(event *Event) {
+		events = append(events, event)
+	})
+	return events, err
+}
+
+// ProcessRawZipBundle returns all of the events in a zip archive of bundles.
+func ProcessRawZipBundle(routingKey string, body []byte, headers amqp.Table) ([]*Event, error) {
+	events := make([]*Event, 0, 1)
+	err := ProcessRawZipBundleFunc(routingKey, body, headers, func(event *Event) {
+		events = append(events, event)
+	})
+	return events, err
 }
 
 func parseIntFromHeader(src interface{}) (int64, error) {
@@ -147,7 +259,6 @@ func parseIntFromHeader(src interface{}) (int64, error) {
 	}
 }
 
-// TODO: This is currently called for *every* protobuf message in a bundle. This should be called only once *per bundle*.
 func createEnvMessage(headers amqp.Table) (*sensor_events.CbEnvironmentMsg, error) {
 	endpointMsg := &sensor_events.CbEndpointEnvironmentMsg{}
 	if hostId, ok := headers["hostId"]; ok {
@@ -192,7 +303,15 @@ func createEnvMessage(headers amqp.Table) (*sensor_events.CbEnvironmentMsg, erro
 	}, nil
 }
 
-func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table) (map[string]interface{}, error) {
+func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table) (*Event, error) {
+	return processProtobufMessage(routingKey, body, func() (*sensor_events.CbEnvironmentMsg, error) {
+		return createEnvMessage(headers)
+	})
+}
+
+// processProtobufMessage decodes a single message. Messages without an environment get the one returned by env.
+func processProtobufMessage(routingKey string, body []byte,
+	env func() (*sensor_events.CbEnvironmentMsg, error)) (*Event, error) {
 	cbMessage := new(sensor_events.CbEventMsg)
 	err := proto.Unmarshal(body, cbMessage)
 	if err != nil {
@@ -202,7 +321,7 @@ func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table)
 	if cbMessage.Env == nil {
 		// if the Env is nil, try to fill it in using the headers from the AMQP message
 		// (the raw sensor exchange does not fill in the SensorEnv or ServerEnv messages)
-		cbMessage.Env, err = createEnvMessage(headers)
+		cbMessage.Env, err = env()
 		if err != nil {
 			return nil, err
 		}
@@ -212,109 +331,169 @@ func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table)
 		OriginalMessage: cbMessage,
 	}
 
-	outmsg := make(map[string]interface{})
-	outmsg["timestamp"] = WindowsTimeToUnixTime(inmsg.OriginalMessage.Header.GetTimestamp())
-	outmsg["process_create_time"] = WindowsTimeToUnixTime(inmsg.OriginalMessage.Header.GetProcessCreateTime())
-	outmsg["type"] = routingKey
+	var header rawEvent
+	header.Timestamp = WindowsTimeToUnixTime(inmsg.OriginalMessage.Header.GetTimestamp())
+	header.ProcessCreateTime = WindowsTimeToUnixTime(inmsg.OriginalMessage.Header.GetProcessCreateTime())
+	header.Type = routingKey
 
-	outmsg["sensor_id"] = cbMessage.Env.Endpoint.GetSensorId()
-	outmsg["computer_name"] = cbMessage.Env.Endpoint.GetSensorHostName()
-	outmsg["ingest_ts"] = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	header.SensorID = cbMessage.Env.Endpoint.GetSensorId()
+	header.ComputerName = cbMessage.Env.Endpoint.GetSensorHostName()
+	header.IngestTS = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	header.mark(rawFieldTimestamp | rawFieldProcessCreateTime | rawFieldType | rawFieldSensorID |
+		rawFieldComputerName | rawFieldIngestTS)
+
+	// events of the typed families are written to their structs, and all others to a map
+	var event rawTypedEvent
+	var outmsg map[string]interface{}
 
 	// is the message from an endpoint event process?
 	eventMsg := true
 
+	eventMap := currentLiveConfiguration().EventMap
+
 	// select only one of network or networkv2
 	gotNetworkV2Message := false
 	gotNetblockV2Message := false
 
 	switch {
 	case cbMessage.Process != nil:
-		if _, ok := config.EventMap["ingress.event.process"]; ok {
-			WriteProcessMessage(inmsg, outmsg)
-		} else if _, ok := config.EventMap["ingress.event.procstart"]; ok {
-			WriteProcessMessage(inmsg, outmsg)
-		} else if _, ok := config.EventMap["ingress.event.procend"]; ok {
-			WriteProcessMessage(inmsg, outmsg)
+		_, process := eventMap["ingress.event.process"]
+		_, procstart := eventMap["ingress.event.procstart"]
+		_, procend := eventMap["ingress.event.procend"]
+		if process || procstart || procend {
+			e := &ProcessEvent{rawEvent: header}
+			WriteProcessMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Modload != nil:
-		if _, ok := config.EventMap["ingress.event.moduleload"]; ok {
-			WriteModloadMessage(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.moduleload"]; ok {
+			e := &ModloadEvent{rawEvent: header}
+			WriteModloadMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Filemod != nil:
-		if _, ok := config.EventMap["ingress.event.filemod"]; ok {
-			WriteFilemodMessage(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.filemod"]; ok {
+			e := &FilemodEvent{rawEvent: header}
+			WriteFilemodMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 
 	case cbMessage.Networkv2 != nil:
 		gotNetworkV2Message = true
-		if _, ok := config.EventMap["ingress.event.netconn"]; ok {
-			WriteNetconn2Message(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.netconn"]; ok {
+			e := &NetconnEvent{rawEvent: header}
+			WriteNetconn2Message(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Network != nil && !gotNetworkV2Message:
-		if _, ok := config.EventMap["ingress.event.netconn"]; ok {
-			WriteNetconnMessage(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.netconn"]; ok {
+			e := &NetconnEvent{rawEvent: header}
+			WriteNetconnMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Regmod != nil:
-		if _, ok := config.EventMap["ingress.event.regmod"]; ok {
-			WriteRegmodMessage(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.regmod"]; ok {
+			e := &RegmodEvent{rawEvent: header}
+			WriteRegmodMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Childproc != nil:
-		if _, ok := config.EventMap["ingress.event.childproc"]; ok {
-			WriteChildprocMessage(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.childproc"]; ok {
+			e := &ChildprocEvent{rawEvent: header}
+			WriteChildprocMessage(inmsg, e)
+			event = e
+		} else {
+			return nil, nil
+		}
+	case cbMessage.Crossproc != nil && cbMessage.Crossproc.Open != nil:
+		if _, ok := eventMap["ingress.event.crossprocopen"]; ok {
+			e := &CrossprocEvent{rawEvent: header}
+			WriteCrossProcMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Crossproc != nil:
-		if _, ok := config.EventMap["ingress.event.crossprocopen"]; ok {
-			WriteCrossProcMessage(inmsg, outmsg)
+		if _, ok := eventMap["ingress.event.remotethread"]; ok {
+			e := &CrossprocEvent{rawEvent: header}
+			WriteCrossProcMessage(inmsg, e)
+			event = e
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Emet != nil:
-		if _, ok := config.EventMap["ingress.event.emetmitigation"]; ok {
+		if _, ok := eventMap["ingress.event.emetmitigation"]; ok {
+			outmsg = header.message()
 			WriteEmetEvent(inmsg, outmsg)
 		} else {
 			return nil, nil
 		}
 	case cbMessage.NetconnBlockedv2 != nil:
 		gotNetblockV2Message = true
+		outmsg = header.message()
 		WriteNetconn2BlockMessage(inmsg, outmsg)
 	case cbMessage.NetconnBlocked != nil && !gotNetblockV2Message:
+		outmsg = header.message()
 		WriteNetconnBlockedMessage(inmsg, outmsg)
 	case cbMessage.TamperAlert != nil:
-		if _, ok := config.EventMap["ingress.event.tamper"]; ok {
+		if _, ok := eventMap["ingress.event.tamper"]; ok {
 			eventMsg = false
+			outmsg = header.message()
 			WriteTamperAlertMsg(inmsg, outmsg)
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Blocked != nil:
-		if _, ok := config.EventMap["ingress.event.processblock"]; ok {
+		if _, ok := eventMap["ingress.event.processblock"]; ok {
 			eventMsg = false
+			outmsg = header.message()
 			WriteProcessBlockedMsg(inmsg, outmsg)
 		} else {
 			return nil, nil
 		}
 	case cbMessage.Module != nil:
-		if _, ok := config.EventMap["ingress.event.module"]; ok {
+		if _, ok := eventMap["ingress.event.module"]; ok {
 			eventMsg = false
+			outmsg = header.message()
 			WriteModinfoMessage(inmsg, outmsg)
 		} else {
 			return nil, nil
 		}
+	case cbMessage.ProcessMeta != nil:
+		if _, ok := eventMap["ingress.event.processmeta"]; ok {
+			eventMsg = false
+			outmsg = header.message()
+			WriteProcessMetadataMessage(inmsg, outmsg)
+		} else {
+			return nil, nil
+		}
+	case cbMessage.Stats != nil:
+		if _, ok := eventMap["ingress.event.stats"]; ok {
+			eventMsg = false
+			outmsg = header.message()
+			WriteStatisticsMessage(inmsg, outmsg)
+		} else {
+			return nil, nil
+		}
+	case cbMessage.Vtwrite != nil:
+		if _, ok := eventMap["ingress.event.vtwrite"]; ok {
+			outmsg = header.message()
+			WriteVtwriteMessage(inmsg, outmsg)
+		} else {
+			return nil, nil
+		}
 	default:
 		if len(routingKey) > 0 {
 			return nil, errors.New(fmt.Sprintf("Unknown event type encountered, routing key was: %s", routingKey))
@@ -324,111 +503,160 @@ func ProcessProtobufMessage(routingKey string, body []byte, headers amqp.Table)
 	}
 
 	// write metadata about the process in case this message is generated by a process on an endpoint
+	result := &Event{msg: outmsg}
+	if event != nil {
+		result = &Event{typed: event}
+	}
+
 	if eventMsg {
+		// the process fields are written to the typed event, or to the map through a rawEvent of their own
+		process := new(rawEvent)
+		if event != nil {
+			process = event.header()
+		}
+
 		processGuid := GetProcessGUID(cbMessage)
-		outmsg["process_guid"] = processGuid
-		outmsg["pid"] = inmsg.OriginalMessage.Header.GetProcessPid()
+		process.ProcessGUID = processGuid
+		process.PID = inmsg.OriginalMessage.Header.GetProcessPid()
+		process.mark(rawFieldProcessGUID | rawFieldPID)
 
 		if inmsg.OriginalMessage.Header.GetForkPid() != 0 {
-			outmsg["fork_pid"] = inmsg.OriginalMessage.Header.GetForkPid()
+			process.ForkPID = inmsg.OriginalMessage.Header.GetForkPid()
+			process.mark(rawFieldForkPID)
 		}
 		/*
 		 * Sometimes Process path is empty
 		 */
 		if inmsg.OriginalMessage.Header.GetProcessPath() != "" {
-			outmsg["process_path"] = inmsg.OriginalMessage.Header.GetProcessPath()
+			process.ProcessPath = inmsg.OriginalMessage.Header.GetProcessPath()
+			process.mark(rawFieldProcessPath)
 		}
-		if _, ok := outmsg["md5"]; !ok {
-			outmsg["md5"] = GetMd5Hexdigest(inmsg.OriginalMessage.Header.GetProcessMd5())
+		if _, ok := result.Get("md5"); !ok {
+			process.MD5 = GetMd5Hexdigest(inmsg.OriginalMessage.Header.GetProcessMd5())
+			process.mark(rawFieldMD5)
 		}
-		if _, ok := outmsg["sha256"]; !ok {
-			outmsg["sha256"] = GetSha256Hexdigest(inmsg.OriginalMessage.Header.GetProcessSha256())
+		if _, ok := result.Get("sha256"); !ok {
+			process.SHA256 = GetSha256Hexdigest(inmsg.OriginalMessage.Header.GetProcessSha256())
+			process.mark(rawFieldSHA256)
 		}
 
 		// add link to process in the Cb UI if the Cb hostname is set
 		// TODO: not happy about reaching in to the "config" object for this
 		if config.CbServerURL != "" {
 
-			outmsg["link_process"] = FastStringConcat(
+			process.LinkProcess = FastStringConcat(
 				config.CbServerURL, "#analyze/", processGuid, "/1")
 
-			outmsg["link_sensor"] = FastStringConcat(
+			process.LinkSensor = FastStringConcat(
 				config.CbServerURL, "#/host/", strconv.Itoa(int(cbMessage.Env.Endpoint.GetSensorId())))
+			process.mark(rawFieldLinkProcess | rawFieldLinkSensor)
+		}
+
+		if event == nil {
+			process.fields(outmsg)
+		}
+
+		if processTable != nil {
+			processTable.Update(result)
 		}
 	}
 
-	return outmsg, nil
+	return result, nil
 }
 
-func WriteProcessMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "proc"
+// rawTypedEvent is a typed event decoded from a raw sensor message.
+type rawTypedEvent interface {
+	typedEvent
+	header() *rawEvent
+}
+
+// message returns the fields for a message that is not of one of the typed families, as a map.
+func (e *rawEvent) message() map[string]interface{} {
+	msg := make(map[string]interface{})
+	e.fields(msg)
+	return msg
+}
+
+func WriteProcessMessage(message *ConvertedCbMessage, e *ProcessEvent) {
+	e.EventType = "proc"
 
 	file_path, _ := message.getStringByGuid(message.OriginalMessage.Header.GetFilepathStringGuid())
-	kv["path"] = file_path
+	e.Path = file_path
+	e.mark(rawFieldEventType | procFieldPath)
 
 	// hack to rewrite the "type" since the Cb server may make incoming process events "ingress.event.process" or
 	// "ingress.event.procstart"
 
 	if message.OriginalMessage.Process.GetCreated() {
-		kv["type"] = "ingress.event.procstart"
+		e.Type = "ingress.event.procstart"
 		if message.OriginalMessage.Process.Md5Hash != nil {
-			kv["md5"] = GetMd5Hexdigest(message.OriginalMessage.Process.GetMd5Hash())
+			e.MD5 = GetMd5Hexdigest(message.OriginalMessage.Process.GetMd5Hash())
+			e.mark(rawFieldMD5)
 		}
 		if message.OriginalMessage.Process.Sha256Hash != nil {
-			kv["sha256"] = GetSha256Hexdigest(message.OriginalMessage.Process.GetSha256Hash())
+			e.SHA256 = GetSha256Hexdigest(message.OriginalMessage.Process.GetSha256Hash())
+			e.mark(rawFieldSHA256)
 		}
 	} else {
-		kv["type"] = "ingress.event.procend"
+		e.Type = "ingress.event.procend"
 	}
 
-	kv["command_line"] = GetUnicodeFromUTF8(message.OriginalMessage.Process.GetCommandline())
+	e.CommandLine = GetUnicodeFromUTF8(message.OriginalMessage.Process.GetCommandline())
 
 	om := message.OriginalMessage
 
-	kv["parent_path"] = om.Process.GetParentPath()
-	kv["parent_create_time"] = WindowsTimeToUnixTime(om.Process.GetParentCreateTime())
+	e.ParentPath = om.Process.GetParentPath()
+	e.ParentCreateTime = WindowsTimeToUnixTime(om.Process.GetParentCreateTime())
+	e.mark(procFieldCommandLine | procFieldParentPath | procFieldParentCreateTime)
 
 	if message.OriginalMessage.Process.ParentMd5 != nil {
-		kv["parent_md5"] = GetMd5Hexdigest(om.Process.GetParentMd5())
+		e.ParentMD5 = GetMd5Hexdigest(om.Process.GetParentMd5())
+		e.mark(procFieldParentMD5)
 	}
 
 	if message.OriginalMessage.Process.ParentSha256 != nil {
-		kv["parent_sha256"] = GetSha256Hexdigest(om.Process.GetSha256Hash())
+		e.ParentSHA256 = GetSha256Hexdigest(om.Process.GetSha256Hash())
+		e.mark(procFieldParentSHA256)
 	}
 
-	kv["expect_followon_w_md5"] = om.Process.GetExpectFollowonWMd5()
+	e.ExpectFollowonWithMD5 = om.Process.GetExpectFollowonWMd5()
 
 	if om.Env != nil && om.Env.Endpoint != nil && om.Env.Endpoint.SensorId != nil && om.Process.ParentPid != nil &&
 		om.Process.ParentCreateTime != nil {
-		kv["parent_process_guid"] = MakeGUID(om.Env.Endpoint.GetSensorId(), om.Process.GetParentPid(),
+		e.ParentProcessGUID = MakeGUID(om.Env.Endpoint.GetSensorId(), om.Process.GetParentPid(),
 			om.Process.GetParentCreateTime())
 	} else {
-		kv["parent_process_guid"] = fmt.Sprintf("%d", om.Process.GetParentGuid())
+		e.ParentProcessGUID = fmt.Sprintf("%d", om.Process.GetParentGuid())
 	}
+	e.mark(procFieldExpectFollowonWithMD5 | procFieldParentProcessGUID)
 
 	// add link to process in the Cb UI if the Cb hostname is set
 	if config.CbServerURL != "" {
-		kv["link_parent"] = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, kv["parent_process_guid"])
+		e.LinkParent = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, e.ParentProcessGUID)
+		e.mark(procFieldLinkParent)
 	}
 
 	if message.OriginalMessage.Process.Username != nil {
-		kv["username"] = message.OriginalMessage.Process.GetUsername()
+		e.Username = message.OriginalMessage.Process.GetUsername()
+		e.mark(procFieldUsername)
 	}
 
 	if message.OriginalMessage.Process.Uid != nil {
-		kv["uid"] = message.OriginalMessage.Process.GetUid()
+		e.UID = message.OriginalMessage.Process.GetUid()
+		e.mark(procFieldUID)
 	}
 
 }
 
-func WriteModloadMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "modload"
-	kv["type"] = "ingress.event.moduleload"
+func WriteModloadMessage(message *ConvertedCbMessage, e *ModloadEvent) {
+	e.EventType = "modload"
+	e.Type = "ingress.event.moduleload"
 
 	file_path, _ := message.getStringByGuid(message.OriginalMessage.Header.GetFilepathStringGuid())
-	kv["path"] = file_path
-	kv["md5"] = GetMd5Hexdigest(message.OriginalMessage.Modload.GetMd5Hash())
-	kv["sha256"] = GetSha256Hexdigest(message.OriginalMessage.Modload.GetSha256Hash())
+	e.Path = file_path
+	e.MD5 = GetMd5Hexdigest(message.OriginalMessage.Modload.GetMd5Hash())
+	e.SHA256 = GetSha256Hexdigest(message.OriginalMessage.Modload.GetSha256Hash())
+	e.mark(rawFieldEventType | modloadFieldPath | rawFieldMD5 | rawFieldSHA256)
 
 }
 
@@ -446,37 +674,43 @@ func filemodAction(a sensor_events.CbFileModMsg_CbFileModAction) string {
 	return fmt.Sprintf("unknown (%d)", int32(a))
 }
 
-func WriteFilemodMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "filemod"
-	kv["type"] = "ingress.event.filemod"
+func WriteFilemodMessage(message *ConvertedCbMessage, e *FilemodEvent) {
+	e.EventType = "filemod"
+	e.Type = "ingress.event.filemod"
 
 	file_path, _ := message.getStringByGuid(message.OriginalMessage.Header.GetFilepathStringGuid())
-	kv["path"] = file_path
+	e.Path = file_path
 
 	action := message.OriginalMessage.Filemod.GetAction()
-	kv["action"] = filemodAction(action)
-	kv["actiontype"] = int32(action)
+	e.Action = filemodAction(action)
+	e.ActionType = int32(action)
 
 	fileType := message.OriginalMessage.Filemod.GetType()
-	kv["filetype"] = int32(fileType)
-	kv["filetype_name"] = strings.TrimPrefix(sensor_events.CbFileModMsg_CbFileType_name[int32(fileType)], "filetype")
+	e.FileType = int32(fileType)
+	e.FileTypeName = strings.TrimPrefix(sensor_events.CbFileModMsg_CbFileType_name[int32(fileType)], "filetype")
+	e.mark(rawFieldEventType | filemodFieldPath | filemodFieldAction | filemodFieldActionType | filemodFieldFileType |
+		filemodFieldFileTypeName)
 
 	if message.OriginalMessage.Filemod.Md5Hash != nil {
-		kv["file_md5"] = GetMd5Hexdigest(message.OriginalMessage.Filemod.GetMd5Hash())
+		e.FileMD5 = GetMd5Hexdigest(message.OriginalMessage.Filemod.GetMd5Hash())
+		e.mark(filemodFieldFileMD5)
 	}
 	if message.OriginalMessage.Filemod.Sha256Hash != nil {
-		kv["file_sha256"] = GetSha256Hexdigest(message.OriginalMessage.Filemod.GetSha256Hash())
+		e.FileSHA256 = GetSha256Hexdigest(message.OriginalMessage.Filemod.GetSha256Hash())
+		e.mark(filemodFieldFileSHA256)
 	}
 }
 
-func WriteChildprocMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "childproc"
-	kv["type"] = "ingress.event.childproc"
-	kv["child_proc_type"] = message.OriginalMessage.Childproc.GetChildProcType()
-	kv["child_create_time"] = WindowsTimeToUnixTime(message.OriginalMessage.Childproc.GetCreateTime())
+func WriteChildprocMessage(message *ConvertedCbMessage, e *ChildprocEvent) {
+	e.EventType = "childproc"
+	e.Type = "ingress.event.childproc"
+	e.ChildProcType = message.OriginalMessage.Childproc.GetChildProcType()
+	e.ChildCreateTime = WindowsTimeToUnixTime(message.OriginalMessage.Childproc.GetCreateTime())
 
-	kv["created"] = message.OriginalMessage.Childproc.GetCreated()
+	e.Created = message.OriginalMessage.Childproc.GetCreated()
+	e.mark(rawFieldEventType | childprocFieldChildProcType | childprocFieldChildCreateTime | childprocFieldCreated)
 
+	var childProcessGUID interface{}
 	om := message.OriginalMessage
 	if om.Childproc.Pid != nil && om.Childproc.CreateTime != nil && om.Env != nil &&
 		om.Env.Endpoint != nil && om.Env.Endpoint.SensorId != nil {
@@ -488,20 +722,26 @@ func WriteChildprocMessage(message *ConvertedCbMessage, kv map[string]interface{
 		// convert the pid to int32
 		pid32 := int32(pid & 0xffffffff)
 
-		kv["child_process_guid"] = MakeGUID(sensor_id, pid32, create_time)
+		e.ChildProcessGUID = MakeGUID(sensor_id, pid32, create_time)
+		e.mark(childprocFieldChildProcessGUID)
+		childProcessGUID = e.ChildProcessGUID
 	} else {
-		kv["child_process_guid"] = om.Childproc.GetChildGuid()
+		// the numeric GUID is not a string, so it is kept as an extra field
+		childProcessGUID = om.Childproc.GetChildGuid()
+		e.addExtra("child_process_guid", childProcessGUID)
 	}
 
 	// add link to process in the Cb UI if the Cb hostname is set
 	if config.CbServerURL != "" {
-		kv["link_child"] = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, kv["child_process_guid"])
+		e.LinkChild = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, childProcessGUID)
+		e.mark(childprocFieldLinkChild)
 	}
 
-	kv["path"] = om.Childproc.GetPath()
+	e.Path = om.Childproc.GetPath()
 
-	kv["md5"] = GetMd5Hexdigest(message.OriginalMessage.Childproc.GetMd5Hash())
-	kv["sha256"] = GetSha256Hexdigest(message.OriginalMessage.Childproc.GetSha256Hash())
+	e.MD5 = GetMd5Hexdigest(message.OriginalMessage.Childproc.GetMd5Hash())
+	e.SHA256 = GetSha256Hexdigest(message.OriginalMessage.Childproc.GetSha256Hash())
+	e.mark(childprocFieldPath | rawFieldMD5 | rawFieldSHA256)
 }
 
 func regmodAction(a sensor_events.CbRegModMsg_CbRegModAction) string {
@@ -518,31 +758,34 @@ func regmodAction(a sensor_events.CbRegModMsg_CbRegModAction) string {
 	return fmt.Sprintf("unknown (%d)", int32(a))
 }
 
-func WriteRegmodMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "regmod"
-	kv["type"] = "ingress.event.regmod"
+func WriteRegmodMessage(message *ConvertedCbMessage, e *RegmodEvent) {
+	e.EventType = "regmod"
+	e.Type = "ingress.event.regmod"
 
-	kv["path"] = GetUnicodeFromUTF8(message.OriginalMessage.Regmod.GetUtf8Regpath())
+	e.Path = GetUnicodeFromUTF8(message.OriginalMessage.Regmod.GetUtf8Regpath())
 
 	action := message.OriginalMessage.Regmod.GetAction()
-	kv["action"] = regmodAction(action)
-	kv["actiontype"] = int32(action)
+	e.Action = regmodAction(action)
+	e.ActionType = int32(action)
+	e.mark(rawFieldEventType | regmodFieldPath | regmodFieldAction | regmodFieldActionType)
 }
 
-func WriteNetconnMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "netconn"
-	kv["type"] = "ingress.event.netconn"
+func WriteNetconnMessage(message *ConvertedCbMessage, e *NetconnEvent) {
+	e.EventType = "netconn"
+	e.Type = "ingress.event.netconn"
 
-	kv["domain"] = GetUnicodeFromUTF8(message.OriginalMessage.Network.GetUtf8Netpath())
-	kv["ipv4"] = GetIPv4Address(message.OriginalMessage.Network.GetIpv4Address())
-	kv["port"] = ntohs(uint16(message.OriginalMessage.Network.GetPort()))
-	kv["protocol"] = int32(message.OriginalMessage.Network.GetProtocol())
+	e.Domain = GetUnicodeFromUTF8(message.OriginalMessage.Network.GetUtf8Netpath())
+	e.IPv4 = GetIPv4Address(message.OriginalMessage.Network.GetIpv4Address())
+	e.Port = ntohs(uint16(message.OriginalMessage.Network.GetPort()))
+	e.Protocol = int32(message.OriginalMessage.Network.GetProtocol())
 
 	if message.OriginalMessage.Network.GetOutbound() {
-		kv["direction"] = "outbound"
+		e.Direction = "outbound"
 	} else {
-		kv["direction"] = "inbound"
+		e.Direction = "inbound"
 	}
+	e.mark(rawFieldEventType | netconnFieldDomain | netconnFieldIPv4 | netconnFieldPort | netconnFieldProtocol |
+		netconnFieldDirection)
 
 	//
 	// In CB 5.1 local and remote ip/port were added.  They aren't guaranteed
@@ -550,13 +793,15 @@ func WriteNetconnMessage(message *ConvertedCbMessage, kv map[string]interface{})
 	// determine them
 
 	if message.OriginalMessage.Network.RemoteIpAddress != nil {
-		kv["remote_ip"] = GetIPv4Address(message.OriginalMessage.Network.GetRemoteIpAddress())
-		kv["remote_port"] = ntohs(uint16(message.OriginalMessage.Network.GetRemotePort()))
+		e.RemoteIP = GetIPv4Address(message.OriginalMessage.Network.GetRemoteIpAddress())
+		e.RemotePort = ntohs(uint16(message.OriginalMessage.Network.GetRemotePort()))
+		e.mark(netconnFieldRemoteIP | netconnFieldRemotePort)
 	}
 
 	if message.OriginalMessage.Network.LocalIpAddress != nil {
-		kv["local_ip"] = GetIPv4Address(message.OriginalMessage.Network.GetLocalIpAddress())
-		kv["local_port"] = ntohs(uint16(message.OriginalMessage.Network.GetLocalPort()))
+		e.LocalIP = GetIPv4Address(message.OriginalMessage.Network.GetLocalIpAddress())
+		e.LocalPort = ntohs(uint16(message.OriginalMessage.Network.GetLocalPort()))
+		e.mark(netconnFieldLocalIP | netconnFieldLocalPort)
 	}
 }
 
@@ -577,36 +822,39 @@ func GetIPAddress(ipAddress *sensor_events.CbIpAddr) string {
 	}
 }
 
-func WriteNetconn2Message(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "netconn"
-	kv["type"] = "ingress.event.netconn"
+func WriteNetconn2Message(message *ConvertedCbMessage, e *NetconnEvent) {
+	e.EventType = "netconn"
+	e.Type = "ingress.event.netconn"
 
-	kv["domain"] = GetUnicodeFromUTF8(message.OriginalMessage.Networkv2.GetUtf8Netpath())
-	kv["protocol"] = int32(message.OriginalMessage.Networkv2.GetProtocol())
+	e.Domain = GetUnicodeFromUTF8(message.OriginalMessage.Networkv2.GetUtf8Netpath())
+	e.Protocol = int32(message.OriginalMessage.Networkv2.GetProtocol())
 
 	if message.OriginalMessage.Networkv2.GetOutbound() {
-		kv["direction"] = "outbound"
+		e.Direction = "outbound"
 	} else {
-		kv["direction"] = "inbound"
+		e.Direction = "inbound"
 	}
 
 	// we are deprecating the "ipv4" and "port" keys here, since this message is guaranteed to have remote &
 	// local ip and port numbers.
 
 	if message.OriginalMessage.Networkv2.GetProxyConnection() {
-		kv["proxy"] = true
-		kv["proxy_ip"] = GetIPAddress(message.OriginalMessage.Networkv2.GetProxyIpAddress())
-		kv["proxy_port"] = ntohs(uint16(message.OriginalMessage.Networkv2.GetProxyPort()))
-		kv["proxy_domain"] = message.OriginalMessage.Networkv2.GetProxyNetPath()
+		e.Proxy = true
+		e.ProxyIP = GetIPAddress(message.OriginalMessage.Networkv2.GetProxyIpAddress())
+		e.ProxyPort = ntohs(uint16(message.OriginalMessage.Networkv2.GetProxyPort()))
+		e.ProxyDomain = message.OriginalMessage.Networkv2.GetProxyNetPath()
+		e.mark(netconnFieldProxyIP | netconnFieldProxyPort | netconnFieldProxyDomain)
 	} else {
-		kv["proxy"] = false
+		e.Proxy = false
 	}
 
-	kv["remote_ip"] = GetIPAddress(message.OriginalMessage.Networkv2.GetRemoteIpAddress())
-	kv["remote_port"] = ntohs(uint16(message.OriginalMessage.Networkv2.GetRemotePort()))
+	e.RemoteIP = GetIPAddress(message.OriginalMessage.Networkv2.GetRemoteIpAddress())
+	e.RemotePort = ntohs(uint16(message.OriginalMessage.Networkv2.GetRemotePort()))
 
-	kv["local_ip"] = GetIPAddress(message.OriginalMessage.Networkv2.GetLocalIpAddress())
-	kv["local_port"] = ntohs(uint16(message.OriginalMessage.Networkv2.GetLocalPort()))
+	e.LocalIP = GetIPAddress(message.OriginalMessage.Networkv2.GetLocalIpAddress())
+	e.LocalPort = ntohs(uint16(message.OriginalMessage.Networkv2.GetLocalPort()))
+	e.mark(rawFieldEventType | netconnFieldDomain | netconnFieldProtocol | netconnFieldDirection | netconnFieldProxy |
+		netconnFieldRemoteIP | netconnFieldRemotePort | netconnFieldLocalIP | netconnFieldLocalPort)
 }
 
 func WriteModinfoMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
@@ -689,48 +937,169 @@ func crossprocOpenType(a sensor_events.CbCrossProcessOpenMsg_OpenType) string {
 	return fmt.Sprintf("unknown (%d)", int32(a))
 }
 
-func WriteCrossProcMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
-	kv["event_type"] = "cross_process"
+func WriteCrossProcMessage(message *ConvertedCbMessage, e *CrossprocEvent) {
+	e.EventType = "cross_process"
 
 	om := message.OriginalMessage
 
-	kv["is_target"] = om.Crossproc.GetIsTarget()
+	e.IsTarget = om.Crossproc.GetIsTarget()
 
 	if message.OriginalMessage.Crossproc.Open != nil {
 		open := message.OriginalMessage.Crossproc.Open
-		kv["type"] = "ingress.event.crossprocopen"
+		e.Type = "ingress.event.crossprocopen"
 
-		kv["cross_process_type"] = crossprocOpenType(open.GetType())
+		e.CrossProcessType = crossprocOpenType(open.GetType())
 
-		kv["requested_access"] = open.GetRequestedAccess()
-		kv["target_pid"] = open.GetTargetPid()
-		kv["target_create_time"] = open.GetTargetProcCreateTime()
-		kv["target_md5"] = GetMd5Hexdigest(open.GetTargetProcMd5())
-		kv["target_sha256"] = GetSha256Hexdigest(open.GetTargetProcSha256())
-		kv["target_path"] = open.GetTargetProcPath()
+		e.RequestedAccess = open.GetRequestedAccess()
+		e.TargetPID = open.GetTargetPid()
+		e.TargetCreateTime = open.GetTargetProcCreateTime()
+		e.TargetMD5 = GetMd5Hexdigest(open.GetTargetProcMd5())
+		e.TargetSHA256 = GetSha256Hexdigest(open.GetTargetProcSha256())
+		e.TargetPath = open.GetTargetProcPath()
+		e.mark(crossprocFieldRequestedAccess)
 
 		pid32 := int32(open.GetTargetPid() & 0xffffffff)
-		kv["target_process_guid"] = MakeGUID(om.Env.Endpoint.GetSensorId(), pid32, int64(open.GetTargetProcCreateTime()))
+		e.TargetProcessGUID = MakeGUID(om.Env.Endpoint.GetSensorId(), pid32, int64(open.GetTargetProcCreateTime()))
 	} else {
 		rt := message.OriginalMessage.Crossproc.Remotethread
-		kv["type"] = "ingress.event.remotethread"
+		e.Type = "ingress.event.remotethread"
+
+		e.CrossProcessType = "remote_thread"
+		e.TargetPID = rt.GetRemoteProcPid()
+		e.TargetCreateTime = rt.GetRemoteProcCreateTime()
+		e.TargetMD5 = GetMd5Hexdigest(rt.GetRemoteProcMd5())
+		e.TargetSHA256 = GetSha256Hexdigest(rt.GetRemoteProcSha256())
+		e.TargetPath = rt.GetRemoteProcPath()
+
+		e.TargetProcessGUID = MakeGUID(om.Env.Endpoint.GetSensorId(), int32(rt.GetRemoteProcPid()), int64(rt.GetRemoteProcCreateTime()))
+	}
+	e.mark(rawFieldEventType | crossprocFieldIsTarget | crossprocFieldCrossProcessType | crossprocFieldTargetPID |
+		crossprocFieldTargetCreateTime | crossprocFieldTargetMD5 | crossprocFieldTargetSHA256 | crossprocFieldTargetPath |
+		crossprocFieldTargetProcessGUID)
+
+	// add link to process in the Cb UI if the Cb hostname is set
+	if config.CbServerURL != "" {
+		e.LinkTarget = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, e.TargetProcessGUID)
+		e.mark(crossprocFieldLinkTarget)
+	}
+}
+
+// WriteProcessMetadataMessage writes the summary a sensor sends for a process: its identity (process_guid, pid,
+// process_path, md5, sha256, uid, username, command_line), its parent (parent_pid, parent_create_time,
+// parent_md5, parent_sha256, parent_path, parent_process_guid), the number of events of each kind recorded for it
+// (modload_count, filemod_count, netconn_count, regmod_count, childproc_count, crossproc_count, emet_count,
+// processblock_count), the sensor segment it was recorded in (sensor_start_time, sensor_segment), whether its
+// creation was observed (creation_observed), and the EMET mitigations applied to it (mitigations).
+func WriteProcessMetadataMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
+	kv["event_type"] = "process_meta"
+	kv["type"] = "ingress.event.processmeta"
+
+	om := message.OriginalMessage
+	meta := om.ProcessMeta
+
+	kv["pid"] = meta.GetProcessPid()
+	kv["process_create_time"] = WindowsTimeToUnixTime(meta.GetProcessCreateTime())
+	kv["process_guid"] = MakeGUID(om.Env.Endpoint.GetSensorId(), meta.GetProcessPid(), meta.GetProcessCreateTime())
+	if meta.GetProcessPath() != "" {
+		kv["process_path"] = meta.GetProcessPath()
+	}
+	kv["md5"] = GetMd5Hexdigest(meta.GetProcessMd5())
+	if meta.ProcessSha256 != nil {
+		kv["sha256"] = GetSha256Hexdigest(meta.GetProcessSha256())
+	}
 
-		kv["cross_process_type"] = "remote_thread"
-		kv["target_pid"] = rt.GetRemoteProcPid()
-		kv["target_create_time"] = rt.GetRemoteProcCreateTime()
-		kv["target_md5"] = GetMd5Hexdigest(rt.GetRemoteProcMd5())
-		kv["target_sha256"] = GetSha256Hexdigest(rt.GetRemoteProcSha256())
-		kv["target_path"] = rt.GetRemoteProcPath()
+	if meta.Uid != nil {
+		kv["uid"] = meta.GetUid()
+	}
+	if meta.Username != nil {
+		kv["username"] = meta.GetUsername()
+	}
+	kv["command_line"] = GetUnicodeFromUTF8(meta.GetCommandline())
 
-		kv["target_process_guid"] = MakeGUID(om.Env.Endpoint.GetSensorId(), int32(rt.GetRemoteProcPid()), int64(rt.GetRemoteProcCreateTime()))
+	kv["parent_pid"] = meta.GetParentPid()
+	kv["parent_create_time"] = WindowsTimeToUnixTime(meta.GetParentCreateTime())
+	kv["parent_path"] = meta.GetParentPath()
+	if meta.ParentMd5 != nil {
+		kv["parent_md5"] = GetMd5Hexdigest(meta.GetParentMd5())
+	}
+	if meta.ParentSha256 != nil {
+		kv["parent_sha256"] = GetSha256Hexdigest(meta.GetParentSha256())
+	}
+	if meta.ParentPid != nil && meta.ParentCreateTime != nil {
+		kv["parent_process_guid"] = MakeGUID(om.Env.Endpoint.GetSensorId(), meta.GetParentPid(),
+			meta.GetParentCreateTime())
+
+		// add link to process in the Cb UI if the Cb hostname is set
+		if config.CbServerURL != "" {
+			kv["link_parent"] = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, kv["parent_process_guid"])
+		}
+	}
+
+	kv["modload_count"] = meta.GetModloadCount()
+	kv["filemod_count"] = meta.GetFilemodCount()
+	kv["netconn_count"] = meta.GetNetconnCount()
+	kv["regmod_count"] = meta.GetRegmodCount()
+	kv["childproc_count"] = meta.GetChildprocCount()
+	kv["crossproc_count"] = meta.GetCrossprocCount()
+	kv["emet_count"] = meta.GetEmetCount()
+	kv["processblock_count"] = meta.GetProcessblockCount()
+
+	kv["sensor_start_time"] = WindowsTimeToUnixTime(meta.GetSensorStartTime())
+	kv["sensor_segment"] = meta.GetSensorSegment()
+	kv["creation_observed"] = meta.GetCreationobserved()
+
+	if len(meta.GetActions()) > 0 {
+		mitigations := make([]string, 0, len(meta.GetActions()))
+		for _, action := range meta.GetActions() {
+			mitigations = append(mitigations, emetMitigationType(action))
+		}
+		kv["mitigations"] = mitigations
 	}
 
 	// add link to process in the Cb UI if the Cb hostname is set
 	if config.CbServerURL != "" {
-		kv["link_target"] = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, kv["target_process_guid"])
+		kv["link_process"] = fmt.Sprintf("%s#analyze/%s/1", config.CbServerURL, kv["process_guid"])
 	}
 }
 
+// WriteStatisticsMessage writes the sensor's own statistics. Only Linux sensors send any today: the number of
+// file scans requested (lin_total), completed (lin_successful), without a scan id (lin_no_scanidi) and pended
+// (lin_total_pended), and the current sizes of the pended queues (lin_current_scanid_pended_size,
+// lin_current_handlepath_pended_size, lin_current_filepath_pended_size).
+func WriteStatisticsMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
+	kv["event_type"] = "stats"
+	kv["type"] = "ingress.event.stats"
+
+	lin := message.OriginalMessage.Stats.LinStats
+	if lin == nil {
+		return
+	}
+
+	kv["lin_total"] = lin.GetLinTotal()
+	kv["lin_successful"] = lin.GetLinSuccessful()
+	kv["lin_no_scanidi"] = lin.GetLinNoScanidi()
+	kv["lin_total_pended"] = lin.GetLinTotalPended()
+	kv["lin_current_scanid_pended_size"] = lin.GetLinCurrentScanidPendedSize()
+	kv["lin_current_handlepath_pended_size"] = lin.GetLinCurrentHandlepathPendedSize()
+	kv["lin_current_filepath_pended_size"] = lin.GetLinCurrentFilepathPendedSize()
+}
+
+// WriteVtwriteMessage writes a file written by a process: the writing process (writing_process_md5,
+// writing_process_filename) and the file it wrote (file_written_md5, file_written_filename, and
+// file_written_is_pe_module_hint, which is true if the file looks like an executable module).
+func WriteVtwriteMessage(message *ConvertedCbMessage, kv map[string]interface{}) {
+	kv["event_type"] = "vtwrite"
+	kv["type"] = "ingress.event.vtwrite"
+
+	vtwrite := message.OriginalMessage.Vtwrite
+
+	kv["writing_process_md5"] = GetMd5Hexdigest(vtwrite.GetWritingProcessExeMd5())
+	kv["writing_process_filename"] = vtwrite.GetWritingProcessFilename()
+	kv["file_written_md5"] = GetMd5Hexdigest(vtwrite.GetFileWrittenMd5())
+	kv["file_written_filename"] = vtwrite.GetFileWrittenFilename()
+	kv["file_written_is_pe_module_hint"] = vtwrite.GetFileWrittenIsPeModuleHint()
+}
+
 func tamperAlertType(a sensor_events.CbTamperAlertMsg_CbTamperAlertType) string {
 	switch a {
 	case sensor_events.CbTamperAlertMsg_AlertCoreDriverUnloaded:
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * Post processing runs on a fixed pool of workers fed by a bounded queue, so that a storm of feed hits slows
+ * down consumption from the bus rather than starting a goroutine and an API connection per event.
+ */
+
+// eventPostprocessor runs post processing, or is nil if post processing is disabled.
+var eventPostprocessor *Postprocessor
+
+var postprocessedEventCount = expvar.NewInt("postprocessed_event_count")
+
+type Postprocessor struct {
+	// a single queue shared by all of the workers, or one queue per worker if events are sharded by sensor
+	queues []chan postprocessJob
+
+	// the next queue for events without a sensor when they are sharded
+	next uint32
+
+	// events queued or being post processed
+	pending sync.WaitGroup
+}
+
+type postprocessJob struct {
+	event    *Event
+	delivery *pendingDelivery
+}
+
+func NewPostprocessor(c Configuration) *Postprocessor {
+	p := &Postprocessor{}
+	if c.EventOrdering == SensorOrderedEvents {
+		// the queue size is shared out between the workers
+		size := c.PostprocessQueueSize / c.PostprocessWorkers
+		p.queues = make([]chan postprocessJob, c.PostprocessWorkers)
+		for i := range p.queues {
+			p.queues[i] = make(chan postprocessJob, size)
+			go p.work(p.queues[i])
+		}
+		return p
+	}
+
+	queue := make(chan postprocessJob, c.PostprocessQueueSize)
+	p.queues = []chan postprocessJob{queue}
+	for i := 0; i < c.PostprocessWorkers; i++ {
+		go p.work(queue)
+	}
+	return p
+}
+
+// Enqueue hands an event to the workers, waiting for room in the queue if it is full. The delivery is not
+// acknowledged until the event has been sent.
+func (p *Postprocessor) Enqueue(event *Event, delivery *pendingDelivery) {
+	delivery.add()
+	p.pending.Add(1)
+	p.queueFor(event) <- postprocessJob{event: event, delivery: delivery}
+}
+
+func (p *Postprocessor) queueFor(event *Event) chan postprocessJob {
+	if len(p.queues) == 1 {
+		return p.queues[0]
+	}
+	if sensorID, ok := eventSensorID(event); ok {
+		return p.queues[shardForSensor(sensorID, len(p.queues))]
+	}
+	return p.queues[atomic.AddUint32(&p.next, 1)%uint32(len(p.queues))]
+}
+
+func (p *Postprocessor) work(queue chan postprocessJob) {
+	for job := range queue {
+		p.process(job)
+	}
+}
+
+func (p *Postprocessor) process(job postprocessJob) {
+	defer p.pending.Done()
+	defer job.delivery.done()
+
+	PostprocessJSONMessage(job.event)
+	postprocessedEventCount.Add(1)
+
+	if err := outputMessage(job.event, job.delivery); err != nil {
+		reportError(job.event.Type(), "Error sending post processed event", err)
+	}
+}
+
+// QueueDepth returns the number of events waiting for a worker.
+func (p *Postprocessor) QueueDepth() int {
+	depth := 0
+	for _, queue := range p.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// Drained returns a channel that is closed once every queued event has been sent.
+func (p *Postprocessor) Drained() <-chan struct{} {
+	return waitGroupDone(&p.pending)
+}
+
+// forwardEvent sends an event that has made it through filtering to the outputs, by way of post processing if it
+// is enabled.
+func forwardEvent(event *Event, delivery *pendingDelivery) error {
+	if eventPostprocessor != nil {
+		eventPostprocessor.Enqueue(event, delivery)
+		return nil
+	}
+	return outputMessage(event, delivery)
+}
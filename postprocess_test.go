@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPostprocessing(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+
+		if r.Header.Get("X-Auth-Token") != "abcdef" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/api/v1/feed/7/report/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Path == "/api/v1/feed/7/report/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"title": "Known bad domain", "score": 90}`)
+	}))
+	defer server.Close()
+
+	savedConfig := config
+	defer func() {
+		config = savedConfig
+		cbAPIClient = nil
+	}()
+	config.CbServerURL = server.URL + "/"
+	config.CbAPIToken = "abcdef"
+	config.PostprocessWorkers = 4
+	config.PostprocessQueueSize = 10
+	cbAPIClient = nil
+	for _, key := range []string{"7|dns-1", "7|missing", "7|unavailable"} {
+		FeedCache.Del(key)
+		FeedNegativeCache.Del(key)
+	}
+
+	output := &OutputConfiguration{Name: "default", OutputFormat: JSONOutputFormat}
+	route := &outputRoute{output: output, messages: make(chan string, 100), stopped: make(chan struct{})}
+	savedRoutes := outputRoutes
+	outputRoutes = []*outputRoute{route}
+	defer func() { outputRoutes = savedRoutes }()
+
+	postprocessor := NewPostprocessor(config)
+	for i := 0; i < 10; i++ {
+		reportID := "dns-1"
+		if i%2 == 1 {
+			reportID = "missing"
+		}
+		postprocessor.Enqueue(newEvent(map[string]interface{}{"type": "feed.storage.hit.process",
+			"feed_id": json.Number("7"), "report_id": reportID}), nil)
+	}
+
+	// the four workers wait on the two lookups, and the rest of the events wait in the queue
+	deadline := time.Now().Add(10 * time.Second)
+	for postprocessor.QueueDepth() != 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := postprocessor.QueueDepth(); depth != 6 {
+		t.Errorf("Expected 6 queued events, got %d", depth)
+	}
+
+	close(release)
+	if !waitUntil(postprocessor.Drained(), time.Now().Add(10*time.Second)) {
+		t.Fatal("Post processing did not finish")
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected one request per report, got %d", n)
+	}
+
+	titled := 0
+	for i := 0; i < 10; i++ {
+		msg := <-route.messages
+		if strings.Contains(msg, `"report_title":"Known bad domain"`) {
+			titled++
+		}
+	}
+	if titled != 5 {
+		t.Errorf("Expected 5 events with a report title, got %d", titled)
+	}
+
+	// reports that could not be retrieved are not looked up again for a while
+	if _, _, err := GetReport(7, "missing"); err == nil {
+		t.Error("Expected the cached error for the missing report")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("The missing report should not have been requested again, got %d requests", n)
+	}
+
+	// server errors are retried by the next lookup
+	for i := 0; i < 2; i++ {
+		if _, _, err := GetReport(7, "unavailable"); err == nil {
+			t.Error("Expected an error for the unavailable report")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Errorf("The unavailable report should have been requested again, got %d requests", n)
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := group.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+			if value != "value" || err != nil {
+				t.Errorf("Wrong result: %v, %v", value, err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected a single call, got %d", calls)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"expvar"
+
+	"zvelo.io/ttlru"
+)
+
+/*
+ * The process table remembers the command line, user and parent of each process from its procstart or childproc
+ * event, and adds them to the other raw events of that process.
+ */
+
+var processTable *ProcessTable
+
+var processTableLookups = expvar.NewMap("process_table_lookups")
+
+type ProcessTable struct {
+	// process_guid -> *processDetails
+	processes ttlru.Cache
+}
+
+type processDetails struct {
+	commandLine string
+	username    string
+	parentPath  string
+	parentGUID  string
+}
+
+type ProcessTableStatus struct {
+	Processes    int `json:"processes"`
+	MaxProcesses int `json:"max_processes"`
+}
+
+func NewProcessTable(c Configuration) *ProcessTable {
+	options := make([]ttlru.Option, 0, 1)
+	if c.ProcessTableTTL > 0 {
+		options = append(options, ttlru.WithTTL(c.ProcessTableTTL))
+	}
+	return &ProcessTable{processes: ttlru.New(c.ProcessTableSize, options...)}
+}
+
+// Update records the process started or ended by a procstart, procend or childproc event, and adds the details
+// of the process behind any other raw event to it.
+func (t *ProcessTable) Update(event *Event) {
+	processGUID, _ := event.GetString("process_guid")
+
+	switch event.Type() {
+	case "ingress.event.procstart":
+		details := &processDetails{}
+		details.commandLine, _ = event.GetString("command_line")
+		details.username, _ = event.GetString("username")
+		details.parentPath, _ = event.GetString("parent_path")
+		details.parentGUID, _ = event.GetString("parent_process_guid")
+		t.processes.Set(processGUID, details)
+		return
+	case "ingress.event.procend":
+		t.processes.Del(processGUID)
+		return
+	case "ingress.event.childproc":
+		// procstart events know more about the child, so this is only a fallback for when they are not subscribed
+		childGUID, _ := event.GetString("child_process_guid")
+		created, _ := event.Get("created")
+		if created == true && childGUID != "" {
+			if _, ok := t.processes.Get(childGUID); !ok {
+				details := &processDetails{parentGUID: processGUID}
+				details.parentPath, _ = event.GetString("process_path")
+				t.processes.Set(childGUID, details)
+			}
+		}
+	}
+
+	t.annotate(processGUID, event)
+}
+
+func (t *ProcessTable) annotate(processGUID string, event *Event) {
+	value, ok := t.processes.Get(processGUID)
+	if !ok {
+		processTableLookups.Add("miss", 1)
+		metricProcessTableLookups.Add(1, "miss")
+		return
+	}
+	processTableLookups.Add("hit", 1)
+	metricProcessTableLookups.Add(1, "hit")
+
+	details := value.(*processDetails)
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"command_line", details.commandLine},
+		{"username", details.username},
+		{"parent_path", details.parentPath},
+		{"parent_guid", details.parentGUID},
+	} {
+		if _, ok := event.Get(field.name); !ok && field.value != "" {
+			event.Set(field.name, field.value)
+		}
+	}
+}
+
+func (t *ProcessTable) Status() ProcessTableStatus {
+	return ProcessTableStatus{Processes: t.processes.Len(), MaxProcesses: t.processes.Cap()}
+}
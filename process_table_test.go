@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestProcessTable(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[process_table]
+enabled=true
+max_processes=1000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseProcessTable(input, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+	if !c.ProcessTableEnabled || c.ProcessTableSize != 1000 {
+		t.Fatalf("Wrong process table settings: %v, %d", c.ProcessTableEnabled, c.ProcessTableSize)
+	}
+
+	table := NewProcessTable(c)
+	update := func(msg map[string]interface{}) map[string]interface{} {
+		event := newEvent(msg)
+		table.Update(event)
+		return event.Map()
+	}
+
+	update(map[string]interface{}{
+		"type":                "ingress.event.procstart",
+		"process_guid":        "00000001-0000-0a2c-01d2-4f8e2c8f7c3e",
+		"command_line":        "powershell.exe -nop -enc ZQBj",
+		"username":            "CORP\\alice",
+		"parent_path":         "c:\\program files\\office\\winword.exe",
+		"parent_process_guid": "00000001-0000-0b1c-01d2-4f8e2c8f0000",
+	})
+
+	modload := update(map[string]interface{}{
+		"type":         "ingress.event.moduleload",
+		"process_guid": "00000001-0000-0a2c-01d2-4f8e2c8f7c3e",
+		"path":         "c:\\windows\\system32\\amsi.dll",
+	})
+	expected := map[string]string{
+		"command_line": "powershell.exe -nop -enc ZQBj",
+		"username":     "CORP\\alice",
+		"parent_path":  "c:\\program files\\office\\winword.exe",
+		"parent_guid":  "00000001-0000-0b1c-01d2-4f8e2c8f0000",
+	}
+	for k, v := range expected {
+		if modload[k] != v {
+			t.Errorf("Expected %s to be %q, got %v", k, v, modload[k])
+		}
+	}
+
+	// the child of a process that was not seen starting only gets its parent
+	update(map[string]interface{}{
+		"type":               "ingress.event.childproc",
+		"process_guid":       "00000001-0000-0a2c-01d2-4f8e2c8f7c3e",
+		"process_path":       "c:\\windows\\system32\\windowspowershell\\v1.0\\powershell.exe",
+		"child_process_guid": "00000001-0000-0d10-01d2-4f8e2c8f8000",
+		"created":            true,
+	})
+	netconn := update(map[string]interface{}{
+		"type":         "ingress.event.netconn",
+		"process_guid": "00000001-0000-0d10-01d2-4f8e2c8f8000",
+	})
+	if netconn["parent_guid"] != "00000001-0000-0a2c-01d2-4f8e2c8f7c3e" ||
+		netconn["parent_path"] != "c:\\windows\\system32\\windowspowershell\\v1.0\\powershell.exe" {
+		t.Errorf("Wrong parent for the child process: %v", netconn)
+	}
+	if _, ok := netconn["command_line"]; ok {
+		t.Errorf("The child's command line is not known: %v", netconn)
+	}
+
+	update(map[string]interface{}{
+		"type":         "ingress.event.procend",
+		"process_guid": "00000001-0000-0a2c-01d2-4f8e2c8f7c3e",
+	})
+	filemod := update(map[string]interface{}{
+		"type":         "ingress.event.filemod",
+		"process_guid": "00000001-0000-0a2c-01d2-4f8e2c8f7c3e",
+	})
+	if len(filemod) != 2 {
+		t.Errorf("Processes should be forgotten once they end: %v", filemod)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Per-sensor rate limiting. Suppressed events are counted and reported once per summary_interval as
+ * forwarder.ratelimit events.
+ */
+
+// rateLimitEventType is the type of the summary events.
+const rateLimitEventType = "forwarder.ratelimit"
+
+// at most this many rate limited sensors are listed on the status page
+const rateLimitStatusMaxEntries = 100
+
+var rateLimitedEventCount = expvar.NewInt("rate_limited_event_count")
+
+var eventRateLimiter *RateLimiter
+
+type RateLimiter struct {
+	sync.Mutex
+
+	rate            float64
+	burst           float64
+	byEventType     bool
+	eventTypes      []string
+	summaryInterval time.Duration
+
+	buckets       map[rateLimitKey]*tokenBucket
+	intervalStart time.Time
+
+	now func() time.Time
+}
+
+type rateLimitKey struct {
+	source    string
+	eventType string
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+
+	sensorID     interface{}
+	computerName interface{}
+
+	// events suppressed since the last summary, by event type, and in total
+	suppressed      map[string]int64
+	totalSuppressed int64
+}
+
+type RateLimitStatus struct {
+	EventsPerSecond float64                 `json:"events_per_second"`
+	Burst           int64                   `json:"burst"`
+	PerEventType    bool                    `json:"per_event_type"`
+	TrackedBuckets  int                     `json:"tracked_buckets"`
+	Limited         []RateLimitBucketStatus `json:"limited"`
+}
+
+type RateLimitBucketStatus struct {
+	SensorID        interface{} `json:"sensor_id"`
+	ComputerName    interface{} `json:"computer_name"`
+	Type            string      `json:"type,omitempty"`
+	Tokens          float64     `json:"tokens"`
+	Suppressed      int64       `json:"suppressed_this_interval"`
+	TotalSuppressed int64       `json:"suppressed_total"`
+}
+
+func NewRateLimiter(c Configuration) *RateLimiter {
+	limiter := &RateLimiter{
+		rate:            c.RateLimit,
+		burst:           float64(c.RateLimitBurst),
+		byEventType:     c.RateLimitByEventType,
+		eventTypes:      c.RateLimitEventTypes,
+		summaryInterval: c.RateLimitSummaryInterval,
+		buckets:         make(map[rateLimitKey]*tokenBucket),
+		now:             time.Now,
+	}
+	limiter.intervalStart = limiter.now()
+
+	return limiter
+}
+
+// Allow returns false if the event is over its sensor's rate limit and should be suppressed.
+func (l *RateLimiter) Allow(event *Event) bool {
+	eventType := event.Type()
+	if eventType == rateLimitEventType || (len(l.eventTypes) > 0 && !eventTypesMatch(l.eventTypes, eventType)) {
+		return true
+	}
+
+	source, ok := event.Lookup("sensor_id")
+	if !ok {
+		computerName, ok := event.Lookup("computer_name")
+		if !ok {
+			return true
+		}
+		source = "host:" + computerName
+	}
+
+	key := rateLimitKey{source: source}
+	if l.byEventType {
+		key.eventType = eventType
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		sensorID, _ := event.Get("sensor_id")
+		computerName, _ := event.Get("computer_name")
+		bucket = &tokenBucket{
+			tokens:       l.burst,
+			updated:      now,
+			sensorID:     sensorID,
+			computerName: computerName,
+			suppressed:   make(map[string]int64),
+		}
+		l.buckets[key] = bucket
+	}
+
+	l.refill(bucket, now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+
+	bucket.suppressed[eventType]++
+	bucket.totalSuppressed++
+	rateLimitedEventCount.Add(1)
+	metricRateLimitedEvents.Add(1, eventType)
+	return false
+}
+
+func (l *RateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * l.rate
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		bucket.updated = now
+	}
+}
+
+// Summaries returns a forwarder.ratelimit event for each sensor and event type that had events suppressed since
+// the last call, and forgets the buckets of sensors that have been idle long enough to be full again.
+func (l *RateLimiter) Summaries() []map[string]interface{} {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	summaries := make([]map[string]interface{}, 0)
+
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+
+		for eventType, count := range bucket.suppressed {
+			summaries = append(summaries, map[string]interface{}{
+				"type":             rateLimitEventType,
+				"sensor_id":        bucket.sensorID,
+				"computer_name":    bucket.computerName,
+				"suppressed_type":  eventType,
+				"suppressed_count": count,
+				"interval_start":   l.intervalStart.Unix(),
+				"timestamp":        now.Unix(),
+			})
+		}
+
+		if len(bucket.suppressed) > 0 {
+			bucket.suppressed = make(map[string]int64)
+		} else if bucket.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.intervalStart = now
+	return summaries
+}
+
+// reportSuppressed sends the summary events to the outputs every summary interval, until shutdown. shutdown
+// sends the last of them itself, before it closes the outputs.
+func (l *RateLimiter) reportSuppressed() {
+	ticker := time.NewTicker(l.summaryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.sendSummaries()
+		case <-shutdownRequested:
+			return
+		}
+	}
+}
+
+func (l *RateLimiter) sendSummaries() {
+	for _, msg := range l.Summaries() {
+		log.Warnf("Rate limit suppressed %d %s events from sensor %v (%v)", msg["suppressed_count"],
+			msg["suppressed_type"], msg["sensor_id"], msg["computer_name"])
+
+		if err := outputMessage(newEvent(msg), nil); err != nil {
+			log.Errorf("Could not send rate limit summary: %s", err)
+		}
+	}
+}
+
+// Status returns the limiter's settings and the sensors that are being, or have recently been, rate limited.
+func (l *RateLimiter) Status() RateLimitStatus {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	status := RateLimitStatus{
+		EventsPerSecond: l.rate,
+		Burst:           int64(l.burst),
+		PerEventType:    l.byEventType,
+		TrackedBuckets:  len(l.buckets),
+		Limited:         make([]RateLimitBucketStatus, 0),
+	}
+
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+
+		var suppressed int64
+		for _, count := range bucket.suppressed {
+			suppressed += count
+		}
+		if suppressed == 0 && bucket.tokens >= 1 {
+			continue
+		}
+
+		status.Limited = append(status.Limited, RateLimitBucketStatus{
+			SensorID:        bucket.sensorID,
+			ComputerName:    bucket.computerName,
+			Type:            key.eventType,
+			Tokens:          bucket.tokens,
+			Suppressed:      suppressed,
+			TotalSuppressed: bucket.totalSuppressed,
+		})
+	}
+
+	sort.Sort(bySuppressed(status.Limited))
+	if len(status.Limited) > rateLimitStatusMaxEntries {
+		status.Limited = status.Limited[:rateLimitStatusMaxEntries]
+	}
+
+	return status
+}
+
+type bySuppressed []RateLimitBucketStatus
+
+func (s bySuppressed) Len() int           { return len(s) }
+func (s bySuppressed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySuppressed) Less(i, j int) bool { return s[i].Suppressed > s[j].Suppressed }
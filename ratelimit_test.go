@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestRateLimiter(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[rate_limit]
+events_per_second=1
+burst=3
+per_event_type=true
+event_types=ingress.event.*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseRateLimit(input, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	now := time.Unix(1500000000, 0)
+	limiter := NewRateLimiter(c)
+	limiter.now = func() time.Time { return now }
+
+	event := func(sensorID, eventType string) *Event {
+		return newEvent(map[string]interface{}{"type": eventType, "sensor_id": json.Number(sensorID),
+			"computer_name": "host-" + sensorID})
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if limiter.Allow(event("7", "ingress.event.regmod")) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("Expected the burst of 3 events to be allowed, got %d", allowed)
+	}
+
+	if !limiter.Allow(event("7", "ingress.event.procstart")) {
+		t.Error("Events of another type should have their own limit")
+	}
+	if !limiter.Allow(event("8", "ingress.event.regmod")) {
+		t.Error("Events from another sensor should have their own limit")
+	}
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow(event("7", "watchlist.hit.process")) {
+			t.Fatal("Event types that are not listed should not be limited")
+		}
+	}
+
+	now = now.Add(2 * time.Second)
+	if !limiter.Allow(event("7", "ingress.event.regmod")) || !limiter.Allow(event("7", "ingress.event.regmod")) {
+		t.Error("The bucket should have refilled by two events")
+	}
+	if limiter.Allow(event("7", "ingress.event.regmod")) {
+		t.Error("The bucket should be empty again")
+	}
+
+	status := limiter.Status()
+	if len(status.Limited) != 1 || status.Limited[0].Suppressed != 8 || status.Limited[0].Type != "ingress.event.regmod" {
+		t.Errorf("Wrong rate limit status: %+v", status.Limited)
+	}
+
+	summaries := limiter.Summaries()
+	if len(summaries) != 1 {
+		t.Fatalf("Expected one summary event, got %v", summaries)
+	}
+	summary := summaries[0]
+	if summary["type"] != "forwarder.ratelimit" || summary["sensor_id"] != json.Number("7") ||
+		summary["suppressed_type"] != "ingress.event.regmod" || summary["suppressed_count"] != int64(8) {
+		t.Errorf("Wrong summary event: %v", summary)
+	}
+
+	if summaries := limiter.Summaries(); len(summaries) != 0 {
+		t.Errorf("Suppressed counts should be reset after each summary, got %v", summaries)
+	}
+
+	// idle sensors are forgotten once their buckets have refilled
+	now = now.Add(time.Minute)
+	limiter.Summaries()
+	if status := limiter.Status(); status.TrackedBuckets != 0 {
+		t.Errorf("Expected idle buckets to be removed, %d left", status.TrackedBuckets)
+	}
+}
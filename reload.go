@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Configuration reload, on SIGHUP or a POST to /reload. Routing keys, event types, filters and transforms are
+ * swapped in place and only the outputs whose sections changed are restarted. A configuration that cannot be
+ * parsed or started is rejected and the running one is kept.
+ */
+
+// liveConfiguration holds the parts of the configuration that a reload can change while events are being
+// processed. Workers read it through currentLiveConfiguration.
+type liveConfiguration struct {
+	EventTypes           []string
+	EventMap             map[string]bool
+	UseRawSensorExchange bool
+	FilterRules          []*FilterRule
+	Transforms           []*Transform
+}
+
+var liveConfig atomic.Value
+
+// configLocation is the configuration file the forwarder was started with.
+var configLocation = "/etc/cb/integrations/event-forwarder/cb-event-forwarder.conf"
+
+// reloadLock serializes reloads with each other and with shutdown.
+var reloadLock sync.Mutex
+
+var (
+	configReloads      = expvar.NewInt("config_reloads")
+	configReloadErrors = expvar.NewInt("config_reload_errors")
+)
+
+func publishLiveConfiguration(c *Configuration) {
+	liveConfig.Store(&liveConfiguration{
+		EventTypes:           c.EventTypes,
+		EventMap:             c.EventMap,
+		UseRawSensorExchange: c.UseRawSensorExchange,
+		FilterRules:          c.FilterRules,
+		Transforms:           c.Transforms,
+	})
+}
+
+func currentLiveConfiguration() *liveConfiguration {
+	if live, ok := liveConfig.Load().(*liveConfiguration); ok {
+		return live
+	}
+	return &liveConfiguration{}
+}
+
+// reloadConfiguration parses the configuration file again and applies it.
+func reloadConfiguration() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if shuttingDown() {
+		return errors.New("the forwarder is shutting down")
+	}
+
+	log.Infof("Reloading configuration from %s", configLocation)
+
+	newConfig, err := ParseConfig(configLocation)
+	if err == nil {
+		applyCommandLineOptions(&newConfig)
+		err = applyConfiguration(newConfig)
+	}
+
+	if err != nil {
+		configReloadErrors.Add(1)
+		log.Errorf("Configuration reload rejected; keeping the running configuration: %s", err)
+		return err
+	}
+
+	configReloads.Add(1)
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// restartOnlyChanges returns the names of the settings that differ between the configurations but that a reload
+// does not apply.
+func restartOnlyChanges(running, reloaded Configuration) []string {
+	for _, c := range []*Configuration{&running, &reloaded} {
+		c.EventTypes = nil
+		c.EventMap = nil
+		c.UseRawSensorExchange = false
+		c.FilterRules = nil
+		c.Transforms = nil
+		c.Outputs = nil
+	}
+
+	changed := make([]string, 0)
+	before, after := reflect.ValueOf(running), reflect.ValueOf(reloaded)
+	for i := 0; i < before.NumField(); i++ {
+		if !reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			changed = append(changed, before.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// routingKeyChanges returns the routing keys in after that are not in before, and those in before that are not
+// in after.
+func routingKeyChanges(before, after []string) (added, removed []string) {
+	beforeSet := make(map[string]bool, len(before))
+	for _, key := range before {
+		beforeSet[key] = true
+	}
+	afterSet := make(map[string]bool, len(after))
+	for _, key := range after {
+		afterSet[key] = true
+		if !beforeSet[key] {
+			added = append(added, key)
+		}
+	}
+	for _, key := range before {
+		if !afterSet[key] {
+			removed = append(removed, key)
+		}
+	}
+	return added, removed
+}
+
+// outputChanges sorts the reloaded outputs by what must happen to them. Running outputs whose section is
+// unchanged are reused and receive the new event types; outputs with a new name are started; outputs whose
+// section changed are restarted with their new configuration, and those no longer configured are stopped.
+func outputChanges(routes []*outputRoute, outputs []*OutputConfiguration) (reused map[string]*outputRoute,
+	added, changed []*OutputConfiguration, retired []*outputRoute) {
+	running := make(map[string]*outputRoute, len(routes))
+	for _, route := range routes {
+		running[route.output.Name] = route
+	}
+
+	reused = make(map[string]*outputRoute)
+	configured := make(map[string]bool, len(outputs))
+	for _, output := range outputs {
+		configured[output.Name] = true
+
+		route, ok := running[output.Name]
+		switch {
+		case !ok:
+			added = append(added, output)
+		case route.output.Signature == output.Signature:
+			reused[output.Name] = route
+		default:
+			changed = append(changed, output)
+			retired = append(retired, route)
+		}
+	}
+
+	for _, route := range routes {
+		if !configured[route.output.Name] {
+			retired = append(retired, route)
+		}
+	}
+
+	return reused, added, changed, retired
+}
+
+// configuredRoutes returns the routes of the configured outputs that are reused or have been started, in the
+// order in which they are configured, and their configurations. Reused routes receive the new event types.
+func configuredRoutes(configured []*OutputConfiguration, reused, started map[string]*outputRoute) ([]*outputRoute,
+	[]*OutputConfiguration) {
+	routes := make([]*outputRoute, 0, len(configured))
+	outputs := make([]*OutputConfiguration, 0, len(configured))
+	for _, output := range configured {
+		route, ok := reused[output.Name]
+		if ok {
+			route.output.EventTypes = output.EventTypes
+		} else if route, ok = started[output.Name]; !ok {
+			continue
+		}
+		routes = append(routes, route)
+		outputs = append(outputs, route.output)
+	}
+	return routes, outputs
+}
+
+// applyConfiguration makes the running forwarder use the reloaded configuration. Nothing is changed if an error
+// is returned.
+func applyConfiguration(newConfig Configuration) error {
+	if changed := restartOnlyChanges(config, newConfig); len(changed) > 0 {
+		log.Warnf("Changes to %s are not applied until the forwarder is restarted", strings.Join(changed, ", "))
+	}
+
+	live := currentLiveConfiguration()
+
+	outputsLock.RLock()
+	reused, added, changed, retired := outputChanges(outputRoutes, newConfig.Outputs)
+	outputsLock.RUnlock()
+
+	// start the outputs that are new first, so that the reload can still be rejected if they fail
+	started := make(map[string]*outputRoute, len(added))
+	stopStarted := func() {
+		for _, route := range started {
+			close(route.messages)
+		}
+	}
+	for _, output := range added {
+		route, err := newOutputRoute(output)
+		if err == nil {
+			err = route.start()
+		}
+		if err != nil {
+			stopStarted()
+			return err
+		}
+		started[output.Name] = route
+	}
+
+	addedKeys, removedKeys := routingKeyChanges(live.EventTypes, newConfig.EventTypes)
+	bindRaw := newConfig.UseRawSensorExchange && !live.UseRawSensorExchange
+	unbindRaw := live.UseRawSensorExchange && !newConfig.UseRawSensorExchange
+
+	// consumers share the queue, so binding it through any of them is enough; consumers that connect later
+	// bind the routing keys of the live configuration themselves
+	consumer := anyActiveConsumer()
+	if consumer != nil && (len(addedKeys) > 0 || bindRaw) {
+		if err := consumer.Bind(addedKeys, bindRaw); err != nil {
+			consumer.Unbind(addedKeys, bindRaw)
+			stopStarted()
+			return errors.New(fmt.Sprintf("Could not subscribe to the new event types: %s", err))
+		}
+	}
+
+	// the retired outputs are taken out of the routes before their channels are closed, so that no dispatcher
+	// sends to them; outputs whose section changed are left out until they have been restarted below
+	outputsLock.Lock()
+	outputRoutes, config.Outputs = configuredRoutes(newConfig.Outputs, reused, started)
+	config.EventTypes = newConfig.EventTypes
+	config.EventMap = newConfig.EventMap
+	config.UseRawSensorExchange = newConfig.UseRawSensorExchange
+	config.FilterRules = newConfig.FilterRules
+	config.Transforms = newConfig.Transforms
+	publishLiveConfiguration(&config)
+
+	for _, route := range retired {
+		close(route.messages)
+	}
+	outputsLock.Unlock()
+
+	// outputs whose section changed may write to the same files or directories as before, so the old handler
+	// has to stop before its replacement is initialized. Events dispatched in the meantime are not sent to them.
+	deadline := time.Now().Add(config.ShutdownTimeout)
+	for _, route := range retired {
+		if waitUntil(route.stopped, deadline) {
+			log.Infof("Output %s has stopped", route.output.Name)
+		} else {
+			log.Errorf("Timed out waiting for output %s to send its remaining events", route.output.Name)
+		}
+	}
+
+	previous := make(map[string]*OutputConfiguration, len(retired))
+	for _, route := range retired {
+		previous[route.output.Name] = route.output
+	}
+	for _, output := range changed {
+		route, err := newOutputRoute(output)
+		if err == nil {
+			err = route.start()
+		}
+		if err != nil {
+			log.Errorf("Could not restart output %s with its new configuration; keeping the old one: %s",
+				output.Name, err)
+
+			route, err = newOutputRoute(previous[output.Name])
+			if err == nil {
+				err = route.start()
+			}
+			if err != nil {
+				log.Errorf("Could not restart output %s: %s", output.Name, err)
+				continue
+			}
+		}
+		started[output.Name] = route
+	}
+
+	if len(changed) > 0 {
+		outputsLock.Lock()
+		outputRoutes, config.Outputs = configuredRoutes(newConfig.Outputs, reused, started)
+		outputsLock.Unlock()
+	}
+
+	// events already routed under the old configuration may still be in the queue; they are processed with the
+	// new event types, so nothing is lost by unbinding last
+	if consumer != nil && (len(removedKeys) > 0 || unbindRaw) {
+		if err := consumer.Unbind(removedKeys, unbindRaw); err != nil {
+			log.Errorf("Could not unsubscribe from removed event types: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// reloadHandler reloads the configuration on a POST to /reload.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "configuration reloads must be requested with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := reloadConfiguration(); err != nil {
+		errMsg, _ := json.Marshal(map[string]string{"status": "error", "error": err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(errMsg)
+		return
+	}
+
+	msg, _ := json.Marshal(map[string]string{"status": "success"})
+	_, _ = w.Write(msg)
+}
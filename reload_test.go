@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func parseTestOutputs(t *testing.T, conf string) []*OutputConfiguration {
+	input, err := ini.Load(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	outputs := make([]*OutputConfiguration, 0)
+	for _, name := range []string{"archive", "alerts", "siem"} {
+		section := "output:" + name
+		if outType, ok := input.Get(section, "output_type"); ok {
+			outputs = append(outputs, parseOutputConfiguration(input, name, section, outType, JSONOutputFormat, &errs))
+		}
+	}
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+	return outputs
+}
+
+func TestReloadOutputChanges(t *testing.T) {
+	running := parseTestOutputs(t, `
+[output:archive]
+output_type=file
+outfile=/var/cb/data/event-forwarder/archive.json
+event_types=ingress.event.*
+
+[output:alerts]
+output_type=tcp
+tcpout=siem.example.com:514
+`)
+	reloaded := parseTestOutputs(t, `
+[output:archive]
+output_type=file
+outfile=/var/cb/data/event-forwarder/archive.json
+event_types=ingress.event.*, watchlist.#
+
+[output:siem]
+output_type=udp
+udpout=siem.example.com:514
+`)
+
+	routes := make([]*outputRoute, 0)
+	for _, output := range running {
+		routes = append(routes, &outputRoute{output: output})
+	}
+
+	reused, added, changed, retired := outputChanges(routes, reloaded)
+	if len(reused) != 1 || reused["archive"] != routes[0] {
+		t.Errorf("Expected the archive output to be reused since only its event types changed, got %v", reused)
+	}
+	if len(added) != 1 || added[0].Name != "siem" {
+		t.Errorf("Expected the siem output to be added, got %v", added)
+	}
+	if len(changed) != 0 {
+		t.Errorf("Expected no outputs to be restarted, got %v", changed)
+	}
+	if len(retired) != 1 || retired[0] != routes[1] {
+		t.Errorf("Expected the alerts output to be stopped, got %v", retired)
+	}
+
+	moved := parseTestOutputs(t, `
+[output:archive]
+output_type=file
+outfile=/var/cb/data/event-forwarder/archive-2.json
+event_types=ingress.event.*
+
+[output:alerts]
+output_type=tcp
+tcpout=siem.example.com:514
+`)
+	reused, added, changed, retired = outputChanges(routes, moved)
+	if len(reused) != 1 || reused["alerts"] != routes[1] {
+		t.Errorf("Expected the unchanged alerts output to be reused, got %v", reused)
+	}
+	if len(added) != 0 {
+		t.Errorf("Expected no outputs to be added, got %v", added)
+	}
+	if len(changed) != 1 || changed[0].Name != "archive" || len(retired) != 1 || retired[0] != routes[0] {
+		t.Errorf("Expected the archive output to be restarted, got %v and %v", changed, retired)
+	}
+}
+
+func TestReloadDoesNotBlockOutputsWhileStopping(t *testing.T) {
+	outputs := parseTestOutputs(t, `
+[output:archive]
+output_type=file
+outfile=/var/cb/data/event-forwarder/archive.json
+
+[output:alerts]
+output_type=tcp
+tcpout=siem.example.com:514
+`)
+
+	savedConfig, savedRoutes := config, outputRoutes
+	defer func() {
+		config, outputRoutes = savedConfig, savedRoutes
+		publishLiveConfiguration(&config)
+	}()
+
+	archive := &outputRoute{output: outputs[0], messages: make(chan string, 1), stopped: make(chan struct{})}
+	alerts := &outputRoute{output: outputs[1], messages: make(chan string, 1), stopped: make(chan struct{})}
+	config.Outputs = outputs
+	config.ShutdownTimeout = 10 * time.Second
+	outputRoutes = []*outputRoute{archive, alerts}
+
+	newConfig := config
+	newConfig.Outputs = outputs[:1]
+	done := make(chan error, 1)
+	go func() { done <- applyConfiguration(newConfig) }()
+
+	// the alerts output never stops on its own, so the reload waits for it once its channel is closed
+	for range alerts.messages {
+	}
+
+	routes := make(chan []*outputRoute, 1)
+	go func() {
+		outputsLock.RLock()
+		routes <- outputRoutes
+		outputsLock.RUnlock()
+	}()
+	select {
+	case current := <-routes:
+		if len(current) != 1 || current[0] != archive {
+			t.Errorf("Expected only the archive output to be routed to, got %v", current)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The outputs were locked while waiting for the alerts output to stop")
+	}
+
+	select {
+	case <-done:
+		t.Error("The reload finished before the alerts output stopped")
+	default:
+	}
+
+	close(alerts.stopped)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected reload error: %s", err)
+	}
+}
+
+func TestReloadRoutingKeyChanges(t *testing.T) {
+	added, removed := routingKeyChanges([]string{"ingress.event.procstart", "watchlist.#"},
+		[]string{"watchlist.#", "alert.#"})
+	if !reflect.DeepEqual(added, []string{"alert.#"}) || !reflect.DeepEqual(removed, []string{"ingress.event.procstart"}) {
+		t.Errorf("Wrong routing key changes: added %v, removed %v", added, removed)
+	}
+}
+
+func TestReloadRestartOnlyChanges(t *testing.T) {
+	running := Configuration{AMQPHostname: "localhost", EventTypes: []string{"watchlist.#"}}
+	reloaded := Configuration{AMQPHostname: "cbserver", EventTypes: []string{"alert.#"}}
+
+	if changed := restartOnlyChanges(running, reloaded); !reflect.DeepEqual(changed, []string{"AMQPHostname"}) {
+		t.Errorf("Expected only AMQPHostname to need a restart, got %v", changed)
+	}
+
+	// the shared Cb API client is built from these, so it is only rebuilt by a restart
+	running = Configuration{CbServerURL: "https://cb1/", CbAPIToken: "abc", CbAPIVerifySSL: true}
+	reloaded = Configuration{CbServerURL: "https://cb2/", CbAPIToken: "def", CbAPIProxyUrl: "http://proxy:3128"}
+	expected := []string{"CbServerURL", "CbAPIToken", "CbAPIVerifySSL", "CbAPIProxyUrl"}
+	if changed := restartOnlyChanges(running, reloaded); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected the Cb API settings to need a restart, got %v", changed)
+	}
+}
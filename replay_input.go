@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+/*
+ * Directory replay input
+ *
+ * Replays deliveries captured to disk through the same workers as the AMQP input. Each captured delivery is a
+ * pair of files: the message body exactly as it was received, and a sidecar named after the body with a ".meta"
+ * suffix holding the CapturedDelivery metadata as JSON. Deliveries are replayed in lexical order of their file
+ * names. Files without a sidecar, such as the samples in tests/raw_data, are replayed with the name of their
+ * directory as the routing key and a content type based on their extension.
+ */
+
+const captureMetadataSuffix = ".meta"
+
+// CapturedDelivery is the metadata stored alongside a captured message body.
+type CapturedDelivery struct {
+	RoutingKey  string                 `json:"routing_key"`
+	ContentType string                 `json:"content_type"`
+	Exchange    string                 `json:"exchange"`
+	Headers     map[string]interface{} `json:"headers"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+var (
+	replayedDeliveries = expvar.NewInt("replayed_deliveries")
+	replayErrors       = expvar.NewInt("replay_errors")
+)
+
+var replayContentTypes = map[string]string{
+	".json":     "application/json",
+	".protobuf": "application/protobuf",
+	".pb":       "application/protobuf",
+	".zip":      "application/zip",
+}
+
+// amqpHeaders converts headers decoded from JSON back into the types the AMQP library produces, so that
+// parseIntFromHeader accepts them.
+func amqpHeaders(headers map[string]interface{}) amqp.Table {
+	table := make(amqp.Table, len(headers))
+	for key, value := range headers {
+		if number, ok := value.(json.Number); ok {
+			if i, err := number.Int64(); err == nil {
+				value = i
+			} else if f, err := number.Float64(); err == nil {
+				value = f
+			}
+		}
+		table[key] = value
+	}
+	return table
+}
+
+// readCapturedDelivery loads a captured delivery from its body file. ok is false if the file is not a
+// delivery, for example a sidecar or a file of unknown type without one.
+func readCapturedDelivery(bodyFile string) (delivery amqp.Delivery, ok bool, err error) {
+	if strings.HasSuffix(bodyFile, captureMetadataSuffix) {
+		return delivery, false, nil
+	}
+
+	metadata, err := ioutil.ReadFile(bodyFile + captureMetadataSuffix)
+	if err == nil {
+		var captured CapturedDelivery
+		decoder := json.NewDecoder(bytes.NewReader(metadata))
+		decoder.UseNumber()
+		if err := decoder.Decode(&captured); err != nil {
+			return delivery, false, err
+		}
+
+		delivery.RoutingKey = captured.RoutingKey
+		delivery.ContentType = captured.ContentType
+		delivery.Exchange = captured.Exchange
+		delivery.Headers = amqpHeaders(captured.Headers)
+		delivery.Timestamp = captured.Timestamp
+	} else if os.IsNotExist(err) {
+		contentType, known := replayContentTypes[strings.ToLower(filepath.Ext(bodyFile))]
+		if !known {
+			return delivery, false, nil
+		}
+
+		delivery.RoutingKey = filepath.Base(filepath.Dir(bodyFile))
+		delivery.ContentType = contentType
+		delivery.Headers = amqp.Table{}
+	} else {
+		return delivery, false, err
+	}
+
+	delivery.Body, err = ioutil.ReadFile(bodyFile)
+	if err != nil {
+		return delivery, false, err
+	}
+
+	return delivery, true, nil
+}
+
+// captureFiles returns the files under dir in lexical order.
+func captureFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// replayDirectory processes every captured delivery under dir and returns once all of them have been handed
+// to the outputs, or once the forwarder starts shutting down.
+func replayDirectory(dir string) error {
+	files, err := captureFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	deliveries := make(chan amqp.Delivery)
+
+	numProcessors := config.MessageProcessorCount
+	log.Infof("Replaying deliveries from %s with %d message processors", dir, numProcessors)
+	startMessageProcessors(deliveries, numProcessors)
+
+	replayed, failed := 0, 0
+feed:
+	for _, file := range files {
+		delivery, ok, err := readCapturedDelivery(file)
+		if err != nil {
+			failed++
+			replayErrors.Add(1)
+			log.Errorf("Could not read captured delivery %s: %s", file, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		select {
+		case deliveries <- delivery:
+			replayed++
+			replayedDeliveries.Add(1)
+		case <-shutdownRequested:
+			log.Infof("Replay of %s interrupted by shutdown", dir)
+			break feed
+		}
+	}
+
+	close(deliveries)
+	wg.Wait()
+	if eventPostprocessor != nil {
+		<-eventPostprocessor.Drained()
+	}
+
+	log.Infof("Replay of %s complete: %d deliveries replayed, %d errors", dir, replayed, failed)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCapturedDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body := []byte(`{"type": "watchlist.hit.process"}`)
+	metadata := []byte(`{"routing_key": "ingress.event.procstart", "content_type": "application/protobuf",
+		"exchange": "api.events", "headers": {"sensorId": 12, "sensorHostName": "WIN-IA9NQ1GN8OI"}}`)
+
+	files := map[string][]byte{
+		"0001":                         body,
+		"0001.meta":                    metadata,
+		"watchlist.hit.process/0.json": body,
+		"zip/0.txt":                    body,
+	}
+	for name, contents := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	delivery, ok, err := readCapturedDelivery(filepath.Join(dir, "0001"))
+	if err != nil || !ok {
+		t.Fatalf("Could not read captured delivery: %v", err)
+	}
+	if delivery.RoutingKey != "ingress.event.procstart" || delivery.ContentType != "application/protobuf" ||
+		delivery.Exchange != "api.events" || string(delivery.Body) != string(body) {
+		t.Errorf("Unexpected delivery %+v", delivery)
+	}
+	if sensorId, err := parseIntFromHeader(delivery.Headers["sensorId"]); err != nil || sensorId != 12 {
+		t.Errorf("Could not read sensorId header back: %v %v", delivery.Headers["sensorId"], err)
+	}
+
+	delivery, ok, err = readCapturedDelivery(filepath.Join(dir, "watchlist.hit.process/0.json"))
+	if err != nil || !ok {
+		t.Fatalf("Could not read sample without a sidecar: %v", err)
+	}
+	if delivery.RoutingKey != "watchlist.hit.process" || delivery.ContentType != "application/json" {
+		t.Errorf("Unexpected delivery %+v", delivery)
+	}
+
+	for _, name := range []string{"0001.meta", "zip/0.txt"} {
+		if _, ok, err := readCapturedDelivery(filepath.Join(dir, name)); ok || err != nil {
+			t.Errorf("Expected %s to be skipped, got ok=%v err=%v", name, ok, err)
+		}
+	}
+
+	captures, err := captureFiles(dir)
+	if err != nil || len(captures) != len(files) || captures[0] != filepath.Join(dir, "0001") {
+		t.Errorf("Unexpected capture files %v: %v", captures, err)
+	}
+}
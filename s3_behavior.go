@@ -21,9 +21,10 @@ import (
 )
 
 type S3Behavior struct {
-	bucketName string
-	out        *s3.S3
-	region     string
+	bucketName   string
+	out          *s3.S3
+	region       string
+	outputConfig *OutputConfiguration
 }
 
 type S3Statistics struct {
@@ -38,11 +39,11 @@ func (o *S3Behavior) Upload(fileName string, fp *os.File) UploadStatus {
 	//
 	// If a prefix is specified then concatenate it with the Base of the filename
 	//
-	if config.S3ObjectPrefix != nil {
-		prefix := *config.S3ObjectPrefix
+	if o.outputConfig.S3ObjectPrefix != nil {
+		prefix := *o.outputConfig.S3ObjectPrefix
 
 		// cust_name=abc/ingest_dt=2017-05-11/format=cb_response/bucket=the-bucket.2017-05-11T23:59:58
-		if config.S3VerboseKey == true {
+		if o.outputConfig.S3VerboseKey == true {
 			current_time := time.Now().UTC()
 
 			baseName = fmt.Sprintf("%s/ingest_dt=%s/format=cb_response/%s,ingest_ts=%s,format=cb_response.json", prefix, current_time.Format("2006-01-02"), prefix, current_time.Format("2006-01-02T15:04:05.000Z"))
@@ -56,7 +57,7 @@ func (o *S3Behavior) Upload(fileName string, fp *os.File) UploadStatus {
 
 	var byteReader io.ReadSeeker
 
-	if config.S3CompressData != false {
+	if o.outputConfig.S3CompressData != false {
 		baseName += ".gz"
 		fileReader := bufio.NewReader(fp)
 
@@ -81,9 +82,9 @@ func (o *S3Behavior) Upload(fileName string, fp *os.File) UploadStatus {
 		Body:                 byteReader,
 		Bucket:               &o.bucketName,
 		Key:                  &baseName,
-		ServerSideEncryption: config.S3ServerSideEncryption,
-		ACL:                  config.S3ACLPolicy,
-        StorageClass:         config.S3StorageClass,
+		ServerSideEncryption: o.outputConfig.S3ServerSideEncryption,
+		ACL:                  o.outputConfig.S3ACLPolicy,
+        StorageClass:         o.outputConfig.S3StorageClass,
 	})
 
 	fp.Close()
@@ -112,8 +113,8 @@ func (o *S3Behavior) Initialize(connString string) error {
 	}
 
 	awsConfig := &aws.Config{Region: aws.String(o.region)}
-	if config.S3CredentialProfileName != nil {
-		parts = strings.SplitN(*config.S3CredentialProfileName, ":", 2)
+	if o.outputConfig.S3CredentialProfileName != nil {
+		parts = strings.SplitN(*o.outputConfig.S3CredentialProfileName, ":", 2)
 		credentialProvider := credentials.SharedCredentialsProvider{}
 
 		if len(parts) == 2 {
@@ -130,8 +131,7 @@ func (o *S3Behavior) Initialize(connString string) error {
 	sess := session.New(awsConfig)
 	o.out = s3.New(sess)
 
-	_, err := o.out.HeadBucket(&s3.HeadBucketInput{Bucket: &o.bucketName})
-	if err != nil {
+	if err := o.Probe(); err != nil {
 		// converting this to a warning, as you could have buckets with PutObject rights but not ListBucket
 		log.Infof("Could not open bucket %s: %s", o.bucketName, err)
 	}
@@ -139,6 +139,12 @@ func (o *S3Behavior) Initialize(connString string) error {
 	return nil
 }
 
+// Probe checks that the bucket exists and can be accessed with HEAD bucket.
+func (o *S3Behavior) Probe() error {
+	_, err := o.out.HeadBucket(&s3.HeadBucketInput{Bucket: &o.bucketName})
+	return err
+}
+
 func (o *S3Behavior) Key() string {
 	return fmt.Sprintf("%s:%s", o.region, o.bucketName)
 }
@@ -151,6 +157,6 @@ func (o *S3Behavior) Statistics() interface{} {
 	return S3Statistics{
 		BucketName:        o.bucketName,
 		Region:            o.region,
-		EncryptionEnabled: config.S3ServerSideEncryption != nil,
+		EncryptionEnabled: o.outputConfig.S3ServerSideEncryption != nil,
 	}
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Graceful shutdown drains the pipeline from the front: the AMQP consumers are cancelled, the workers finish
+ * the deliveries they have, and each output sends what it has left and stops. The whole sequence is bounded by
+ * shutdown_timeout.
+ */
+
+// shutdownRequested is closed when the shutdown sequence starts. Inputs stop reading new messages once it is.
+var shutdownRequested = make(chan struct{})
+
+// fatalErrors carries the exit status requested by parts of the forwarder that cannot continue.
+var fatalErrors = make(chan int, 1)
+
+var (
+	activeConsumers     = make(map[*Consumer]bool)
+	activeConsumersLock sync.Mutex
+)
+
+// requestShutdown asks main to shut the forwarder down and exit with the given status.
+func requestShutdown(exitCode int) {
+	select {
+	case fatalErrors <- exitCode:
+	default:
+		// a shutdown has already been requested
+	}
+}
+
+func shuttingDown() bool {
+	select {
+	case <-shutdownRequested:
+		return true
+	default:
+		return false
+	}
+}
+
+func registerConsumer(c *Consumer) {
+	activeConsumersLock.Lock()
+	defer activeConsumersLock.Unlock()
+
+	activeConsumers[c] = true
+}
+
+func unregisterConsumer(c *Consumer) {
+	activeConsumersLock.Lock()
+	defer activeConsumersLock.Unlock()
+
+	delete(activeConsumers, c)
+}
+
+// anyActiveConsumer returns one of the connected consumers, or nil if there are none.
+func anyActiveConsumer() *Consumer {
+	activeConsumersLock.Lock()
+	defer activeConsumersLock.Unlock()
+
+	for c := range activeConsumers {
+		return c
+	}
+	return nil
+}
+
+// waitUntil waits for done to be closed, giving up at the deadline. It returns false if the deadline passed.
+func waitUntil(done <-chan struct{}, deadline time.Time) bool {
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// waitGroupDone returns a channel that is closed once the wait group's counter reaches zero.
+func waitGroupDone(group *sync.WaitGroup) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// shutdown drains the pipeline and returns the status the forwarder should exit with.
+func shutdown(exitCode int) int {
+	// let a reload in progress finish, and keep new ones from starting
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	deadline := time.Now().Add(config.ShutdownTimeout)
+	log.Infof("Shutting down; waiting up to %s for events in flight to be sent", config.ShutdownTimeout)
+
+	close(shutdownRequested)
+
+	activeConsumersLock.Lock()
+	for c := range activeConsumers {
+		if err := c.Cancel(); err != nil {
+			log.Errorf("Could not cancel AMQP consumer %s: %s", c.tag, err)
+		}
+	}
+	activeConsumersLock.Unlock()
+
+	if waitUntil(waitGroupDone(&wg), deadline) {
+		log.Info("All workers have exited")
+	} else {
+		log.Error("Timed out waiting for workers to exit")
+	}
+
+	if eventDeduplicator != nil {
+		eventDeduplicator.flushAll()
+	}
+
+	// no more events are rate limited once the workers have exited
+	if eventRateLimiter != nil {
+		eventRateLimiter.sendSummaries()
+	}
+
+	if eventPostprocessor != nil {
+		if waitUntil(eventPostprocessor.Drained(), deadline) {
+			log.Info("All post processed events have been sent")
+		} else {
+			log.Error("Timed out waiting for post processing to finish")
+		}
+	}
+
+	closeOutputs()
+	for _, route := range outputRoutes {
+		if waitUntil(route.stopped, deadline) {
+			log.Infof("Output %s has stopped", route.output.Name)
+		} else {
+			log.Errorf("Timed out waiting for output %s to send its remaining events", route.output.Name)
+		}
+	}
+
+	// acknowledgements for the events the outputs just sent go out on these connections, so close them last
+	activeConsumersLock.Lock()
+	for c := range activeConsumers {
+		if err := c.Close(); err != nil {
+			log.Errorf("Could not close AMQP connection for consumer %s: %s", c.tag, err)
+		}
+	}
+	activeConsumersLock.Unlock()
+
+	log.Info("cb-event-forwarder exiting")
+	return exitCode
+}
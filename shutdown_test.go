@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingBehavior struct {
+	sync.Mutex
+	uploads []string
+}
+
+func (b *recordingBehavior) Upload(fileName string, fp *os.File) UploadStatus {
+	contents, err := ioutil.ReadAll(fp)
+
+	b.Lock()
+	b.uploads = append(b.uploads, string(contents))
+	b.Unlock()
+
+	return UploadStatus{fileName: fileName, result: err, status: 200}
+}
+
+func (b *recordingBehavior) Initialize(connString string) error { return nil }
+func (b *recordingBehavior) Statistics() interface{}            { return nil }
+func (b *recordingBehavior) Key() string                        { return "recording" }
+func (b *recordingBehavior) String() string                     { return "recording" }
+
+func TestShutdownUploadsFinalBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := &OutputConfiguration{
+		Name:              "bundle",
+		OutputFormat:      JSONOutputFormat,
+		BundleSizeMax:     10 * 1024 * 1024,
+		BundleSendTimeout: 5 * time.Minute,
+	}
+	behavior := &recordingBehavior{}
+	handler := &BundledOutput{behavior: behavior, outputConfig: output}
+	if err := handler.Initialize(dir + ":recording"); err != nil {
+		t.Fatal(err)
+	}
+
+	route := &outputRoute{
+		output:   output,
+		handler:  handler,
+		messages: make(chan string, 100),
+		errors:   make(chan error),
+		stopped:  make(chan struct{}),
+	}
+
+	savedRoutes := outputRoutes
+	outputRoutes = []*outputRoute{route}
+	defer func() {
+		outputRoutes = savedRoutes
+		outputsClosed = false
+	}()
+
+	go route.forwardOutputErrors()
+	if err := handler.Go(route.messages, route.errors); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, eventType := range []string{"ingress.event.procstart", "ingress.event.netconn", "ingress.event.procend"} {
+		if err := dispatchMessage(newEvent(map[string]interface{}{"type": eventType}), eventType, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closeOutputs()
+	if !waitUntil(route.stopped, time.Now().Add(10*time.Second)) {
+		t.Fatal("Output did not stop after its channel was closed")
+	}
+
+	if len(behavior.uploads) != 1 || strings.Count(behavior.uploads[0], "\n") != 3 {
+		t.Errorf("Expected one bundle with all three events, got %q", behavior.uploads)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "event-forwarder" {
+			t.Errorf("Bundle %s was left behind", file.Name())
+		}
+	}
+
+	procstart := newEvent(map[string]interface{}{"type": "ingress.event.procstart"})
+	if err := dispatchMessage(procstart, "ingress.event.procstart",
+		nil); err != errOutputsClosed {
+		t.Errorf("Expected events dispatched after shutdown to be refused, got %v", err)
+	}
+}
+
+func TestCloseOutputsWithStalledOutput(t *testing.T) {
+	output := &OutputConfiguration{Name: "stalled", OutputFormat: JSONOutputFormat}
+	route := &outputRoute{
+		output:   output,
+		messages: make(chan string, 1),
+		stopped:  make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+
+	savedRoutes := outputRoutes
+	outputRoutes = []*outputRoute{route}
+	defer func() {
+		outputRoutes = savedRoutes
+		outputsClosed = false
+	}()
+
+	// nothing reads the output's channel, so the second event blocks its dispatcher
+	dispatched := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			dispatchMessage(newEvent(map[string]interface{}{"type": "ingress.event.netconn"}), "ingress.event.netconn", nil)
+		}
+		close(dispatched)
+	}()
+	for len(route.messages) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		closeOutputs()
+		close(closed)
+	}()
+
+	if !waitUntil(closed, time.Now().Add(10*time.Second)) {
+		t.Fatal("closeOutputs blocked behind a dispatcher waiting on a stalled output")
+	}
+	if !waitUntil(dispatched, time.Now().Add(10*time.Second)) {
+		t.Error("The dispatcher was not released when the outputs were closed")
+	}
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"text/template"
 )
 
 /* This is the Splunk HTTP Event Collector (HEC) implementation of the OutputHandler interface defined in main.go */
 type SplunkBehavior struct {
-	dest    string
-	headers map[string]string
+	dest         string
+	headers      map[string]string
+	outputConfig *OutputConfiguration
 
 	client *http.Client
 
@@ -27,7 +30,7 @@ type SplunkStatistics struct {
 
 /* Construct the SplunkBehavior object */
 func (this *SplunkBehavior) Initialize(dest string) error {
-	this.httpPostTemplate = config.HttpPostTemplate
+	this.httpPostTemplate = this.outputConfig.HttpPostTemplate
 	this.firstEventTemplate = template.Must(template.New("first_event").Parse("{{.}}"))
 	this.subsequentEventTemplate = template.Must(template.New("subsequent_event").Parse("{{.}}"))
 	this.headers = make(map[string]string)
@@ -35,20 +38,39 @@ func (this *SplunkBehavior) Initialize(dest string) error {
 	this.dest = dest
 
 	/* add authorization token, if applicable */
-	if config.SplunkToken != nil {
-		this.headers["Authorization"] = fmt.Sprintf("Splunk %s", *config.SplunkToken)
+	if this.outputConfig.SplunkToken != nil {
+		this.headers["Authorization"] = fmt.Sprintf("Splunk %s", *this.outputConfig.SplunkToken)
 	}
 
-	this.headers["Content-Type"] = *config.HttpContentType
+	this.headers["Content-Type"] = *this.outputConfig.HttpContentType
 
 	transport := &http.Transport{
-		TLSClientConfig: config.TLSConfig,
+		TLSClientConfig: this.outputConfig.TLSConfig,
 	}
 	this.client = &http.Client{Transport: transport}
 
 	return nil
 }
 
+// Probe asks the HTTP Event Collector for its health.
+func (this *SplunkBehavior) Probe() error {
+	healthURL, err := url.Parse(this.dest)
+	if err != nil {
+		return err
+	}
+	healthURL.Path = "/services/collector/health"
+	healthURL.RawQuery = ""
+
+	status, err := probeHTTP(this.client, "GET", healthURL.String(), this.headers)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New(fmt.Sprintf("HTTP Event Collector health check returned HTTP %d", status))
+	}
+	return nil
+}
+
 func (this *SplunkBehavior) String() string {
 	return "Splunk HTTP Event Collector " + this.Key()
 }
@@ -85,7 +107,8 @@ func (this *SplunkBehavior) Upload(fileName string, fp *os.File) UploadStatus {
 		defer writer.Close()
 
 		// spawn goroutine to read from the file
-		go convertFileIntoTemplate(fp, uploadData.Events, this.firstEventTemplate, this.subsequentEventTemplate)
+		go convertFileIntoTemplate(fp, uploadData.Events, this.firstEventTemplate, this.subsequentEventTemplate,
+			this.outputConfig.CommaSeparateEvents)
 		this.httpPostTemplate.Execute(writer, uploadData)
 	}()
 
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * DiskSpool holds events for a network output while its destination is unreachable. Events are appended to
+ * numbered segment files in the spool directory; each record is a 4-byte big-endian length followed by the
+ * event. Segments are replayed oldest first and removed once every event in them has been sent.
+ */
+
+var ErrSpoolFull = errors.New("spool is full")
+
+type DiskSpool struct {
+	directory   string
+	segmentSize int64
+	maxSize     int64
+
+	// segment numbers on disk, oldest first. The last one is open for writing.
+	segments    []int64
+	writer      *os.File
+	writtenSize int64
+
+	reader *bufio.Reader
+	readFp *os.File
+	next   *string
+
+	depth int64
+	bytes int64
+
+	sync.RWMutex
+}
+
+type SpoolStatistics struct {
+	Directory string `json:"directory"`
+	Depth     int64  `json:"depth"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+func segmentFileName(segment int64) string {
+	return fmt.Sprintf("segment-%010d.spool", segment)
+}
+
+// OpenDiskSpool opens the spool in directory, creating it if necessary. Segments left over from a previous run
+// are kept and will be replayed first.
+func OpenDiskSpool(directory string, segmentSize, maxSize int64) (*DiskSpool, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &DiskSpool{directory: directory, segmentSize: segmentSize, maxSize: maxSize}
+
+	fp, err := os.Open(directory)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fp.Readdirnames(0)
+	fp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, "segment-") || !strings.HasSuffix(name, ".spool") {
+			continue
+		}
+		segment, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment)
+	}
+	sort.Sort(int64Slice(s.segments))
+
+	for _, segment := range s.segments {
+		events, size, err := countSegment(filepath.Join(directory, segmentFileName(segment)))
+		if err != nil {
+			return nil, err
+		}
+		s.depth += events
+		s.bytes += size
+	}
+
+	if s.depth > 0 {
+		log.Infof("Spool %s holds %d events (%d bytes) from a previous run", directory, s.depth, s.bytes)
+	}
+
+	return s, nil
+}
+
+func countSegment(fileName string) (int64, int64, error) {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fp.Close()
+
+	var events, size int64
+	reader := bufio.NewReader(fp)
+	for {
+		length, err := readRecordHeader(reader)
+		if err != nil {
+			break
+		}
+		if _, err := reader.Discard(int(length)); err != nil {
+			break
+		}
+		events++
+		size += int64(length) + 4
+	}
+	return events, size, nil
+}
+
+func readRecordHeader(reader *bufio.Reader) (uint32, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header[:]), nil
+}
+
+// Write appends an event to the spool, returning ErrSpoolFull if that would exceed the size limit.
+func (s *DiskSpool) Write(event string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	recordSize := int64(len(event)) + 4
+	if s.bytes+recordSize > s.maxSize {
+		return ErrSpoolFull
+	}
+
+	if s.writer == nil || s.writtenSize+recordSize > s.segmentSize {
+		if err := s.newSegment(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record, uint32(len(event)))
+	copy(record[4:], event)
+
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+
+	s.writtenSize += recordSize
+	s.depth++
+	s.bytes += recordSize
+	return nil
+}
+
+func (s *DiskSpool) newSegment() error {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	var segment int64
+	if len(s.segments) > 0 {
+		segment = s.segments[len(s.segments)-1] + 1
+	}
+
+	fp, err := os.OpenFile(filepath.Join(s.directory, segmentFileName(segment)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.segments = append(s.segments, segment)
+	s.writer = fp
+	s.writtenSize = 0
+	return nil
+}
+
+// Peek returns the oldest event in the spool without removing it. ok is false if the spool is empty.
+func (s *DiskSpool) Peek() (event string, ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.next != nil {
+		return *s.next, true, nil
+	}
+
+	for len(s.segments) > 0 {
+		if s.reader == nil {
+			s.readFp, err = os.Open(filepath.Join(s.directory, segmentFileName(s.segments[0])))
+			if err != nil {
+				return "", false, err
+			}
+			s.reader = bufio.NewReader(s.readFp)
+		}
+
+		length, err := readRecordHeader(s.reader)
+		if err == nil {
+			buf := make([]byte, length)
+			_, err = io.ReadFull(s.reader, buf)
+			if err == nil {
+				event := string(buf)
+				s.next = &event
+				return event, true, nil
+			}
+		}
+
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", false, err
+		}
+
+		if len(s.segments) == 1 && s.writer != nil {
+			// caught up with the segment being written
+			if s.depth == 0 {
+				s.removeOldestSegment()
+			}
+			return "", false, nil
+		}
+
+		// end of this segment (or a record truncated by a crash); move on to the next one
+		s.removeOldestSegment()
+	}
+
+	return "", false, nil
+}
+
+// Pop removes the event last returned by Peek.
+func (s *DiskSpool) Pop() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.next == nil {
+		return
+	}
+
+	s.depth--
+	s.bytes -= int64(len(*s.next)) + 4
+	s.next = nil
+
+	if s.depth == 0 {
+		// everything has been replayed; remove the segments so they aren't replayed again after a restart
+		for len(s.segments) > 0 {
+			s.removeOldestSegment()
+		}
+	}
+}
+
+func (s *DiskSpool) removeOldestSegment() {
+	if s.readFp != nil {
+		s.readFp.Close()
+		s.readFp = nil
+		s.reader = nil
+	}
+
+	if len(s.segments) == 1 && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	fileName := filepath.Join(s.directory, segmentFileName(s.segments[0]))
+	if err := os.Remove(fileName); err != nil {
+		log.Infof("error removing spool segment %s: %s", fileName, err.Error())
+	}
+	s.segments = s.segments[1:]
+
+	if len(s.segments) == 0 {
+		// anything left in a truncated segment is gone
+		s.depth = 0
+		s.bytes = 0
+	}
+}
+
+func (s *DiskSpool) Depth() int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.depth
+}
+
+func (s *DiskSpool) Full() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.bytes >= s.maxSize
+}
+
+func (s *DiskSpool) Statistics() SpoolStatistics {
+	s.RLock()
+	defer s.RUnlock()
+
+	return SpoolStatistics{Directory: s.directory, Depth: s.depth, Bytes: s.bytes, MaxBytes: s.maxSize}
+}
+
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDiskSpoolReplaysInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small segments so the events span several files
+	spool, err := OpenDiskSpool(dir, 64, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := spool.Write(fmt.Sprintf("event %d\nsecond line", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if spool.Depth() != 10 {
+		t.Errorf("Expected 10 spooled events, got %d", spool.Depth())
+	}
+
+	// reopen as if the forwarder restarted and make sure nothing was lost
+	spool, err = OpenDiskSpool(dir, 64, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spool.Depth() != 10 {
+		t.Fatalf("Expected 10 spooled events after reopening, got %d", spool.Depth())
+	}
+
+	for i := 0; i < 10; i++ {
+		event, ok, err := spool.Peek()
+		if err != nil || !ok {
+			t.Fatalf("Could not read event %d: %v", i, err)
+		}
+		if event != fmt.Sprintf("event %d\nsecond line", i) {
+			t.Errorf("Events replayed out of order: expected %d, got %s", i, event)
+		}
+		spool.Pop()
+	}
+
+	if _, ok, _ := spool.Peek(); ok {
+		t.Error("Spool should be empty")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Segments should be removed once replayed, found %d files", len(files))
+	}
+}
+
+func TestDiskSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenDiskSpool(dir, 1024, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.Write("0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Write("0123456789012345678901234567890"); err != ErrSpoolFull {
+		t.Errorf("Expected ErrSpoolFull, got %v", err)
+	}
+	if spool.Depth() != 1 || spool.Statistics().Bytes != 14 {
+		t.Errorf("Unexpected spool statistics: %+v", spool.Statistics())
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	syslog "github.com/RackSec/srslog"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -19,6 +21,8 @@ type SyslogOutput struct {
 	hostnamePort string
 	tag          string
 	outputSocket *syslog.Writer
+	outputConfig *OutputConfiguration
+	spool        *DiskSpool
 
 	connectTime                 time.Time
 	reconnectTime               time.Time
@@ -26,6 +30,9 @@ type SyslogOutput struct {
 	droppedEventCount           int64
 	droppedEventSinceConnection int64
 
+	received    int64
+	acknowledge DeliveryAcknowledger
+
 	sync.RWMutex
 }
 
@@ -35,6 +42,8 @@ type SyslogStatistics struct {
 	RemoteHostnamePort string    `json:"remote_hostname_port"`
 	DroppedEventCount  int64     `json:"dropped_event_count"`
 	Connected          bool      `json:"connected"`
+	SpoolDepth         int64     `json:"spool_depth"`
+	SpoolBytes         int64     `json:"spool_bytes"`
 }
 
 // Initialize() expects a connection string in the following format:
@@ -54,7 +63,15 @@ func (o *SyslogOutput) Initialize(netConn string) error {
 	o.hostnamePort = connSpecification[1]
 
 	var err error
-	o.outputSocket, err = syslog.DialWithTLSConfig(o.protocol, o.hostnamePort, syslog.LOG_INFO, o.tag, config.TLSConfig)
+	if o.spool == nil && len(o.outputConfig.SpoolDirectory) > 0 {
+		o.spool, err = OpenDiskSpool(o.outputConfig.SpoolDirectory, o.outputConfig.SpoolSegmentSize,
+			o.outputConfig.SpoolMaxSize)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error opening spool '%s': %s", o.outputConfig.SpoolDirectory, err))
+		}
+	}
+
+	o.outputSocket, err = syslog.DialWithTLSConfig(o.protocol, o.hostnamePort, syslog.LOG_INFO, o.tag, o.outputConfig.TLSConfig)
 
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error connecting to '%s': %s", netConn, err))
@@ -65,6 +82,40 @@ func (o *SyslogOutput) Initialize(netConn string) error {
 	return nil
 }
 
+// Probe connects to the syslog server and disconnects again; UDP destinations are only looked up.
+func (o *SyslogOutput) Probe(netConn string) error {
+	connSpecification := strings.SplitN(netConn, ":", 2)
+	if len(connSpecification) != 2 {
+		return errors.New(fmt.Sprintf("Invalid destination '%s'", netConn))
+	}
+	protocol, hostnamePort := connSpecification[0], connSpecification[1]
+
+	if len(o.outputConfig.SpoolDirectory) > 0 {
+		if err := checkWritableDirectory(o.outputConfig.SpoolDirectory); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(protocol, "udp"):
+		_, err := net.ResolveUDPAddr(protocol, hostnamePort)
+		return err
+	case strings.HasSuffix(protocol, "+tls"):
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: probeTimeout}, strings.TrimSuffix(protocol, "+tls"),
+			hostnamePort, o.outputConfig.TLSConfig)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		return probeTCP(protocol, hostnamePort)
+	}
+}
+
+func (o *SyslogOutput) SetAcknowledger(ack DeliveryAcknowledger) {
+	o.acknowledge = ack
+}
+
 func (o *SyslogOutput) Key() string {
 	return o.String()
 }
@@ -80,13 +131,19 @@ func (o *SyslogOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return SyslogStatistics{
+	stats := SyslogStatistics{
 		LastOpenTime:       o.connectTime,
 		Protocol:           o.protocol,
 		RemoteHostnamePort: o.hostnamePort,
 		DroppedEventCount:  o.droppedEventCount,
 		Connected:          o.connected,
 	}
+	if o.spool != nil {
+		spoolStats := o.spool.Statistics()
+		stats.SpoolDepth = spoolStats.Depth
+		stats.SpoolBytes = spoolStats.Bytes
+	}
+	return stats
 }
 
 func (o *SyslogOutput) markConnected() {
@@ -100,6 +157,18 @@ func (o *SyslogOutput) markConnected() {
 	}
 }
 
+// disconnect closes the connection to the destination when the output stops.
+func (o *SyslogOutput) disconnect() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		o.outputSocket.Close()
+		o.connected = false
+	}
+	log.Infof("Disconnected from %s", o.hostnamePort)
+}
+
 func (o *SyslogOutput) closeAndScheduleReconnection() {
 	o.Lock()
 	defer o.Unlock()
@@ -114,27 +183,94 @@ func (o *SyslogOutput) closeAndScheduleReconnection() {
 	log.Infof("Lost connection to %s. Will try to reconnect at %s.", o.hostnamePort, o.reconnectTime)
 }
 
+func (o *SyslogOutput) write(m string) error {
+	err := o.outputSocket.Info(m)
+	if err != nil {
+		o.closeAndScheduleReconnection()
+	}
+
+	return err
+}
+
 func (o *SyslogOutput) output(m string) error {
+	if o.spool != nil && (!o.connected || o.spool.Depth() > 0) {
+		// once anything is spooled, new events queue up behind it so they are sent in order
+		return o.spoolEvent(m)
+	}
+
 	if !o.connected {
 		// drop this event on the floor...
 		atomic.AddInt64(&o.droppedEventCount, 1)
+		metricOutputDroppedEvents.Add(1, o.outputConfig.Name)
 		return nil
 	}
 
-	err := o.outputSocket.Info(m)
-	if err != nil {
-		o.closeAndScheduleReconnection()
+	err := o.write(m)
+	if err != nil && o.spool != nil {
+		log.Errorf("Error sending to %s, spooling event: %s", o.hostnamePort, err)
+		return o.spoolEvent(m)
 	}
+	return err
+}
 
+func (o *SyslogOutput) spoolEvent(m string) error {
+	err := o.spool.Write(m)
+	if err == ErrSpoolFull {
+		atomic.AddInt64(&o.droppedEventCount, 1)
+		metricOutputDroppedEvents.Add(1, o.outputConfig.Name)
+		if o.acknowledge == nil {
+			return nil
+		}
+	}
 	return err
 }
 
+// replaySpool sends up to 1000 spooled events, stopping at the first error.
+func (o *SyslogOutput) replaySpool() {
+	for i := 0; i < 1000; i++ {
+		m, ok, err := o.spool.Peek()
+		if err != nil {
+			log.Errorf("Error reading spool for %s: %s", o.hostnamePort, err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		if err := o.write(m); err != nil {
+			log.Errorf("Error replaying spooled events to %s: %s", o.hostnamePort, err)
+			return
+		}
+		o.spool.Pop()
+
+		if o.spool.Depth() == 0 {
+			log.Infof("Finished replaying spooled events to %s", o.hostnamePort)
+			return
+		}
+	}
+}
+
+// accepting returns false when messages should be left queued: with acknowledgements enabled we stop reading
+// rather than dropping events.
+func (o *SyslogOutput) accepting() bool {
+	if o.acknowledge == nil {
+		return true
+	}
+	if o.spool != nil {
+		return !o.spool.Full()
+	}
+	return o.connected
+}
+
 func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
 	}
 
 	go func() {
+		// closing errorChan tells the dispatcher that this output has stopped
+		defer close(errorChan)
+
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
 
@@ -143,10 +279,39 @@ func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error
 
 		defer signal.Stop(hup)
 
+		// always ready; selected to replay the spool in between incoming messages
+		replayReady := make(chan struct{})
+		close(replayReady)
+
 		for {
+			// when acknowledging deliveries, leave messages queued while disconnected instead of dropping them
+			input := messages
+			if !o.accepting() {
+				input = nil
+			}
+
+			var replay chan struct{}
+			if o.spool != nil && o.connected && o.spool.Depth() > 0 {
+				replay = replayReady
+			}
+
 			select {
-			case message := <-messages:
-				if err := o.output(message); err != nil {
+			case <-replay:
+				o.replaySpool()
+
+			case message, ok := <-input:
+				if !ok {
+					// anything still spooled stays on disk and is sent after the next start
+					o.disconnect()
+					return
+				}
+
+				o.received++
+				err := o.output(message)
+				if o.acknowledge != nil {
+					o.acknowledge(o.received, err)
+				}
+				if err != nil {
 					errorChan <- err
 				}
 
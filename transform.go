@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+/*
+ * Event transforms
+ *
+ * Transforms rewrite each event just before it is encoded for the outputs, so they apply the same way to
+ * events that arrived as JSON or protobuf. They run in the order of their section names.
+ */
+
+const (
+	TransformRename = iota
+	TransformDelete
+	TransformAdd
+	TransformCopy
+	TransformLowercase
+	TransformUppercase
+	TransformHash
+)
+
+type Transform struct {
+	Name       string
+	Operation  int
+	Fields     []string
+	EventTypes []string
+
+	// destination field for rename and copy, constant value for add
+	Target string
+	Value  string
+}
+
+var transformOperations = map[string]int{
+	"rename":    TransformRename,
+	"delete":    TransformDelete,
+	"add":       TransformAdd,
+	"copy":      TransformCopy,
+	"lowercase": TransformLowercase,
+	"uppercase": TransformUppercase,
+	"hash":      TransformHash,
+}
+
+// fieldParent returns the map holding a (possibly dotted) field and the field's key within it.
+func fieldParent(msg map[string]interface{}, field string) (map[string]interface{}, string, bool) {
+	parts := strings.Split(field, ".")
+	parent := msg
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := parent[part].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		parent = child
+	}
+	return parent, parts[len(parts)-1], true
+}
+
+func (t *Transform) Apply(msg map[string]interface{}) {
+	for _, field := range t.Fields {
+		parent, key, ok := fieldParent(msg, field)
+		if !ok {
+			continue
+		}
+
+		if t.Operation == TransformAdd {
+			parent[key] = t.Value
+			continue
+		}
+
+		value, ok := parent[key]
+		if !ok {
+			continue
+		}
+
+		switch t.Operation {
+		case TransformRename, TransformCopy:
+			if targetParent, targetKey, ok := fieldParent(msg, t.Target); ok {
+				targetParent[targetKey] = value
+				if t.Operation == TransformRename {
+					delete(parent, key)
+				}
+			}
+		case TransformDelete:
+			delete(parent, key)
+		case TransformLowercase:
+			if s, ok := value.(string); ok {
+				parent[key] = strings.ToLower(s)
+			}
+		case TransformUppercase:
+			if s, ok := value.(string); ok {
+				parent[key] = strings.ToUpper(s)
+			}
+		case TransformHash:
+			if s, ok := lookupField(parent, key); ok {
+				sum := sha256.Sum256([]byte(s))
+				parent[key] = hex.EncodeToString(sum[:])
+			}
+		}
+	}
+}
+
+func transformEvent(event *Event, routingKey string) {
+	for _, transform := range currentLiveConfiguration().Transforms {
+		if eventTypesMatch(transform.EventTypes, routingKey) {
+			transform.Apply(event.Map())
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestTransforms(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[transform:10-hash-pii]
+operation=hash
+field=username, computer_name
+
+[transform:20-rename]
+operation=rename
+field=cb_server
+to=source
+
+[transform:30-tenant]
+operation=add
+field=tenant
+value=acme
+
+[transform:40-copy]
+operation=copy
+field=process_path
+to=image
+
+[transform:50-lowercase]
+operation=lowercase
+field=image
+
+[transform:60-drop]
+operation=delete
+field=event_guid, docs.0
+event_types=ingress.event.*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseTransforms(input, &errs)
+	if !errs.Empty {
+		t.Fatalf("Unexpected configuration errors: %v", errs.Errors)
+	}
+
+	publishLiveConfiguration(&c)
+	defer publishLiveConfiguration(&config)
+
+	event := newEvent(map[string]interface{}{
+		"type":          "ingress.event.procstart",
+		"cb_server":     "cbserver",
+		"event_guid":    "guid",
+		"username":      "alice",
+		"process_path":  `C:\Windows\System32\CMD.EXE`,
+		"computer_name": "WORKSTATION",
+	})
+	transformEvent(event, "ingress.event.procstart")
+	msg := event.Map()
+
+	expected := map[string]interface{}{
+		"type":          "ingress.event.procstart",
+		"source":        "cbserver",
+		"tenant":        "acme",
+		"username":      "2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90",
+		"process_path":  `C:\Windows\System32\CMD.EXE`,
+		"image":         `c:\windows\system32\cmd.exe`,
+		"computer_name": "9024e3b945967b397d0c7513427beb71bbb56411cc4d675faded1adbf96dfae2",
+	}
+
+	for k, v := range expected {
+		if msg[k] != v {
+			t.Errorf("Field %s: expected %v, got %v", k, v, msg[k])
+		}
+	}
+	if len(msg) != len(expected) {
+		t.Errorf("Unexpected fields after transform: %v", msg)
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	input, err := ini.Load(strings.NewReader(`
+[transform:bad-operation]
+operation=explode
+field=username
+
+[transform:rename-without-target]
+operation=rename
+field=username
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ConfigurationError{Empty: true}
+	var c Configuration
+	c.parseTransforms(input, &errs)
+	if len(errs.Errors) != 2 || len(c.Transforms) != 0 {
+		t.Errorf("Expected both transforms to be rejected, got errors %v", errs.Errors)
+	}
+}